@@ -0,0 +1,434 @@
+// Package client implements an HTTP client that only talks to veil enclaves
+// whose PCR values match a given policy.  The client attests every TLS
+// connection before sending requests over it: it requests the enclave's
+// attestation document over the new connection, verifies the document and its
+// PCR values, and makes sure that the document contains the hash of the
+// connection's certificate.  The client then pins the certificate and rejects
+// responses from connections whose certificate it didn't pin.
+//
+// A typical use looks as follows:
+//
+//	policy, err := client.ReadPolicy("policy.json")
+//	if err != nil {
+//		return err
+//	}
+//	c, err := client.New(policy)
+//	if err != nil {
+//		return err
+//	}
+//	resp, err := c.Get("https://enclave.example.com/api")
+//
+// Enclaves that run veil with -ra-tls embed their attestation document in
+// their TLS certificate.  NewTLSConfig returns a TLS configuration that
+// verifies the embedded document during the handshake, which works for
+// protocols other than HTTP, too.
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/Amnesic-Systems/veil/internal/enclave"
+	"github.com/Amnesic-Systems/veil/internal/enclave/nitro/verify"
+	"github.com/Amnesic-Systems/veil/internal/enclave/noop"
+	"github.com/Amnesic-Systems/veil/internal/errs"
+	"github.com/Amnesic-Systems/veil/internal/httpx"
+	"github.com/Amnesic-Systems/veil/internal/nonce"
+	"github.com/Amnesic-Systems/veil/internal/service/attestation"
+)
+
+// maxDocLen is the maximum size of an attestation response that we read.
+const maxDocLen = 1 << 20
+
+var (
+	// ErrPCRMismatch means that the enclave's PCR values violate the policy.
+	ErrPCRMismatch = errs.ErrPCRMismatch
+	// ErrBindingMismatch means that the enclave's attestation document
+	// doesn't contain the hash of the connection's certificate.
+	ErrBindingMismatch = errs.ErrBindingMismatch
+	// ErrChannelBindingMismatch means that the enclave's attestation
+	// document isn't bound to our TLS connection.
+	ErrChannelBindingMismatch = errs.ErrChannelBinding
+	// ErrNotAttested means that a response arrived over a connection whose
+	// certificate we didn't attest.
+	ErrNotAttested = errors.New("connection's certificate is not attested")
+	// ErrNoCertAttestation means that the enclave's certificate doesn't embed
+	// an attestation document.
+	ErrNoCertAttestation = attestation.ErrNoCertAttestation
+
+	errNotHTTPS     = errors.New("only HTTPS requests can be attested")
+	errTrailingData = errors.New("enclave sent data after attestation response")
+	errClosed       = errors.New("enclave closed connection after attestation")
+)
+
+// PCR maps PCR indices to their values.
+type PCR = enclave.PCR
+
+// Policy determines what PCR values we accept from an enclave.
+type Policy = enclave.Policy
+
+// NewPolicy returns a policy that allows any of the given sets of PCR values.
+func NewPolicy(allowed ...PCR) *Policy {
+	return enclave.NewPolicy(allowed...)
+}
+
+// ReadPolicy reads the JSON-encoded policy at the given path.  See
+// veil-verify's README for the file format.
+func ReadPolicy(path string) (*Policy, error) {
+	return enclave.ReadPolicy(path)
+}
+
+// Option configures how we verify enclaves.
+type Option func(*verifier)
+
+// WithRoots sets the root certificates that attestation documents must chain
+// to.  By default, we trust AWS's Nitro Enclaves root certificate.
+func WithRoots(roots *x509.CertPool) Option {
+	return func(v *verifier) {
+		v.docVerifier = verify.NewVerifier(verify.WithRoots(roots))
+	}
+}
+
+// WithInsecureTesting makes us accept the noop attestation documents of
+// enclaves that run in testing mode.  Never use this option in production:
+// noop attestation documents provide no security.
+func WithInsecureTesting() Option {
+	return func(v *verifier) {
+		v.docVerifier = noop.NewAttester()
+	}
+}
+
+// WithChannelBinding makes the transport request attestation documents that
+// are bound to the TLS connection that it requests them over, using the
+// connection's tls-exporter channel binding (RFC 9266).  Unlike the
+// certificate hash, the binding differs for every connection, so a
+// man-in-the-middle that holds a copy of the enclave's certificate can't relay
+// the enclave's attestation documents.  The enclave must run a version of veil
+// that serves /veil/attestation/tls-exporter.
+func WithChannelBinding() Option {
+	return func(v *verifier) {
+		v.channelBinding = true
+	}
+}
+
+// verifier verifies attestation documents and their PCR values.
+type verifier struct {
+	policy         *Policy
+	docVerifier    enclave.Verifier
+	channelBinding bool
+}
+
+func newVerifier(policy *Policy, opts ...Option) (*verifier, error) {
+	if policy == nil {
+		return nil, enclave.ErrEmptyPolicy
+	}
+	if err := policy.CanCheck(); err != nil {
+		return nil, err
+	}
+	v := &verifier{
+		policy:      policy,
+		docVerifier: verify.NewVerifier(),
+	}
+	for _, opt := range opts {
+		opt(v)
+	}
+	return v, nil
+}
+
+// Transport is an http.RoundTripper that attests every new TLS connection to an
+// enclave before using it.  A Transport is safe for concurrent use.
+type Transport struct {
+	*verifier
+	base *http.Transport
+
+	mu sync.RWMutex
+	// pinned contains the SHA-256 hashes of the certificates that we
+	// attested.
+	pinned map[[sha256.Size]byte]struct{}
+}
+
+// NewTransport returns a new Transport that accepts enclaves whose PCR values
+// satisfy the given policy.
+func NewTransport(policy *Policy, opts ...Option) (*Transport, error) {
+	v, err := newVerifier(policy, opts...)
+	if err != nil {
+		return nil, err
+	}
+	t := &Transport{
+		verifier: v,
+		pinned:   make(map[[sha256.Size]byte]struct{}),
+	}
+	// We don't use a proxy because the transport would then establish TLS
+	// connections without calling our dialer.  We also stick to HTTP/1.1
+	// because we request the attestation document over the raw connection.
+	t.base = &http.Transport{
+		DialTLSContext:    t.dialTLS,
+		ForceAttemptHTTP2: false,
+	}
+	return t, nil
+}
+
+// New returns an HTTP client that uses a new Transport with the given policy
+// and options.
+func New(policy *Policy, opts ...Option) (*http.Client, error) {
+	t, err := NewTransport(policy, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{Transport: t}, nil
+}
+
+// RoundTrip implements http.RoundTripper.  It rejects responses that arrive
+// over a connection whose certificate we didn't attest.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "https" {
+		return nil, errNotHTTPS
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.TLS == nil || len(resp.TLS.PeerCertificates) == 0 ||
+		!t.isPinned(sha256.Sum256(resp.TLS.PeerCertificates[0].Raw)) {
+		_ = resp.Body.Close()
+		return nil, ErrNotAttested
+	}
+	return resp, nil
+}
+
+// CloseIdleConnections closes connections that aren't in use.
+func (t *Transport) CloseIdleConnections() {
+	t.base.CloseIdleConnections()
+}
+
+func (t *Transport) isPinned(hash [sha256.Size]byte) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	_, ok := t.pinned[hash]
+	return ok
+}
+
+func (t *Transport) pin(hash [sha256.Size]byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pinned[hash] = struct{}{}
+}
+
+// dialTLS establishes a TLS connection to the given address and attests the
+// enclave over the new connection.  We don't verify the enclave's certificate
+// because authentication is happening via the attestation document.
+func (t *Transport) dialTLS(ctx context.Context, network, addr string) (_ net.Conn, err error) {
+	dialer := &tls.Dialer{Config: &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{"http/1.1"},
+	}}
+	conn, err := dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := conn.(*tls.Conn)
+	defer func() {
+		if err != nil {
+			_ = tlsConn.Close()
+		}
+	}()
+
+	cert := tlsConn.ConnectionState().PeerCertificates[0]
+	if err := t.attest(ctx, tlsConn, addr, cert); err != nil {
+		return nil, err
+	}
+	t.pin(sha256.Sum256(cert.Raw))
+	return tlsConn, nil
+}
+
+// attest requests the enclave's attestation document over the given
+// connection, and verifies the document, its PCR values, and that it contains
+// the hash of the given certificate.
+func (t *Transport) attest(
+	ctx context.Context,
+	conn *tls.Conn,
+	addr string,
+	cert *x509.Certificate,
+) (err error) {
+	defer errs.Wrap(&err, "failed to attest enclave")
+
+	// Generate a nonce to ensure that the attestation document is fresh.
+	n, err := nonce.New()
+	if err != nil {
+		return err
+	}
+	u := url.URL{
+		Scheme:   "https",
+		Host:     addr,
+		Path:     attestation.PathAttestation,
+		RawQuery: url.Values{httpx.ParamNonce: {n.B64()}}.Encode(),
+	}
+	if t.channelBinding {
+		u.Path = attestation.PathChannelBoundAttestation
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+		defer func() { _ = conn.SetDeadline(time.Time{}) }()
+	}
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return err
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxDocLen))
+	_ = resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: %q with body: %s",
+			errs.ErrEnclaveErr, resp.Status, string(body))
+	}
+	// The transport reads subsequent responses from the connection, so we
+	// must not have consumed any of their bytes.
+	if br.Buffered() > 0 {
+		return errTrailingData
+	}
+	if resp.Close {
+		return errClosed
+	}
+
+	var rawDoc enclave.RawDocument
+	if err := json.Unmarshal(body, &rawDoc); err != nil {
+		return err
+	}
+	doc, err := t.docVerifier.Verify(&rawDoc, n)
+	if err != nil {
+		return err
+	}
+	if err := checkTLSBinding(cert, doc); err != nil {
+		return err
+	}
+	if t.channelBinding {
+		if err := checkChannelBinding(conn, n, doc); err != nil {
+			return err
+		}
+	}
+	return checkPCRs(doc, t.policy)
+}
+
+// checkTLSBinding returns an error if the given attestation document doesn't
+// contain the hash of the given certificate.
+func checkTLSBinding(cert *x509.Certificate, doc *enclave.Document) error {
+	hashes, err := attestation.GetHashes(&doc.AuxInfo)
+	if err != nil {
+		return fmt.Errorf("failed to get attested TLS certificate hash: %w", err)
+	}
+	// During a certificate rotation's overlap window, the enclave also
+	// attests to its previous certificate.
+	gotHash := sha256.Sum256(cert.Raw)
+	if !hashes.HasTLSHash(&gotHash) {
+		return ErrBindingMismatch
+	}
+	return nil
+}
+
+// checkChannelBinding returns an error if the given attestation document
+// doesn't contain the channel binding of the given connection and nonce.
+func checkChannelBinding(conn *tls.Conn, n *nonce.Nonce, doc *enclave.Document) error {
+	cs := conn.ConnectionState()
+	want, err := attestation.ChannelBinding(&cs, n)
+	if err != nil {
+		return err
+	}
+	got, err := attestation.GetSHA256(&doc.AuxInfo)
+	if err != nil {
+		return fmt.Errorf("failed to get attested channel binding: %w", err)
+	}
+	if *got != want {
+		return ErrChannelBindingMismatch
+	}
+	return nil
+}
+
+// checkPCRs checks the given document's PCR values against the given policy.
+func checkPCRs(doc *enclave.Document, policy *Policy) error {
+	// Like veil-verify, we ignore the empty PCR values that the nsm package
+	// returns.
+	empty := make([]byte, sha512.Size384)
+	for i, pcr := range doc.PCRs {
+		if bytes.Equal(pcr, empty) {
+			delete(doc.PCRs, i)
+		}
+	}
+	mismatches := policy.Check(doc.PCRs)
+	if len(mismatches) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrPCRMismatch, mismatches[0])
+}
+
+// NewTLSConfig returns a TLS client configuration that only completes
+// handshakes with enclaves whose certificate embeds an attestation document
+// that satisfies the given policy.  This works for any protocol on top of TLS,
+// but requires the enclave to run veil with -ra-tls.
+func NewTLSConfig(policy *Policy, opts ...Option) (*tls.Config, error) {
+	verify, err := VerifyPeerCertificate(policy, opts...)
+	if err != nil {
+		return nil, err
+	}
+	// We don't verify the enclave's certificate chain because authentication
+	// is happening via the embedded attestation document.
+	return &tls.Config{
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: verify,
+	}, nil
+}
+
+// VerifyPeerCertificate returns a function for
+// tls.Config.VerifyPeerCertificate that verifies the attestation document that
+// is embedded in the peer's certificate, makes sure that the document attests
+// to the certificate's public key, and checks the document's PCR values
+// against the given policy.
+func VerifyPeerCertificate(
+	policy *Policy,
+	opts ...Option,
+) (func(rawCerts [][]byte, _ [][]*x509.Certificate) error, error) {
+	v, err := newVerifier(policy, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) (err error) {
+		defer errs.Wrap(&err, "failed to attest enclave")
+
+		if len(rawCerts) == 0 {
+			return errors.New("peer sent no certificate")
+		}
+		cert, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return err
+		}
+		doc, err := attestation.VerifyCertificate(cert, v.docVerifier)
+		if err != nil {
+			return err
+		}
+		return checkPCRs(doc, v.policy)
+	}, nil
+}
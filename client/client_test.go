@@ -0,0 +1,333 @@
+package client
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/Amnesic-Systems/veil/internal/enclave"
+	"github.com/Amnesic-Systems/veil/internal/errs"
+	"github.com/Amnesic-Systems/veil/internal/httpx"
+	"github.com/Amnesic-Systems/veil/internal/service"
+	"github.com/Amnesic-Systems/veil/internal/service/attestation"
+	"github.com/Amnesic-Systems/veil/internal/util/must"
+)
+
+func testPCRs() PCR {
+	return PCR{
+		0: []byte(strings.Repeat("a", 48)),
+		1: []byte(strings.Repeat("b", 48)),
+		2: []byte(strings.Repeat("c", 48)),
+	}
+}
+
+// newEnclave returns a TLS server that mimics an enclave in testing mode.  The
+// given function can mutate the server's attestation documents.  The server
+// counts how often it was attested.
+func newEnclave(t *testing.T, mutate func(*enclave.Document)) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+
+	var (
+		srv      *httptest.Server
+		attested = new(atomic.Int32)
+	)
+	srv = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != service.PathAttestation &&
+			r.URL.Path != service.PathChannelBoundAttestation {
+			_, _ = io.WriteString(w, "hello world")
+			return
+		}
+		attested.Add(1)
+		n, err := httpx.ExtractNonce(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		certHash := sha256.Sum256(srv.Certificate().Raw)
+		doc := &enclave.Document{
+			PCRs: testPCRs(),
+			AuxInfo: enclave.AuxInfo{
+				PublicKey: (&attestation.Hashes{TlsKeyHash: &certHash}).Serialize(),
+				Nonce:     n.ToSlice(),
+			},
+		}
+		if r.URL.Path == service.PathChannelBoundAttestation {
+			binding, err := attestation.ChannelBinding(r.TLS, n)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			doc.UserData = binding[:]
+		}
+		if mutate != nil {
+			mutate(doc)
+		}
+		docBytes, err := json.Marshal(doc)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(&enclave.RawDocument{
+			Type: enclave.TypeNoop,
+			Doc:  docBytes,
+		})
+	}))
+	t.Cleanup(srv.Close)
+	return srv, attested
+}
+
+func TestNewTransport(t *testing.T) {
+	_, err := NewTransport(nil)
+	require.ErrorIs(t, err, enclave.ErrEmptyPolicy)
+	_, err = NewTransport(new(Policy))
+	require.ErrorIs(t, err, enclave.ErrEmptyPolicy)
+	_, err = NewTransport(&Policy{Required: PCR{3: testPCRs()[0]}})
+	require.ErrorIs(t, err, enclave.ErrNoAllowedPCRs)
+	_, err = NewTransport(NewPolicy(testPCRs()))
+	require.NoError(t, err)
+}
+
+func TestClient(t *testing.T) {
+	otherPCRs := testPCRs()
+	otherPCRs[0] = []byte(strings.Repeat("d", 48))
+
+	cases := []struct {
+		name    string
+		mutate  func(*enclave.Document)
+		policy  *Policy
+		wantErr error
+	}{
+		{
+			name:   "valid",
+			policy: NewPolicy(testPCRs()),
+		},
+		{
+			name:   "one of several allowed PCR sets",
+			policy: NewPolicy(otherPCRs, testPCRs()),
+		},
+		{
+			name:    "PCR mismatch",
+			policy:  NewPolicy(otherPCRs),
+			wantErr: ErrPCRMismatch,
+		},
+		{
+			name: "binding mismatch",
+			mutate: func(doc *enclave.Document) {
+				var wrongHash [sha256.Size]byte
+				doc.PublicKey = (&attestation.Hashes{TlsKeyHash: &wrongHash}).Serialize()
+			},
+			policy:  NewPolicy(testPCRs()),
+			wantErr: ErrBindingMismatch,
+		},
+		{
+			name: "previous certificate during rotation",
+			mutate: func(doc *enclave.Document) {
+				hashes := must.Get(attestation.DeserializeHashes(doc.PublicKey))
+				hashes.RotateTLSHash(new([sha256.Size]byte))
+				doc.PublicKey = hashes.Serialize()
+			},
+			policy: NewPolicy(testPCRs()),
+		},
+		{
+			name:    "nonce mismatch",
+			mutate:  func(doc *enclave.Document) { doc.Nonce = make([]byte, len(doc.Nonce)) },
+			policy:  NewPolicy(testPCRs()),
+			wantErr: errs.ErrNonceMismatch,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			srv, _ := newEnclave(t, c.mutate)
+			client, err := New(c.policy, WithInsecureTesting())
+			require.NoError(t, err)
+
+			resp, err := client.Get(srv.URL)
+			if c.wantErr != nil {
+				require.ErrorIs(t, err, c.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			require.Equal(t, "hello world", string(body))
+		})
+	}
+}
+
+func TestClientChannelBinding(t *testing.T) {
+	cases := []struct {
+		name    string
+		mutate  func(*enclave.Document)
+		wantErr error
+	}{
+		{
+			name: "valid",
+		},
+		{
+			name:    "binding of other connection",
+			mutate:  func(doc *enclave.Document) { doc.UserData = make([]byte, sha256.Size) },
+			wantErr: ErrChannelBindingMismatch,
+		},
+		{
+			name:    "no binding",
+			mutate:  func(doc *enclave.Document) { doc.UserData = nil },
+			wantErr: errs.ErrIsNil,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			srv, _ := newEnclave(t, c.mutate)
+			client, err := New(NewPolicy(testPCRs()), WithInsecureTesting(), WithChannelBinding())
+			require.NoError(t, err)
+
+			resp, err := client.Get(srv.URL)
+			if c.wantErr != nil {
+				require.ErrorIs(t, err, c.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.NoError(t, resp.Body.Close())
+		})
+	}
+}
+
+func TestClientAttestsOncePerConnection(t *testing.T) {
+	srv, attested := newEnclave(t, nil)
+	transport, err := NewTransport(NewPolicy(testPCRs()), WithInsecureTesting())
+	require.NoError(t, err)
+	client := &http.Client{Transport: transport}
+
+	get := func() {
+		resp, err := client.Get(srv.URL)
+		require.NoError(t, err)
+		_, err = io.Copy(io.Discard, resp.Body)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+	}
+	// Requests reuse the attested connection.
+	for range 3 {
+		get()
+	}
+	require.EqualValues(t, 1, attested.Load())
+
+	// A new connection is attested again.
+	transport.CloseIdleConnections()
+	get()
+	require.EqualValues(t, 2, attested.Load())
+}
+
+func TestClientRejectsUnattestedCertificate(t *testing.T) {
+	srv, _ := newEnclave(t, nil)
+	transport, err := NewTransport(NewPolicy(testPCRs()), WithInsecureTesting())
+	require.NoError(t, err)
+
+	// Make the transport reach the enclave without attesting it, as if the
+	// connection's certificate had changed after attestation.
+	transport.base.DialTLSContext = nil
+	transport.base.TLSClientConfig = srv.Client().Transport.(*http.Transport).TLSClientConfig
+	_, err = (&http.Client{Transport: transport}).Get(srv.URL)
+	require.ErrorIs(t, err, ErrNotAttested)
+
+	_, err = (&http.Client{Transport: transport}).Get(strings.Replace(srv.URL, "https", "http", 1))
+	require.ErrorIs(t, err, errNotHTTPS)
+}
+
+// newRATLSEnclave returns a TLS server whose certificate embeds a noop
+// attestation document with the given PCR values.  If bind is false, the
+// document attests to a different public key.
+func newRATLSEnclave(t *testing.T, pcrs PCR, bind bool) *httptest.Server {
+	t.Helper()
+
+	attest := func(pubKeyHash *[sha256.Size]byte) ([]byte, error) {
+		if !bind {
+			pubKeyHash = new([sha256.Size]byte)
+		}
+		claims, err := (&attestation.Claims{
+			Version: attestation.ClaimsVersion,
+			Keys: map[string]attestation.Digest{
+				attestation.KeyTLSPublicKey: attestation.NewSHA256Digest(pubKeyHash),
+			},
+		}).Marshal()
+		if err != nil {
+			return nil, err
+		}
+		doc, err := json.Marshal(&enclave.Document{
+			PCRs:    pcrs,
+			AuxInfo: enclave.AuxInfo{PublicKey: claims},
+		})
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(&enclave.RawDocument{Type: enclave.TypeNoop, Doc: doc})
+	}
+	rawCert, rawKey, err := httpx.CreateCertificate("example.com", httpx.WithAttestation(attest))
+	require.NoError(t, err)
+	cert, err := tls.X509KeyPair(rawCert, rawKey)
+	require.NoError(t, err)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = io.WriteString(w, "hello world")
+	}))
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	otherPCRs := testPCRs()
+	otherPCRs[0] = []byte(strings.Repeat("d", 48))
+	plain, _ := newEnclave(t, nil)
+
+	cases := []struct {
+		name    string
+		srv     *httptest.Server
+		wantErr error
+	}{
+		{
+			name: "valid",
+			srv:  newRATLSEnclave(t, testPCRs(), true),
+		},
+		{
+			name:    "PCR mismatch",
+			srv:     newRATLSEnclave(t, otherPCRs, true),
+			wantErr: ErrPCRMismatch,
+		},
+		{
+			name:    "binding mismatch",
+			srv:     newRATLSEnclave(t, testPCRs(), false),
+			wantErr: ErrBindingMismatch,
+		},
+		{
+			name:    "no embedded attestation document",
+			srv:     plain,
+			wantErr: ErrNoCertAttestation,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg, err := NewTLSConfig(NewPolicy(testPCRs()), WithInsecureTesting())
+			require.NoError(t, err)
+			conn, err := tls.Dial("tcp", c.srv.Listener.Addr().String(), cfg)
+			if c.wantErr != nil {
+				require.ErrorIs(t, err, c.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.NoError(t, conn.Close())
+		})
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/url"
 	"os"
 	"os/exec"
@@ -26,15 +27,37 @@ import (
 )
 
 const (
-	defaultExtPort     = 8443
-	defaultIntPort     = 8080
-	defaultDNSResolver = "1.1.1.1"
+	defaultExtPort      = 8443
+	defaultIntPort      = 8080
+	defaultDNSResolver  = "1.1.1.1"
+	defaultCertRotation = 30 * 24 * time.Hour
+	defaultCertOverlap  = time.Hour
 )
 
 func parseFlags(out io.Writer, args []string) (*config.Veil, error) {
 	fs := flag.NewFlagSet("veil", flag.ContinueOnError)
 	fs.SetOutput(out)
 
+	acmeDirectory := fs.String(
+		"acme-directory",
+		"",
+		"ACME directory URL to obtain the TLS certificate from, e.g. https://acme-v02.api.letsencrypt.org/directory",
+	)
+	acmeEmail := fs.String(
+		"acme-email",
+		"",
+		"contact email address of the ACME account",
+	)
+	acmeRoots := fs.String(
+		"acme-roots",
+		"",
+		"PEM file with root certificates to trust for the ACME directory (for testing)",
+	)
+	altFQDNs := fs.String(
+		"alt-fqdns",
+		"",
+		"comma- or whitespace-separated additional domain names that the enclave serves",
+	)
 	appCmd := fs.String(
 		"app-cmd",
 		"",
@@ -45,6 +68,21 @@ func parseFlags(out io.Writer, args []string) (*config.Veil, error) {
 		"",
 		"application web server, e.g. http://localhost:8081",
 	)
+	certOverlap := fs.Duration(
+		"cert-overlap",
+		defaultCertOverlap,
+		"how long to keep attesting the previous TLS certificate after rotating it",
+	)
+	certPerHost := fs.Bool(
+		"cert-per-host",
+		false,
+		"serve a separate TLS certificate for each of -alt-fqdns",
+	)
+	certRotation := fs.Duration(
+		"cert-rotation",
+		defaultCertRotation,
+		"how often to rotate the TLS key and certificate; 0 disables rotation",
+	)
 	debug := fs.Bool(
 		"debug",
 		false,
@@ -55,6 +93,11 @@ func parseFlags(out io.Writer, args []string) (*config.Veil, error) {
 		"",
 		"the enclave application's source code",
 	)
+	enclaveCodeRev := fs.String(
+		"enclave-code-rev",
+		"",
+		"the commit or tag of the enclave application's source code",
+	)
 	extPort := fs.Int(
 		"ext-port",
 		defaultExtPort,
@@ -65,11 +108,21 @@ func parseFlags(out io.Writer, args []string) (*config.Veil, error) {
 		"",
 		"the enclave's fully qualified domain name",
 	)
+	ipSANs := fs.String(
+		"ip-sans",
+		"",
+		"comma- or whitespace-separated IP addresses to add to the TLS certificate",
+	)
 	intPort := fs.Int(
 		"int-port",
 		defaultIntPort,
 		"internal port",
 	)
+	raTLS := fs.Bool(
+		"ra-tls",
+		false,
+		"embed an attestation document in the TLS certificate",
+	)
 	resolver := fs.String(
 		"dns-resolver",
 		defaultDNSResolver,
@@ -95,6 +148,11 @@ func parseFlags(out io.Writer, args []string) (*config.Veil, error) {
 		false,
 		"enable testing by disabling attestation",
 	)
+	vhosts := fs.String(
+		"vhosts",
+		"",
+		"comma- or whitespace-separated virtual hosts, e.g. api.example.com=http://localhost:8082",
+	)
 	vsockPort := fs.Uint(
 		"vsock-port",
 		tunnel.DefaultVSOCKPort,
@@ -118,21 +176,44 @@ func parseFlags(out io.Writer, args []string) (*config.Veil, error) {
 			return nil, fmt.Errorf("failed to parse -app-web-srv: %w", err)
 		}
 	}
+	var ips []net.IP
+	for _, s := range splitList(*ipSANs) {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("failed to parse -ip-sans: invalid IP address %q", s)
+		}
+		ips = append(ips, ip)
+	}
+	virtualHosts, err := parseVirtualHosts(*vhosts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse -vhosts: %w", err)
+	}
 
 	// Build and validate the configuration.
 	cfg := &config.Veil{
+		ACMEDirectory:  *acmeDirectory,
+		ACMEEmail:      *acmeEmail,
+		ACMERoots:      *acmeRoots,
+		AltFQDNs:       splitList(*altFQDNs),
 		AppCmd:         *appCmd,
 		AppWebSrv:      u,
+		CertOverlap:    *certOverlap,
+		CertPerHost:    *certPerHost,
+		CertRotation:   *certRotation,
 		Debug:          *debug,
 		EnclaveCodeURI: *enclaveCodeURI,
+		EnclaveCodeRev: *enclaveCodeRev,
 		ExtPort:        *extPort,
 		FQDN:           *fqdn,
+		IPSANs:         ips,
 		IntPort:        *intPort,
 		NDots:          optionalInt(ndots),
+		RATLS:          *raTLS,
 		Resolver:       *resolver,
 		SearchDomains:  splitList(*search),
 		SilenceApp:     *silenceApp,
 		Testing:        *testing,
+		VirtualHosts:   virtualHosts,
 		VSOCKPort:      uint32(*vsockPort),
 		WaitForApp:     *waitForApp,
 	}
@@ -146,6 +227,27 @@ func optionalInt(v *int) *int {
 	return v
 }
 
+// parseVirtualHosts parses a list of virtual hosts of the form
+// "host=url", e.g., "api.example.com=http://localhost:8082".
+func parseVirtualHosts(s string) (map[string]*url.URL, error) {
+	var vhosts map[string]*url.URL
+	for _, vhost := range splitList(s) {
+		host, rawURL, ok := strings.Cut(vhost, "=")
+		if !ok || host == "" {
+			return nil, fmt.Errorf("expected host=url but got %q", vhost)
+		}
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			return nil, err
+		}
+		if vhosts == nil {
+			vhosts = make(map[string]*url.URL)
+		}
+		vhosts[host] = u
+	}
+	return vhosts, nil
+}
+
 func splitList(s string) []string {
 	return strings.FieldsFunc(s, func(r rune) bool {
 		return r == ',' || unicode.IsSpace(r)
@@ -4,12 +4,17 @@ import (
 	"bytes"
 	"context"
 	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"slices"
 	"sync"
@@ -27,6 +32,7 @@ import (
 	"github.com/Amnesic-Systems/veil/internal/nonce"
 	"github.com/Amnesic-Systems/veil/internal/service"
 	"github.com/Amnesic-Systems/veil/internal/service/attestation"
+	"github.com/Amnesic-Systems/veil/internal/service/handle"
 	"github.com/Amnesic-Systems/veil/internal/testutil"
 	"github.com/Amnesic-Systems/veil/internal/util/must"
 	"github.com/stretchr/testify/assert"
@@ -127,6 +133,22 @@ func TestBadConfig(t *testing.T) {
 			name: "bad application url",
 			args: []string{"-app-web-srv", "http://localhost:foo"},
 		},
+		{
+			name: "bad IP SAN",
+			args: []string{"-fqdn", "example.com", "-ip-sans", "127.0.0.300"},
+		},
+		{
+			name: "bad virtual host",
+			args: []string{"-fqdn", "example.com", "-vhosts", "http://localhost:8082"},
+		},
+		{
+			name: "virtual host without certificate",
+			args: []string{"-fqdn", "example.com", "-vhosts", "other.example.com=http://localhost:8082"},
+		},
+		{
+			name: "virtual host without FQDN",
+			args: []string{"-vhosts", "example.com=http://localhost:8082"},
+		},
 	}
 
 	for _, c := range cases {
@@ -168,6 +190,22 @@ func TestParseDefaultDNSFlags(t *testing.T) {
 	require.Empty(t, cfg.SearchDomains)
 }
 
+func TestParseVirtualHostFlags(t *testing.T) {
+	cfg, err := parseFlags(io.Discard, []string{
+		"-fqdn", "example.com",
+		"-alt-fqdns", "api.example.com,www.example.com",
+		"-ip-sans", "127.0.0.1 ::1",
+		"-vhosts", "api.example.com=http://localhost:8082,example.com=http://localhost:8083",
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"api.example.com", "www.example.com"}, cfg.AltFQDNs)
+	require.Equal(t, []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::1")}, cfg.IPSANs)
+	require.Equal(t, map[string]*url.URL{
+		"api.example.com": must.Get(url.Parse("http://localhost:8082")),
+		"example.com":     must.Get(url.Parse("http://localhost:8083")),
+	}, cfg.VirtualHosts)
+}
+
 func TestPages(t *testing.T) {
 	defer stopSvc(startSvc(t, withFlags()))
 
@@ -345,6 +383,233 @@ func TestAttestation(t *testing.T) {
 	}
 }
 
+func TestRATLS(t *testing.T) {
+	defer stopSvc(startSvc(t, withFlags("-ra-tls")))
+
+	attester := nitro.NewAttester()
+	if !nitro.IsEnclave() {
+		attester = noop.NewAttester()
+	}
+	conn, err := tls.Dial(
+		"tcp",
+		fmt.Sprintf("127.0.0.1:%d", defaultExtPort),
+		&tls.Config{InsecureSkipVerify: true},
+	)
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+
+	cert := conn.ConnectionState().PeerCertificates[0]
+	_, err = attestation.VerifyCertificate(cert, attester)
+	require.NoError(t, err)
+
+	// The in-band attestation hashes contain the certificate's hash.
+	resp, err := testutil.Client.Get(intSrv(service.PathHashes))
+	require.NoError(t, err)
+	defer func() { _ = resp.Body.Close() }()
+	var hashes attestation.Hashes
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&hashes))
+	require.Equal(t, sha256.Sum256(cert.Raw), *hashes.TlsKeyHash)
+}
+
+func TestACME(t *testing.T) {
+	const lifetime = 3 * time.Second
+	ca := testutil.NewACMEServer(t, fmt.Sprintf("127.0.0.1:%d", defaultExtPort), lifetime)
+	defer stopSvc(startSvc(t, withFlags(
+		"-fqdn", "example.com",
+		"-acme-directory", ca.DirectoryURL(),
+		"-acme-roots", ca.WriteRoots(t),
+	)))
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.CA)
+	getCert := func() *x509.Certificate {
+		conn, err := tls.Dial(
+			"tcp",
+			fmt.Sprintf("127.0.0.1:%d", defaultExtPort),
+			&tls.Config{ServerName: "example.com", RootCAs: roots},
+		)
+		if err != nil {
+			return nil
+		}
+		defer func() { _ = conn.Close() }()
+		return conn.ConnectionState().PeerCertificates[0]
+	}
+	getHash := func() [sha256.Size]byte {
+		resp, err := testutil.Client.Get(intSrv(service.PathHashes))
+		require.NoError(t, err)
+		defer func() { _ = resp.Body.Close() }()
+		var hashes attestation.Hashes
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&hashes))
+		return *hashes.TlsKeyHash
+	}
+
+	// Eventually, veil serves a certificate that the ACME server issued, and
+	// the in-band attestation hashes contain the certificate's hash.
+	var cert *x509.Certificate
+	require.Eventually(t, func() bool {
+		cert = getCert()
+		return cert != nil
+	}, 5*time.Second, 50*time.Millisecond)
+	require.Equal(t, []string{"example.com"}, cert.DNSNames)
+	require.Equal(t, sha256.Sum256(cert.Raw), getHash())
+
+	// Before the certificate expires, veil renews it.
+	require.Eventually(t, func() bool {
+		renewed := getCert()
+		return renewed != nil && !renewed.Equal(cert) &&
+			sha256.Sum256(renewed.Raw) == getHash()
+	}, 2*lifetime, 50*time.Millisecond)
+	require.GreaterOrEqual(t, ca.Issued(), 2)
+}
+
+func TestCertRotation(t *testing.T) {
+	const (
+		rotation = time.Second
+		overlap  = 500 * time.Millisecond
+	)
+	defer stopSvc(startSvc(t, withFlags(
+		"-cert-rotation", rotation.String(),
+		"-cert-overlap", overlap.String(),
+	)))
+
+	getCertHash := func() string {
+		conn, err := tls.Dial(
+			"tcp",
+			fmt.Sprintf("127.0.0.1:%d", defaultExtPort),
+			&tls.Config{InsecureSkipVerify: true},
+		)
+		require.NoError(t, err)
+		defer func() { _ = conn.Close() }()
+		hash := sha256.Sum256(conn.ConnectionState().PeerCertificates[0].Raw)
+		return hex.EncodeToString(hash[:])
+	}
+	getCerts := func() (*handle.CertHashes, *attestation.Hashes) {
+		var (
+			certs  handle.CertHashes
+			hashes attestation.Hashes
+		)
+		for path, v := range map[string]any{
+			service.PathCerts:  &certs,
+			service.PathHashes: &hashes,
+		} {
+			resp, err := testutil.Client.Get(intSrv(path))
+			require.NoError(t, err)
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(v))
+			require.NoError(t, resp.Body.Close())
+		}
+		return &certs, &hashes
+	}
+	hexHash := func(h *[sha256.Size]byte) string {
+		if h == nil {
+			return ""
+		}
+		return hex.EncodeToString(h[:])
+	}
+
+	first := getCertHash()
+	certs, hashes := getCerts()
+	require.Equal(t, first, certs.Current.SHA256)
+	require.Nil(t, certs.Previous)
+	require.Equal(t, first, hexHash(hashes.TlsKeyHash))
+
+	// After the rotation, we serve a new certificate, and keep attesting to
+	// the previous one during the overlap window.
+	var second string
+	require.Eventually(t, func() bool {
+		second = getCertHash()
+		return second != first
+	}, 2*rotation, 20*time.Millisecond)
+	certs, hashes = getCerts()
+	require.Equal(t, second, certs.Current.SHA256)
+	require.NotNil(t, certs.Previous)
+	require.Equal(t, first, certs.Previous.SHA256)
+	require.Equal(t, second, hexHash(hashes.TlsKeyHash))
+	require.Equal(t, first, hexHash(hashes.PrevTlsKeyHash))
+
+	// Once the overlap window ends, we stop attesting to the previous
+	// certificate.
+	require.Eventually(t, func() bool {
+		certs, hashes := getCerts()
+		return certs.Previous == nil && hashes.PrevTlsKeyHash == nil &&
+			certs.Current.SHA256 == second
+	}, rotation, 20*time.Millisecond)
+}
+
+func TestVirtualHosts(t *testing.T) {
+	newBackend := func(name string) *httptest.Server {
+		srv := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, _ *http.Request) {
+				_, _ = io.WriteString(w, name)
+			},
+		))
+		t.Cleanup(srv.Close)
+		return srv
+	}
+	app, api := newBackend("app"), newBackend("api")
+	defer stopSvc(startSvc(t, withFlags(
+		"-fqdn", "example.com",
+		"-alt-fqdns", "api.example.com,www.example.com",
+		"-cert-per-host",
+		"-ip-sans", "127.0.0.1",
+		"-app-web-srv", app.URL,
+		"-vhosts", "api.example.com="+api.URL,
+	)))
+
+	tlsConfig := func(serverName string) *tls.Config {
+		return &tls.Config{ServerName: serverName, InsecureSkipVerify: true}
+	}
+	getCert := func(serverName string) *x509.Certificate {
+		conn, err := tls.Dial(
+			"tcp",
+			fmt.Sprintf("127.0.0.1:%d", defaultExtPort),
+			tlsConfig(serverName),
+		)
+		require.NoError(t, err)
+		defer func() { _ = conn.Close() }()
+		return conn.ConnectionState().PeerCertificates[0]
+	}
+	get := func(serverName string) string {
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig: tlsConfig(serverName),
+		}}
+		resp, err := client.Get(extSrv("/"))
+		require.NoError(t, err)
+		defer func() { _ = resp.Body.Close() }()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(body)
+	}
+
+	// Each host name with its own certificate gets it via SNI, and all
+	// other names get FQDN's certificate.
+	primary, apiCert := getCert("example.com"), getCert("api.example.com")
+	require.Equal(t, []string{"example.com"}, primary.DNSNames)
+	require.True(t, primary.IPAddresses[0].Equal(net.ParseIP("127.0.0.1")))
+	require.Equal(t, []string{"api.example.com"}, apiCert.DNSNames)
+	require.Empty(t, apiCert.IPAddresses)
+	require.True(t, getCert("").Equal(primary))
+	require.True(t, getCert("API.example.com").Equal(apiCert))
+	wwwCert := getCert("www.example.com")
+	require.Equal(t, []string{"www.example.com"}, wwwCert.DNSNames)
+
+	// The attestation hashes contain the hashes of all certificates.
+	resp, err := testutil.Client.Get(intSrv(service.PathHashes))
+	require.NoError(t, err)
+	defer func() { _ = resp.Body.Close() }()
+	var hashes attestation.Hashes
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&hashes))
+	for _, cert := range []*x509.Certificate{primary, apiCert, wwwCert} {
+		require.True(t, hashes.HasTLSHash(addr.Of(sha256.Sum256(cert.Raw))))
+	}
+	require.Equal(t, sha256.Sum256(apiCert.Raw), *hashes.HostTlsKeyHashes["api.example.com"])
+
+	// Requests reach the backend of the host name that the client asked for
+	// via SNI, and AppWebSrv otherwise.
+	require.Equal(t, "api", get("api.example.com"))
+	require.Equal(t, "app", get("www.example.com"))
+	require.Equal(t, "app", get("example.com"))
+}
+
 func TestHashes(t *testing.T) {
 	defer stopSvc(startSvc(t, withFlags()))
 
@@ -362,6 +627,10 @@ func TestHashes(t *testing.T) {
 		}
 	)
 	hashes.SetAppHash(addr.Of(sha256.Sum256([]byte("foo"))))
+	claims := &attestation.Hashes{
+		AppKeyHash: hashes.AppKeyHash,
+		AppClaims:  map[string][]byte{"region": []byte("eu-west-1")},
+	}
 
 	cases := []struct {
 		name       string
@@ -388,6 +657,32 @@ func TestHashes(t *testing.T) {
 			wantCode:   http.StatusOK,
 			wantHashes: hashes,
 		},
+		{
+			name:      "post application claims",
+			reqFunc:   doPost,
+			toMarshal: claims,
+			wantCode:  http.StatusOK,
+		},
+		{
+			name:       "get application claims",
+			reqFunc:    doGet,
+			wantCode:   http.StatusOK,
+			wantHashes: claims,
+		},
+		{
+			name:    "post oversized application claims",
+			reqFunc: doPost,
+			toMarshal: &attestation.Hashes{
+				AppClaims: map[string][]byte{"blob": make([]byte, enclave.AuxFieldLen)},
+			},
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:       "get unchanged application claims",
+			reqFunc:    doGet,
+			wantCode:   http.StatusOK,
+			wantHashes: claims,
+		},
 	}
 
 	for _, c := range cases {
@@ -413,6 +708,7 @@ func TestHashes(t *testing.T) {
 
 			// Make sure that the application hashes match.
 			require.Equal(t, c.wantHashes.AppKeyHash, gotHashes.AppKeyHash)
+			require.Equal(t, c.wantHashes.AppClaims, gotHashes.AppClaims)
 			// Make sure that the TLS certificate hash is set.
 			require.NotEmpty(t, *gotHashes.TlsKeyHash)
 		})
@@ -5,18 +5,23 @@ import (
 	"context"
 	"crypto/sha256"
 	"crypto/sha512"
+	"crypto/x509"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
 	"strings"
+	"time"
 
 	"github.com/fatih/color"
 
+	"github.com/Amnesic-Systems/veil/internal/addr"
 	"github.com/Amnesic-Systems/veil/internal/config"
 	"github.com/Amnesic-Systems/veil/internal/enclave"
 	"github.com/Amnesic-Systems/veil/internal/enclave/nitro"
@@ -26,7 +31,6 @@ import (
 	"github.com/Amnesic-Systems/veil/internal/nonce"
 	"github.com/Amnesic-Systems/veil/internal/service"
 	"github.com/Amnesic-Systems/veil/internal/service/attestation"
-	"github.com/Amnesic-Systems/veil/internal/util/must"
 )
 
 var (
@@ -37,7 +41,8 @@ var (
 func attestEnclave(
 	ctx context.Context,
 	cfg *config.VeilVerify,
-	pcrs enclave.PCR,
+	policy *enclave.Policy,
+	rep *report,
 ) (err error) {
 	defer errs.WrapErr(&err, errFailedToAttest)
 
@@ -46,19 +51,22 @@ func attestEnclave(
 	if err != nil {
 		return err
 	}
+	rep.Nonce = nonce.B64()
+	start := time.Now()
 
-	req, err := buildReq(ctx, cfg.Addr, nonce)
+	req, err := buildReq(ctx, cfg.Addr, service.PathAttestation, nonce)
 	if err != nil {
 		return err
 	}
 	// Request the enclave's attestation document.  We don't verify HTTPS
 	// certificates because authentication is happening via the attestation
 	// document.
-	client := httpx.NewUnauthClient()
+	client := newClient(rep.IP)
 	resp, err := client.Do(req)
 	if err != nil {
 		return err
 	}
+	rep.StatusCode = resp.StatusCode
 	// Read the response body first, so we can log it in case of an error.
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
@@ -70,6 +78,9 @@ func attestEnclave(
 			errs.ErrEnclaveErr, resp.Status, string(body))
 	}
 
+	rep.timePhase("fetch", start)
+	start = time.Now()
+
 	// Parse the attestation document.
 	var rawDoc enclave.RawDocument
 	if err := json.Unmarshal(body, &rawDoc); err != nil {
@@ -79,18 +90,43 @@ func attestEnclave(
 	// Verify the attestation document, which provides assurance that we are
 	// talking to an enclave.  The nonce provides assurance that we are talking
 	// to an alive enclave (instead of a replayed attestation document).
-	attester := nitro.NewAttester()
-	if cfg.Testing {
-		attester = noop.NewAttester()
+	attester, err := newAttester(cfg.Roots, cfg.Testing)
+	if err != nil {
+		return err
 	}
 	doc, err := attester.Verify(&rawDoc, nonce)
 	if err != nil {
 		return err
 	}
-	if err := verifyTLSBinding(resp, doc); err != nil {
+	rep.Document = newDocReport(doc)
+	err = verifyTLSBinding(resp, doc)
+	rep.TLSBinding = addr.Of(err == nil)
+	if err != nil {
 		return err
 	}
 
+	// Verify the attestation document's PCR values, which provide assurance
+	// that the remote enclave's image and kernel match the local copy.
+	err = checkPCRs(doc, policy, rep)
+	rep.timePhase("verify", start)
+	if errors.Is(err, errs.ErrPCRMismatch) && cfg.Output != config.OutputJSON {
+		color.Red("Enclave's code DOES NOT match local code!")
+		if cfg.Dir != "" || cfg.Checkout {
+			log.Printf("Run %q to check if the build is reproducible.", "veil-verify "+cmdReproduce)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if cfg.Output != config.OutputJSON {
+		color.Green("Enclave's code matches local code!")
+	}
+	return nil
+}
+
+// checkPCRs checks the given document's PCR values against the given policy,
+// and records mismatches in the given report.
+func checkPCRs(doc *enclave.Document, policy *enclave.Policy, rep *report) error {
 	// Delete empty PCR values from the attestation document.  This is not
 	// ideal; we should either have the rest of the code tolerate empty PCR
 	// values or fix the nsm package, so it doesn't return empty PCR values.
@@ -101,29 +137,84 @@ func attestEnclave(
 		}
 	}
 
-	// Verify the attestation document's PCR values, which provide assurance
-	// that the remote enclave's image and kernel match the local copy.
-	if !pcrs.Equal(doc.PCRs) {
-		log.Printf("Expected PCRs:\n%sbut got PCRs:\n%s", pcrs, doc.PCRs)
-		color.Red("Enclave's code DOES NOT match local code!")
-		return errs.ErrPCRMismatch
-	} else {
-		color.Green("Enclave's code matches local code!")
+	if err := policy.CanCheck(); err != nil {
+		return err
+	}
+	mismatches := policy.Check(doc.PCRs)
+	if len(mismatches) == 0 {
 		return nil
 	}
+	log.Printf("Got PCRs:\n%s", doc.PCRs)
+	for _, m := range mismatches {
+		log.Print(m)
+		rep.Mismatches = append(rep.Mismatches, m.String())
+	}
+	return errs.ErrPCRMismatch
+}
+
+// newClient returns an HTTP client that doesn't verify HTTPS certificates.  If
+// the given IP address isn't empty, the client connects to it regardless of
+// what the request's host name resolves to.
+func newClient(ip string) *http.Client {
+	client := httpx.NewUnauthClient()
+	if ip == "" {
+		return client
+	}
+	transport := client.Transport.(*http.Transport)
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		_, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		var d net.Dialer
+		return d.DialContext(ctx, network, net.JoinHostPort(ip, port))
+	}
+	return client
+}
+
+// newAttester returns the attester that we use to verify attestation documents.
+// If testing is set, we use the noop attester.  Otherwise, we use the nitro
+// attester, which trusts the root certificates in the given PEM file, or AWS's
+// root certificate if the path is empty.
+func newAttester(rootsPath string, testing bool) (_ enclave.Attester, err error) {
+	defer errs.Wrap(&err, "failed to create attester")
+
+	if testing {
+		return noop.NewAttester(), nil
+	}
+	if rootsPath == "" {
+		return nitro.NewAttester(), nil
+	}
+
+	rawRoots, err := os.ReadFile(rootsPath)
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(rawRoots) {
+		return nil, fmt.Errorf("found no certificates in %q", rootsPath)
+	}
+	return nitro.NewAttester(nitro.WithRoots(roots)), nil
 }
 
 func verifyTLSBinding(resp *http.Response, doc *enclave.Document) error {
 	if resp.TLS == nil || len(resp.TLS.PeerCertificates) == 0 {
 		return errors.New("response has no TLS peer certificate")
 	}
+	return checkTLSBinding(resp.TLS.PeerCertificates[0], doc)
+}
 
+// checkTLSBinding returns an error if the given attestation document doesn't
+// contain the hash of the given certificate.
+func checkTLSBinding(cert *x509.Certificate, doc *enclave.Document) error {
 	hashes, err := attestation.GetHashes(&doc.AuxInfo)
 	if err != nil {
 		return fmt.Errorf("failed to get attested TLS certificate hash: %w", err)
 	}
-	gotHash := sha256.Sum256(resp.TLS.PeerCertificates[0].Raw)
-	if !bytes.Equal(gotHash[:], hashes.TlsKeyHash[:]) {
+	// During a certificate rotation's overlap window, the enclave also
+	// attests to its previous certificate.
+	gotHash := sha256.Sum256(cert.Raw)
+	if !hashes.HasTLSHash(&gotHash) {
 		return errs.ErrBindingMismatch
 	}
 	return nil
@@ -132,6 +223,7 @@ func verifyTLSBinding(resp *http.Response, doc *enclave.Document) error {
 func buildReq(
 	ctx context.Context,
 	addr string,
+	path string,
 	nonce *nonce.Nonce,
 ) (_ *http.Request, err error) {
 	defer errs.Wrap(&err, "failed to build request")
@@ -142,7 +234,7 @@ func buildReq(
 	if err != nil {
 		return nil, err
 	}
-	u.Path = service.PathAttestation
+	u.Path = path
 	query := u.Query()
 	query.Set(httpx.ParamNonce, nonce.B64())
 	u.RawQuery = query.Encode()
@@ -154,28 +246,40 @@ func buildReq(
 	return req, nil
 }
 
+// measurements represents the JSON-encoded measurements of the enclave image.
+// The JSON tags must match the output of the nitro-cli command line tool. An
+// example:
+//
+//	{
+//	  "Measurements": {
+//	    "HashAlgorithm": "Sha384 { ... }",
+//	    "PCR0": "8b927cf0bbf2d668a8c24c69afd23bff2dda713b4f0d70195205950f9a5a1fbb7089ad937e3025ee8d5a084f3d6c9126",
+//	    "PCR1": "4b4d5b3661b3efc12920900c80e126e4ce783c522de6c02a2a5bf7af3a2b9327b86776f188e4be1c1c404a129dbda493",
+//	    "PCR2": "22d2194eb27a7cda42e66dd5b91ef13e5a153d797c04ae179e59bef1c93438d6ad0365c175c119230e36d0f8d6b6b59e"
+//	  }
+//	}
+type measurements struct {
+	HashAlgorithm string `json:"HashAlgorithm"`
+	PCR0          string `json:"PCR0"`
+	PCR1          string `json:"PCR1"`
+	PCR2          string `json:"PCR2"`
+}
+
+// newMeasurements returns the measurements of the given PCR values.
+func newMeasurements(pcrs enclave.PCR) measurements {
+	return measurements{
+		HashAlgorithm: "Sha384 { ... }",
+		PCR0:          hex.EncodeToString(pcrs[0]),
+		PCR1:          hex.EncodeToString(pcrs[1]),
+		PCR2:          hex.EncodeToString(pcrs[2]),
+	}
+}
+
 func toPCR(jsonMsmts []byte) (_ enclave.PCR, err error) {
 	defer errs.WrapErr(&err, errFailedToConvert)
 
-	// This structs represents the JSON-encoded measurements of the enclave
-	// image.  The JSON tags must match the output of the nitro-cli command
-	// line tool. An example:
-	//
-	//	{
-	//	  "Measurements": {
-	//	    "HashAlgorithm": "Sha384 { ... }",
-	//	    "PCR0": "8b927cf0bbf2d668a8c24c69afd23bff2dda713b4f0d70195205950f9a5a1fbb7089ad937e3025ee8d5a084f3d6c9126",
-	//	    "PCR1": "4b4d5b3661b3efc12920900c80e126e4ce783c522de6c02a2a5bf7af3a2b9327b86776f188e4be1c1c404a129dbda493",
-	//	    "PCR2": "22d2194eb27a7cda42e66dd5b91ef13e5a153d797c04ae179e59bef1c93438d6ad0365c175c119230e36d0f8d6b6b59e"
-	//	  }
-	//	}
 	m := struct {
-		Measurements struct {
-			HashAlgorithm string `json:"HashAlgorithm"`
-			PCR0          string `json:"PCR0"`
-			PCR1          string `json:"PCR1"`
-			PCR2          string `json:"PCR2"`
-		} `json:"Measurements"`
+		Measurements measurements `json:"Measurements"`
 	}{}
 	if err := json.Unmarshal(jsonMsmts, &m); err != nil {
 		return nil, err
@@ -187,9 +291,25 @@ func toPCR(jsonMsmts []byte) (_ enclave.PCR, err error) {
 		return nil, fmt.Errorf("expected hash algorithm %q but got %q", want, got)
 	}
 
-	return enclave.PCR{
-		0: must.Get(hex.DecodeString(m.Measurements.PCR0)),
-		1: must.Get(hex.DecodeString(m.Measurements.PCR1)),
-		2: must.Get(hex.DecodeString(m.Measurements.PCR2)),
-	}, nil
+	pcrs := make(enclave.PCR)
+	for i, s := range []string{
+		m.Measurements.PCR0,
+		m.Measurements.PCR1,
+		m.Measurements.PCR2,
+	} {
+		if pcrs[uint(i)], err = hex.DecodeString(s); err != nil {
+			return nil, fmt.Errorf("invalid value of PCR%d: %w", i, err)
+		}
+	}
+	return pcrs, nil
+}
+
+// readPCRs reads the given file, which contains JSON-encoded measurements in
+// the format that toPCR expects.
+func readPCRs(path string) (enclave.PCR, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return toPCR(raw)
 }
@@ -5,19 +5,29 @@ import (
 	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
+	"fmt"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/Amnesic-Systems/veil/internal/config"
 	"github.com/Amnesic-Systems/veil/internal/enclave"
+	"github.com/Amnesic-Systems/veil/internal/enclave/emulator"
 	"github.com/Amnesic-Systems/veil/internal/errs"
 	"github.com/Amnesic-Systems/veil/internal/httpx"
 	"github.com/Amnesic-Systems/veil/internal/nonce"
 	"github.com/Amnesic-Systems/veil/internal/service"
 	"github.com/Amnesic-Systems/veil/internal/service/attestation"
+	"github.com/Amnesic-Systems/veil/internal/tunnel"
+	"github.com/Amnesic-Systems/veil/internal/util/must"
 	"github.com/stretchr/testify/require"
 )
 
@@ -78,7 +88,7 @@ func newAttestationServer(
 
 func TestBuildReq(t *testing.T) {
 	n := new(nonce.Nonce)
-	req, err := buildReq(t.Context(), "https://example.com/", n)
+	req, err := buildReq(t.Context(), "https://example.com/", service.PathAttestation, n)
 	require.NoError(t, err)
 
 	u := req.URL
@@ -122,6 +132,17 @@ func TestAttestEnclave(t *testing.T) {
 			localPCRs: testPCRs(),
 			wantErr:   errs.ErrBindingMismatch,
 		},
+		{
+			name: "legacy claims",
+			newServer: func(t *testing.T) *httptest.Server {
+				return newAttestationServer(t, func(doc *enclave.Document) {
+					hashes := must.Get(attestation.DeserializeHashes(doc.PublicKey))
+					doc.PublicKey = fmt.Appendf(nil, "sha256:%s;sha256:",
+						base64.StdEncoding.EncodeToString(hashes.TlsKeyHash[:]))
+				})
+			},
+			localPCRs: testPCRs(),
+		},
 		{
 			name: "missing tls binding",
 			newServer: func(t *testing.T) *httptest.Server {
@@ -186,7 +207,7 @@ func TestAttestEnclave(t *testing.T) {
 			defer srv.Close()
 
 			cfg := &config.VeilVerify{Addr: srv.URL, Testing: true}
-			err := attestEnclave(t.Context(), cfg, c.localPCRs)
+			err := attestEnclave(t.Context(), cfg, enclave.NewPolicy(c.localPCRs), new(report))
 			require.ErrorIs(t, err, c.wantErr)
 		})
 	}
@@ -200,10 +221,155 @@ func TestAttestEnclaveCanceledContext(t *testing.T) {
 	cancel()
 
 	cfg := &config.VeilVerify{Addr: srv.URL, Testing: true}
-	err := attestEnclave(ctx, cfg, testPCRs())
+	err := attestEnclave(ctx, cfg, enclave.NewPolicy(testPCRs()), new(report))
 	require.ErrorIs(t, err, context.Canceled)
 }
 
+func TestAttestEnclavePolicy(t *testing.T) {
+	srv := newAttestationServer(t, nil)
+	defer srv.Close()
+
+	previous := enclave.PCR{0: []byte(strings.Repeat("z", 48))}
+	cases := []struct {
+		name    string
+		policy  *enclave.Policy
+		wantErr error
+	}{
+		{
+			name:    "empty policy",
+			policy:  enclave.NewPolicy(),
+			wantErr: enclave.ErrEmptyPolicy,
+		},
+		{
+			name:    "policy without allowed sets",
+			policy:  &enclave.Policy{Required: enclave.PCR{3: testPCRs()[0]}},
+			wantErr: enclave.ErrNoAllowedPCRs,
+		},
+		{
+			name:   "one of several releases",
+			policy: enclave.NewPolicy(previous, testPCRs()),
+		},
+		{
+			name: "required pcr mismatch",
+			policy: &enclave.Policy{
+				Allowed:  []enclave.PCR{testPCRs()},
+				Required: enclave.PCR{3: []byte("role")},
+			},
+			wantErr: errs.ErrPCRMismatch,
+		},
+		{
+			name: "ignored pcr",
+			policy: &enclave.Policy{
+				Allowed: []enclave.PCR{previous},
+				Ignored: []uint{0, 1, 2},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg := &config.VeilVerify{Addr: srv.URL, Testing: true}
+			err := attestEnclave(t.Context(), cfg, c.policy, new(report))
+			require.ErrorIs(t, err, c.wantErr)
+		})
+	}
+}
+
+func freePort(t *testing.T) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = ln.Close() }()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+// startEmulatedEnclave runs veil's service with the given attester and returns
+// the address of its external Web server.  The given functions may modify
+// veil's configuration.
+func startEmulatedEnclave(
+	t *testing.T,
+	attester enclave.Attester,
+	opts ...func(*config.Veil),
+) string {
+	t.Helper()
+
+	cfg := &config.Veil{
+		ExtPort:   freePort(t),
+		IntPort:   freePort(t),
+		VSOCKPort: tunnel.DefaultVSOCKPort,
+		Testing:   true,
+	}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		service.Run(ctx, cfg, attester, tunnel.NewNoop())
+	}()
+	t.Cleanup(func() {
+		cancel()
+		wg.Wait()
+	})
+
+	addr := fmt.Sprintf("https://127.0.0.1:%d", cfg.ExtPort)
+	deadline, cancelDl := context.WithTimeout(ctx, time.Second)
+	defer cancelDl()
+	require.NoError(t, httpx.WaitForSvc(deadline, httpx.NewUnauthClient(), addr))
+	return addr
+}
+
+func TestAttestEmulatedEnclave(t *testing.T) {
+	attester := must.Get(emulator.NewAttester(emulator.WithPCRs(testPCRs())))
+	addr := startEmulatedEnclave(t, attester)
+
+	roots := filepath.Join(t.TempDir(), "roots.pem")
+	require.NoError(t, os.WriteFile(roots, attester.RootPEM(), 0o600))
+	foreignRoots := filepath.Join(t.TempDir(), "foreign-roots.pem")
+	require.NoError(t, os.WriteFile(foreignRoots,
+		must.Get(emulator.NewAttester()).RootPEM(), 0o600))
+
+	cases := []struct {
+		name      string
+		roots     string
+		localPCRs enclave.PCR
+		wantErr   bool
+	}{
+		{
+			name:      "aws roots",
+			localPCRs: testPCRs(),
+			wantErr:   true,
+		},
+		{
+			name:      "foreign roots",
+			roots:     foreignRoots,
+			localPCRs: testPCRs(),
+			wantErr:   true,
+		},
+		{
+			name:      "pcr mismatch",
+			roots:     roots,
+			localPCRs: enclave.PCR{0: []byte(strings.Repeat("z", 48))},
+			wantErr:   true,
+		},
+		{
+			name:      "valid",
+			roots:     roots,
+			localPCRs: testPCRs(),
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg := &config.VeilVerify{Addr: addr, Roots: c.roots}
+			err := attestEnclave(t.Context(), cfg, enclave.NewPolicy(c.localPCRs), new(report))
+			require.Equal(t, c.wantErr, err != nil, err)
+		})
+	}
+}
+
 func TestToPCR(t *testing.T) {
 	cases := []struct {
 		name     string
@@ -238,6 +404,16 @@ func TestToPCR(t *testing.T) {
 			}`),
 			wantErr: true,
 		},
+		{
+			name: "invalid hex",
+			in: []byte(`{
+				"Measurements": {
+					"HashAlgorithm": "Sha384 { ... }",
+					"PCR0": "foobar"
+				}
+			}`),
+			wantErr: true,
+		},
 		{
 			name: "valid",
 			in:   []byte(validPCRs),
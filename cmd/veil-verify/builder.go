@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/moby/moby/api/types/container"
+
+	"github.com/Amnesic-Systems/veil/internal/config"
+)
+
+const (
+	kanikoImage   = "gcr.io/kaniko-project/executor:v1.9.2"
+	buildKitImage = "moby/buildkit:v0.17.3"
+	// The directory in the builder container that contains the enclave
+	// application's source code.
+	workspace = "/workspace"
+	// The timestamp that BuildKit sets on all files and image metadata.  The
+	// enclave's developers must build with the same timestamp to arrive at
+	// the same PCR values.
+	sourceDateEpoch = "0"
+)
+
+// imageBuilder represents a backend that reproducibly builds the enclave
+// image in a Docker container.  The container finds the enclave application's
+// source code in the workspace directory and must write the enclave image as
+// a tar archive to enclaveTarImage in the workspace, in a format that both
+// `docker load` and eif.FromImage understand.
+type imageBuilder interface {
+	// name returns the builder's name, which we also use as the container's
+	// name.
+	name() string
+	// image returns the reference of the builder's container image.
+	image() string
+	// container returns the configuration of the builder's container.  The
+	// caller mounts the workspace.
+	container(cfg *config.VeilVerify) (*container.Config, *container.HostConfig)
+}
+
+// targetArch returns the CPU architecture that the enclave runs on.  The
+// default is amd64.
+func targetArch(arch string) string {
+	if arch == "" {
+		return config.ArchAMD64
+	}
+	return arch
+}
+
+// targetPlatform returns the platform that we build the enclave image for,
+// e.g., "linux/arm64".
+func targetPlatform(arch string) string {
+	return "linux/" + targetArch(arch)
+}
+
+// newImageBuilder returns the builder with the given name, which uses the
+// image that the given lock determines.  Kaniko is the default.
+func newImageBuilder(name string, lock *lockFile) (imageBuilder, error) {
+	switch name {
+	case "", config.BuilderKaniko:
+		return kanikoBuilder{ref: lock.image(imageKaniko)}, nil
+	case config.BuilderBuildKit:
+		return buildKitBuilder{ref: lock.image(imageBuildKit)}, nil
+	default:
+		return nil, fmt.Errorf("unknown builder %q", name)
+	}
+}
+
+// kanikoBuilder builds enclave images with kaniko, which writes a Docker image
+// archive.
+type kanikoBuilder struct {
+	ref string
+}
+
+func (kanikoBuilder) name() string    { return config.BuilderKaniko }
+func (b kanikoBuilder) image() string { return b.ref }
+
+func (b kanikoBuilder) container(cfg *config.VeilVerify) (*container.Config, *container.HostConfig) {
+	// We want a reproducible build for the platform that the enclave is
+	// running on.
+	return &container.Config{
+		Tty:   true,
+		Image: b.ref,
+		Cmd: []string{
+			"--dockerfile", cfg.Dockerfile,
+			"--reproducible",
+			"--no-push",
+			"--log-format", "text",
+			"--verbosity", "warn",
+			"--tarPath", enclaveTarImage,
+			"--destination", "enclave",
+			"--custom-platform", targetPlatform(cfg.Arch),
+		},
+	}, &container.HostConfig{}
+}
+
+// buildKitBuilder builds enclave images with BuildKit's daemonless buildctl,
+// which writes an OCI image archive.  SOURCE_DATE_EPOCH and rewrite-timestamp
+// make BuildKit's output reproducible.
+type buildKitBuilder struct {
+	ref string
+}
+
+func (buildKitBuilder) name() string    { return config.BuilderBuildKit }
+func (b buildKitBuilder) image() string { return b.ref }
+
+func (b buildKitBuilder) container(cfg *config.VeilVerify) (*container.Config, *container.HostConfig) {
+	dockerfile := path.Join(workspace, cfg.Dockerfile)
+	output := fmt.Sprintf("type=oci,dest=%s,name=enclave:latest,rewrite-timestamp=true",
+		path.Join(workspace, enclaveTarImage))
+	containerConfig := &container.Config{
+		Tty:        true,
+		Image:      b.ref,
+		Entrypoint: []string{"buildctl-daemonless.sh"},
+		Env:        []string{"SOURCE_DATE_EPOCH=" + sourceDateEpoch},
+		Cmd: []string{
+			"build",
+			"--frontend", "dockerfile.v0",
+			"--local", "context=" + workspace,
+			"--local", "dockerfile=" + path.Dir(dockerfile),
+			"--opt", "filename=" + path.Base(dockerfile),
+			"--opt", "platform=" + targetPlatform(cfg.Arch),
+			"--opt", "build-arg:SOURCE_DATE_EPOCH=" + sourceDateEpoch,
+			"--output", output,
+		},
+	}
+	// BuildKit's daemon needs privileges to create its build containers.
+	return containerConfig, &container.HostConfig{Privileged: true}
+}
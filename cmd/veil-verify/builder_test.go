@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/Amnesic-Systems/veil/internal/config"
+	"github.com/Amnesic-Systems/veil/internal/util/must"
+)
+
+func TestNewImageBuilder(t *testing.T) {
+	cases := []struct {
+		name     string
+		builder  string
+		wantName string
+		wantErr  bool
+	}{
+		{
+			name:     "default",
+			wantName: config.BuilderKaniko,
+		},
+		{
+			name:     "kaniko",
+			builder:  config.BuilderKaniko,
+			wantName: config.BuilderKaniko,
+		},
+		{
+			name:     "buildkit",
+			builder:  config.BuilderBuildKit,
+			wantName: config.BuilderBuildKit,
+		},
+		{
+			name:    "unknown",
+			builder: "docker",
+			wantErr: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			b, err := newImageBuilder(c.builder, unpinnedLock())
+			require.Equal(t, c.wantErr, err != nil)
+			if c.wantErr {
+				return
+			}
+			require.Equal(t, c.wantName, b.name())
+
+			containerCfg, _ := b.container(&config.VeilVerify{Dockerfile: "Dockerfile"})
+			require.Equal(t, b.image(), containerCfg.Image)
+			require.Contains(t, strings.Join(containerCfg.Cmd, " "), enclaveTarImage)
+		})
+	}
+}
+
+func TestBuildKitBuilder(t *testing.T) {
+	containerCfg, hostCfg := buildKitBuilder{ref: buildKitImage}.container(&config.VeilVerify{
+		Dockerfile: "docker/Dockerfile.enclave",
+	})
+	cmd := strings.Join(containerCfg.Cmd, " ")
+
+	require.True(t, hostCfg.Privileged)
+	require.Contains(t, containerCfg.Env, "SOURCE_DATE_EPOCH="+sourceDateEpoch)
+	require.Contains(t, cmd, "--opt build-arg:SOURCE_DATE_EPOCH="+sourceDateEpoch)
+	require.Contains(t, cmd, "rewrite-timestamp=true")
+	require.Contains(t, cmd, "type=oci,dest=/workspace/enclave.tar")
+	require.Contains(t, cmd, "--local dockerfile=/workspace/docker")
+	require.Contains(t, cmd, "--opt filename=Dockerfile.enclave")
+}
+
+func TestOfflineBuild(t *testing.T) {
+	// In offline mode, we must fail before contacting Docker if we would have
+	// to pull the builder image.
+	_, _, err := buildEnclaveImage(context.Background(), nil, &config.VeilVerify{
+		Dir:        t.TempDir(),
+		Dockerfile: "Dockerfile",
+		Offline:    true,
+	}, io.Discard)
+	require.ErrorIs(t, err, errOffline)
+}
+
+func TestBuilderPlatform(t *testing.T) {
+	for _, name := range []string{config.BuilderKaniko, config.BuilderBuildKit} {
+		b := must.Get(newImageBuilder(name, unpinnedLock()))
+		for arch, want := range map[string]string{
+			"":               "linux/amd64",
+			config.ArchARM64: "linux/arm64",
+		} {
+			containerCfg, _ := b.container(&config.VeilVerify{Dockerfile: "Dockerfile", Arch: arch})
+			require.Contains(t, strings.Join(containerCfg.Cmd, " "), want, name)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/Amnesic-Systems/veil/internal/config"
+	"github.com/Amnesic-Systems/veil/internal/enclave"
+	"github.com/Amnesic-Systems/veil/internal/errs"
+)
+
+const (
+	// Bump cacheVersion whenever a change to veil-verify changes the PCR
+	// values that a build results in.
+	cacheVersion = "1"
+	cachePCRs    = "pcrs.json"
+)
+
+// errUnpinnedBuild means that a build depends on helper images that we only
+// know by tag.  Tags move, so we must not cache the result of such builds.
+var errUnpinnedBuild = errors.New("helper images aren't pinned by digest (use -lock)")
+
+// buildCache stores the results of reproducible builds in a directory that's
+// keyed by the hash of everything that determines a build's result: the build
+// context (which includes the Dockerfile), the builder, and the compiler.
+type buildCache struct {
+	dir string
+}
+
+// newBuildCache returns the cache entry for the build that the given
+// configuration describes.
+func newBuildCache(cfg *config.VeilVerify) (_ *buildCache, err error) {
+	defer errs.Wrap(&err, "failed to determine build cache key")
+
+	root := cfg.CacheDir
+	if root == "" {
+		userCache, err := os.UserCacheDir()
+		if err != nil {
+			return nil, err
+		}
+		root = filepath.Join(userCache, "veil-verify")
+	}
+	key, err := buildCacheKey(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &buildCache{dir: filepath.Join(root, key)}, nil
+}
+
+// buildCacheKey returns the hex-encoded hash over everything that determines
+// the result of the build that the given configuration describes.  The build
+// must be fully pinned: a lock file pins the helper images by digest, and
+// tarballs are hashed by content.  Otherwise, we return
+// errUnpinnedBuild.
+func buildCacheKey(cfg *config.VeilVerify) (string, error) {
+	lock, err := readLockFile(cfg.Lock)
+	if err != nil {
+		return "", err
+	}
+	builderPinned := lock.pinned() || cfg.BuilderImage != ""
+	compilerPinned := lock.pinned() || cfg.CompilerImage != ""
+	if !builderPinned || !compilerPinned {
+		return "", errUnpinnedBuild
+	}
+	builder, err := newImageBuilder(cfg.Builder, lock)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	writeField := func(name, value string) {
+		_, _ = fmt.Fprintf(h, "%s=%q\n", name, value)
+	}
+	writeField("version", cacheVersion)
+	writeField("builder", builder.name())
+	writeField("builder-image", builder.image())
+	// Tarballs may contain a different image than their tag suggests.
+	for _, tarball := range []struct{ name, path string }{
+		{"builder-tarball", cfg.BuilderImage},
+		{"compiler-tarball", cfg.CompilerImage},
+	} {
+		if tarball.path == "" {
+			continue
+		}
+		writeField(tarball.name, "")
+		if err := hashTree(h, tarball.path, nil); err != nil {
+			return "", err
+		}
+	}
+	writeField("dockerfile", cfg.Dockerfile)
+	writeField("arch", targetArch(cfg.Arch))
+	writeField("compiler", compilerDockerfile(lock))
+	// We skip git's metadata, which changes with every clone, and the image
+	// that the builder writes to the build context.
+	skip := func(rel string) bool {
+		return rel == ".git" || rel == enclaveTarImage
+	}
+	if err := hashTree(h, cfg.Dir, skip); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashTree writes the names, types, permissions, and contents of all files
+// in the given directory to the given hash.  Files for which skip returns true
+// are ignored.
+func hashTree(h hash.Hash, root string, skip func(rel string) bool) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if skip != nil && skip(filepath.ToSlash(rel)) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		_, _ = fmt.Fprintf(h, "%q %s\n", filepath.ToSlash(rel), info.Mode())
+
+		switch {
+		case info.Mode()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			_, _ = fmt.Fprintf(h, "-> %q\n", target)
+		case info.Mode().IsRegular():
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer func() { _ = f.Close() }()
+			_, _ = fmt.Fprintf(h, "%d\n", info.Size())
+			if _, err := io.Copy(h, f); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// load returns the cached PCR values.
+func (c *buildCache) load() (enclave.PCR, bool) {
+	pcrs, err := readPCRs(filepath.Join(c.dir, cachePCRs))
+	if err != nil {
+		return nil, false
+	}
+	return pcrs, true
+}
+
+// store caches the given PCR values.
+func (c *buildCache) store(pcrs enclave.PCR) (err error) {
+	defer errs.Wrap(&err, "failed to store build in cache")
+
+	if err := os.MkdirAll(c.dir, 0o755); err != nil {
+		return err
+	}
+	raw, err := json.MarshalIndent(struct {
+		Measurements measurements `json:"Measurements"`
+	}{newMeasurements(pcrs)}, "", "  ")
+	if err != nil {
+		return err
+	}
+	// The presence of the PCR values marks the entry as complete, so we write
+	// them atomically.
+	return writeFileAtomically(filepath.Join(c.dir, cachePCRs), raw)
+}
+
+// writeFileAtomically writes the given data to a temporary file and then
+// renames it, so concurrent readers never see a partially-written file.
+func writeFileAtomically(path string, data []byte) (err error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = os.Remove(tmp.Name())
+		}
+	}()
+	if _, err := tmp.Write(data); err != nil {
+		return errors.Join(err, tmp.Close())
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// cachedBuild returns the cached PCR values for the build that the given
+// configuration describes, or runs the given build function and caches its
+// result.  Caching is best effort: we build if we cannot use the cache.
+func cachedBuild(
+	cfg *config.VeilVerify,
+	build func() (enclave.PCR, error),
+) (enclave.PCR, error) {
+	cache, err := newBuildCache(cfg)
+	if err != nil {
+		log.Printf("Not using build cache: %v", err)
+		return build()
+	}
+	if !cfg.NoCache {
+		if pcrs, ok := cache.load(); ok {
+			log.Printf("Using cached build from %s.", cache.dir)
+			return pcrs, nil
+		}
+	}
+
+	pcrs, err := build()
+	if err != nil {
+		return nil, err
+	}
+	if err := cache.store(pcrs); err != nil {
+		log.Print(err)
+	}
+	return pcrs, nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/Amnesic-Systems/veil/internal/config"
+	"github.com/Amnesic-Systems/veil/internal/enclave"
+)
+
+func TestCachedBuild(t *testing.T) {
+	dir := t.TempDir()
+	writeFile := func(name, content string) {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	}
+	writeFile("Dockerfile", "FROM alpine")
+	writeFile("src/main.go", "package main")
+
+	var builds int
+	build := func(cfg *config.VeilVerify) func() (enclave.PCR, error) {
+		return func() (enclave.PCR, error) {
+			builds++
+			return testPCRs(), nil
+		}
+	}
+	builderImage := filepath.Join(t.TempDir(), "kaniko.tar")
+	require.NoError(t, os.WriteFile(builderImage, []byte("kaniko"), 0o600))
+	compilerImage := filepath.Join(t.TempDir(), "nitro-cli-builder.tar")
+	require.NoError(t, os.WriteFile(compilerImage, []byte("nitro-cli"), 0o600))
+	cacheDir := t.TempDir()
+	lock := writeLock(t, testLock())
+	newCfg := func() *config.VeilVerify {
+		return &config.VeilVerify{Dir: dir, Dockerfile: "Dockerfile", CacheDir: cacheDir, Lock: lock}
+	}
+
+	cases := []struct {
+		name      string
+		mutate    func(*config.VeilVerify)
+		wantBuild bool
+	}{
+		{
+			name:      "empty cache",
+			wantBuild: true,
+		},
+		{
+			name: "cached",
+		},
+		{
+			name:      "no cache",
+			mutate:    func(cfg *config.VeilVerify) { cfg.NoCache = true },
+			wantBuild: true,
+		},
+		{
+			name: "modified git metadata and build output",
+			mutate: func(*config.VeilVerify) {
+				writeFile(".git/HEAD", "ref: refs/heads/main")
+				writeFile(enclaveTarImage, "image")
+			},
+		},
+		{
+			name:      "modified source code",
+			mutate:    func(*config.VeilVerify) { writeFile("src/main.go", "package foo") },
+			wantBuild: true,
+		},
+		{
+			name:      "different builder",
+			mutate:    func(cfg *config.VeilVerify) { cfg.Builder = config.BuilderBuildKit },
+			wantBuild: true,
+		},
+		{
+			name:      "builder image tarball",
+			mutate:    func(cfg *config.VeilVerify) { cfg.BuilderImage = builderImage },
+			wantBuild: true,
+		},
+		{
+			name: "modified builder image tarball",
+			mutate: func(cfg *config.VeilVerify) {
+				require.NoError(t, os.WriteFile(builderImage, []byte("kaniko v2"), 0o600))
+				cfg.BuilderImage = builderImage
+			},
+			wantBuild: true,
+		},
+		{
+			name:      "unpinned helper images",
+			mutate:    func(cfg *config.VeilVerify) { cfg.Lock = "" },
+			wantBuild: true,
+		},
+		{
+			name:      "unpinned helper images again",
+			mutate:    func(cfg *config.VeilVerify) { cfg.Lock = "" },
+			wantBuild: true,
+		},
+		{
+			name: "tarballs instead of lock file",
+			mutate: func(cfg *config.VeilVerify) {
+				cfg.Lock = ""
+				cfg.BuilderImage = builderImage
+				cfg.CompilerImage = compilerImage
+			},
+			wantBuild: true,
+		},
+		{
+			name: "cached tarballs",
+			mutate: func(cfg *config.VeilVerify) {
+				cfg.Lock = ""
+				cfg.BuilderImage = builderImage
+				cfg.CompilerImage = compilerImage
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg := newCfg()
+			if c.mutate != nil {
+				c.mutate(cfg)
+			}
+			before := builds
+			pcrs, err := cachedBuild(cfg, build(cfg))
+			require.NoError(t, err)
+			require.True(t, testPCRs().Equal(pcrs))
+			require.Equal(t, c.wantBuild, builds > before)
+		})
+	}
+}
+
+func TestBuildEnclaveRecordsCachedLock(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "Dockerfile"), []byte("FROM alpine"), 0o600))
+	cfg := &config.VeilVerify{
+		Dir:        dir,
+		Dockerfile: "Dockerfile",
+		CacheDir:   t.TempDir(),
+		Lock:       writeLock(t, testLock()),
+	}
+	_, err := cachedBuild(cfg, func() (enclave.PCR, error) { return testPCRs(), nil })
+	require.NoError(t, err)
+
+	// A cached build doesn't need Docker, and it used exactly the images and
+	// the nitro-cli version that the lock pins.
+	pcrs, used, err := buildEnclave(t.Context(), cfg)
+	require.NoError(t, err)
+	require.True(t, testPCRs().Equal(pcrs))
+	require.Equal(t, testLock(), used)
+}
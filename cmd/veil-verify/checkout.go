@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+
+	"github.com/Amnesic-Systems/veil/internal/config"
+	"github.com/Amnesic-Systems/veil/internal/enclave"
+	"github.com/Amnesic-Systems/veil/internal/errs"
+)
+
+// The URL schemes that we're willing to pass to git.  In particular, we don't
+// allow git's "ext" transport, which runs arbitrary commands.
+var codeURISchemes = []string{"https", "http", "ssh", "git", "file"}
+
+// checkCodeSource returns an error if the given source code URI and revision
+// aren't safe to pass to git.  The enclave's configuration is under the
+// control of whoever runs the enclave, so we must not trust it.
+func checkCodeSource(uri, rev string) error {
+	if uri == "" {
+		return errors.New("enclave doesn't advertise its source code URI")
+	}
+	if rev == "" {
+		return errors.New("enclave doesn't advertise its source code revision")
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(codeURISchemes, u.Scheme) {
+		return fmt.Errorf("source code URI %q must have one of the schemes: %s",
+			uri, strings.Join(codeURISchemes, ", "))
+	}
+	if strings.HasPrefix(rev, "-") {
+		return fmt.Errorf("invalid source code revision %q", rev)
+	}
+	return nil
+}
+
+// git runs git with the given arguments and returns its output as part of the
+// error if git fails.
+func git(ctx context.Context, args ...string) error {
+	cmd := exec.CommandContext(ctx, "git", append([]string{"-c", "protocol.ext.allow=never"}, args...)...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("git %s: %w: %s", args[0], err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// checkoutEnclaveCode fetches the attested configuration of the (first)
+// configured enclave, and clones the source code revision that the enclave
+// advertises into a temporary directory.  The caller must delete the
+// directory.
+//
+// We don't check the configuration's PCR values because we don't know them
+// before we've built the source code.  That's fine: we subsequently verify
+// the enclave's PCR values against what we've built, and the enclave binds
+// both attestation documents to the same TLS certificate.
+func checkoutEnclaveCode(ctx context.Context, cfg *config.VeilVerify) (_ string, err error) {
+	defer errs.Wrap(&err, "failed to check out enclave's source code")
+
+	c := *cfg
+	c.Addr = splitList(cfg.Addr)[0]
+	rep := &report{Addr: c.Addr}
+	if _, err := fetchConfig(ctx, &c, rep); err != nil {
+		return "", err
+	}
+	uri, _ := rep.Config["EnclaveCodeURI"].(string)
+	rev, _ := rep.Config["EnclaveCodeRev"].(string)
+	if err := checkCodeSource(uri, rev); err != nil {
+		return "", err
+	}
+
+	dir, err := os.MkdirTemp("", "veil-verify-checkout-")
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err != nil {
+			_ = os.RemoveAll(dir)
+		}
+	}()
+	if err := git(ctx, "clone", "--quiet", "--no-checkout", "--", uri, dir); err != nil {
+		return "", err
+	}
+	if err := git(ctx, "-C", dir, "checkout", "--quiet", "--detach", rev, "--"); err != nil {
+		return "", err
+	}
+	log.Printf("Checked out %s at revision %s.", uri, rev)
+	return dir, nil
+}
+
+// buildCheckout checks out the source code that the enclave advertises and
+// reproduces the enclave image from it.
+func buildCheckout(ctx context.Context, cfg *config.VeilVerify) (enclave.PCR, *lockFile, error) {
+	dir, err := checkoutEnclaveCode(ctx, cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	c := *cfg
+	c.Dir = dir
+	return buildEnclave(ctx, &c)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/Amnesic-Systems/veil/internal/config"
+	"github.com/Amnesic-Systems/veil/internal/enclave/emulator"
+	"github.com/Amnesic-Systems/veil/internal/util/must"
+)
+
+// newBareRepo creates a local bare repository that stands in for the
+// enclave's remote repository.  The repository has two commits: the first one,
+// tagged v1, contains a Dockerfile with the given content, and the second
+// one modifies the Dockerfile.
+func newBareRepo(t *testing.T, dockerfile string) string {
+	t.Helper()
+
+	gitCmd := func(dir string, args ...string) {
+		cmd := exec.Command("git", append([]string{
+			"-C", dir,
+			"-c", "user.name=veil",
+			"-c", "user.email=veil@example.com",
+		}, args...)...)
+		out, err := cmd.CombinedOutput()
+		require.NoError(t, err, string(out))
+	}
+
+	work, bare := t.TempDir(), t.TempDir()
+	gitCmd(work, "init", "--quiet")
+	require.NoError(t, os.WriteFile(filepath.Join(work, "Dockerfile"), []byte(dockerfile), 0o600))
+	gitCmd(work, "add", "Dockerfile")
+	gitCmd(work, "commit", "--quiet", "-m", "Add Dockerfile")
+	gitCmd(work, "tag", "v1")
+	require.NoError(t, os.WriteFile(filepath.Join(work, "Dockerfile"), []byte("FROM scratch"), 0o600))
+	gitCmd(work, "commit", "--quiet", "-am", "Update Dockerfile")
+	gitCmd(bare, "clone", "--quiet", "--bare", work, ".")
+	return bare
+}
+
+func TestCheckoutEnclaveCode(t *testing.T) {
+	const dockerfile = "FROM alpine"
+	repo := "file://" + newBareRepo(t, dockerfile)
+
+	cases := []struct {
+		name    string
+		codeURI string
+		codeRev string
+		wantErr bool
+	}{
+		{
+			name:    "tag",
+			codeURI: repo,
+			codeRev: "v1",
+		},
+		{
+			name:    "missing revision",
+			codeURI: repo,
+			wantErr: true,
+		},
+		{
+			name:    "unknown revision",
+			codeURI: repo,
+			codeRev: "v2",
+			wantErr: true,
+		},
+		{
+			name:    "ext transport",
+			codeURI: "ext::sh -c touch% /tmp/pwned",
+			codeRev: "v1",
+			wantErr: true,
+		},
+		{
+			name:    "option as revision",
+			codeURI: repo,
+			codeRev: "--orphan=foo",
+			wantErr: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			attester := must.Get(emulator.NewAttester(emulator.WithPCRs(testPCRs())))
+			addr := startEmulatedEnclave(t, attester, func(cfg *config.Veil) {
+				cfg.EnclaveCodeURI = c.codeURI
+				cfg.EnclaveCodeRev = c.codeRev
+			})
+			roots := filepath.Join(t.TempDir(), "roots.pem")
+			require.NoError(t, os.WriteFile(roots, attester.RootPEM(), 0o600))
+
+			cfg := &config.VeilVerify{Addr: addr, Roots: roots, Checkout: true}
+			dir, err := checkoutEnclaveCode(t.Context(), cfg)
+			require.Equal(t, c.wantErr, err != nil, err)
+			if c.wantErr {
+				return
+			}
+			defer func() { _ = os.RemoveAll(dir) }()
+			require.Equal(t, dockerfile,
+				string(must.Get(os.ReadFile(filepath.Join(dir, "Dockerfile")))))
+		})
+	}
+}
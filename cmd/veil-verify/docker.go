@@ -27,12 +27,130 @@ import (
 )
 
 const (
-	compilerImage    = "nitro-cli-builder"
-	builderImage     = "gcr.io/kaniko-project/executor:v1.9.2"
-	builderContainer = "kaniko"
-	enclaveTarImage  = "enclave.tar"
+	compilerImage   = "nitro-cli-builder"
+	enclaveTarImage = "enclave.tar"
+	// networkNone disables a container's network access.
+	networkNone container.NetworkMode = "none"
 )
 
+var errOffline = errors.New("offline mode forbids network access")
+
+// compilerDockerfile returns the Dockerfile that installs the tooling that we
+// need to compile enclave images, using the base image and nitro-cli version
+// that the given lock determines.  We run nitro-cli via bash, to discard
+// stderr, which leaves us with only the JSON output.  For more details on the
+// tooling, refer to:
+// https://docs.aws.amazon.com/enclaves/latest/user/nitro-enclave-cli-install.html#install-cli
+func compilerDockerfile(lock *lockFile) string {
+	cliPackage, develPackage := lock.nitroCLIPackages()
+	return fmt.Sprintf(`
+FROM %s
+RUN dnf install %s -y
+RUN dnf install %s -y
+RUN nitro-cli -V
+CMD ["bash", "-c", "nitro-cli build-enclave --docker-uri enclave:latest --output-file /dev/null 2>/dev/null"]
+`, lock.image(imageAmazonLinux), cliPackage, develPackage)
+}
+
+// buildEnclave returns the PCR values of the enclave image that the source
+// code in the configured directory results in, and the helper images and
+// nitro-cli version that the build used.  We only reproduce the enclave image
+// if the build cache doesn't contain the PCR values yet.
+func buildEnclave(
+	ctx context.Context,
+	cfg *config.VeilVerify,
+) (enclave.PCR, *lockFile, error) {
+	// We only cache builds whose lock pins all helper images, so a cached
+	// build used exactly what the lock file says.
+	used, err := readLockFile(cfg.Lock)
+	if err != nil {
+		return nil, nil, err
+	}
+	pcrs, err := cachedBuild(cfg, func() (pcrs enclave.PCR, err error) {
+		pcrs, used, err = reproduceEnclave(ctx, cfg)
+		return pcrs, err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return pcrs, used, nil
+}
+
+// reproduceEnclave reproduces the enclave image from the source code in the
+// configured directory and returns the image's PCR values, and the
+// digest-qualified helper images and the nitro-cli version that we used.
+func reproduceEnclave(
+	ctx context.Context,
+	cfg *config.VeilVerify,
+) (_ enclave.PCR, _ *lockFile, err error) {
+	// By default, we discard Docker's logs but we print them in verbose mode.
+	writer := io.Discard
+	if cfg.Verbose {
+		writer = log.Writer()
+	}
+
+	// Create a new Docker client to interact with the Docker daemon.
+	cli, err := client.New(client.FromEnv)
+	if err != nil {
+		// The Docker API errors are poor, so we wrap them in an attempt to
+		// provide useful context.
+		return nil, nil, errs.Add(err, "failed to create Docker client")
+	}
+	defer func() { _ = cli.Close() }()
+	log.Print("Created Docker client.")
+
+	lock, err := readLockFile(cfg.Lock)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !lock.pinned() {
+		log.Printf("No lock file given, so the helper images aren't pinned.  "+
+			"Run %q to pin them.", "veil-verify "+cmdLock)
+	}
+	// used records what we actually use, which differs from the lock if the
+	// lock references images by tag, or if we load images from tarballs.
+	used := &lockFile{Images: make(map[string]string)}
+
+	// Create a deterministically-built enclave image.  The image is written to
+	// disk as a tar archive.
+	builder, ref, err := buildEnclaveImage(ctx, cli, cfg, writer)
+	if err != nil {
+		return nil, nil, err
+	}
+	used.Images[builder] = ref
+	// Load the tar archive into Docker as an image.
+	if err := loadEnclaveImage(ctx, cli, cfg, writer); err != nil {
+		return nil, nil, err
+	}
+	// Create a container that compiles the previously created enclave image
+	// into AWS's EIF format, which is what we need for remote attestation.
+	switch {
+	case cfg.CompilerImage != "":
+		ref, err := loadImage(ctx, cli, cfg.CompilerImage, compilerImage, writer)
+		if err != nil {
+			return nil, nil, err
+		}
+		log.Printf("Loaded compiler image %s.", ref)
+		used.Images[imageCompiler] = ref
+	case cfg.Offline:
+		return nil, nil, fmt.Errorf("%w: building the compiler image requires a tarball", errOffline)
+	default:
+		ref, err := buildCompilerImage(ctx, cli, lock, cfg.Arch, writer)
+		if err != nil {
+			return nil, nil, err
+		}
+		used.Images[imageAmazonLinux] = ref
+	}
+	if used.NitroCLIVersion, err = installedNitroCLIVersion(ctx, cli, cfg.Arch); err != nil {
+		return nil, nil, err
+	}
+	log.Printf("Using nitro-cli version %s.", used.NitroCLIVersion)
+
+	// Compile the enclave image as discussed above.
+	pcrs, err := compileEnclaveImage(ctx, cli, cfg)
+	return pcrs, used, err
+}
+
 func removeContainer(cli *client.Client, id string) {
 	// Create a new context because the original context may have been
 	// cancelled.
@@ -53,53 +171,56 @@ func removeContainer(cli *client.Client, id string) {
 	log.Printf("Removed container %s.", id)
 }
 
+// buildEnclaveImage builds the enclave image with the configured builder, and
+// returns the builder's name and the digest-qualified reference of its image.
 func buildEnclaveImage(
 	ctx context.Context,
 	cli *client.Client,
 	cfg *config.VeilVerify,
 	out io.Writer,
-) (err error) {
+) (_, _ string, err error) {
 	defer errs.Wrap(&err, "failed to build enclave image")
 
-	// Pull the kaniko image, which we use to reproducibly build the
-	// enclave image.
-	output, err := cli.ImagePull(ctx, builderImage, client.ImagePullOptions{})
+	lock, err := readLockFile(cfg.Lock)
 	if err != nil {
-		return errs.Add(err, "failed to pull image")
+		return "", "", err
 	}
-	defer close(output)
-	if err := printDockerLogs(output, out); err != nil {
-		return err
+	builder, err := newImageBuilder(cfg.Builder, lock)
+	if err != nil {
+		return "", "", err
 	}
-	log.Print("Pulled kaniko builder image.")
 
-	// Configure kaniko.  We want a reproducible build for linux/amd64 because
-	// that's the platform the enclave is running on.
-	containerConfig := &container.Config{
-		Tty:   true,
-		Image: builderImage,
-		Cmd: []string{
-			"--dockerfile", cfg.Dockerfile,
-			"--reproducible",
-			"--no-push",
-			"--log-format", "text",
-			"--verbosity", "warn",
-			"--tarPath", enclaveTarImage,
-			"--destination", "enclave",
-			"--custom-platform", "linux/amd64",
-		},
+	// Pull or load the builder's image, which we use to reproducibly build
+	// the enclave image.  If the lock pins the image, we refuse to use an
+	// image with a different digest.
+	var ref string
+	switch {
+	case cfg.BuilderImage != "":
+		if ref, err = loadImage(ctx, cli, cfg.BuilderImage, builder.image(), out); err != nil {
+			return "", "", err
+		}
+		log.Printf("Loaded %s builder image %s.", builder.name(), ref)
+	case cfg.Offline:
+		return "", "", fmt.Errorf("%w: pulling the builder image requires a tarball", errOffline)
+	default:
+		if ref, err = pullImage(ctx, cli, builder.image(), "", out); err != nil {
+			return "", "", err
+		}
+		log.Printf("Pulled %s builder image %s.", builder.name(), ref)
 	}
 
 	// Set our volume mounts, which we need to get the enclave's tar image out.
-	hostConfig := &container.HostConfig{
-		Mounts: []mount.Mount{
-			{
-				Type:   mount.TypeBind,
-				Source: cfg.Dir,
-				Target: "/workspace",
-			},
-		},
-	}
+	// In offline mode, the builder has no network access, so builds that need
+	// the network fail instead of hanging.
+	containerConfig, hostConfig := builder.container(cfg)
+	if cfg.Offline {
+		hostConfig.NetworkMode = networkNone
+	}
+	hostConfig.Mounts = append(hostConfig.Mounts, mount.Mount{
+		Type:   mount.TypeBind,
+		Source: cfg.Dir,
+		Target: workspace,
+	})
 
 	// Create the container for our builder image.  We are going to remove it
 	// after we're done building the enclave image.
@@ -108,17 +229,17 @@ func buildEnclaveImage(
 		HostConfig:       hostConfig,
 		NetworkingConfig: &network.NetworkingConfig{},
 		Platform:         &v1.Platform{},
-		Name:             builderContainer,
+		Name:             builder.name(),
 	})
 	if err != nil {
-		return errs.Add(err, "failed to create container")
+		return "", "", errs.Add(err, "failed to create container")
 	}
 	defer removeContainer(cli, resp.ID)
 	log.Print("Created builder container.")
 
 	// Start the container.  A build will take a minute or so to complete.
 	if _, err := cli.ContainerStart(ctx, resp.ID, client.ContainerStartOptions{}); err != nil {
-		return errs.Add(err, "failed to start container")
+		return "", "", errs.Add(err, "failed to start container")
 	}
 	log.Print("Started builder container.")
 
@@ -130,14 +251,17 @@ func buildEnclaveImage(
 	}
 	reader, err := cli.ContainerLogs(ctx, resp.ID, options)
 	if err != nil {
-		return errs.Add(err, "failed to get container logs")
+		return "", "", errs.Add(err, "failed to get container logs")
 	}
 	defer close(reader)
 	printLogs(reader, out)
 
 	// Check the container's exit code and return an error if the exit code is
 	// non-zero.
-	return getContainerExitCode(ctx, cli, resp.ID)
+	if err := getContainerExitCode(ctx, cli, resp.ID); err != nil {
+		return "", "", err
+	}
+	return builder.name(), ref, nil
 }
 
 func getContainerExitCode(
@@ -174,8 +298,18 @@ func loadEnclaveImage(
 ) (err error) {
 	defer errs.Wrap(&err, "failed to load enclave image")
 
+	return loadImageTarball(ctx, cli, path.Join(cfg.Dir, enclaveTarImage), verbose)
+}
+
+// loadImageTarball loads the image tarball at the given path into Docker.
+func loadImageTarball(
+	ctx context.Context,
+	cli *client.Client,
+	tarball string,
+	verbose io.Writer,
+) error {
 	// Read the tar image.
-	file, err := os.Open(path.Join(cfg.Dir, enclaveTarImage))
+	file, err := os.Open(tarball)
 	if err != nil {
 		return err
 	}
@@ -193,24 +327,31 @@ func loadEnclaveImage(
 	return printDockerLogs(reader, verbose)
 }
 
+// buildCompilerImage builds the compiler image and returns the
+// digest-qualified reference of its base image.
 func buildCompilerImage(
 	ctx context.Context,
 	cli *client.Client,
+	lock *lockFile,
+	arch string,
 	verbose io.Writer,
-) (err error) {
+) (_ string, err error) {
 	defer errs.Wrap(&err, "failed to build compiler image")
 
-	// Install the tooling that we need to compile enclave images.  We run
-	// nitro-cli via bash, to discard stderr, which leaves us with only the JSON
-	// output.  For more details on the tooling, refer to:
-	// https://docs.aws.amazon.com/enclaves/latest/user/nitro-enclave-cli-install.html#install-cli
-	const dockerfile = `
-FROM public.ecr.aws/amazonlinux/amazonlinux:2023
-RUN dnf install aws-nitro-enclaves-cli -y
-RUN dnf install aws-nitro-enclaves-cli-devel -y
-RUN nitro-cli -V
-CMD ["bash", "-c", "nitro-cli build-enclave --docker-uri enclave:latest --output-file /dev/null 2>/dev/null"]
-`
+	// Pull the base image ourselves, so that the Dockerfile can reference it
+	// by digest even if the lock references it by tag.  Docker refuses to use
+	// a base image whose digest doesn't match the one that the Dockerfile
+	// pins.
+	base, err := pullImage(ctx, cli, lock.image(imageAmazonLinux), arch, verbose)
+	if err != nil {
+		return "", err
+	}
+	log.Printf("Pulled compiler base image %s.", base)
+	resolved := &lockFile{
+		Images:          map[string]string{imageAmazonLinux: base},
+		NitroCLIVersion: lock.NitroCLIVersion,
+	}
+	dockerfile := compilerDockerfile(resolved)
 
 	// Create a tar archive containing only the Dockerfile as we don't need a
 	// build context.
@@ -220,13 +361,13 @@ CMD ["bash", "-c", "nitro-cli build-enclave --docker-uri enclave:latest --output
 		Name: "Dockerfile",
 		Size: int64(len(dockerfile)),
 	}); err != nil {
-		return errs.Add(err, "failed to write header")
+		return "", errs.Add(err, "failed to write header")
 	}
 	if _, err := tw.Write([]byte(dockerfile)); err != nil {
-		return errs.Add(err, "failed to write Dockerfile")
+		return "", errs.Add(err, "failed to write Dockerfile")
 	}
 	if err := tw.Close(); err != nil {
-		return errs.Add(err, "failed to close tar writer")
+		return "", errs.Add(err, "failed to close tar writer")
 	}
 
 	// Finally, build the compiler image.
@@ -235,22 +376,23 @@ CMD ["bash", "-c", "nitro-cli build-enclave --docker-uri enclave:latest --output
 		Dockerfile: "Dockerfile",
 		Remove:     true, // Clean up intermediate images.
 		Platforms: []v1.Platform{{
-			Architecture: "amd64",
+			Architecture: targetArch(arch),
 			OS:           "linux",
 		}},
 	}
 	resp, err := cli.ImageBuild(ctx, &buf, opts)
 	if err != nil {
-		return errs.Add(err, "failed to build compiler image")
+		return "", errs.Add(err, "failed to build compiler image")
 	}
 	defer close(resp.Body)
 
-	return printDockerLogs(resp.Body, verbose)
+	return base, printDockerLogs(resp.Body, verbose)
 }
 
 func compileEnclaveImage(
 	ctx context.Context,
 	cli *client.Client,
+	cfg *config.VeilVerify,
 ) (_ enclave.PCR, err error) {
 	defer errs.Wrap(&err, "failed to compile enclave image")
 
@@ -266,6 +408,9 @@ func compileEnclaveImage(
 			},
 		},
 	}
+	if cfg.Offline {
+		hostConfig.NetworkMode = networkNone
+	}
 
 	// Configure our custom builder image.  We are going to run the nitro-cli
 	// tool to compile the enclave image and obtain the PCR values.  These PCR
@@ -281,7 +426,7 @@ func compileEnclaveImage(
 		HostConfig:       hostConfig,
 		NetworkingConfig: &network.NetworkingConfig{},
 		Platform: &v1.Platform{
-			Architecture: "amd64",
+			Architecture: targetArch(cfg.Arch),
 			OS:           "linux",
 		},
 		Name: compilerImage,
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"reflect"
+	"slices"
+	"time"
+
+	"github.com/fatih/color"
+
+	"github.com/Amnesic-Systems/veil/internal/config"
+	"github.com/Amnesic-Systems/veil/internal/enclave"
+	"github.com/Amnesic-Systems/veil/internal/errs"
+	"github.com/Amnesic-Systems/veil/internal/nonce"
+	"github.com/Amnesic-Systems/veil/internal/service"
+	"github.com/Amnesic-Systems/veil/internal/service/attestation"
+)
+
+// configPolicy maps the names of the fields of veil's configuration to the
+// values that we require them to have.  The names are the same as the fields
+// of config.Veil, e.g.:
+//
+//	{"Debug": false, "EnclaveCodeURI": "https://github.com/foo/bar"}
+type configPolicy map[string]any
+
+// readConfigPolicy reads the JSON-encoded configuration policy at the given
+// path.
+func readConfigPolicy(path string) (_ configPolicy, err error) {
+	defer errs.Wrap(&err, "failed to read config policy %q", path)
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var p configPolicy
+	if err := json.Unmarshal(raw, &p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// check returns the ways in which the given JSON-decoded configuration
+// violates the policy.
+func (p configPolicy) check(cfg map[string]any) []string {
+	var violations []string
+	for _, field := range slices.Sorted(maps.Keys(p)) {
+		got, ok := cfg[field]
+		if !ok {
+			violations = append(violations, fmt.Sprintf("%s: field does not exist", field))
+			continue
+		}
+		if want := p[field]; !reflect.DeepEqual(want, got) {
+			violations = append(violations, fmt.Sprintf("%s: expected %s but got %s",
+				field, toJSON(want), toJSON(got)))
+		}
+	}
+	return violations
+}
+
+func toJSON(v any) string {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(raw)
+}
+
+// fetchConfig fetches the enclave's runtime configuration together with an
+// attestation document over the configuration's hash, and records the
+// configuration in the given report.  We verify the document's signature and
+// nonce, and check that it's bound to both the TLS certificate and the
+// configuration.  The caller must check the document's PCR values.
+func fetchConfig(
+	ctx context.Context,
+	cfg *config.VeilVerify,
+	rep *report,
+) (_ *enclave.Document, err error) {
+	defer errs.Wrap(&err, "failed to fetch enclave configuration")
+
+	nonce, err := nonce.New()
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+
+	req, err := buildReq(ctx, cfg.Addr, service.PathConfig, nonce)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := newClient(rep.IP).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: %q with body: %s",
+			errs.ErrEnclaveErr, resp.Status, string(body))
+	}
+
+	// The enclave only attests its configuration if we provide a nonce, so a
+	// missing header means that we're not talking to an enclave.
+	header := resp.Header.Get(attestationHeader)
+	if header == "" {
+		return nil, fmt.Errorf("response has no %s header", attestationHeader)
+	}
+	var rawDoc enclave.RawDocument
+	if err := json.Unmarshal([]byte(header), &rawDoc); err != nil {
+		return nil, err
+	}
+	attester, err := newAttester(cfg.Roots, cfg.Testing)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := attester.Verify(&rawDoc, nonce)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyTLSBinding(resp, doc); err != nil {
+		return nil, err
+	}
+
+	// The enclave attests the hash of the JSON-encoded configuration, without
+	// the trailing newline that it appends to the response body.
+	hash, err := attestation.GetSHA256(&doc.AuxInfo)
+	if err != nil {
+		return nil, err
+	}
+	body = bytes.TrimSuffix(body, []byte("\n"))
+	if *hash != sha256.Sum256(body) {
+		return nil, fmt.Errorf("%w: attested hash doesn't match configuration",
+			errs.ErrBindingMismatch)
+	}
+	// Enclaves also attest their configuration's hash in the claims of every
+	// attestation document.  Legacy claims lack the hash.
+	hashes, err := attestation.GetHashes(&doc.AuxInfo)
+	if err != nil {
+		return nil, err
+	}
+	if hashes.ConfigHash != nil && *hashes.ConfigHash != *hash {
+		return nil, fmt.Errorf("%w: configuration doesn't match attested claims",
+			errs.ErrBindingMismatch)
+	}
+	if err := json.Unmarshal(body, &rep.Config); err != nil {
+		return nil, err
+	}
+	rep.timePhase("config", start)
+	return doc, nil
+}
+
+// verifyConfig fetches the enclave's attested runtime configuration, checks
+// the attestation document's PCR values against the given policy, and finally
+// checks the configuration against the user's configuration policy (if any).
+func verifyConfig(
+	ctx context.Context,
+	cfg *config.VeilVerify,
+	policy *enclave.Policy,
+	rep *report,
+	out io.Writer,
+) (err error) {
+	defer errs.Wrap(&err, "failed to verify enclave configuration")
+
+	doc, err := fetchConfig(ctx, cfg, rep)
+	if err != nil {
+		return err
+	}
+	if err := checkPCRs(doc, policy, rep); err != nil {
+		return err
+	}
+	if cfg.Output != config.OutputJSON {
+		printConfig(out, rep.Config)
+	}
+
+	if cfg.ConfigPolicy == "" {
+		return nil
+	}
+	cfgPolicy, err := readConfigPolicy(cfg.ConfigPolicy)
+	if err != nil {
+		return err
+	}
+	rep.ConfigViolations = cfgPolicy.check(rep.Config)
+	if len(rep.ConfigViolations) == 0 {
+		if cfg.Output != config.OutputJSON {
+			_, _ = fmt.Fprintln(out, color.GreenString("Enclave's configuration satisfies policy!"))
+		}
+		return nil
+	}
+	if cfg.Output != config.OutputJSON {
+		for _, v := range rep.ConfigViolations {
+			_, _ = fmt.Fprintln(out, color.RedString("%s", v))
+		}
+		_, _ = fmt.Fprintln(out, color.RedString("Enclave's configuration DOES NOT satisfy policy!"))
+	}
+	return errs.ErrConfigMismatch
+}
+
+// printConfig prints the most relevant fields of the given JSON-decoded
+// configuration.
+func printConfig(out io.Writer, cfg map[string]any) {
+	_, _ = fmt.Fprintf(out, "Enclave configuration:\n"+
+		"  FQDN:     %v\n"+
+		"  Ports:    %v (external), %v (internal)\n"+
+		"  Resolver: %v\n"+
+		"  App cmd:  %v\n",
+		cfg["FQDN"], cfg["ExtPort"], cfg["IntPort"], cfg["Resolver"], cfg["AppCmd"])
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/Amnesic-Systems/veil/internal/config"
+	"github.com/Amnesic-Systems/veil/internal/enclave"
+	"github.com/Amnesic-Systems/veil/internal/enclave/emulator"
+	"github.com/Amnesic-Systems/veil/internal/errs"
+	"github.com/Amnesic-Systems/veil/internal/httpx"
+	"github.com/Amnesic-Systems/veil/internal/service"
+	"github.com/Amnesic-Systems/veil/internal/service/attestation"
+	"github.com/Amnesic-Systems/veil/internal/util/must"
+)
+
+func TestVerifyConfig(t *testing.T) {
+	attester := must.Get(emulator.NewAttester(emulator.WithPCRs(testPCRs())))
+	addr := startEmulatedEnclave(t, attester)
+	roots := filepath.Join(t.TempDir(), "roots.pem")
+	require.NoError(t, os.WriteFile(roots, attester.RootPEM(), 0o600))
+
+	writePolicy := func(policy string) string {
+		path := filepath.Join(t.TempDir(), "config-policy.json")
+		require.NoError(t, os.WriteFile(path, []byte(policy), 0o600))
+		return path
+	}
+
+	cases := []struct {
+		name           string
+		configPolicy   string
+		pcrs           enclave.PCR
+		wantErr        error
+		wantViolations []string
+	}{
+		{
+			name: "no policy",
+			pcrs: testPCRs(),
+		},
+		{
+			name:         "satisfied policy",
+			configPolicy: `{"Debug": false, "Testing": true, "EnclaveCodeURI": ""}`,
+			pcrs:         testPCRs(),
+		},
+		{
+			name:         "violated policy",
+			configPolicy: `{"Debug": true, "Foo": "bar", "Testing": true}`,
+			pcrs:         testPCRs(),
+			wantErr:      errs.ErrConfigMismatch,
+			wantViolations: []string{
+				"Debug: expected true but got false",
+				"Foo: field does not exist",
+			},
+		},
+		{
+			name:    "pcr mismatch",
+			pcrs:    enclave.PCR{0: testPCRs()[1]},
+			wantErr: errs.ErrPCRMismatch,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg := &config.VeilVerify{
+				Addr:        addr,
+				Roots:       roots,
+				CheckConfig: true,
+				Output:      config.OutputJSON,
+			}
+			if c.configPolicy != "" {
+				cfg.ConfigPolicy = writePolicy(c.configPolicy)
+			}
+			rep := new(report)
+			err := verifyConfig(t.Context(), cfg, enclave.NewPolicy(c.pcrs), rep, io.Discard)
+			if c.wantErr != nil {
+				require.ErrorIs(t, err, c.wantErr)
+			} else {
+				require.NoError(t, err)
+			}
+			require.Equal(t, c.wantViolations, rep.ConfigViolations)
+			if c.wantErr == nil {
+				require.Equal(t, true, rep.Config["Testing"])
+			}
+		})
+	}
+}
+
+func TestPrintConfig(t *testing.T) {
+	var out strings.Builder
+	printConfig(&out, map[string]any{
+		"FQDN":     "example.com",
+		"ExtPort":  443,
+		"IntPort":  8080,
+		"Resolver": "1.1.1.1",
+		"AppCmd":   "nc -l -p 1234",
+	})
+	require.Equal(t, "Enclave configuration:\n"+
+		"  FQDN:     example.com\n"+
+		"  Ports:    443 (external), 8080 (internal)\n"+
+		"  Resolver: 1.1.1.1\n"+
+		"  App cmd:  nc -l -p 1234\n", out.String())
+}
+
+func TestVerifyConfigWithoutAttestation(t *testing.T) {
+	// The test server doesn't serve the enclave's configuration.
+	srv := newAttestationServer(t, nil)
+	defer srv.Close()
+
+	cfg := &config.VeilVerify{Addr: srv.URL, Testing: true, CheckConfig: true}
+	err := verifyConfig(t.Context(), cfg, enclave.NewPolicy(testPCRs()), new(report), io.Discard)
+	require.ErrorIs(t, err, errs.ErrEnclaveErr)
+}
+
+func TestVerifyConfigTamperedBody(t *testing.T) {
+	attestedBody := []byte(`{"Debug":false}`)
+	cases := []struct {
+		name       string
+		body       string
+		configHash [sha256.Size]byte
+	}{
+		{
+			name:       "body doesn't match user data",
+			body:       `{"Debug":true}`,
+			configHash: sha256.Sum256(attestedBody),
+		},
+		{
+			name:       "body doesn't match claims",
+			body:       string(attestedBody),
+			configHash: sha256.Sum256([]byte(`{"Debug":true}`)),
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			srv := newConfigServer(t, attestedBody, c.configHash, c.body)
+			cfg := &config.VeilVerify{Addr: srv.URL, Testing: true, CheckConfig: true}
+			err := verifyConfig(t.Context(), cfg, enclave.NewPolicy(testPCRs()), new(report), io.Discard)
+			require.ErrorIs(t, err, errs.ErrBindingMismatch)
+		})
+	}
+}
+
+// newConfigServer returns a test server whose attestation documents attest
+// the given body hash and configuration hash, and that serves the given body
+// as its configuration.
+func newConfigServer(
+	t *testing.T,
+	attestedBody []byte,
+	configHash [sha256.Size]byte,
+	body string,
+) *httptest.Server {
+	t.Helper()
+
+	var srv *httptest.Server
+	srv = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != service.PathConfig {
+			http.NotFound(w, r)
+			return
+		}
+		n, err := httpx.ExtractNonce(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		certHash := sha256.Sum256(srv.Certificate().Raw)
+		bodyHash := sha256.Sum256(attestedBody)
+		rawDoc := &enclave.RawDocument{
+			Type: enclave.TypeNoop,
+			Doc: must.Get(json.Marshal(&enclave.Document{
+				PCRs: testPCRs(),
+				AuxInfo: enclave.AuxInfo{
+					PublicKey: (&attestation.Hashes{
+						TlsKeyHash: &certHash,
+						ConfigHash: &configHash,
+					}).Serialize(),
+					UserData: bodyHash[:],
+					Nonce:    n.ToSlice(),
+				},
+			})),
+		}
+		w.Header().Set(attestationHeader, string(must.Get(json.Marshal(rawDoc))))
+		_, _ = fmt.Fprintln(w, body)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
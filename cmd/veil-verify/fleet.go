@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fatih/color"
+
+	"github.com/Amnesic-Systems/veil/internal/config"
+	"github.com/Amnesic-Systems/veil/internal/errs"
+)
+
+// The properties in which instances of a fleet may differ from each other.
+const (
+	propPCRs       = "pcrs"
+	propTLSKeyHash = "tls_key_hash"
+)
+
+// instance represents one enclave of a fleet.  If ip is set, we connect to
+// the given IP address instead of resolving the address's host name.
+type instance struct {
+	addr string
+	ip   string
+}
+
+// fleetReport contains the reports of all instances of a fleet.
+type fleetReport struct {
+	Success   bool      `json:"success"`
+	ExitCode  int       `json:"exit_code"`
+	Instances []*report `json:"instances"`
+}
+
+// isFleet returns true if the given configuration refers to more than a
+// single enclave.
+func isFleet(cfg *config.VeilVerify) bool {
+	return cfg.Resolve || len(splitList(cfg.Addr)) > 1
+}
+
+// fleetInstances returns the instances that the given configuration refers
+// to.  If requested, we resolve each address's host name and return one
+// instance per IPv4 address.
+func fleetInstances(
+	ctx context.Context,
+	cfg *config.VeilVerify,
+) (_ []instance, err error) {
+	defer errs.Wrap(&err, "failed to determine instances")
+
+	var instances []instance
+	for _, addr := range splitList(cfg.Addr) {
+		if !cfg.Resolve {
+			instances = append(instances, instance{addr: addr})
+			continue
+		}
+		u, err := url.Parse(addr)
+		if err != nil {
+			return nil, err
+		}
+		ips, err := net.DefaultResolver.LookupIP(ctx, "ip4", u.Hostname())
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range ips {
+			instances = append(instances, instance{addr: addr, ip: ip.String()})
+		}
+	}
+	if len(instances) == 0 {
+		return nil, errors.New("found no instances")
+	}
+	return instances, nil
+}
+
+// verifyFleet determines the PCR values that we expect once, and then
+// verifies all instances of the fleet concurrently.  We fail if any instance
+// fails verification.
+func verifyFleet(
+	ctx context.Context,
+	cfg *config.VeilVerify,
+	out io.Writer,
+) (err error) {
+	start := time.Now()
+	policy, lock, err := expectedPolicy(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	expectDuration := time.Since(start).Seconds()
+	instances, err := fleetInstances(ctx, cfg)
+	if err != nil {
+		return err
+	}
+
+	reports := make([]*report, len(instances))
+	results := make([]error, len(instances))
+	var wg sync.WaitGroup
+	for i, inst := range instances {
+		wg.Go(func() {
+			c := *cfg
+			c.Addr = inst.addr
+			// We print a summary instead of per-instance colored text.
+			c.Output = config.OutputJSON
+			rep := &report{
+				Addr:     inst.addr,
+				IP:       inst.ip,
+				Expected: policy,
+				Lock:     lock,
+				Timings:  []timing{{Phase: "expect", Duration: expectDuration}},
+			}
+			results[i] = attestEnclave(ctx, &c, policy, rep)
+			if results[i] == nil && c.CheckConfig {
+				results[i] = verifyConfig(ctx, &c, policy, rep, out)
+			}
+			rep.setResult(results[i])
+			reports[i] = rep
+		})
+	}
+	wg.Wait()
+	markDivergent(reports, policy.Ignored)
+
+	var failed []error
+	for i, err := range results {
+		if err != nil {
+			failed = append(failed, fmt.Errorf("%s: %w", instanceName(reports[i]), err))
+		}
+	}
+	if len(failed) > 0 {
+		err = fmt.Errorf("%d of %d instances failed: %w",
+			len(failed), len(instances), errors.Join(failed...))
+	}
+
+	if cfg.Output == config.OutputJSON {
+		rep := &fleetReport{
+			Success:   err == nil,
+			ExitCode:  exitCode(err),
+			Instances: reports,
+		}
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		errs.Join(&err, enc.Encode(rep))
+		return err
+	}
+	printFleet(out, reports)
+	return err
+}
+
+func instanceName(rep *report) string {
+	if rep.IP == "" {
+		return rep.Addr
+	}
+	return fmt.Sprintf("%s (%s)", rep.Addr, rep.IP)
+}
+
+func printFleet(out io.Writer, reports []*report) {
+	for _, rep := range reports {
+		if rep.Success {
+			_, _ = fmt.Fprintln(out, color.GreenString("PASS %s", instanceName(rep)))
+		} else {
+			_, _ = fmt.Fprintln(out, color.RedString("FAIL %s: %s", instanceName(rep), rep.Error))
+		}
+		if len(rep.Divergent) > 0 {
+			_, _ = fmt.Fprintln(out, color.YellowString("     differs from the other instances in: %s",
+				strings.Join(rep.Divergent, ", ")))
+		}
+	}
+}
+
+// markDivergent flags the instances whose PCR values or TLS key hash differ
+// from the majority of instances.  If there's no single most common value,
+// all instances are flagged.  We don't compare the given ignored PCRs, which
+// include PCR4, the parent's instance ID, that differs across hosts.
+func markDivergent(reports []*report, ignored []uint) {
+	ignoredNames := make(map[string]bool, len(ignored))
+	for _, i := range ignored {
+		ignoredNames[fmt.Sprintf("PCR%d", i)] = true
+	}
+
+	props := []struct {
+		name  string
+		value func(*report) string
+	}{
+		{propPCRs, func(r *report) string {
+			if r.Document == nil {
+				return ""
+			}
+			var pcrs []string
+			for name, value := range r.Document.PCRs {
+				if ignoredNames[name] {
+					continue
+				}
+				pcrs = append(pcrs, name+"="+value)
+			}
+			slices.Sort(pcrs)
+			return strings.Join(pcrs, ",")
+		}},
+		{propTLSKeyHash, func(r *report) string {
+			tlsKey, _ := r.Document.keyHashes()
+			return tlsKey
+		}},
+	}
+
+	for _, prop := range props {
+		counts := make(map[string]int)
+		for _, r := range reports {
+			if v := prop.value(r); v != "" {
+				counts[v]++
+			}
+		}
+		if len(counts) < 2 {
+			continue
+		}
+
+		var majority string
+		var maxCount int
+		for v, n := range counts {
+			switch {
+			case n > maxCount:
+				majority, maxCount = v, n
+			case n == maxCount:
+				majority = ""
+			}
+		}
+		for _, r := range reports {
+			if v := prop.value(r); v != "" && v != majority {
+				r.Divergent = append(r.Divergent, prop.name)
+			}
+		}
+	}
+}
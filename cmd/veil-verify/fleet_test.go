@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/Amnesic-Systems/veil/internal/addr"
+	"github.com/Amnesic-Systems/veil/internal/config"
+	"github.com/Amnesic-Systems/veil/internal/enclave"
+	"github.com/Amnesic-Systems/veil/internal/service/attestation"
+)
+
+func TestVerifyFleet(t *testing.T) {
+	var addrs []string
+	for range 2 {
+		srv := newAttestationServer(t, nil)
+		defer srv.Close()
+		addrs = append(addrs, srv.URL)
+	}
+	bad := newAttestationServer(t, func(doc *enclave.Document) {
+		doc.PCRs[0] = []byte(strings.Repeat("z", 48))
+	})
+	defer bad.Close()
+	addrs = append(addrs, bad.URL)
+
+	pcrs := filepath.Join(t.TempDir(), "pcrs.json")
+	require.NoError(t, os.WriteFile(pcrs, []byte(validPCRs), 0o600))
+
+	var out strings.Builder
+	err := run(t.Context(), &out, []string{
+		"-addr", strings.Join(addrs, ","),
+		"-pcrs", pcrs,
+		"-output", "json",
+		"-insecure",
+	})
+	require.Equal(t, exitPCRMismatch, exitCode(err))
+
+	var rep struct {
+		Success   bool      `json:"success"`
+		ExitCode  int       `json:"exit_code"`
+		Instances []*report `json:"instances"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(out.String()), &rep))
+	require.False(t, rep.Success)
+	require.Equal(t, exitPCRMismatch, rep.ExitCode)
+	require.Len(t, rep.Instances, 3)
+	for i, inst := range rep.Instances {
+		require.Equal(t, addrs[i], inst.Addr)
+		// All test servers share the same TLS certificate.
+		require.NotContains(t, inst.Divergent, propTLSKeyHash)
+	}
+	require.True(t, rep.Instances[0].Success)
+	require.True(t, rep.Instances[1].Success)
+	require.False(t, rep.Instances[2].Success)
+	require.Empty(t, rep.Instances[0].Divergent)
+	require.Equal(t, []string{propPCRs}, rep.Instances[2].Divergent)
+}
+
+func TestVerifyFleetParentInstances(t *testing.T) {
+	// The instances run on different parents, so only PCR4 differs.
+	var addrs []string
+	for i := range 3 {
+		srv := newAttestationServer(t, func(doc *enclave.Document) {
+			doc.PCRs[4] = []byte(strings.Repeat(strconv.Itoa(i), 48))
+		})
+		defer srv.Close()
+		addrs = append(addrs, srv.URL)
+	}
+	pcrs := filepath.Join(t.TempDir(), "pcrs.json")
+	require.NoError(t, os.WriteFile(pcrs, []byte(validPCRs), 0o600))
+
+	var out strings.Builder
+	require.NoError(t, run(t.Context(), &out, []string{
+		"-addr", strings.Join(addrs, ","),
+		"-pcrs", pcrs,
+		"-output", "json",
+		"-insecure",
+	}))
+	var rep struct {
+		Instances []*report `json:"instances"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(out.String()), &rep))
+	require.Len(t, rep.Instances, 3)
+	for _, inst := range rep.Instances {
+		require.True(t, inst.Success)
+		require.Empty(t, inst.Divergent)
+	}
+}
+
+func TestFleetInstances(t *testing.T) {
+	srv := newAttestationServer(t, nil)
+	defer srv.Close()
+	u, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+	u.Host = "localhost:" + u.Port()
+
+	cfg := &config.VeilVerify{Addr: u.String(), Resolve: true}
+	instances, err := fleetInstances(t.Context(), cfg)
+	require.NoError(t, err)
+	require.Contains(t, instances, instance{addr: u.String(), ip: "127.0.0.1"})
+
+	// We must be able to attest an instance by its IP address.
+	rep := &report{IP: "127.0.0.1"}
+	cfg = &config.VeilVerify{Addr: u.String(), Testing: true, Output: config.OutputJSON}
+	require.NoError(t, attestEnclave(t.Context(), cfg, enclave.NewPolicy(testPCRs()), rep))
+}
+
+func TestMarkDivergent(t *testing.T) {
+	newReport := func(pcr0, tlsKey string) *report {
+		var hashes attestation.Hashes
+		if tlsKey != "" {
+			hashes.SetTLSHash(addr.Of(sha256.Sum256([]byte(tlsKey))))
+		}
+		return &report{Document: &docReport{
+			PCRs:      map[string]string{"PCR0": pcr0},
+			PublicKey: hashes.Serialize(),
+		}}
+	}
+	withPCR4 := func(r *report, pcr4 string) *report {
+		r.Document.PCRs["PCR4"] = pcr4
+		return r
+	}
+
+	cases := []struct {
+		name    string
+		reports []*report
+		want    [][]string
+	}{
+		{
+			name:    "identical",
+			reports: []*report{newReport("aa", "a"), newReport("aa", "a")},
+			want:    [][]string{nil, nil},
+		},
+		{
+			name: "one divergent tls key",
+			reports: []*report{
+				newReport("aa", "a"),
+				newReport("aa", "b"),
+				newReport("aa", "a"),
+			},
+			want: [][]string{nil, {propTLSKeyHash}, nil},
+		},
+		{
+			name: "different parent instances",
+			reports: []*report{
+				withPCR4(newReport("aa", "a"), "01"),
+				withPCR4(newReport("aa", "a"), "02"),
+				withPCR4(newReport("aa", "a"), "03"),
+			},
+			want: [][]string{nil, nil, nil},
+		},
+		{
+			name:    "tie",
+			reports: []*report{newReport("aa", "a"), newReport("bb", "a")},
+			want:    [][]string{{propPCRs}, {propPCRs}},
+		},
+		{
+			name:    "failed instance",
+			reports: []*report{{}, newReport("aa", "a"), newReport("bb", "b")},
+			want:    [][]string{nil, {propPCRs, propTLSKeyHash}, {propPCRs, propTLSKeyHash}},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			markDivergent(c.reports, enclave.NewPolicy().Ignored)
+			for i, r := range c.reports {
+				require.Equal(t, c.want[i], r.Divergent)
+			}
+		})
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Amnesic-Systems/veil/internal/addr"
+	"github.com/Amnesic-Systems/veil/internal/config"
+	"github.com/Amnesic-Systems/veil/internal/enclave"
+	"github.com/Amnesic-Systems/veil/internal/errs"
+	"github.com/Amnesic-Systems/veil/internal/nonce"
+	"github.com/Amnesic-Systems/veil/internal/service/attestation"
+	"github.com/Amnesic-Systems/veil/internal/types/validate"
+)
+
+const (
+	cmdInspect = "inspect"
+	// The header in which veil returns attestation documents for HTTP
+	// responses.
+	attestationHeader = "X-Veil-Attestation"
+)
+
+// inspection contains the decoded fields of an attestation document and the
+// results of the checks that we ran against it.
+type inspection struct {
+	Type           string            `json:"type"`
+	Document       *docReport        `json:"document"`
+	Nonce          string            `json:"nonce,omitempty"`
+	Certificates   []certSummary     `json:"certificates,omitempty"`
+	TLSKeyHash     string            `json:"tls_key_hash,omitempty"`
+	AppKeyHash     string            `json:"app_key_hash,omitempty"`
+	ClaimsVersion  *uint             `json:"claims_version,omitempty"`
+	ConfigHash     string            `json:"config_hash,omitempty"`
+	AppClaims      map[string][]byte `json:"app_claims,omitempty"`
+	UserDataSHA256 string            `json:"user_data_sha256,omitempty"`
+	NonceValid     *bool             `json:"nonce_valid,omitempty"`
+	TLSBinding     *bool             `json:"tls_binding_valid,omitempty"`
+	Error          string            `json:"error,omitempty"`
+}
+
+// certSummary contains the details of a certificate in the attestation
+// document's certificate chain.
+type certSummary struct {
+	Subject  string    `json:"subject"`
+	NotAfter time.Time `json:"not_after"`
+}
+
+func newInspection(rawDoc *enclave.RawDocument, doc *enclave.Document) *inspection {
+	in := &inspection{
+		Type:     rawDoc.Type,
+		Document: newDocReport(doc),
+	}
+	in.TLSKeyHash, in.AppKeyHash = in.Document.keyHashes()
+	if claims, err := attestation.GetClaims(&doc.AuxInfo); err == nil {
+		in.ClaimsVersion = addr.Of(claims.Version)
+		in.AppClaims = claims.App
+		if claims.Config != nil {
+			in.ConfigHash = fmt.Sprintf("%s:%x", claims.Config.Alg, claims.Config.Value)
+		}
+	}
+	if n, err := nonce.FromSlice(doc.Nonce); err == nil {
+		in.Nonce = n.B64()
+	}
+	if sha, err := attestation.GetSHA256(&doc.AuxInfo); err == nil {
+		in.UserDataSHA256 = hex.EncodeToString(sha[:])
+	}
+	// The document's certificate is followed by the CA bundle, which starts
+	// with the root certificate.
+	for _, der := range append([][]byte{doc.Certificate}, doc.CABundle...) {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			continue
+		}
+		in.Certificates = append(in.Certificates, certSummary{
+			Subject:  cert.Subject.String(),
+			NotAfter: cert.NotAfter,
+		})
+	}
+	return in
+}
+
+// readRawDocument reads a JSON-encoded attestation document from the given
+// file, or from stdin if the path is empty or "-".
+func readRawDocument(path string) (_ *enclave.RawDocument, err error) {
+	defer errs.Wrap(&err, "failed to read attestation document")
+
+	var raw []byte
+	if path == "" || path == "-" {
+		raw, err = io.ReadAll(os.Stdin)
+	} else {
+		raw, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Strip the header's name, so users can paste the entire header line.
+	raw = bytes.TrimSpace(raw)
+	prefix := attestationHeader + ":"
+	if len(raw) >= len(prefix) && strings.EqualFold(string(raw[:len(prefix)]), prefix) {
+		raw = bytes.TrimSpace(raw[len(prefix):])
+	}
+	var rawDoc enclave.RawDocument
+	if err := json.Unmarshal(raw, &rawDoc); err != nil {
+		return nil, err
+	}
+	if rawDoc.Type == "" || len(rawDoc.Doc) == 0 {
+		return nil, errors.New("input is not an attestation document")
+	}
+	return &rawDoc, nil
+}
+
+// readCert reads the first certificate in the given PEM file.
+func readCert(path string) (_ *x509.Certificate, err error) {
+	defer errs.Wrap(&err, "failed to read certificate %q", path)
+
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// inspect verifies the given attestation document and decodes its fields.  If
+// verification fails after the document was decoded (e.g., because the
+// enclave runs in debug mode), we return the inspection *and* an error.
+func inspect(cfg *config.Inspect, rawDoc *enclave.RawDocument) (*inspection, error) {
+	attester, err := newAttester(cfg.Roots, cfg.Testing)
+	if err != nil {
+		return nil, err
+	}
+	var wantNonce *nonce.Nonce
+	if cfg.Nonce != "" {
+		raw, err := base64.StdEncoding.DecodeString(cfg.Nonce)
+		if err != nil {
+			return nil, err
+		}
+		if wantNonce, err = nonce.FromSlice(raw); err != nil {
+			return nil, err
+		}
+	}
+
+	// We check the nonce ourselves because the attester doesn't return the
+	// document if the nonce doesn't match, but we still want to decode it.
+	doc, err := attester.Verify(rawDoc, nil)
+	if doc == nil {
+		return nil, err
+	}
+	in := newInspection(rawDoc, doc)
+	if wantNonce != nil {
+		gotNonce, nonceErr := nonce.FromSlice(doc.Nonce)
+		in.NonceValid = addr.Of(nonceErr == nil && *gotNonce == *wantNonce)
+		if !*in.NonceValid {
+			errs.Join(&err, errs.ErrNonceMismatch)
+		}
+	}
+	if cfg.TLSCert != "" {
+		cert, certErr := readCert(cfg.TLSCert)
+		if certErr == nil {
+			certErr = checkTLSBinding(cert, doc)
+		}
+		in.TLSBinding = addr.Of(certErr == nil)
+		errs.Join(&err, certErr)
+	}
+	if err != nil {
+		in.Error = err.Error()
+	}
+	return in, err
+}
+
+// print writes a human-readable representation of the inspection to the given
+// writer.
+func (in *inspection) print(out io.Writer) error {
+	var b strings.Builder
+	field := func(name, format string, a ...any) {
+		fmt.Fprintf(&b, "%-15s "+format+"\n", append([]any{name + ":"}, a...)...)
+	}
+	orNone := func(s string) string {
+		if s == "" {
+			return "none"
+		}
+		return s
+	}
+
+	field("Type", "%s", in.Type)
+	field("Module ID", "%s", orNone(in.Document.ModuleID))
+	if in.Document.Timestamp == 0 {
+		field("Timestamp", "none")
+	} else {
+		field("Timestamp", "%s", time.UnixMilli(int64(in.Document.Timestamp)).UTC().Format(time.RFC3339))
+	}
+	field("Digest", "%s", orNone(in.Document.Digest))
+	// Nitro Enclaves have up to 32 PCRs.
+	for i := range 32 {
+		name := fmt.Sprintf("PCR%d", i)
+		if v, ok := in.Document.PCRs[name]; ok {
+			field(name, "%s", v)
+		}
+	}
+	for _, c := range in.Certificates {
+		field("Certificate", "%s (expires %s)", c.Subject, c.NotAfter.UTC().Format(time.RFC3339))
+	}
+	field("TLS key hash", "%s", orNone(in.TLSKeyHash))
+	field("App key hash", "%s", orNone(in.AppKeyHash))
+	if in.ClaimsVersion != nil {
+		field("Claims version", "%d", *in.ClaimsVersion)
+	}
+	field("Config hash", "%s", orNone(in.ConfigHash))
+	for _, name := range slices.Sorted(maps.Keys(in.AppClaims)) {
+		field("App claim", "%s=%x", name, in.AppClaims[name])
+	}
+	field("User data", "%s", orNone(in.UserDataSHA256))
+	field("Nonce", "%s", orNone(in.Nonce))
+	if in.NonceValid != nil {
+		field("Nonce valid", "%t", *in.NonceValid)
+	}
+	if in.TLSBinding != nil {
+		field("TLS binding", "%t", *in.TLSBinding)
+	}
+	_, err := io.WriteString(out, b.String())
+	return err
+}
+
+func parseInspectFlags(out io.Writer, args []string) (_ *config.Inspect, err error) {
+	defer errs.WrapErr(&err, errFailedToParse)
+
+	fs := flag.NewFlagSet(cmdInspect, flag.ContinueOnError)
+	fs.SetOutput(out)
+
+	doc := fs.String(
+		"doc",
+		"-",
+		"File with the JSON-encoded attestation document or X-Veil-Attestation header ('-' for stdin)",
+	)
+	nonceStr := fs.String(
+		"nonce",
+		"",
+		"Base64-encoded nonce that the attestation document must contain",
+	)
+	tlsCert := fs.String(
+		"tls-cert",
+		"",
+		"PEM file with the TLS certificate that the attestation document must be bound to",
+	)
+	roots := fs.String(
+		"roots",
+		"",
+		"PEM file with root certificates to trust instead of AWS's (for testing)",
+	)
+	output := fs.String(
+		"output",
+		config.OutputText,
+		"Output format: 'text' or 'json'",
+	)
+	testing := fs.Bool(
+		"insecure",
+		false,
+		"Inspect noop attestation documents instead of Nitro documents",
+	)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	cfg := &config.Inspect{
+		Doc:     *doc,
+		Nonce:   *nonceStr,
+		TLSCert: *tlsCert,
+		Roots:   *roots,
+		Output:  *output,
+		Testing: *testing,
+	}
+	return cfg, validate.Object(cfg)
+}
+
+func runInspect(out io.Writer, args []string) error {
+	cfg, err := parseInspectFlags(out, args)
+	if err != nil {
+		return err
+	}
+
+	rawDoc, err := readRawDocument(cfg.Doc)
+	if err != nil {
+		return err
+	}
+	in, err := inspect(cfg, rawDoc)
+	if in == nil {
+		return err
+	}
+	if cfg.Output == config.OutputJSON {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		errs.Join(&err, enc.Encode(in))
+		return err
+	}
+	errs.Join(&err, in.print(out))
+	return err
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/Amnesic-Systems/veil/internal/addr"
+	"github.com/Amnesic-Systems/veil/internal/enclave"
+	"github.com/Amnesic-Systems/veil/internal/enclave/emulator"
+	"github.com/Amnesic-Systems/veil/internal/enclave/noop"
+	"github.com/Amnesic-Systems/veil/internal/errs"
+	"github.com/Amnesic-Systems/veil/internal/httpx"
+	"github.com/Amnesic-Systems/veil/internal/nonce"
+	"github.com/Amnesic-Systems/veil/internal/service/attestation"
+	"github.com/Amnesic-Systems/veil/internal/util/must"
+)
+
+func TestInspect(t *testing.T) {
+	dir := t.TempDir()
+	writeFile := func(name string, data []byte) string {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, data, 0o600))
+		return path
+	}
+
+	rawCert, _, err := httpx.CreateCertificate("example.com")
+	require.NoError(t, err)
+	certHash := must.Get(httpx.GetCertHash(rawCert))
+	certPath := writeFile("cert.pem", rawCert)
+	otherCert, _, err := httpx.CreateCertificate("example.com")
+	require.NoError(t, err)
+	otherCertPath := writeFile("other-cert.pem", otherCert)
+
+	n := must.Get(nonce.New())
+	otherNonce := must.Get(nonce.New())
+	aux := &enclave.AuxInfo{
+		PublicKey: (&attestation.Hashes{TlsKeyHash: &certHash}).Serialize(),
+		UserData:  bytes.Repeat([]byte{1}, 32),
+		Nonce:     n.ToSlice(),
+	}
+	noopDoc := writeFile("noop.json", must.Get(json.Marshal(
+		must.Get(noop.NewAttester().Attest(aux)),
+	)))
+
+	emulated := must.Get(emulator.NewAttester(emulator.WithPCRs(testPCRs())))
+	roots := writeFile("roots.pem", emulated.RootPEM())
+	nitroRaw := must.Get(json.Marshal(must.Get(emulated.Attest(aux))))
+	nitroDoc := writeFile("nitro.json", nitroRaw)
+	header := writeFile("header.txt",
+		append([]byte("X-Veil-Attestation: "), nitroRaw...))
+
+	cases := []struct {
+		name      string
+		args      []string
+		wantErr   bool
+		wantErrIs error
+		decoded   bool // True if we expect the document to be decoded.
+		nitro     bool
+	}{
+		{
+			name:    "noop document",
+			args:    []string{"-insecure", "-doc", noopDoc, "-nonce", n.B64(), "-tls-cert", certPath},
+			decoded: true,
+		},
+		{
+			name:      "wrong nonce",
+			args:      []string{"-insecure", "-doc", noopDoc, "-nonce", otherNonce.B64()},
+			wantErr:   true,
+			wantErrIs: errs.ErrNonceMismatch,
+			decoded:   true,
+		},
+		{
+			name:      "wrong certificate",
+			args:      []string{"-insecure", "-doc", noopDoc, "-tls-cert", otherCertPath},
+			wantErr:   true,
+			wantErrIs: errs.ErrBindingMismatch,
+			decoded:   true,
+		},
+		{
+			name:      "noop document without insecure",
+			args:      []string{"-doc", noopDoc},
+			wantErr:   true,
+			wantErrIs: errs.ErrTypeMismatch,
+		},
+		{
+			name:    "emulated nitro document",
+			args:    []string{"-roots", roots, "-doc", nitroDoc, "-nonce", n.B64()},
+			decoded: true,
+			nitro:   true,
+		},
+		{
+			name:    "header",
+			args:    []string{"-roots", roots, "-doc", header},
+			decoded: true,
+			nitro:   true,
+		},
+		{
+			name:    "untrusted roots",
+			args:    []string{"-doc", nitroDoc},
+			wantErr: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var out bytes.Buffer
+			args := append([]string{cmdInspect, "-output", "json"}, c.args...)
+			err := run(t.Context(), &out, args)
+			require.Equal(t, c.wantErr, err != nil, err)
+			if c.wantErrIs != nil {
+				require.ErrorIs(t, err, c.wantErrIs)
+			}
+			if !c.decoded {
+				require.Empty(t, out.String())
+				return
+			}
+
+			var in inspection
+			require.NoError(t, json.Unmarshal(out.Bytes(), &in))
+			require.Equal(t, hex.EncodeToString(certHash[:]), in.TLSKeyHash)
+			require.Equal(t, n.B64(), in.Nonce)
+			require.Equal(t, hex.EncodeToString(aux.UserData), in.UserDataSHA256)
+			require.Equal(t, addr.Of(uint(attestation.ClaimsVersion)), in.ClaimsVersion)
+			if c.nitro {
+				require.Equal(t, enclave.TypeNitro, in.Type)
+				require.NotEmpty(t, in.Document.ModuleID)
+				require.NotEmpty(t, in.Certificates)
+			}
+		})
+	}
+}
+
+func TestInspectText(t *testing.T) {
+	n := must.Get(nonce.New())
+	rawDoc := must.Get(noop.NewAttester().Attest(&enclave.AuxInfo{Nonce: n.ToSlice()}))
+	path := filepath.Join(t.TempDir(), "doc.json")
+	require.NoError(t, os.WriteFile(path, must.Get(json.Marshal(rawDoc)), 0o600))
+
+	var out bytes.Buffer
+	require.NoError(t, run(t.Context(), &out, []string{cmdInspect, "-insecure", "-doc", path}))
+	require.Contains(t, out.String(), "Nonce:          "+n.B64())
+	require.Contains(t, out.String(), "TLS key hash:   none")
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/moby/moby/api/types/container"
+	"github.com/moby/moby/api/types/network"
+	"github.com/moby/moby/client"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/Amnesic-Systems/veil/internal/config"
+	"github.com/Amnesic-Systems/veil/internal/errs"
+	"github.com/Amnesic-Systems/veil/internal/types/validate"
+)
+
+const (
+	cmdLock = "lock"
+	// The names of the helper images in lock files.
+	imageKaniko      = "kaniko"
+	imageBuildKit    = "buildkit"
+	imageAmazonLinux = "amazonlinux"
+	// imageCompiler is the name under which reports record a compiler image
+	// that we loaded from a tarball instead of building it.  Lock files don't
+	// contain it.
+	imageCompiler = "compiler"
+	// amazonLinuxImage is the base image of our compiler image, which
+	// contains nitro-cli.
+	amazonLinuxImage = "public.ecr.aws/amazonlinux/amazonlinux:2023"
+	// nitroCLIPackage is the name of nitro-cli's RPM package.
+	nitroCLIPackage = "aws-nitro-enclaves-cli"
+)
+
+var (
+	errDigestMismatch = errors.New("image digest doesn't match lock file")
+	// The helper images that veil-verify uses, referenced by tag.  A lock
+	// file pins each of them by digest.
+	defaultImages = map[string]string{
+		imageKaniko:      kanikoImage,
+		imageBuildKit:    buildKitImage,
+		imageAmazonLinux: amazonLinuxImage,
+	}
+	pinnedImageRegexp = regexp.MustCompile(`^[^@\s]+@sha256:[0-9a-f]{64}$`)
+	// Package versions end up in the compiler's Dockerfile, so we're strict
+	// about what they may contain.
+	packageVersionRegexp = regexp.MustCompile(`^[0-9A-Za-z][0-9A-Za-z._+~-]*$`)
+)
+
+// lockFile pins the helper images that veil-verify uses by digest, and the
+// version of nitro-cli that we install in the compiler image, so that a
+// verification doesn't depend on what tags resolve to on a given day.  The
+// lock file is JSON-encoded, e.g.:
+//
+//	{
+//	  "images": {
+//	    "amazonlinux": "public.ecr.aws/amazonlinux/amazonlinux:2023@sha256:...",
+//	    "buildkit": "moby/buildkit:v0.17.3@sha256:...",
+//	    "kaniko": "gcr.io/kaniko-project/executor:v1.9.2@sha256:..."
+//	  },
+//	  "nitro_cli_version": "1.4.2-0.amzn2023"
+//	}
+type lockFile struct {
+	Images          map[string]string `json:"images"`
+	NitroCLIVersion string            `json:"nitro_cli_version,omitempty"`
+}
+
+// unpinnedLock returns a lock that references the helper images by tag and
+// installs the latest version of nitro-cli.
+func unpinnedLock() *lockFile {
+	return &lockFile{Images: maps.Clone(defaultImages)}
+}
+
+// readLockFile reads and validates the lock file at the given path.  If the
+// path is empty, we return an unpinned lock.
+func readLockFile(path string) (_ *lockFile, err error) {
+	if path == "" {
+		return unpinnedLock(), nil
+	}
+	defer errs.Wrap(&err, "failed to read lock file")
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var lock lockFile
+	if err := json.Unmarshal(raw, &lock); err != nil {
+		return nil, err
+	}
+	return &lock, lock.validate()
+}
+
+func (l *lockFile) validate() error {
+	for _, name := range slices.Sorted(maps.Keys(defaultImages)) {
+		ref, ok := l.Images[name]
+		if !ok {
+			return fmt.Errorf("image %q is missing", name)
+		}
+		if !pinnedImageRegexp.MatchString(ref) {
+			return fmt.Errorf("image %q must be pinned by SHA-256 digest but is %q", name, ref)
+		}
+	}
+	for name := range l.Images {
+		if _, ok := defaultImages[name]; !ok {
+			return fmt.Errorf("unknown image %q", name)
+		}
+	}
+	if !packageVersionRegexp.MatchString(l.NitroCLIVersion) {
+		return fmt.Errorf("invalid nitro-cli version %q", l.NitroCLIVersion)
+	}
+	return nil
+}
+
+// image returns the reference of the given helper image.
+func (l *lockFile) image(name string) string {
+	if ref, ok := l.Images[name]; ok {
+		return ref
+	}
+	return defaultImages[name]
+}
+
+// pinned returns true if the lock pins all helper images by digest.
+func (l *lockFile) pinned() bool {
+	return l.validate() == nil
+}
+
+// nitroCLIPackages returns the RPM packages that the compiler image installs.
+func (l *lockFile) nitroCLIPackages() (string, string) {
+	cli, devel := nitroCLIPackage, nitroCLIPackage+"-devel"
+	if l.NitroCLIVersion != "" {
+		cli += "-" + l.NitroCLIVersion
+		devel += "-" + l.NitroCLIVersion
+	}
+	return cli, devel
+}
+
+// pullImage pulls the given image and returns the digest-qualified reference
+// of the pulled image.  If the reference contains a digest, we make sure that
+// the pulled image has that digest.
+func pullImage(
+	ctx context.Context,
+	cli *client.Client,
+	ref string,
+	arch string,
+	out io.Writer,
+) (_ string, err error) {
+	defer errs.Wrap(&err, "failed to pull image %q", ref)
+
+	var opts client.ImagePullOptions
+	if arch != "" {
+		opts.Platforms = []v1.Platform{{Architecture: arch, OS: "linux"}}
+	}
+	output, err := cli.ImagePull(ctx, ref, opts)
+	if err != nil {
+		return "", err
+	}
+	defer close(output)
+	if err := printDockerLogs(output, out); err != nil {
+		return "", err
+	}
+
+	return resolveImage(ctx, cli, ref)
+}
+
+// loadImage loads the image tarball at the given path, which must contain the
+// given image, and returns the digest-qualified reference of the loaded image.
+// If the reference contains a digest, we make sure that the loaded image has
+// that digest.
+func loadImage(
+	ctx context.Context,
+	cli *client.Client,
+	tarball string,
+	ref string,
+	out io.Writer,
+) (_ string, err error) {
+	defer errs.Wrap(&err, "failed to load image %q", ref)
+
+	if err := loadImageTarball(ctx, cli, tarball, out); err != nil {
+		return "", err
+	}
+	return resolveImage(ctx, cli, ref)
+}
+
+// resolveImage returns the digest-qualified reference of the given local
+// image.  Images that were loaded from a tarball may lack a digest, in which
+// case we return the reference and the image's ID.
+func resolveImage(ctx context.Context, cli *client.Client, ref string) (string, error) {
+	inspection, err := cli.ImageInspect(ctx, ref)
+	if err != nil {
+		return "", errs.Add(err, "failed to inspect image")
+	}
+	pinned, err := pinnedReference(ref, inspection.RepoDigests)
+	if err != nil && !strings.Contains(ref, "@") {
+		return fmt.Sprintf("%s (%s)", ref, inspection.ID), nil
+	}
+	return pinned, err
+}
+
+// pinnedReference returns the given image reference, qualified with the digest
+// that the given repository digests (as reported by Docker) contain for the
+// reference's repository.  If the reference already contains a digest, the
+// repository digests must contain it.
+func pinnedReference(ref string, repoDigests []string) (string, error) {
+	name, digest, pinned := strings.Cut(ref, "@")
+	repo := repository(name)
+	for _, repoDigest := range repoDigests {
+		r, d, ok := strings.Cut(repoDigest, "@")
+		if !ok || repository(r) != repo {
+			continue
+		}
+		if !pinned {
+			return name + "@" + d, nil
+		}
+		if d == digest {
+			return ref, nil
+		}
+	}
+	if pinned {
+		return "", fmt.Errorf("%w: expected %s", errDigestMismatch, digest)
+	}
+	return "", fmt.Errorf("no digest for %q", ref)
+}
+
+// repository strips the tag from the given image name.
+func repository(name string) string {
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		return name[:i]
+	}
+	return name
+}
+
+func parseLockFlags(out io.Writer, args []string) (_ *config.Lock, err error) {
+	defer errs.WrapErr(&err, errFailedToParse)
+
+	fs := flag.NewFlagSet(cmdLock, flag.ContinueOnError)
+	fs.SetOutput(out)
+
+	lockOut := fs.String(
+		"out",
+		"veil-verify.lock",
+		"Path to write the lock file to",
+	)
+	arch := fs.String(
+		"arch",
+		config.ArchAMD64,
+		"CPU architecture that the enclave runs on: 'amd64' or 'arm64'",
+	)
+	nitroCLIVersion := fs.String(
+		"nitro-cli-version",
+		"",
+		"Version of nitro-cli to pin (default: the latest version)",
+	)
+	verbose := fs.Bool(
+		"verbose",
+		false,
+		"Enable verbose logging",
+	)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	cfg := &config.Lock{
+		Out:             *lockOut,
+		NitroCLIVersion: *nitroCLIVersion,
+		Arch:            *arch,
+		Verbose:         *verbose,
+	}
+	return cfg, validate.Object(cfg)
+}
+
+// runLock resolves the current digests of veil-verify's helper images and the
+// latest version of nitro-cli, and writes them to a lock file.
+func runLock(ctx context.Context, out io.Writer, args []string) (err error) {
+	cfg, err := parseLockFlags(out, args)
+	if err != nil {
+		return err
+	}
+	defer errs.Wrap(&err, "failed to lock images")
+
+	writer := io.Discard
+	if cfg.Verbose {
+		writer = log.Writer()
+	}
+	cli, err := client.New(client.FromEnv)
+	if err != nil {
+		return errs.Add(err, "failed to create Docker client")
+	}
+	defer func() { _ = cli.Close() }()
+
+	lock := &lockFile{
+		Images:          make(map[string]string),
+		NitroCLIVersion: cfg.NitroCLIVersion,
+	}
+	for _, name := range slices.Sorted(maps.Keys(defaultImages)) {
+		// The builders run on our machine, but the compiler image, which
+		// is based on Amazon Linux, targets the enclave's architecture.
+		arch := ""
+		if name == imageAmazonLinux {
+			arch = cfg.Arch
+		}
+		ref, err := pullImage(ctx, cli, defaultImages[name], arch, writer)
+		if err != nil {
+			return err
+		}
+		lock.Images[name] = ref
+		log.Printf("Pinned %s.", ref)
+	}
+	if lock.NitroCLIVersion == "" {
+		v, err := latestNitroCLIVersion(ctx, cli, lock.image(imageAmazonLinux), cfg.Arch)
+		if err != nil {
+			return err
+		}
+		lock.NitroCLIVersion = v
+	}
+	if err := lock.validate(); err != nil {
+		return err
+	}
+	log.Printf("Pinned nitro-cli version %s.", lock.NitroCLIVersion)
+
+	raw, err := json.MarshalIndent(lock, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(cfg.Out, append(raw, '\n'), 0o644); err != nil {
+		return err
+	}
+	_, _ = fmt.Fprintf(out, "Wrote lock file to %s.\n", cfg.Out)
+	return nil
+}
+
+// latestNitroCLIVersion asks dnf in the given Amazon Linux image for the
+// latest version of nitro-cli's package for the given architecture.
+func latestNitroCLIVersion(
+	ctx context.Context,
+	cli *client.Client,
+	image string,
+	arch string,
+) (_ string, err error) {
+	defer errs.Wrap(&err, "failed to determine latest nitro-cli version")
+
+	return containerOutput(ctx, cli, image, arch, []string{
+		"dnf", "-q", "repoquery", "--latest-limit=1",
+		"--qf", "%{version}-%{release}", nitroCLIPackage,
+	})
+}
+
+// installedNitroCLIVersion asks rpm in the compiler image for the version of
+// nitro-cli that the image contains.
+func installedNitroCLIVersion(
+	ctx context.Context,
+	cli *client.Client,
+	arch string,
+) (_ string, err error) {
+	defer errs.Wrap(&err, "failed to determine installed nitro-cli version")
+
+	return containerOutput(ctx, cli, compilerImage, arch, []string{
+		"rpm", "-q", "--qf", "%{version}-%{release}", nitroCLIPackage,
+	})
+}
+
+// containerOutput runs the given command in a new container of the given
+// image for the given architecture, and returns the last word of the
+// command's output.
+func containerOutput(
+	ctx context.Context,
+	cli *client.Client,
+	image string,
+	arch string,
+	cmd []string,
+) (string, error) {
+	resp, err := cli.ContainerCreate(ctx, client.ContainerCreateOptions{
+		Config: &container.Config{
+			Tty:   true,
+			Image: image,
+			Cmd:   cmd,
+		},
+		HostConfig:       &container.HostConfig{},
+		NetworkingConfig: &network.NetworkingConfig{},
+		Platform: &v1.Platform{
+			Architecture: targetArch(arch),
+			OS:           "linux",
+		},
+	})
+	if err != nil {
+		return "", errs.Add(err, "failed to create container")
+	}
+	defer removeContainer(cli, resp.ID)
+
+	if _, err := cli.ContainerStart(ctx, resp.ID, client.ContainerStartOptions{}); err != nil {
+		return "", errs.Add(err, "failed to start container")
+	}
+	reader, err := cli.ContainerLogs(ctx, resp.ID, client.ContainerLogsOptions{
+		ShowStdout: true,
+		Follow:     true,
+	})
+	if err != nil {
+		return "", errs.Add(err, "failed to get container logs")
+	}
+	defer close(reader)
+	raw, err := io.ReadAll(reader)
+	if err != nil {
+		return "", errs.Add(err, "failed to read container logs")
+	}
+	if err := getContainerExitCode(ctx, cli, resp.ID); err != nil {
+		return "", err
+	}
+
+	words := strings.Fields(string(raw))
+	if len(words) == 0 {
+		return "", fmt.Errorf("%s returned no output", cmd[0])
+	}
+	return words[len(words)-1], nil
+}
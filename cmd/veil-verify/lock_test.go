@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/Amnesic-Systems/veil/internal/config"
+	"github.com/Amnesic-Systems/veil/internal/util/must"
+)
+
+const testDigest = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+func testLock() *lockFile {
+	return &lockFile{
+		Images: map[string]string{
+			imageKaniko:      kanikoImage + "@" + testDigest,
+			imageBuildKit:    buildKitImage + "@" + testDigest,
+			imageAmazonLinux: amazonLinuxImage + "@" + testDigest,
+		},
+		NitroCLIVersion: "1.4.2-0.amzn2023",
+	}
+}
+
+func writeLock(t *testing.T, lock *lockFile) string {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), "veil-verify.lock")
+	require.NoError(t, os.WriteFile(p, must.Get(json.Marshal(lock)), 0o600))
+	return p
+}
+
+func TestReadLockFile(t *testing.T) {
+	cases := []struct {
+		name    string
+		mutate  func(*lockFile)
+		wantErr string
+	}{
+		{
+			name: "valid",
+		},
+		{
+			name:    "missing image",
+			mutate:  func(l *lockFile) { delete(l.Images, imageBuildKit) },
+			wantErr: `image "buildkit" is missing`,
+		},
+		{
+			name:    "unpinned image",
+			mutate:  func(l *lockFile) { l.Images[imageKaniko] = kanikoImage },
+			wantErr: "must be pinned",
+		},
+		{
+			name:    "unknown image",
+			mutate:  func(l *lockFile) { l.Images["foo"] = "foo@" + testDigest },
+			wantErr: `unknown image "foo"`,
+		},
+		{
+			name:    "missing nitro-cli version",
+			mutate:  func(l *lockFile) { l.NitroCLIVersion = "" },
+			wantErr: "invalid nitro-cli version",
+		},
+		{
+			name:    "nitro-cli version with shell metacharacters",
+			mutate:  func(l *lockFile) { l.NitroCLIVersion = "1.0 && curl evil" },
+			wantErr: "invalid nitro-cli version",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			lock := testLock()
+			if c.mutate != nil {
+				c.mutate(lock)
+			}
+			got, err := readLockFile(writeLock(t, lock))
+			if c.wantErr != "" {
+				require.ErrorContains(t, err, c.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, lock, got)
+			require.True(t, got.pinned())
+		})
+	}
+
+	lock, err := readLockFile("")
+	require.NoError(t, err)
+	require.False(t, lock.pinned())
+	require.Equal(t, kanikoImage, lock.image(imageKaniko))
+}
+
+func TestPinnedReference(t *testing.T) {
+	const otherDigest = "sha256:fedcba9876543210fedcba9876543210fedcba9876543210fedcba9876543210"
+	cases := []struct {
+		name        string
+		ref         string
+		repoDigests []string
+		want        string
+		wantErr     error
+	}{
+		{
+			name:        "unpinned",
+			ref:         kanikoImage,
+			repoDigests: []string{"moby/buildkit@" + otherDigest, "gcr.io/kaniko-project/executor@" + testDigest},
+			want:        kanikoImage + "@" + testDigest,
+		},
+		{
+			name:        "pinned",
+			ref:         kanikoImage + "@" + testDigest,
+			repoDigests: []string{"gcr.io/kaniko-project/executor@" + otherDigest, "gcr.io/kaniko-project/executor@" + testDigest},
+			want:        kanikoImage + "@" + testDigest,
+		},
+		{
+			name:        "digest mismatch",
+			ref:         kanikoImage + "@" + testDigest,
+			repoDigests: []string{"gcr.io/kaniko-project/executor@" + otherDigest},
+			wantErr:     errDigestMismatch,
+		},
+		{
+			name:        "digest of other repository",
+			ref:         "localhost:5000/kaniko@" + testDigest,
+			repoDigests: []string{"gcr.io/kaniko-project/executor@" + testDigest},
+			wantErr:     errDigestMismatch,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := pinnedReference(c.ref, c.repoDigests)
+			require.ErrorIs(t, err, c.wantErr)
+			require.Equal(t, c.want, got)
+		})
+	}
+}
+
+func TestLockedBuild(t *testing.T) {
+	lock := testLock()
+	dockerfile := compilerDockerfile(lock)
+	require.Contains(t, dockerfile, "FROM "+amazonLinuxImage+"@"+testDigest)
+	require.Contains(t, dockerfile, "dnf install aws-nitro-enclaves-cli-1.4.2-0.amzn2023 -y")
+	require.Contains(t, dockerfile, "dnf install aws-nitro-enclaves-cli-devel-1.4.2-0.amzn2023 -y")
+	require.False(t, strings.Contains(compilerDockerfile(unpinnedLock()), "@sha256:"))
+
+	builder, err := newImageBuilder(config.BuilderKaniko, lock)
+	require.NoError(t, err)
+	containerCfg, _ := builder.container(&config.VeilVerify{Dockerfile: "Dockerfile"})
+	require.Equal(t, kanikoImage+"@"+testDigest, containerCfg.Image)
+
+	// We only cache pinned builds, and the digests determine the build
+	// cache's key.
+	dir := t.TempDir()
+	_, err = buildCacheKey(&config.VeilVerify{Dir: dir})
+	require.ErrorIs(t, err, errUnpinnedBuild)
+	pinned := must.Get(buildCacheKey(&config.VeilVerify{Dir: dir, Lock: writeLock(t, lock)}))
+	otherLock := testLock()
+	otherLock.Images[imageAmazonLinux] = amazonLinuxImage + "@sha256:" + strings.Repeat("f", 64)
+	other := must.Get(buildCacheKey(&config.VeilVerify{Dir: dir, Lock: writeLock(t, otherLock)}))
+	require.NotEqual(t, pinned, other)
+}
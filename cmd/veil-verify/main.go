@@ -4,14 +4,17 @@ import (
 	"context"
 	"errors"
 	"flag"
+	"fmt"
 	"io"
 	"log"
 	"os"
 	"os/signal"
-
-	"github.com/moby/moby/client"
+	"strings"
+	"time"
+	"unicode"
 
 	"github.com/Amnesic-Systems/veil/internal/config"
+	"github.com/Amnesic-Systems/veil/internal/enclave"
 	"github.com/Amnesic-Systems/veil/internal/errs"
 	"github.com/Amnesic-Systems/veil/internal/types/validate"
 )
@@ -24,10 +27,28 @@ func parseFlags(out io.Writer, args []string) (_ *config.VeilVerify, err error)
 	fs := flag.NewFlagSet("veil-verify", flag.ContinueOnError)
 	fs.SetOutput(out)
 
+	newConfig := addVerifyFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	// Build and validate the configuration.
+	cfg := newConfig()
+	return cfg, validate.Object(cfg)
+}
+
+// addVerifyFlags adds veil-verify's flags to the given flag set.  After
+// parsing the flags, the returned function builds the configuration.
+func addVerifyFlags(fs *flag.FlagSet) func() *config.VeilVerify {
 	addr := fs.String(
 		"addr",
 		"",
-		"Address of the enclave, e.g.: https://example.com:8443",
+		"Address of the enclave, e.g.: https://example.com:8443 (or a comma-separated list)",
+	)
+	resolve := fs.Bool(
+		"resolve",
+		false,
+		"Verify every IP address that the host name in 'addr' resolves to",
 	)
 	dir := fs.String(
 		"dir",
@@ -39,6 +60,96 @@ func parseFlags(out io.Writer, args []string) (_ *config.VeilVerify, err error)
 		"Dockerfile",
 		"Path to the Dockerfile used to build the enclave image, relative to 'dir'",
 	)
+	eifPath := fs.String(
+		"eif",
+		"",
+		"Enclave image file to compute PCR values from, instead of building from 'dir'",
+	)
+	pcrsPath := fs.String(
+		"pcrs",
+		"",
+		"JSON file with published PCR values to check against, instead of building from 'dir'",
+	)
+	manifestPath := fs.String(
+		"manifest",
+		"",
+		"Signed manifest with PCR values to check against, instead of building from 'dir'",
+	)
+	pubKey := fs.String(
+		"pubkey",
+		"",
+		"PEM file with the public key that we trust to sign manifests",
+	)
+	arch := fs.String(
+		"arch",
+		config.ArchAMD64,
+		"CPU architecture that the enclave runs on: 'amd64' or 'arm64'",
+	)
+	builder := fs.String(
+		"builder",
+		config.BuilderKaniko,
+		"Backend that reproducibly builds the enclave image: 'kaniko' or 'buildkit'",
+	)
+	cacheDir := fs.String(
+		"cache-dir",
+		"",
+		"Directory that caches the results of builds (default: veil-verify's user cache directory)",
+	)
+	lock := fs.String(
+		"lock",
+		"",
+		"Lock file that pins the helper images by digest (see the 'lock' subcommand)",
+	)
+	offline := fs.Bool(
+		"offline",
+		false,
+		"Don't access the network except for attestation (requires 'builder-image')",
+	)
+	builderImage := fs.String(
+		"builder-image",
+		"",
+		"Tarball of the builder image (as created by 'docker save') to load instead of pulling it",
+	)
+	compilerImage := fs.String(
+		"compiler-image",
+		"",
+		"Tarball of the nitro-cli compiler image to load instead of building it",
+	)
+	noCache := fs.Bool(
+		"no-cache",
+		false,
+		"Rebuild the enclave image even if the build cache contains its PCR values",
+	)
+	policy := fs.String(
+		"policy",
+		"",
+		"JSON file with the PCR values to accept, in addition to the ones we build",
+	)
+	checkout := fs.Bool(
+		"checkout",
+		false,
+		"Clone and build the source code revision that the enclave advertises, instead of 'dir'",
+	)
+	checkConfig := fs.Bool(
+		"check-config",
+		false,
+		"Fetch and verify the enclave's attested runtime configuration",
+	)
+	configPolicy := fs.String(
+		"config-policy",
+		"",
+		"JSON file with the configuration values that the enclave must have (implies 'check-config')",
+	)
+	roots := fs.String(
+		"roots",
+		"",
+		"PEM file with root certificates to trust instead of AWS's (for testing)",
+	)
+	output := fs.String(
+		"output",
+		config.OutputText,
+		"Output format: 'text' or 'json' (see README for exit codes)",
+	)
 	verbose := fs.Bool(
 		"verbose",
 		false,
@@ -49,73 +160,155 @@ func parseFlags(out io.Writer, args []string) (_ *config.VeilVerify, err error)
 		false,
 		"Enable testing by disabling attestation",
 	)
-	if err := fs.Parse(args); err != nil {
-		return nil, err
-	}
 
-	// Build and validate the configuration.
-	cfg := &config.VeilVerify{
-		Addr:       *addr,
-		Dir:        *dir,
-		Dockerfile: *dockerfile,
-		Testing:    *testing,
-		Verbose:    *verbose,
+	return func() *config.VeilVerify {
+		return &config.VeilVerify{
+			Addr:          *addr,
+			Resolve:       *resolve,
+			Dir:           *dir,
+			Dockerfile:    *dockerfile,
+			EIF:           *eifPath,
+			PCRs:          *pcrsPath,
+			Manifest:      *manifestPath,
+			PublicKey:     *pubKey,
+			Arch:          *arch,
+			Builder:       *builder,
+			CacheDir:      *cacheDir,
+			NoCache:       *noCache,
+			Lock:          *lock,
+			Offline:       *offline,
+			BuilderImage:  *builderImage,
+			CompilerImage: *compilerImage,
+			Policy:        *policy,
+			Checkout:      *checkout,
+			CheckConfig:   *checkConfig || *configPolicy != "",
+			ConfigPolicy:  *configPolicy,
+			Roots:         *roots,
+			Output:        *output,
+			Testing:       *testing,
+			Verbose:       *verbose,
+		}
 	}
-	return cfg, validate.Object(cfg)
 }
 
 func run(ctx context.Context, out io.Writer, args []string) error {
 	ctx, cancel := signal.NotifyContext(ctx, os.Interrupt)
 	defer cancel()
 
+	if len(args) > 0 {
+		switch args[0] {
+		case cmdSignManifest:
+			return runSignManifest(out, args[1:])
+		case cmdVerifyManifest:
+			return runVerifyManifest(out, args[1:])
+		case cmdMonitor:
+			return runMonitor(ctx, out, args[1:])
+		case cmdInspect:
+			return runInspect(out, args[1:])
+		case cmdLock:
+			return runLock(ctx, out, args[1:])
+		case cmdReproduce:
+			return runReproduce(ctx, out, args[1:])
+		}
+	}
+
 	cfg, err := parseFlags(out, args)
 	if err != nil {
 		return err
 	}
 
-	// By default, we discard Docker's logs but we print them in verbose mode.
-	writer := io.Discard
-	if cfg.Verbose {
-		writer = log.Writer()
+	if isFleet(cfg) {
+		return verifyFleet(ctx, cfg, out)
 	}
 
-	// Create a new Docker client to interact with the Docker daemon.
-	cli, err := client.New(client.FromEnv)
-	if err != nil {
-		// The Docker API errors are poor, so we wrap them in an attempt to
-		// provide useful context.
-		return errs.Add(err, "failed to create Docker client")
+	rep := &report{Addr: cfg.Addr}
+	err = verifyEnclave(ctx, cfg, rep, out)
+	if cfg.Output == config.OutputJSON {
+		errs.Join(&err, rep.finish(out, err))
 	}
-	defer func() { _ = cli.Close() }()
-	log.Print("Created Docker client.")
+	return err
+}
 
-	// Create a deterministically-built enclave image.  The image is written to
-	// disk as a tar archive.
-	if err := buildEnclaveImage(ctx, cli, cfg, writer); err != nil {
+// verifyEnclave determines the PCR values that we expect the enclave to have,
+// and checks them against the enclave's attestation document.
+func verifyEnclave(
+	ctx context.Context,
+	cfg *config.VeilVerify,
+	rep *report,
+	out io.Writer,
+) error {
+	start := time.Now()
+	policy, lock, err := expectedPolicy(ctx, cfg)
+	if err != nil {
 		return err
 	}
-	// Load the tar archive into Docker as an image.
-	if err := loadEnclaveImage(ctx, cli, cfg, writer); err != nil {
+	rep.Lock = lock
+	rep.Expected = policy
+	rep.timePhase("expect", start)
+
+	// Fetch the attestation document from the enclave and check its PCR
+	// values against our policy.
+	if err := attestEnclave(ctx, cfg, policy, rep); err != nil {
 		return err
 	}
-	// Create a container that compiles the previously created enclave image
-	// into AWS's EIF format, which is what we need for remote attestation.
-	if err := buildCompilerImage(ctx, cli, writer); err != nil {
-		return err
+	if cfg.CheckConfig {
+		return verifyConfig(ctx, cfg, policy, rep, out)
+	}
+	return nil
+}
+
+// expectedPolicy returns the policy that determines the PCR values that we
+// expect the enclave to have.  The policy file may already contain them, or
+// we may have been given published measurements or a signed manifest.  If we
+// were given an enclave image file, we compute the PCR values ourselves.  If
+// we were given source code, we reproduce the enclave image, and also return
+// the helper images and the nitro-cli version that we used.
+func expectedPolicy(
+	ctx context.Context,
+	cfg *config.VeilVerify,
+) (_ *enclave.Policy, used *lockFile, err error) {
+	policy := enclave.NewPolicy()
+	if cfg.Policy != "" {
+		if policy, err = enclave.ReadPolicy(cfg.Policy); err != nil {
+			return nil, nil, err
+		}
+	}
+	var pcrs enclave.PCR
+	switch {
+	case cfg.Manifest != "":
+		var m *manifest
+		if m, pcrs, err = readSignedManifest(cfg.Manifest, cfg.PublicKey); err == nil &&
+			targetArch(m.Architecture) != targetArch(cfg.Arch) {
+			err = fmt.Errorf("%w: manifest targets %q instead of %q",
+				errArchMismatch, targetArch(m.Architecture), targetArch(cfg.Arch))
+		}
+	case cfg.PCRs != "":
+		pcrs, err = readPCRs(cfg.PCRs)
+	case cfg.EIF != "":
+		pcrs, _, err = readEIF(cfg.EIF, targetArch(cfg.Arch))
+	case cfg.Dir != "":
+		pcrs, used, err = buildEnclave(ctx, cfg)
+	case cfg.Checkout:
+		pcrs, used, err = buildCheckout(ctx, cfg)
 	}
-	// Compile the enclave image as discussed above.
-	pcrs, err := compileEnclaveImage(ctx, cli)
 	if err != nil {
-		return err
+		return nil, nil, err
+	}
+	if pcrs != nil {
+		policy.Allowed = append(policy.Allowed, pcrs)
 	}
+	return policy, used, nil
+}
 
-	// Fetch the attestation document from the enclave and compare its PCR
-	// values to the ones we just computed.
-	return attestEnclave(ctx, cfg, pcrs)
+func splitList(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
 }
 
 func main() {
 	if err := run(context.Background(), os.Stdout, os.Args[1:]); err != nil {
-		log.Fatalf("Failed to verify enclave: %v", err)
+		log.Printf("Failed to verify enclave: %v", err)
+		os.Exit(exitCode(err))
 	}
 }
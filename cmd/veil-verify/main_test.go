@@ -6,6 +6,8 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -53,6 +55,16 @@ func TestRun(t *testing.T) {
 			args:    []string{"-addr", srv.URL, "-dir", "/foo"},
 			wantErr: errFailedToParse,
 		},
+		{
+			name:    "missing eif",
+			args:    []string{"-addr", srv.URL, "-eif", "/foo.eif"},
+			wantErr: errFailedToParse,
+		},
+		{
+			name:    "missing pcrs",
+			args:    []string{"-addr", srv.URL, "-pcrs", "/foo.json"},
+			wantErr: errFailedToParse,
+		},
 	}
 
 	for _, c := range cases {
@@ -62,3 +74,38 @@ func TestRun(t *testing.T) {
 		})
 	}
 }
+
+func TestRunWithPublishedPCRs(t *testing.T) {
+	srv := newAttestationServer(t, nil)
+	defer srv.Close()
+
+	dir := t.TempDir()
+	valid := filepath.Join(dir, "valid.json")
+	require.NoError(t, os.WriteFile(valid, []byte(validPCRs), 0o600))
+	invalid := filepath.Join(dir, "invalid.json")
+	require.NoError(t, os.WriteFile(invalid, []byte("invalid"), 0o600))
+
+	cases := []struct {
+		name    string
+		pcrs    string
+		wantErr error
+	}{
+		{
+			name: "matching pcrs",
+			pcrs: valid,
+		},
+		{
+			name:    "invalid pcrs",
+			pcrs:    invalid,
+			wantErr: errFailedToConvert,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			args := []string{"-addr", srv.URL, "-pcrs", c.pcrs, "-insecure"}
+			err := run(t.Context(), io.Discard, args)
+			require.ErrorIs(t, err, c.wantErr)
+		})
+	}
+}
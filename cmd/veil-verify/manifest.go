@@ -0,0 +1,349 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/Amnesic-Systems/veil/internal/config"
+	"github.com/Amnesic-Systems/veil/internal/eif"
+	"github.com/Amnesic-Systems/veil/internal/enclave"
+	"github.com/Amnesic-Systems/veil/internal/errs"
+	"github.com/Amnesic-Systems/veil/internal/types/validate"
+)
+
+const (
+	cmdSignManifest   = "sign-manifest"
+	cmdVerifyManifest = "verify-manifest"
+)
+
+var (
+	errBadSignature   = errors.New("manifest signature is invalid")
+	errUnsupportedKey = errors.New("key must be Ed25519 or ECDSA")
+	errArchMismatch   = errors.New("architecture mismatch")
+)
+
+// manifest describes an enclave release.  Its measurements have the same
+// format as nitro-cli's output, so toPCR can parse manifests.  Manifests
+// without an architecture predate arm64 support and describe amd64 enclaves.
+type manifest struct {
+	Measurements measurements `json:"Measurements"`
+	SourceCommit string       `json:"SourceCommit"`
+	Dockerfile   string       `json:"Dockerfile"`
+	Architecture string       `json:"Architecture,omitempty"`
+}
+
+// signedManifest contains a JSON-encoded manifest and its signature.  We sign
+// the manifest's exact bytes, which spares us from canonicalizing JSON.
+type signedManifest struct {
+	Manifest  []byte `json:"manifest"`
+	Signature []byte `json:"signature"`
+}
+
+// readPrivateKey reads a PEM-encoded Ed25519 or ECDSA private key.
+func readPrivateKey(path string) (_ crypto.Signer, err error) {
+	defer errs.Wrap(&err, "failed to read private key %q", path)
+
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	var key any
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch k := key.(type) {
+	case ed25519.PrivateKey:
+		return k, nil
+	case *ecdsa.PrivateKey:
+		return k, nil
+	default:
+		return nil, errUnsupportedKey
+	}
+}
+
+// readPublicKey reads a PEM-encoded Ed25519 or ECDSA public key.
+func readPublicKey(path string) (_ crypto.PublicKey, err error) {
+	defer errs.Wrap(&err, "failed to read public key %q", path)
+
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	switch k := key.(type) {
+	case ed25519.PublicKey, *ecdsa.PublicKey:
+		return k, nil
+	default:
+		return nil, errUnsupportedKey
+	}
+}
+
+func readPEM(path string) (*pem.Block, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, errors.New("found no PEM block")
+	}
+	return block, nil
+}
+
+// sign signs the given message.  Ed25519 signs the message itself while
+// ECDSA signs the message's SHA-256 hash.
+func sign(key crypto.Signer, msg []byte) ([]byte, error) {
+	switch k := key.(type) {
+	case ed25519.PrivateKey:
+		return ed25519.Sign(k, msg), nil
+	case *ecdsa.PrivateKey:
+		hash := sha256.Sum256(msg)
+		return ecdsa.SignASN1(rand.Reader, k, hash[:])
+	default:
+		return nil, errUnsupportedKey
+	}
+}
+
+func verify(key crypto.PublicKey, msg, sig []byte) error {
+	var ok bool
+	switch k := key.(type) {
+	case ed25519.PublicKey:
+		ok = ed25519.Verify(k, msg, sig)
+	case *ecdsa.PublicKey:
+		hash := sha256.Sum256(msg)
+		ok = ecdsa.VerifyASN1(k, hash[:], sig)
+	default:
+		return errUnsupportedKey
+	}
+	if !ok {
+		return errBadSignature
+	}
+	return nil
+}
+
+// signManifest returns the signed, JSON-encoded representation of the given
+// manifest.
+func signManifest(key crypto.Signer, m *manifest) ([]byte, error) {
+	rawManifest, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	sig, err := sign(key, rawManifest)
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(&signedManifest{
+		Manifest:  rawManifest,
+		Signature: sig,
+	}, "", "  ")
+}
+
+// readSignedManifest reads the signed manifest at the given path, verifies
+// its signature using the public key at the given path, and returns the
+// manifest and its PCR values.
+func readSignedManifest(path, pubKeyPath string) (_ *manifest, _ enclave.PCR, err error) {
+	defer errs.Wrap(&err, "failed to read signed manifest %q", path)
+
+	pubKey, err := readPublicKey(pubKeyPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	var s signedManifest
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return nil, nil, err
+	}
+	if err := verify(pubKey, s.Manifest, s.Signature); err != nil {
+		return nil, nil, err
+	}
+
+	// Only parse the manifest after we've verified its signature.
+	var m manifest
+	if err := json.Unmarshal(s.Manifest, &m); err != nil {
+		return nil, nil, err
+	}
+	pcrs, err := toPCR(s.Manifest)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &m, pcrs, nil
+}
+
+func parseSignManifestFlags(out io.Writer, args []string) (_ *config.SignManifest, err error) {
+	defer errs.WrapErr(&err, errFailedToParse)
+
+	fs := flag.NewFlagSet(cmdSignManifest, flag.ContinueOnError)
+	fs.SetOutput(out)
+
+	key := fs.String(
+		"key",
+		"",
+		"PEM file with the Ed25519 or ECDSA private key that signs the manifest",
+	)
+	pcrs := fs.String(
+		"pcrs",
+		"",
+		"JSON file with the measurements that nitro-cli printed",
+	)
+	eifPath := fs.String(
+		"eif",
+		"",
+		"Enclave image file to compute PCR values from, instead of 'pcrs'",
+	)
+	commit := fs.String(
+		"commit",
+		"",
+		"Source code commit that the enclave image was built from",
+	)
+	dockerfile := fs.String(
+		"dockerfile",
+		"Dockerfile",
+		"Path to the Dockerfile that the enclave image was built from",
+	)
+	arch := fs.String(
+		"arch",
+		"",
+		"CPU architecture that the enclave image targets (default: the EIF's architecture or amd64)",
+	)
+	outPath := fs.String(
+		"out",
+		"",
+		"File to write the signed manifest to (default: stdout)",
+	)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	cfg := &config.SignManifest{
+		Key:        *key,
+		PCRs:       *pcrs,
+		EIF:        *eifPath,
+		Commit:     *commit,
+		Dockerfile: *dockerfile,
+		Arch:       *arch,
+		Out:        *outPath,
+	}
+	return cfg, validate.Object(cfg)
+}
+
+func runSignManifest(out io.Writer, args []string) error {
+	cfg, err := parseSignManifestFlags(out, args)
+	if err != nil {
+		return err
+	}
+
+	key, err := readPrivateKey(cfg.Key)
+	if err != nil {
+		return err
+	}
+	var pcrs enclave.PCR
+	arch := targetArch(cfg.Arch)
+	if cfg.EIF != "" {
+		pcrs, arch, err = readEIF(cfg.EIF, cfg.Arch)
+	} else {
+		pcrs, err = readPCRs(cfg.PCRs)
+	}
+	if err != nil {
+		return err
+	}
+
+	signed, err := signManifest(key, &manifest{
+		Measurements: newMeasurements(pcrs),
+		SourceCommit: cfg.Commit,
+		Dockerfile:   cfg.Dockerfile,
+		Architecture: arch,
+	})
+	if err != nil {
+		return err
+	}
+	if cfg.Out == "" {
+		_, err = fmt.Fprintln(out, string(signed))
+		return err
+	}
+	return os.WriteFile(cfg.Out, signed, 0o644)
+}
+
+// readEIF returns the PCR values and the architecture of the enclave image
+// file at the given path.  If arch is set, the image must target it.
+func readEIF(path, arch string) (_ enclave.PCR, _ string, err error) {
+	img, err := eif.Open(path)
+	if err != nil {
+		return nil, "", err
+	}
+	defer func() { _ = img.Close() }()
+
+	if arch != "" && arch != img.Header.Arch() {
+		return nil, "", fmt.Errorf("%w: enclave image file targets %q instead of %q",
+			errArchMismatch, img.Header.Arch(), arch)
+	}
+	pcrs, err := img.PCRs()
+	if err != nil {
+		return nil, "", err
+	}
+	return pcrs, img.Header.Arch(), nil
+}
+
+func parseVerifyManifestFlags(out io.Writer, args []string) (_ *config.VerifyManifest, err error) {
+	defer errs.WrapErr(&err, errFailedToParse)
+
+	fs := flag.NewFlagSet(cmdVerifyManifest, flag.ContinueOnError)
+	fs.SetOutput(out)
+
+	pubKey := fs.String(
+		"pubkey",
+		"",
+		"PEM file with the trusted Ed25519 or ECDSA public key",
+	)
+	manifestPath := fs.String(
+		"manifest",
+		"",
+		"Signed manifest to verify",
+	)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	cfg := &config.VerifyManifest{
+		PublicKey: *pubKey,
+		Manifest:  *manifestPath,
+	}
+	return cfg, validate.Object(cfg)
+}
+
+func runVerifyManifest(out io.Writer, args []string) error {
+	cfg, err := parseVerifyManifestFlags(out, args)
+	if err != nil {
+		return err
+	}
+
+	m, pcrs, err := readSignedManifest(cfg.Manifest, cfg.PublicKey)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(out, "Manifest signature is valid.\nCommit: %s\nDockerfile: %s\nArchitecture: %s\n%s",
+		m.SourceCommit, m.Dockerfile, targetArch(m.Architecture), pcrs)
+	return err
+}
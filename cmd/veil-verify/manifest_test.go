@@ -0,0 +1,195 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/Amnesic-Systems/veil/internal/config"
+	"github.com/Amnesic-Systems/veil/internal/eif"
+	"github.com/Amnesic-Systems/veil/internal/util/must"
+)
+
+func newEd25519Key(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	return key
+}
+
+// writeKeyPair writes the given private key and its public key as PEM files
+// and returns their paths.
+func writeKeyPair(t *testing.T, key crypto.Signer) (string, string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	privPath, pubPath := filepath.Join(dir, "key.pem"), filepath.Join(dir, "pub.pem")
+	require.NoError(t, os.WriteFile(privPath, pem.EncodeToMemory(&pem.Block{
+		Type:  "PRIVATE KEY",
+		Bytes: must.Get(x509.MarshalPKCS8PrivateKey(key)),
+	}), 0o600))
+	require.NoError(t, os.WriteFile(pubPath, pem.EncodeToMemory(&pem.Block{
+		Type:  "PUBLIC KEY",
+		Bytes: must.Get(x509.MarshalPKIXPublicKey(key.Public())),
+	}), 0o600))
+	return privPath, pubPath
+}
+
+func TestSignAndVerifyManifest(t *testing.T) {
+	edKey := newEd25519Key(t)
+	ecKey := must.Get(ecdsa.GenerateKey(elliptic.P256(), rand.Reader))
+	_, otherPub := writeKeyPair(t, newEd25519Key(t))
+
+	dir := t.TempDir()
+	pcrsPath := filepath.Join(dir, "pcrs.json")
+	require.NoError(t, os.WriteFile(pcrsPath, []byte(validPCRs), 0o600))
+
+	for name, key := range map[string]crypto.Signer{
+		"ed25519": edKey,
+		"ecdsa":   ecKey,
+	} {
+		t.Run(name, func(t *testing.T) {
+			priv, pub := writeKeyPair(t, key)
+			out := filepath.Join(t.TempDir(), "manifest.json")
+			require.NoError(t, run(t.Context(), io.Discard, []string{
+				cmdSignManifest,
+				"-key", priv,
+				"-pcrs", pcrsPath,
+				"-commit", "abcd",
+				"-arch", "arm64",
+				"-out", out,
+			}))
+
+			var buf strings.Builder
+			require.NoError(t, run(t.Context(), &buf, []string{
+				cmdVerifyManifest,
+				"-pubkey", pub,
+				"-manifest", out,
+			}))
+			require.Contains(t, buf.String(), "Commit: abcd")
+			require.Contains(t, buf.String(), "Architecture: arm64")
+
+			m, pcrs, err := readSignedManifest(out, pub)
+			require.NoError(t, err)
+			require.Equal(t, "Dockerfile", m.Dockerfile)
+			require.True(t, pcrs.Equal(testPCRs()))
+
+			// The manifest must not verify with somebody else's key.
+			_, _, err = readSignedManifest(out, otherPub)
+			require.ErrorIs(t, err, errBadSignature)
+		})
+	}
+}
+
+func TestTamperedManifest(t *testing.T) {
+	key := newEd25519Key(t)
+	_, pub := writeKeyPair(t, key)
+
+	signed := must.Get(signManifest(key, &manifest{
+		Measurements: newMeasurements(testPCRs()),
+		SourceCommit: "abcd",
+	}))
+	var s signedManifest
+	require.NoError(t, json.Unmarshal(signed, &s))
+	s.Manifest = []byte(strings.Replace(string(s.Manifest), "abcd", "dcba", 1))
+	path := filepath.Join(t.TempDir(), "manifest.json")
+	require.NoError(t, os.WriteFile(path, must.Get(json.Marshal(&s)), 0o600))
+
+	_, _, err := readSignedManifest(path, pub)
+	require.ErrorIs(t, err, errBadSignature)
+}
+
+func TestRunWithSignedManifest(t *testing.T) {
+	srv := newAttestationServer(t, nil)
+	defer srv.Close()
+
+	key := newEd25519Key(t)
+	_, pub := writeKeyPair(t, key)
+	path := filepath.Join(t.TempDir(), "manifest.json")
+	require.NoError(t, os.WriteFile(path, must.Get(signManifest(key, &manifest{
+		Measurements: newMeasurements(testPCRs()),
+		SourceCommit: "abcd",
+	})), 0o600))
+
+	require.NoError(t, run(t.Context(), io.Discard, []string{
+		"-addr", srv.URL,
+		"-manifest", path,
+		"-pubkey", pub,
+		"-insecure",
+	}))
+}
+
+func TestExpectedPolicyArch(t *testing.T) {
+	key := newEd25519Key(t)
+	_, pub := writeKeyPair(t, key)
+	dir := t.TempDir()
+	writeManifest := func(arch string) string {
+		path := filepath.Join(dir, "manifest-"+arch+".json")
+		require.NoError(t, os.WriteFile(path, must.Get(signManifest(key, &manifest{
+			Measurements: newMeasurements(testPCRs()),
+			Architecture: arch,
+		})), 0o600))
+		return path
+	}
+	writeEIF := func(arch string) string {
+		path := filepath.Join(dir, "enclave-"+arch+".eif")
+		b := &eif.Builder{
+			Arch:     arch,
+			Kernel:   []byte("kernel"),
+			Ramdisks: [][]byte{[]byte("bootstrap"), []byte("customer")},
+		}
+		require.NoError(t, b.WriteFile(path))
+		return path
+	}
+
+	cases := []struct {
+		name    string
+		cfg     *config.VeilVerify
+		wantErr error
+	}{
+		{
+			name: "legacy manifest for amd64",
+			cfg:  &config.VeilVerify{Manifest: writeManifest(""), PublicKey: pub},
+		},
+		{
+			name: "arm64 manifest",
+			cfg: &config.VeilVerify{
+				Manifest:  writeManifest(config.ArchARM64),
+				PublicKey: pub,
+				Arch:      config.ArchARM64,
+			},
+		},
+		{
+			name:    "arm64 manifest for amd64",
+			cfg:     &config.VeilVerify{Manifest: writeManifest(config.ArchARM64), PublicKey: pub},
+			wantErr: errArchMismatch,
+		},
+		{
+			name: "arm64 image file",
+			cfg:  &config.VeilVerify{EIF: writeEIF(config.ArchARM64), Arch: config.ArchARM64},
+		},
+		{
+			name:    "arm64 image file for amd64",
+			cfg:     &config.VeilVerify{EIF: writeEIF(config.ArchARM64)},
+			wantErr: errArchMismatch,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, _, err := expectedPolicy(t.Context(), c.cfg)
+			require.ErrorIs(t, err, c.wantErr)
+		})
+	}
+}
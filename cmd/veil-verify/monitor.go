@@ -0,0 +1,466 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Amnesic-Systems/veil/internal/config"
+	"github.com/Amnesic-Systems/veil/internal/enclave"
+	"github.com/Amnesic-Systems/veil/internal/errs"
+	"github.com/Amnesic-Systems/veil/internal/types/validate"
+)
+
+const (
+	cmdMonitor  = "monitor"
+	pathMetrics = "/metrics"
+)
+
+// The states of an enclave's PCR values and TLS binding.  The state is
+// unknown if we couldn't get that far in the verification.
+const (
+	stateUnknown = "unknown"
+	stateValid   = "valid"
+	stateInvalid = "invalid"
+)
+
+// The kinds of changes that trigger an event.
+const (
+	changeReachability = "reachability"
+	changePCRs         = "pcrs"
+	changeTLSBinding   = "tls_binding"
+	changeTLSKeyHash   = "tls_key_hash"
+	changeAppKeyHash   = "app_key_hash"
+)
+
+// enclaveState represents what we learned about an enclave during its most
+// recent attestation.
+type enclaveState struct {
+	Reachable  bool   `json:"reachable"`
+	PCRs       string `json:"pcrs"`
+	TLSBinding string `json:"tls_binding"`
+	TLSKeyHash string `json:"tls_key_hash,omitempty"`
+	AppKeyHash string `json:"app_key_hash,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// event is sent to the webhook and passed to the command whenever an
+// enclave's state or one of its attested key hashes changes.
+type event struct {
+	Addr       string         `json:"addr"`
+	Time       time.Time      `json:"time"`
+	Changes    []string       `json:"changes"`
+	Old        *enclaveState  `json:"old"`
+	New        *enclaveState  `json:"new"`
+	TLSKeyHash *keyHashChange `json:"tls_key_hash,omitempty"`
+	AppKeyHash *keyHashChange `json:"app_key_hash,omitempty"`
+}
+
+// keyHashChange contains an attested key hash before and after it changed.
+// The old hash is the last one that we saw, which may be from an earlier
+// check than the event's old state if the enclave failed attestation in
+// between.
+type keyHashChange struct {
+	Old string `json:"old"`
+	New string `json:"new"`
+}
+
+// newKeyHashChange returns the change from the last key hash that we saw to
+// the current one, or nil if the hash didn't change or either is unknown.
+func newKeyHashChange(last, current string) *keyHashChange {
+	if last == "" || current == "" || last == current {
+		return nil
+	}
+	return &keyHashChange{Old: last, New: current}
+}
+
+// target contains the monitoring state of a single enclave.
+type target struct {
+	state        *enclaveState
+	lastCheck    time.Time
+	checks       uint64
+	failures     uint64
+	keyChanges   uint64
+	stateChanges uint64
+	lastDuration time.Duration
+	lastTLSKey   string
+	lastAppKey   string
+}
+
+// monitor continuously attests enclaves against a policy.
+type monitor struct {
+	cfg    *config.Monitor
+	policy *enclave.Policy
+
+	sync.Mutex
+	targets map[string]*target
+}
+
+func newMonitor(cfg *config.Monitor, policy *enclave.Policy) *monitor {
+	m := &monitor{
+		cfg:     cfg,
+		policy:  policy,
+		targets: make(map[string]*target),
+	}
+	for _, addr := range cfg.Addrs {
+		m.targets[addr] = &target{}
+	}
+	return m
+}
+
+// newEnclaveState derives an enclave's state from the result of attesting it.
+func newEnclaveState(rep *report, err error) *enclaveState {
+	s := &enclaveState{
+		Reachable:  rep.StatusCode != 0,
+		PCRs:       stateUnknown,
+		TLSBinding: stateUnknown,
+	}
+	if err != nil {
+		s.Error = err.Error()
+	}
+	switch {
+	case err == nil:
+		s.PCRs = stateValid
+	case errors.Is(err, errs.ErrPCRMismatch):
+		s.PCRs = stateInvalid
+	}
+	if rep.TLSBinding != nil {
+		s.TLSBinding = stateInvalid
+		if *rep.TLSBinding {
+			s.TLSBinding = stateValid
+		}
+	}
+	s.TLSKeyHash, s.AppKeyHash = rep.Document.keyHashes()
+	return s
+}
+
+// changes returns the kinds of changes between the given states.
+func changes(old, new *enclaveState) []string {
+	var c []string
+	if old.Reachable != new.Reachable {
+		c = append(c, changeReachability)
+	}
+	if old.PCRs != new.PCRs {
+		c = append(c, changePCRs)
+	}
+	if old.TLSBinding != new.TLSBinding {
+		c = append(c, changeTLSBinding)
+	}
+	return c
+}
+
+// check attests the enclave at the given address and returns an event if the
+// enclave's state or one of its attested key hashes changed.  The first check
+// of an enclave never results in an event.
+func (m *monitor) check(ctx context.Context, addr string) *event {
+	cfg := m.cfg.VeilVerify
+	cfg.Addr = addr
+	// We don't want attestEnclave to print colored text.
+	cfg.Output = config.OutputJSON
+
+	start := time.Now()
+	rep := &report{Addr: addr}
+	err := attestEnclave(ctx, &cfg, m.policy, rep)
+	if err != nil {
+		log.Printf("Failed to attest %s: %v", addr, err)
+	}
+	state := newEnclaveState(rep, err)
+
+	m.Lock()
+	defer m.Unlock()
+
+	t := m.targets[addr]
+	t.checks++
+	if err != nil {
+		t.failures++
+	}
+	t.lastCheck = start
+	t.lastDuration = time.Since(start)
+	tlsKeyChange := newKeyHashChange(t.lastTLSKey, state.TLSKeyHash)
+	appKeyChange := newKeyHashChange(t.lastAppKey, state.AppKeyHash)
+	if tlsKeyChange != nil || appKeyChange != nil {
+		t.keyChanges++
+	}
+	if state.TLSKeyHash != "" {
+		t.lastTLSKey = state.TLSKeyHash
+	}
+	if state.AppKeyHash != "" {
+		t.lastAppKey = state.AppKeyHash
+	}
+
+	old := t.state
+	t.state = state
+	if old == nil {
+		return nil
+	}
+	c := changes(old, state)
+	if len(c) > 0 {
+		t.stateChanges++
+	}
+	if tlsKeyChange != nil {
+		c = append(c, changeTLSKeyHash)
+	}
+	if appKeyChange != nil {
+		c = append(c, changeAppKeyHash)
+	}
+	if len(c) == 0 {
+		return nil
+	}
+	return &event{
+		Addr:       addr,
+		Time:       start,
+		Changes:    c,
+		Old:        old,
+		New:        state,
+		TLSKeyHash: tlsKeyChange,
+		AppKeyHash: appKeyChange,
+	}
+}
+
+// checkAll attests all enclaves concurrently and notifies about state
+// changes.
+func (m *monitor) checkAll(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, addr := range m.cfg.Addrs {
+		wg.Go(func() {
+			ev := m.check(ctx, addr)
+			if ev == nil {
+				return
+			}
+			log.Printf("State of %s changed: %s", addr, strings.Join(ev.Changes, ", "))
+			if err := m.notify(ctx, ev); err != nil {
+				log.Printf("Failed to notify about state change of %s: %v", addr, err)
+			}
+		})
+	}
+	wg.Wait()
+}
+
+// notify sends the given event to the configured webhook and command.
+func (m *monitor) notify(ctx context.Context, ev *event) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+
+	var errWebhook, errExec error
+	if m.cfg.Webhook != "" {
+		errWebhook = m.callWebhook(ctx, body)
+	}
+	if m.cfg.Exec != "" {
+		errExec = m.runCommand(ctx, body)
+	}
+	return errors.Join(errWebhook, errExec)
+}
+
+func (m *monitor) callWebhook(ctx context.Context, body []byte) (err error) {
+	defer errs.Wrap(&err, "failed to call webhook")
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.cfg.Webhook, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %q", resp.Status)
+	}
+	return nil
+}
+
+// runCommand runs the configured command with the given event on stdin.  We
+// run the command via "sh -c", so it may contain quoted arguments.
+func (m *monitor) runCommand(ctx context.Context, body []byte) (err error) {
+	defer errs.Wrap(&err, "failed to run command")
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", m.cfg.Exec)
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.Stdout = log.Writer()
+	cmd.Stderr = log.Writer()
+	return cmd.Run()
+}
+
+// ServeHTTP exposes the monitor's state as Prometheus metrics.
+func (m *monitor) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != pathMetrics {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.writeMetrics(w)
+}
+
+func (m *monitor) writeMetrics(w io.Writer) {
+	m.Lock()
+	defer m.Unlock()
+
+	boolToFloat := func(b bool) float64 {
+		if b {
+			return 1
+		}
+		return 0
+	}
+	type sample struct {
+		labels string
+		value  float64
+	}
+	metric := func(name, typ, help string, value func(string, *target) []sample) {
+		_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+		for _, addr := range m.cfg.Addrs {
+			for _, s := range value(addr, m.targets[addr]) {
+				_, _ = fmt.Fprintf(w, "%s{addr=%q%s} %g\n", name, addr, s.labels, s.value)
+			}
+		}
+	}
+	gauge := func(name, help string, value func(*target) float64) {
+		metric(name, "gauge", help, func(_ string, t *target) []sample {
+			if t.state == nil {
+				return nil
+			}
+			return []sample{{"", value(t)}}
+		})
+	}
+	counter := func(name, help string, value func(*target) uint64) {
+		metric(name, "counter", help, func(_ string, t *target) []sample {
+			return []sample{{"", float64(value(t))}}
+		})
+	}
+
+	gauge("veil_monitor_up",
+		"Whether the enclave responded to the last attestation request.",
+		func(t *target) float64 { return boolToFloat(t.state.Reachable) })
+	gauge("veil_monitor_pcrs_valid",
+		"Whether the enclave's PCR values satisfied the policy.",
+		func(t *target) float64 { return boolToFloat(t.state.PCRs == stateValid) })
+	gauge("veil_monitor_tls_binding_valid",
+		"Whether the enclave's TLS certificate was bound to its attestation document.",
+		func(t *target) float64 { return boolToFloat(t.state.TLSBinding == stateValid) })
+	gauge("veil_monitor_last_check_timestamp_seconds",
+		"When the enclave was last attested.",
+		func(t *target) float64 { return float64(t.lastCheck.Unix()) })
+	gauge("veil_monitor_last_check_duration_seconds",
+		"How long the enclave's last attestation took.",
+		func(t *target) float64 { return t.lastDuration.Seconds() })
+	counter("veil_monitor_checks_total",
+		"The number of attestations of the enclave.",
+		func(t *target) uint64 { return t.checks })
+	counter("veil_monitor_failures_total",
+		"The number of failed attestations of the enclave.",
+		func(t *target) uint64 { return t.failures })
+	counter("veil_monitor_state_changes_total",
+		"The number of times the enclave's state changed.",
+		func(t *target) uint64 { return t.stateChanges })
+	counter("veil_monitor_key_changes_total",
+		"The number of times the enclave's attested key hashes changed.",
+		func(t *target) uint64 { return t.keyChanges })
+	metric("veil_monitor_key_info", "gauge",
+		"The enclave's most recently attested key hashes.",
+		func(_ string, t *target) []sample {
+			if t.lastTLSKey == "" && t.lastAppKey == "" {
+				return nil
+			}
+			return []sample{{
+				fmt.Sprintf(",tls_key_hash=%q,app_key_hash=%q", t.lastTLSKey, t.lastAppKey),
+				1,
+			}}
+		})
+}
+
+func parseMonitorFlags(out io.Writer, args []string) (_ *config.Monitor, err error) {
+	defer errs.WrapErr(&err, errFailedToParse)
+
+	fs := flag.NewFlagSet(cmdMonitor, flag.ContinueOnError)
+	fs.SetOutput(out)
+
+	newVerifyConfig := addVerifyFlags(fs)
+	interval := fs.Duration(
+		"interval",
+		time.Minute,
+		"How often to attest each enclave",
+	)
+	listen := fs.String(
+		"listen",
+		"127.0.0.1:9090",
+		"Address to serve Prometheus metrics on (empty to disable)",
+	)
+	webhook := fs.String(
+		"webhook",
+		"",
+		"URL to POST a JSON-encoded event to whenever an enclave's state changes",
+	)
+	execCmd := fs.String(
+		"exec",
+		"",
+		"Shell command to run whenever an enclave's state changes; receives the event on stdin",
+	)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	verifyCfg := newVerifyConfig()
+	cfg := &config.Monitor{
+		VeilVerify: *verifyCfg,
+		Addrs:      splitList(verifyCfg.Addr),
+		Interval:   *interval,
+		Listen:     *listen,
+		Webhook:    *webhook,
+		Exec:       *execCmd,
+	}
+	return cfg, validate.Object(cfg)
+}
+
+func runMonitor(ctx context.Context, out io.Writer, args []string) error {
+	cfg, err := parseMonitorFlags(out, args)
+	if err != nil {
+		return err
+	}
+
+	// We only determine the expected PCR values once, which may involve
+	// reproducing the enclave image.
+	policy, _, err := expectedPolicy(ctx, &cfg.VeilVerify)
+	if err != nil {
+		return err
+	}
+	m := newMonitor(cfg, policy)
+
+	if cfg.Listen != "" {
+		srv := &http.Server{
+			Addr:              cfg.Listen,
+			Handler:           m,
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		go func() {
+			log.Printf("Serving metrics on http://%s%s.", cfg.Listen, pathMetrics)
+			if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				log.Printf("Metrics server failed: %v", err)
+			}
+		}()
+		defer func() { _ = srv.Shutdown(context.Background()) }()
+	}
+
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+	for {
+		m.checkAll(ctx)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
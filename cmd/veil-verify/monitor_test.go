@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/Amnesic-Systems/veil/internal/addr"
+	"github.com/Amnesic-Systems/veil/internal/config"
+	"github.com/Amnesic-Systems/veil/internal/enclave"
+	"github.com/Amnesic-Systems/veil/internal/service/attestation"
+	"github.com/Amnesic-Systems/veil/internal/util/must"
+)
+
+func TestMonitor(t *testing.T) {
+	// The enclave's PCR values change once we flip the switch, and its
+	// application key hash changes once we store a new one.
+	var (
+		changeCode atomic.Bool
+		appKeyHash atomic.Pointer[[sha256.Size]byte]
+		oldKeyHash = sha256.Sum256([]byte("old key"))
+	)
+	appKeyHash.Store(&oldKeyHash)
+	srv := newAttestationServer(t, func(doc *enclave.Document) {
+		if changeCode.Load() {
+			doc.PCRs[0] = []byte(strings.Repeat("z", 48))
+		}
+		hashes := must.Get(attestation.DeserializeHashes(doc.PublicKey))
+		hashes.SetAppHash(appKeyHash.Load())
+		doc.PublicKey = hashes.Serialize()
+	})
+	defer srv.Close()
+
+	events := make(chan *event, 10)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ev event
+		if err := json.NewDecoder(r.Body).Decode(&ev); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		events <- &ev
+	}))
+	defer hook.Close()
+
+	cmdOut := filepath.Join(t.TempDir(), "event.json")
+	cfg := &config.Monitor{
+		VeilVerify: config.VeilVerify{Testing: true},
+		Addrs:      []string{srv.URL},
+		Interval:   time.Second,
+		Webhook:    hook.URL,
+		Exec:       "tee '" + cmdOut + "'",
+	}
+	m := newMonitor(cfg, enclave.NewPolicy(testPCRs()))
+
+	// The first check establishes the enclave's state.
+	m.checkAll(t.Context())
+	require.Empty(t, events)
+
+	// Nothing changed, so there's no event.
+	m.checkAll(t.Context())
+	require.Empty(t, events)
+
+	changeCode.Store(true)
+	m.checkAll(t.Context())
+	ev := <-events
+	require.Equal(t, srv.URL, ev.Addr)
+	require.Equal(t, []string{changePCRs}, ev.Changes)
+	require.Equal(t, stateValid, ev.Old.PCRs)
+	require.Equal(t, stateInvalid, ev.New.PCRs)
+	require.NotEmpty(t, ev.New.TLSKeyHash)
+
+	// The command received the same event on stdin.
+	var cmdEvent event
+	require.NoError(t, json.Unmarshal(must.Get(os.ReadFile(cmdOut)), &cmdEvent))
+	require.Equal(t, ev.Changes, cmdEvent.Changes)
+
+	// The enclave starts attesting a new application key.
+	appKeyHash.Store(addr.Of(sha256.Sum256([]byte("new key"))))
+	m.checkAll(t.Context())
+	ev = <-events
+	require.Equal(t, []string{changeAppKeyHash}, ev.Changes)
+	require.Equal(t, hex.EncodeToString(oldKeyHash[:]), ev.AppKeyHash.Old)
+	require.Equal(t, ev.New.AppKeyHash, ev.AppKeyHash.New)
+	require.Nil(t, ev.TLSKeyHash)
+
+	srv.Close()
+	m.checkAll(t.Context())
+	ev = <-events
+	require.Contains(t, ev.Changes, changeReachability)
+	require.False(t, ev.New.Reachable)
+
+	var metrics strings.Builder
+	m.writeMetrics(&metrics)
+	for _, want := range []string{
+		`veil_monitor_up{addr="` + srv.URL + `"} 0`,
+		`veil_monitor_checks_total{addr="` + srv.URL + `"} 5`,
+		`veil_monitor_failures_total{addr="` + srv.URL + `"} 3`,
+		`veil_monitor_state_changes_total{addr="` + srv.URL + `"} 2`,
+		`veil_monitor_key_changes_total{addr="` + srv.URL + `"} 1`,
+		`veil_monitor_key_info{addr="` + srv.URL + `",tls_key_hash=`,
+	} {
+		require.Contains(t, metrics.String(), want)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/Amnesic-Systems/veil/internal/enclave"
+	"github.com/Amnesic-Systems/veil/internal/errs"
+	"github.com/Amnesic-Systems/veil/internal/service/attestation"
+)
+
+// veil-verify's exit codes.  Each class of verification failure has its own
+// exit code, so scripts can tell failures apart without parsing our output.
+const (
+	exitOK              = 0
+	exitFailure         = 1 // Any failure that has no dedicated exit code.
+	exitUsage           = 2 // Invalid command line flags.
+	exitPCRMismatch     = 3 // The enclave's PCR values violate our policy.
+	exitBindingMismatch = 4 // The TLS certificate isn't bound to the document.
+	exitNonceMismatch   = 5 // The attestation document isn't fresh.
+	exitEnclaveErr      = 6 // The enclave returned an error.
+	exitConfigMismatch  = 7 // The enclave's configuration violates our policy.
+)
+
+// exitCode maps the given error to veil-verify's exit code.
+func exitCode(err error) int {
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.Is(err, errFailedToParse):
+		return exitUsage
+	case errors.Is(err, errs.ErrPCRMismatch):
+		return exitPCRMismatch
+	case errors.Is(err, errs.ErrBindingMismatch):
+		return exitBindingMismatch
+	case errors.Is(err, errs.ErrNonceMismatch):
+		return exitNonceMismatch
+	case errors.Is(err, errs.ErrEnclaveErr):
+		return exitEnclaveErr
+	case errors.Is(err, errs.ErrConfigMismatch):
+		return exitConfigMismatch
+	default:
+		return exitFailure
+	}
+}
+
+// report contains the details of a verification run.  In JSON output mode,
+// we print the report once we're done.
+type report struct {
+	Addr       string          `json:"addr"`
+	IP         string          `json:"ip,omitempty"`
+	Success    bool            `json:"success"`
+	Error      string          `json:"error,omitempty"`
+	ExitCode   int             `json:"exit_code"`
+	Nonce      string          `json:"nonce,omitempty"`
+	StatusCode int             `json:"status_code,omitempty"`
+	Expected   *enclave.Policy `json:"expected,omitempty"`
+	// Lock records the digest-qualified helper images and the nitro-cli
+	// version that we used to reproduce the enclave image.  It has the format
+	// of a lock file, so a third party can rerun the same verification.
+	Lock       *lockFile  `json:"lock,omitempty"`
+	Document   *docReport `json:"document,omitempty"`
+	Mismatches []string   `json:"mismatches,omitempty"`
+	TLSBinding *bool      `json:"tls_binding_valid,omitempty"`
+	Timings    []timing   `json:"timings"`
+	// Config contains the enclave's attested runtime configuration, and
+	// ConfigViolations the ways in which it violates our configuration
+	// policy.
+	Config           map[string]any `json:"config,omitempty"`
+	ConfigViolations []string       `json:"config_violations,omitempty"`
+	// Divergent lists the properties (e.g., the PCR values) in which an
+	// instance of a fleet differs from the majority of instances.
+	Divergent []string `json:"divergent,omitempty"`
+}
+
+// docReport contains the fields of a verified attestation document.  PCR
+// values are hex-encoded.
+type docReport struct {
+	ModuleID  string            `json:"module_id"`
+	Timestamp uint64            `json:"timestamp"`
+	Digest    string            `json:"digest"`
+	PCRs      map[string]string `json:"pcrs"`
+	PublicKey []byte            `json:"public_key,omitempty"`
+	UserData  []byte            `json:"user_data,omitempty"`
+}
+
+// keyHashes returns the hex-encoded hashes of the TLS and application keys
+// that the document attests to.  The hashes are empty if the document is nil
+// or doesn't contain them.
+func (d *docReport) keyHashes() (tlsKey, appKey string) {
+	if d == nil {
+		return "", ""
+	}
+	hashes, err := attestation.GetHashes(&enclave.AuxInfo{PublicKey: d.PublicKey})
+	if err != nil {
+		return "", ""
+	}
+	if hashes.TlsKeyHash != nil {
+		tlsKey = hex.EncodeToString(hashes.TlsKeyHash[:])
+	}
+	if hashes.AppKeyHash != nil {
+		appKey = hex.EncodeToString(hashes.AppKeyHash[:])
+	}
+	return tlsKey, appKey
+}
+
+// timing contains the duration of one of veil-verify's phases.
+type timing struct {
+	Phase    string  `json:"phase"`
+	Duration float64 `json:"duration_seconds"`
+}
+
+func newDocReport(doc *enclave.Document) *docReport {
+	pcrs := make(map[string]string, len(doc.PCRs))
+	for i, v := range doc.PCRs {
+		pcrs[fmt.Sprintf("PCR%d", i)] = hex.EncodeToString(v)
+	}
+	return &docReport{
+		ModuleID:  doc.ModuleID,
+		Timestamp: doc.Timestamp,
+		Digest:    doc.Digest,
+		PCRs:      pcrs,
+		PublicKey: doc.PublicKey,
+		UserData:  doc.UserData,
+	}
+}
+
+// timePhase records the time that passed since the given start time as the
+// duration of the given phase.
+func (r *report) timePhase(phase string, start time.Time) {
+	r.Timings = append(r.Timings, timing{
+		Phase:    phase,
+		Duration: time.Since(start).Seconds(),
+	})
+}
+
+// setResult records the given result of the verification run.
+func (r *report) setResult(err error) {
+	r.Success = err == nil
+	r.ExitCode = exitCode(err)
+	if err != nil {
+		r.Error = err.Error()
+	}
+}
+
+// finish records the given result of the verification run and writes the
+// report as JSON to the given writer.
+func (r *report) finish(out io.Writer, err error) error {
+	r.setResult(err)
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/Amnesic-Systems/veil/internal/errs"
+)
+
+func TestExitCode(t *testing.T) {
+	cases := []struct {
+		err  error
+		want int
+	}{
+		{nil, exitOK},
+		{errors.New("foo"), exitFailure},
+		{errFailedToParse, exitUsage},
+		{fmt.Errorf("%w: %w", errFailedToAttest, errs.ErrPCRMismatch), exitPCRMismatch},
+		{fmt.Errorf("%w: %w", errFailedToAttest, errs.ErrBindingMismatch), exitBindingMismatch},
+		{fmt.Errorf("%w: %w", errFailedToAttest, errs.ErrNonceMismatch), exitNonceMismatch},
+		{fmt.Errorf("%w: %w", errFailedToAttest, errs.ErrEnclaveErr), exitEnclaveErr},
+	}
+
+	for _, c := range cases {
+		require.Equal(t, c.want, exitCode(c.err), c.err)
+	}
+}
+
+func TestJSONOutput(t *testing.T) {
+	srv := newAttestationServer(t, nil)
+	defer srv.Close()
+
+	dir := t.TempDir()
+	valid := filepath.Join(dir, "valid.json")
+	require.NoError(t, os.WriteFile(valid, []byte(validPCRs), 0o600))
+	mismatch := filepath.Join(dir, "mismatch.json")
+	require.NoError(t, os.WriteFile(mismatch,
+		[]byte(strings.Replace(validPCRs, "6161", "6262", 1)), 0o600))
+
+	cases := []struct {
+		name         string
+		pcrs         string
+		wantExitCode int
+	}{
+		{
+			name:         "valid",
+			pcrs:         valid,
+			wantExitCode: exitOK,
+		},
+		{
+			name:         "pcr mismatch",
+			pcrs:         mismatch,
+			wantExitCode: exitPCRMismatch,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var out strings.Builder
+			err := run(t.Context(), &out, []string{
+				"-addr", srv.URL,
+				"-pcrs", c.pcrs,
+				"-output", "json",
+				"-insecure",
+			})
+			require.Equal(t, c.wantExitCode, exitCode(err))
+
+			var rep report
+			require.NoError(t, json.Unmarshal([]byte(out.String()), &rep))
+			require.Equal(t, c.wantExitCode, rep.ExitCode)
+			require.Equal(t, err == nil, rep.Success)
+			require.Equal(t, srv.URL, rep.Addr)
+			require.NotEmpty(t, rep.Nonce)
+			require.NotNil(t, rep.Expected)
+			require.NotNil(t, rep.Document)
+			require.Len(t, rep.Document.PCRs, 3)
+			require.True(t, *rep.TLSBinding)
+			require.Equal(t, c.wantExitCode == exitPCRMismatch, len(rep.Mismatches) > 0)
+			require.NotEmpty(t, rep.Timings)
+		})
+	}
+}
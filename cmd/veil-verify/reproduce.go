@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/moby/moby/client"
+
+	"github.com/Amnesic-Systems/veil/internal/config"
+	"github.com/Amnesic-Systems/veil/internal/errs"
+	"github.com/Amnesic-Systems/veil/internal/oci"
+	"github.com/Amnesic-Systems/veil/internal/types/validate"
+)
+
+const cmdReproduce = "reproduce"
+
+// The modification time that we set on all files of the second build's
+// source code.  The first build's files have the time of copying.  Builds that
+// depend on the source code's modification times therefore differ.
+var secondBuildMTime = time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+
+var (
+	errNotReproducible  = errors.New("enclave image is not reproducible")
+	errDiffersReference = errors.New("enclave image differs from reference image")
+)
+
+func parseReproduceFlags(out io.Writer, args []string) (_ *config.Reproduce, err error) {
+	defer errs.WrapErr(&err, errFailedToParse)
+
+	fs := flag.NewFlagSet(cmdReproduce, flag.ContinueOnError)
+	fs.SetOutput(out)
+
+	dir := fs.String(
+		"dir",
+		"",
+		"Directory containing the enclave application's source code",
+	)
+	dockerfile := fs.String(
+		"dockerfile",
+		"Dockerfile",
+		"Path to the Dockerfile used to build the enclave image, relative to 'dir'",
+	)
+	arch := fs.String(
+		"arch",
+		config.ArchAMD64,
+		"CPU architecture that the enclave runs on: 'amd64' or 'arm64'",
+	)
+	builder := fs.String(
+		"builder",
+		config.BuilderKaniko,
+		"Backend that reproducibly builds the enclave image: 'kaniko' or 'buildkit'",
+	)
+	lock := fs.String(
+		"lock",
+		"",
+		"Lock file that pins the helper images by digest (see the 'lock' subcommand)",
+	)
+	offline := fs.Bool(
+		"offline",
+		false,
+		"Don't access the network (requires 'builder-image')",
+	)
+	builderImage := fs.String(
+		"builder-image",
+		"",
+		"Tarball of the builder image (as created by 'docker save') to load instead of pulling it",
+	)
+	reference := fs.String(
+		"reference",
+		"",
+		"Image tarball to compare the builds to, e.g., the one the enclave was built from",
+	)
+	verbose := fs.Bool(
+		"verbose",
+		false,
+		"Enable verbose logging",
+	)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	cfg := &config.Reproduce{
+		Dir:          *dir,
+		Dockerfile:   *dockerfile,
+		Arch:         *arch,
+		Builder:      *builder,
+		Lock:         *lock,
+		Offline:      *offline,
+		BuilderImage: *builderImage,
+		Reference:    *reference,
+		Verbose:      *verbose,
+	}
+	return cfg, validate.Object(cfg)
+}
+
+func runReproduce(ctx context.Context, out io.Writer, args []string) error {
+	cfg, err := parseReproduceFlags(out, args)
+	if err != nil {
+		return err
+	}
+
+	// Build the enclave image twice, from copies of the source code in
+	// different directories, with different modification times, and at
+	// different times.
+	first, err := reproduceImage(ctx, cfg, time.Time{})
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.RemoveAll(filepath.Dir(first)) }()
+	second, err := reproduceImage(ctx, cfg, secondBuildMTime)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.RemoveAll(filepath.Dir(second)) }()
+
+	arch := targetArch(cfg.Arch)
+	identical, err := compareImages(out, arch, "first build", "second build", first, second)
+	if err != nil {
+		return err
+	}
+	if !identical {
+		err = errNotReproducible
+	}
+	if cfg.Reference == "" {
+		return err
+	}
+	identical, err2 := compareImages(out, arch, "first build", "reference", first, cfg.Reference)
+	if err2 != nil {
+		return err2
+	}
+	if !identical {
+		err = errors.Join(err, errDiffersReference)
+	}
+	return err
+}
+
+// reproduceImage copies the source code to a temporary directory and builds
+// the enclave image from the copy.  If mtime is set, all copied files have the
+// given modification time.  reproduceImage returns the path of the image
+// tarball.  The caller must delete the tarball's directory.
+func reproduceImage(
+	ctx context.Context,
+	cfg *config.Reproduce,
+	mtime time.Time,
+) (_ string, err error) {
+	defer errs.Wrap(&err, "failed to reproduce enclave image")
+
+	dir, err := os.MkdirTemp("", "veil-verify-reproduce-")
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err != nil {
+			_ = os.RemoveAll(dir)
+		}
+	}()
+	if err := copyTree(cfg.Dir, dir, mtime); err != nil {
+		return "", err
+	}
+
+	writer := io.Discard
+	if cfg.Verbose {
+		writer = log.Writer()
+	}
+	cli, err := client.New(client.FromEnv)
+	if err != nil {
+		return "", errs.Add(err, "failed to create Docker client")
+	}
+	defer func() { _ = cli.Close() }()
+
+	if _, _, err := buildEnclaveImage(ctx, cli, &config.VeilVerify{
+		Dir:          dir,
+		Dockerfile:   cfg.Dockerfile,
+		Arch:         cfg.Arch,
+		Builder:      cfg.Builder,
+		Lock:         cfg.Lock,
+		Offline:      cfg.Offline,
+		BuilderImage: cfg.BuilderImage,
+		Verbose:      cfg.Verbose,
+	}, writer); err != nil {
+		return "", err
+	}
+	log.Printf("Built enclave image in %s.", dir)
+	return filepath.Join(dir, enclaveTarImage), nil
+}
+
+// copyTree copies the directory src to the existing directory dst, except for
+// a previously built enclave image.  If mtime is set, we set the modification
+// time of all copied files and directories to mtime.
+func copyTree(src, dst string, mtime time.Time) error {
+	// We set the directories' modification times last because copying files
+	// into a directory updates its modification time.
+	var dirs []string
+	err := filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if rel == enclaveTarImage {
+			return nil
+		}
+		target := filepath.Join(dst, rel)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case d.IsDir():
+			if err := os.MkdirAll(target, info.Mode().Perm()); err != nil {
+				return err
+			}
+			dirs = append(dirs, target)
+			return nil
+		case info.Mode()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case info.Mode().IsRegular():
+			raw, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			if err := os.WriteFile(target, raw, info.Mode().Perm()); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("cannot copy irregular file %q", path)
+		}
+		if mtime.IsZero() {
+			return nil
+		}
+		return os.Chtimes(target, mtime, mtime)
+	})
+	if err != nil || mtime.IsZero() {
+		return err
+	}
+	for _, dir := range dirs {
+		if err := os.Chtimes(dir, mtime, mtime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compareImages prints the differences between the image tarballs a and b,
+// which are called nameA and nameB, and returns true if the images are
+// identical.  If a tarball contains images for several architectures, we
+// compare the images for the given architecture.
+func compareImages(out io.Writer, arch, nameA, nameB, a, b string) (bool, error) {
+	imgA, err := oci.Open(a, arch)
+	if err != nil {
+		return false, err
+	}
+	imgB, err := oci.Open(b, arch)
+	if err != nil {
+		return false, err
+	}
+	diffs, err := oci.Diff(imgA, imgB)
+	if err != nil {
+		return false, err
+	}
+
+	if len(diffs) == 0 {
+		_, _ = fmt.Fprintln(out, color.GreenString("The %s and the %s are identical.", nameA, nameB))
+		return true, nil
+	}
+	_, _ = fmt.Fprintln(out, color.RedString("The %s and the %s differ (%s != %s):", nameA, nameB, nameA, nameB))
+	for _, d := range diffs {
+		_, _ = fmt.Fprintf(out, "  %s\n", d)
+	}
+	return false, nil
+}
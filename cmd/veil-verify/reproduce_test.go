@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/Amnesic-Systems/veil/internal/testutil"
+	"github.com/Amnesic-Systems/veil/internal/util/must"
+)
+
+func TestCopyTree(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(src, "src"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "src", "main.go"), []byte("package main"), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(src, enclaveTarImage), []byte("image"), 0o600))
+	require.NoError(t, os.Symlink("src/main.go", filepath.Join(src, "main.go")))
+
+	require.NoError(t, copyTree(src, dst, secondBuildMTime))
+
+	require.Equal(t, "package main", string(must.Get(os.ReadFile(filepath.Join(dst, "main.go")))))
+	require.NoFileExists(t, filepath.Join(dst, enclaveTarImage))
+	for _, name := range []string{"src", "src/main.go"} {
+		info := must.Get(os.Stat(filepath.Join(dst, name)))
+		require.True(t, secondBuildMTime.Equal(info.ModTime()), name)
+	}
+}
+
+func TestCompareImages(t *testing.T) {
+	config := map[string]any{"architecture": "amd64", "os": "linux"}
+	layer := testutil.NewTar(t, testutil.TarFile{Name: "app", Body: "app"})
+	a := testutil.NewImageTarball(t, config, layer)
+	b := testutil.NewImageTarball(t, config, layer)
+	c := testutil.NewImageTarball(t, config, testutil.NewTar(t,
+		testutil.TarFile{Name: "app", Body: "app", Mode: 0o755},
+	))
+
+	var out bytes.Buffer
+	identical, err := compareImages(&out, "amd64", "a", "b", a, b)
+	require.NoError(t, err)
+	require.True(t, identical)
+
+	out.Reset()
+	identical, err = compareImages(&out, "amd64", "a", "c", a, c)
+	require.NoError(t, err)
+	require.False(t, identical)
+	require.Contains(t, out.String(), "layer 0: app: mode: 0644 != 0755")
+}
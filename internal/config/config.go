@@ -11,4 +11,10 @@ var (
 	_ = validate.Validator(&Veil{})
 	_ = validate.Validator(&VeilProxy{})
 	_ = validate.Validator(&VeilVerify{})
+	_ = validate.Validator(&SignManifest{})
+	_ = validate.Validator(&VerifyManifest{})
+	_ = validate.Validator(&Monitor{})
+	_ = validate.Validator(&Inspect{})
+	_ = validate.Validator(&Reproduce{})
+	_ = validate.Validator(&Lock{})
 )
@@ -0,0 +1,69 @@
+package config
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+
+	"github.com/Amnesic-Systems/veil/internal/nonce"
+)
+
+// Inspect represents the configuration of veil-verify's inspect subcommand,
+// which decodes and verifies a captured attestation document.
+type Inspect struct {
+	// Doc contains the path to a file with the JSON-encoded attestation
+	// document.  If empty or "-", we read the document from stdin.
+	Doc string
+
+	// Nonce contains the Base64-encoded nonce that the attestation document
+	// must contain.  If empty, we don't check the nonce.
+	Nonce string
+
+	// TLSCert contains the path to a PEM-encoded certificate whose hash the
+	// attestation document must contain.  If empty, we don't check the
+	// certificate.
+	TLSCert string
+
+	// Roots contains the path to a PEM file with root certificates that
+	// attestation documents must chain up to.  If empty, we use AWS's Nitro
+	// Enclaves root certificate.
+	Roots string
+
+	// Output determines the output format, i.e., `OutputText` or
+	// `OutputJSON`.
+	Output string
+
+	// Testing facilitates local testing by using the noop verifier.
+	Testing bool
+}
+
+func (c *Inspect) Validate() map[string]string {
+	problems := make(map[string]string)
+
+	if c.Doc != "" && c.Doc != "-" {
+		if _, err := os.Stat(c.Doc); err != nil {
+			problems["-doc"] = fmt.Sprintf("given document %q does not exist", c.Doc)
+		}
+	}
+	if c.Nonce != "" {
+		n, err := base64.StdEncoding.DecodeString(c.Nonce)
+		if err != nil || len(n) != nonce.Len {
+			problems["-nonce"] = fmt.Sprintf("nonce must be %d Base64-encoded bytes", nonce.Len)
+		}
+	}
+	if c.TLSCert != "" {
+		if _, err := os.Stat(c.TLSCert); err != nil {
+			problems["-tls-cert"] = fmt.Sprintf("given certificate %q does not exist", c.TLSCert)
+		}
+	}
+	if c.Roots != "" {
+		if _, err := os.Stat(c.Roots); err != nil {
+			problems["-roots"] = fmt.Sprintf("given roots %q do not exist", c.Roots)
+		}
+	}
+	if c.Output != "" && c.Output != OutputText && c.Output != OutputJSON {
+		problems["-output"] = fmt.Sprintf("output must be %q or %q", OutputText, OutputJSON)
+	}
+
+	return problems
+}
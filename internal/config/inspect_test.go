@@ -0,0 +1,52 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/Amnesic-Systems/veil/internal/types/validate"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInspectConfig(t *testing.T) {
+	cases := []struct {
+		name     string
+		cfg      *Inspect
+		wantErrs int
+	}{
+		{
+			name: "stdin",
+			cfg:  &Inspect{},
+		},
+		{
+			name:     "missing document",
+			cfg:      &Inspect{Doc: "does-not-exist.json"},
+			wantErrs: 1,
+		},
+		{
+			name:     "invalid nonce",
+			cfg:      &Inspect{Doc: "-", Nonce: "Zm9v"},
+			wantErrs: 1,
+		},
+		{
+			name:     "missing certificate and invalid output",
+			cfg:      &Inspect{TLSCert: "does-not-exist.pem", Output: "yaml"},
+			wantErrs: 2,
+		},
+		{
+			name: "valid",
+			cfg: &Inspect{
+				Doc:     "inspect.go",
+				Nonce:   "AAAAAAAAAAAAAAAAAAAAAAAAAAA=",
+				TLSCert: "inspect.go",
+				Output:  OutputJSON,
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			errs := c.cfg.Validate()
+			require.Equal(t, c.wantErrs, len(errs), validate.SprintErrs(errs))
+		})
+	}
+}
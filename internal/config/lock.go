@@ -0,0 +1,35 @@
+package config
+
+import "fmt"
+
+// Lock represents the configuration of veil-verify's lock subcommand, which
+// pins the helper images that veil-verify uses.
+type Lock struct {
+	// Out contains the path that the lock file is written to.
+	Out string
+
+	// NitroCLIVersion contains the version of nitro-cli to pin.  If empty, we
+	// pin the latest version.
+	NitroCLIVersion string
+
+	// Arch contains the CPU architecture that the enclave runs on, i.e.,
+	// `ArchAMD64` (the default) or `ArchARM64`.  We resolve the latest
+	// version of nitro-cli for this architecture.
+	Arch string
+
+	// Verbose prints extra information if set to true.
+	Verbose bool
+}
+
+func (c *Lock) Validate() map[string]string {
+	problems := make(map[string]string)
+
+	if c.Out == "" {
+		problems["-out"] = "argument is required"
+	}
+	if !validArch(c.Arch) {
+		problems["-arch"] = fmt.Sprintf("architecture must be %q or %q", ArchAMD64, ArchARM64)
+	}
+
+	return problems
+}
@@ -0,0 +1,101 @@
+package config
+
+import (
+	"fmt"
+	"os"
+)
+
+// SignManifest represents the configuration of veil-verify's sign-manifest
+// subcommand.
+type SignManifest struct {
+	// Key contains the path to the PEM-encoded Ed25519 or ECDSA private key
+	// that signs the manifest.
+	Key string
+
+	// PCRs contains the path to a file with JSON-encoded measurements, as
+	// printed by nitro-cli.
+	PCRs string
+
+	// EIF contains the path to an enclave image file whose PCR values we
+	// compute.  This is an alternative to `PCRs`.
+	EIF string
+
+	// Arch contains the CPU architecture that the enclave image targets, i.e.,
+	// `ArchAMD64` or `ArchARM64`.  If empty, we use the enclave image file's
+	// architecture or `ArchAMD64`.
+	Arch string
+
+	// Commit contains the source code commit that the enclave image was
+	// built from.
+	Commit string
+
+	// Dockerfile contains the path (relative to the repository's root) of the
+	// Dockerfile that the enclave image was built from.
+	Dockerfile string
+
+	// Out contains the path that the signed manifest is written to.  If
+	// empty, the signed manifest is written to stdout.
+	Out string
+}
+
+func (c *SignManifest) Validate() map[string]string {
+	problems := make(map[string]string)
+
+	if c.Key == "" {
+		problems["-key"] = "argument is required"
+	} else if _, err := os.Stat(c.Key); err != nil {
+		problems["-key"] = fmt.Sprintf("given key %q does not exist", c.Key)
+	}
+	if c.Commit == "" {
+		problems["-commit"] = "argument is required"
+	}
+	if !validArch(c.Arch) {
+		problems["-arch"] = fmt.Sprintf("architecture must be %q or %q", ArchAMD64, ArchARM64)
+	}
+
+	// We need exactly one source of PCR values.
+	switch {
+	case c.PCRs == "" && c.EIF == "":
+		problems["-pcrs"] = "either -pcrs or -eif is required"
+	case c.PCRs != "" && c.EIF != "":
+		problems["-pcrs"] = "argument cannot be combined with -eif"
+	case c.PCRs != "":
+		if _, err := os.Stat(c.PCRs); err != nil {
+			problems["-pcrs"] = fmt.Sprintf("given measurements %q do not exist", c.PCRs)
+		}
+	case c.EIF != "":
+		if _, err := os.Stat(c.EIF); err != nil {
+			problems["-eif"] = fmt.Sprintf("given EIF %q does not exist", c.EIF)
+		}
+	}
+
+	return problems
+}
+
+// VerifyManifest represents the configuration of veil-verify's
+// verify-manifest subcommand.
+type VerifyManifest struct {
+	// PublicKey contains the path to the PEM-encoded public key that we
+	// trust to sign manifests.
+	PublicKey string
+
+	// Manifest contains the path to the signed manifest.
+	Manifest string
+}
+
+func (c *VerifyManifest) Validate() map[string]string {
+	problems := make(map[string]string)
+
+	if c.PublicKey == "" {
+		problems["-pubkey"] = "argument is required"
+	} else if _, err := os.Stat(c.PublicKey); err != nil {
+		problems["-pubkey"] = fmt.Sprintf("given public key %q does not exist", c.PublicKey)
+	}
+	if c.Manifest == "" {
+		problems["-manifest"] = "argument is required"
+	} else if _, err := os.Stat(c.Manifest); err != nil {
+		problems["-manifest"] = fmt.Sprintf("given manifest %q does not exist", c.Manifest)
+	}
+
+	return problems
+}
@@ -0,0 +1,102 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/Amnesic-Systems/veil/internal/types/validate"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignManifestConfig(t *testing.T) {
+	cases := []struct {
+		name     string
+		cfg      *SignManifest
+		wantErrs int
+	}{
+		{
+			name:     "missing everything",
+			cfg:      &SignManifest{},
+			wantErrs: 3,
+		},
+		{
+			name: "missing key file",
+			cfg: &SignManifest{
+				Key:    "does-not-exist.pem",
+				Commit: "abcd",
+				PCRs:   "manifest.go",
+			},
+			wantErrs: 1,
+		},
+		{
+			name: "pcrs and eif",
+			cfg: &SignManifest{
+				Key:    "manifest.go",
+				Commit: "abcd",
+				PCRs:   "manifest.go",
+				EIF:    "manifest.go",
+			},
+			wantErrs: 1,
+		},
+		{
+			name: "invalid architecture",
+			cfg: &SignManifest{
+				Key:    "manifest.go",
+				Commit: "abcd",
+				PCRs:   "manifest.go",
+				Arch:   "x86_64",
+			},
+			wantErrs: 1,
+		},
+		{
+			name: "valid",
+			cfg: &SignManifest{
+				Key:    "manifest.go",
+				Commit: "abcd",
+				EIF:    "manifest.go",
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			errs := c.cfg.Validate()
+			require.Equal(t, c.wantErrs, len(errs), validate.SprintErrs(errs))
+		})
+	}
+}
+
+func TestVerifyManifestConfig(t *testing.T) {
+	cases := []struct {
+		name     string
+		cfg      *VerifyManifest
+		wantErrs int
+	}{
+		{
+			name:     "missing everything",
+			cfg:      &VerifyManifest{},
+			wantErrs: 2,
+		},
+		{
+			name: "missing manifest file",
+			cfg: &VerifyManifest{
+				PublicKey: "manifest.go",
+				Manifest:  "does-not-exist.json",
+			},
+			wantErrs: 1,
+		},
+		{
+			name: "valid",
+			cfg: &VerifyManifest{
+				PublicKey: "manifest.go",
+				Manifest:  "manifest.go",
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			errs := c.cfg.Validate()
+			require.Equal(t, c.wantErrs, len(errs), validate.SprintErrs(errs))
+		})
+	}
+}
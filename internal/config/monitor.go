@@ -0,0 +1,58 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// Monitor represents the configuration of veil-verify's monitor subcommand,
+// which continuously attests one or more enclaves.
+type Monitor struct {
+	// VeilVerify determines how we obtain the PCR values that we expect the
+	// enclaves to have, and how we verify their attestation documents.  Its
+	// `Addr` field is ignored in favor of `Addrs`.
+	VeilVerify
+
+	// Addrs contains the addresses of the enclaves to monitor.
+	Addrs []string
+
+	// Interval determines how often we attest each enclave.
+	Interval time.Duration
+
+	// Listen contains the address that we serve Prometheus metrics on, e.g.:
+	//	127.0.0.1:9090
+	Listen string
+
+	// Webhook contains a URL that we send a JSON-encoded event to whenever
+	// an enclave's state changes.
+	Webhook string
+
+	// Exec contains a command that we run via "sh -c" whenever an enclave's
+	// state changes.  The command receives the JSON-encoded event on stdin.
+	Exec string
+}
+
+func (c *Monitor) Validate() map[string]string {
+	problems := c.VeilVerify.Validate()
+
+	if len(c.Addrs) == 0 {
+		problems["-addr"] = "at least one address is required"
+	}
+	for _, addr := range c.Addrs {
+		if u, err := url.Parse(addr); err != nil || u.Host == "" {
+			problems["-addr"] = fmt.Sprintf("invalid address %q", addr)
+		}
+	}
+	if c.Interval < time.Second {
+		problems["-interval"] = "interval must be at least one second"
+	}
+	if c.Webhook != "" {
+		if u, err := url.Parse(c.Webhook); err != nil ||
+			(u.Scheme != "http" && u.Scheme != "https") {
+			problems["-webhook"] = fmt.Sprintf("invalid webhook URL %q", c.Webhook)
+		}
+	}
+
+	return problems
+}
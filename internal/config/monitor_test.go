@@ -0,0 +1,66 @@
+package config
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Amnesic-Systems/veil/internal/types/validate"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMonitorConfig(t *testing.T) {
+	verify := VeilVerify{
+		Addr: "https://a.example.com,https://b.example.com",
+		PCRs: "monitor.go",
+	}
+
+	cases := []struct {
+		name     string
+		cfg      *Monitor
+		wantErrs int
+	}{
+		{
+			name: "valid",
+			cfg: &Monitor{
+				VeilVerify: verify,
+				Addrs:      []string{"https://a.example.com", "https://b.example.com"},
+				Interval:   time.Minute,
+				Webhook:    "https://hooks.example.com",
+			},
+		},
+		{
+			name: "no addresses",
+			cfg: &Monitor{
+				VeilVerify: verify,
+				Interval:   time.Minute,
+			},
+			wantErrs: 1,
+		},
+		{
+			name: "short interval and bad webhook",
+			cfg: &Monitor{
+				VeilVerify: verify,
+				Addrs:      []string{"https://a.example.com"},
+				Interval:   time.Millisecond,
+				Webhook:    "ftp://hooks.example.com",
+			},
+			wantErrs: 2,
+		},
+		{
+			name: "missing expectations",
+			cfg: &Monitor{
+				VeilVerify: VeilVerify{Addr: "https://a.example.com"},
+				Addrs:      []string{"https://a.example.com"},
+				Interval:   time.Minute,
+			},
+			wantErrs: 2,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			errs := c.cfg.Validate()
+			require.Equal(t, c.wantErrs, len(errs), validate.SprintErrs(errs))
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path"
+)
+
+// Reproduce represents the configuration of veil-verify's reproduce
+// subcommand, which builds the enclave image twice and compares the builds.
+type Reproduce struct {
+	// Dir contains the (relative or absolute) directory of the software
+	// repository containing the enclave application.
+	Dir string
+
+	// Dockerfile contains the path (relative to `Dir`) of the Dockerfile that's
+	// used to build the enclave application.
+	Dockerfile string
+
+	// Arch contains the CPU architecture that the enclave runs on, i.e.,
+	// `ArchAMD64` (the default) or `ArchARM64`.
+	Arch string
+
+	// Builder determines the backend that reproducibly builds the enclave
+	// image, i.e., `BuilderKaniko` or `BuilderBuildKit`.
+	Builder string
+
+	// Lock contains the path to a lock file that pins the helper images that
+	// we use to build the enclave image by digest.  If empty, we use the
+	// images' tags.
+	Lock string
+
+	// Offline forbids network access.  We then load the builder's image from
+	// the tarball in `BuilderImage` instead of pulling it, and the builder has
+	// no network access.
+	Offline bool
+
+	// BuilderImage contains the path to a tarball of the builder's image, as
+	// created by `docker save`.  If set, we load the image instead of pulling
+	// it.
+	BuilderImage string
+
+	// Reference contains the path to an image tarball that we compare our
+	// builds to, e.g., the image that the enclave's PCR values were computed
+	// from.  If empty, we only compare our builds to each other.
+	Reference string
+
+	// Verbose prints extra information if set to true.
+	Verbose bool
+}
+
+func (c *Reproduce) Validate() map[string]string {
+	problems := make(map[string]string)
+
+	if c.Dir == "" {
+		problems["-dir"] = "argument is required"
+	}
+	p := path.Join(c.Dir, c.Dockerfile)
+	if _, err := os.Stat(p); err != nil {
+		problems["-dockerfile"] = fmt.Sprintf("given Dockerfile %q does not exist", p)
+	}
+	if !validArch(c.Arch) {
+		problems["-arch"] = fmt.Sprintf("architecture must be %q or %q", ArchAMD64, ArchARM64)
+	}
+	if c.Builder != "" && c.Builder != BuilderKaniko && c.Builder != BuilderBuildKit {
+		problems["-builder"] = fmt.Sprintf("builder must be %q or %q", BuilderKaniko, BuilderBuildKit)
+	}
+	if c.Lock != "" {
+		if _, err := os.Stat(c.Lock); err != nil {
+			problems["-lock"] = fmt.Sprintf("given lock file %q does not exist", c.Lock)
+		}
+	}
+	if c.BuilderImage != "" {
+		if _, err := os.Stat(c.BuilderImage); err != nil {
+			problems["-builder-image"] = fmt.Sprintf("given builder image %q does not exist", c.BuilderImage)
+		}
+	} else if c.Offline {
+		problems["-builder-image"] = "argument is required for -offline"
+	}
+	if c.Reference != "" {
+		if _, err := os.Stat(c.Reference); err != nil {
+			problems["-reference"] = fmt.Sprintf("given reference image %q does not exist", c.Reference)
+		}
+	}
+
+	return problems
+}
@@ -0,0 +1,48 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/Amnesic-Systems/veil/internal/types/validate"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReproduceConfig(t *testing.T) {
+	cases := []struct {
+		name     string
+		cfg      *Reproduce
+		wantErrs int
+	}{
+		{
+			name:     "missing directory",
+			cfg:      &Reproduce{Dockerfile: "does-not-exist"},
+			wantErrs: 2,
+		},
+		{
+			name:     "invalid builder and missing reference",
+			cfg:      &Reproduce{Dir: ".", Dockerfile: "reproduce.go", Builder: "docker", Reference: "does-not-exist.tar"},
+			wantErrs: 2,
+		},
+		{
+			name:     "offline without builder image",
+			cfg:      &Reproduce{Dir: ".", Dockerfile: "reproduce.go", Offline: true},
+			wantErrs: 1,
+		},
+		{
+			name: "valid",
+			cfg: &Reproduce{
+				Dir:        ".",
+				Dockerfile: "reproduce.go",
+				Builder:    BuilderBuildKit,
+				Reference:  "reproduce.go",
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			errs := c.cfg.Validate()
+			require.Equal(t, c.wantErrs, len(errs), validate.SprintErrs(errs))
+		})
+	}
+}
@@ -1,11 +1,43 @@
 package config
 
 import (
+	"fmt"
+	"maps"
+	"net"
 	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Amnesic-Systems/veil/internal/httpx"
 )
 
 // Veil represents veil's configuration.
 type Veil struct {
+	// ACMEDirectory can be set to the URL of an ACME server's directory, e.g.,
+	// "https://acme-v02.api.letsencrypt.org/directory".  If set, veil
+	// obtains a certificate for FQDN from the ACME server instead of using a
+	// self-signed certificate.  Veil generates the certificate's key inside
+	// the enclave, solves the TLS-ALPN-01 challenge on the external Web
+	// server, and renews the certificate automatically.  Until the first
+	// certificate is issued, veil serves a self-signed certificate.
+	ACMEDirectory string
+
+	// ACMEEmail can be set to the contact email address of veil's ACME
+	// account.
+	ACMEEmail string
+
+	// ACMERoots can be set to a PEM file containing the root certificates
+	// that veil trusts when talking to the ACME server, instead of the
+	// system's root certificates.  This is useful for testing against a
+	// local ACME server like Pebble.
+	ACMERoots string
+
+	// AltFQDNs contains additional fully qualified domain names that the
+	// external Web server serves, e.g., "api.example.com".  Unless
+	// CertPerHost is set, the names share FQDN's certificate.
+	AltFQDNs []string
+
 	// AppCmd can be set to the command that starts the enclave application.
 	// For example:
 	//
@@ -24,6 +56,25 @@ type Veil struct {
 	// applications can ignore this.
 	AppWebSrv *url.URL
 
+	// CertOverlap determines how long veil keeps attesting the previous TLS
+	// certificate's hash after rotating the certificate.  Clients that pinned
+	// the previous certificate can therefore re-pin without downtime.
+	CertOverlap time.Duration
+
+	// CertPerHost can be set to serve a separate certificate for each of
+	// AltFQDNs instead of one certificate for all names.  Veil picks the
+	// certificate based on the name that the client asks for via SNI, and
+	// falls back to FQDN's certificate.
+	CertPerHost bool
+
+	// CertRotation determines how often veil rotates the external Web
+	// server's TLS key and self-signed certificate, e.g., every 30 days.  It
+	// must be shorter than the certificate's validity of one year.  If zero,
+	// veil never rotates the certificate, unless RA-TLS is enabled, in which
+	// case veil rotates the certificate at least hourly.  Certificates from
+	// an ACME server are renewed on the ACME server's schedule instead.
+	CertRotation time.Duration
+
 	// Debug can be set to true to see debug messages, i.e., if you are
 	// starting the enclave in debug mode by running:
 	//
@@ -41,6 +92,12 @@ type Veil struct {
 	// attestation.
 	EnclaveCodeURI string
 
+	// EnclaveCodeRev contains the revision (i.e., a commit or tag) of
+	// EnclaveCodeURI that the enclave image was built from, e.g., "v1.2.0".
+	// veil-verify uses the URI and revision to check out and reproduce the
+	// enclave image.
+	EnclaveCodeRev string
+
 	// ExtPort contains the TCP port that the public Web server should
 	// listen on, e.g. 443.  This port is not *directly* reachable by the
 	// Internet but the EC2 host's proxy *does* forward Internet traffic to
@@ -52,6 +109,10 @@ type Veil struct {
 	// is required.
 	FQDN string
 
+	// IPSANs contains IP addresses to add to FQDN's certificate, for
+	// deployments that clients reach without DNS.
+	IPSANs []net.IP
+
 	// IntPort contains the TCP port that the internal Web server should listen
 	// on, e.g., 8080.  This port is only reachable from within the enclave and
 	// is only used by the enclave application.  This field is required.
@@ -61,6 +122,13 @@ type Veil struct {
 	// If nil, veil leaves this option out of resolv.conf.
 	NDots *int
 
+	// RATLS can be set to embed an attestation document in the external Web
+	// server's TLS certificate, so that clients can verify the enclave during
+	// the TLS handshake.  The attestation document attests to the
+	// certificate's public key.  Veil re-issues the certificate hourly to
+	// keep the embedded attestation document verifiable.
+	RATLS bool
+
 	// Resolver contains the IP address of the DNS resolver that the enclave
 	// should use, e.g., 1.1.1.1.
 	Resolver string
@@ -82,6 +150,14 @@ type Veil struct {
 	// on the EC2 host.
 	VSOCKPort uint32
 
+	// VirtualHosts maps host names to the enclave-internal Web servers that
+	// veil forwards their requests to, e.g., "api.example.com" to
+	// "http://127.0.0.1:8081".  Veil picks the Web server based on the name
+	// that the client asks for via SNI, and falls back to AppWebSrv.  Host
+	// names must be FQDN or one of AltFQDNs, so that veil's certificates
+	// cover them.
+	VirtualHosts map[string]*url.URL
+
 	// WaitForApp instructs veil to wait for the application's signal
 	// before launching the Internet-facing Web server.  Set this flag if your
 	// application takes a while to bootstrap and you don't want to risk
@@ -110,6 +186,12 @@ func (c *Veil) Validate() map[string]string {
 	if c.VSOCKPort == 0 {
 		problems["-vsock-port"] = "port must not be 0"
 	}
+	if c.CertRotation < 0 || c.CertRotation >= httpx.CertValidity {
+		problems["-cert-rotation"] = "must be between 0 and the certificate's validity of one year"
+	}
+	if c.CertOverlap < 0 || (c.CertRotation > 0 && c.CertOverlap > c.CertRotation) {
+		problems["-cert-overlap"] = "must be between 0 and -cert-rotation"
+	}
 	if c.NDots != nil && (*c.NDots < 0 || *c.NDots > 15) {
 		problems["-dns-ndots"] = "must be between 0 and 15"
 	}
@@ -118,6 +200,44 @@ func (c *Veil) Validate() map[string]string {
 	if c.SilenceApp && c.AppCmd == "" {
 		problems["-silence-app"] = "requires -app-cmd to be set"
 	}
+	if c.ACMEDirectory != "" {
+		if !strings.HasPrefix(c.ACMEDirectory, "https://") {
+			problems["-acme-directory"] = "must be an https URL"
+		}
+		if c.FQDN == "" {
+			problems["-fqdn"] = "required by -acme-directory"
+		}
+		if c.RATLS {
+			problems["-ra-tls"] = "cannot be used with -acme-directory"
+		}
+	}
+	if len(c.IPSANs) > 0 && c.ACMEDirectory != "" {
+		problems["-ip-sans"] = "cannot be used with -acme-directory"
+	}
+	if len(c.AltFQDNs) > 0 && c.FQDN == "" {
+		problems["-alt-fqdns"] = "requires -fqdn to be set"
+	}
+	if c.CertPerHost && len(c.AltFQDNs) == 0 {
+		problems["-cert-per-host"] = "requires -alt-fqdns to be set"
+	}
+	if len(c.VirtualHosts) > 0 && c.FQDN == "" {
+		problems["-vhosts"] = "requires -fqdn to be set"
+	}
+	// Clients can only reach a virtual host if one of our certificates
+	// contains its name as SAN.
+	for _, host := range slices.Sorted(maps.Keys(c.VirtualHosts)) {
+		isServed := func(name string) bool { return strings.EqualFold(name, host) }
+		if c.FQDN != "" && !isServed(c.FQDN) && !slices.ContainsFunc(c.AltFQDNs, isServed) {
+			problems["-vhosts"] = fmt.Sprintf("host name %q must be set in -fqdn or -alt-fqdns", host)
+			break
+		}
+	}
+	if c.ACMEEmail != "" && c.ACMEDirectory == "" {
+		problems["-acme-email"] = "requires -acme-directory to be set"
+	}
+	if c.ACMERoots != "" && c.ACMEDirectory == "" {
+		problems["-acme-roots"] = "requires -acme-directory to be set"
+	}
 
 	return problems
 }
@@ -1,12 +1,17 @@
 package config
 
 import (
+	"net"
+	"net/url"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 
 	"github.com/Amnesic-Systems/veil/internal/addr"
+	"github.com/Amnesic-Systems/veil/internal/httpx"
 	"github.com/Amnesic-Systems/veil/internal/types/validate"
+	"github.com/Amnesic-Systems/veil/internal/util/must"
 )
 
 func TestVeilConfig(t *testing.T) {
@@ -58,6 +63,138 @@ func TestVeilConfig(t *testing.T) {
 			},
 			wantErrs: 1,
 		},
+		{
+			name: "valid certificate rotation",
+			cfg: &Veil{
+				CertRotation: 30 * 24 * time.Hour,
+				CertOverlap:  time.Hour,
+				ExtPort:      8443,
+				IntPort:      8080,
+				VSOCKPort:    1024,
+			},
+		},
+		{
+			name: "invalid certificate rotation",
+			cfg: &Veil{
+				CertRotation: 2 * httpx.CertValidity,
+				CertOverlap:  -time.Hour,
+				ExtPort:      8443,
+				IntPort:      8080,
+				VSOCKPort:    1024,
+			},
+			wantErrs: 2,
+		},
+		{
+			name: "overlap exceeds rotation",
+			cfg: &Veil{
+				CertRotation: time.Hour,
+				CertOverlap:  2 * time.Hour,
+				ExtPort:      8443,
+				IntPort:      8080,
+				VSOCKPort:    1024,
+			},
+			wantErrs: 1,
+		},
+		{
+			name: "valid virtual hosts",
+			cfg: &Veil{
+				FQDN:        "example.com",
+				AltFQDNs:    []string{"api.example.com"},
+				CertPerHost: true,
+				IPSANs:      []net.IP{net.ParseIP("192.0.2.1")},
+				VirtualHosts: map[string]*url.URL{
+					"example.com":     must.Get(url.Parse("http://127.0.0.1:8081")),
+					"api.example.com": must.Get(url.Parse("http://127.0.0.1:8082")),
+				},
+				ExtPort:   8443,
+				IntPort:   8080,
+				VSOCKPort: 1024,
+			},
+		},
+		{
+			name: "invalid virtual hosts",
+			cfg: &Veil{
+				ACMEDirectory: "https://acme.example.com/directory",
+				FQDN:          "example.com",
+				CertPerHost:   true,
+				IPSANs:        []net.IP{net.ParseIP("192.0.2.1")},
+				VirtualHosts: map[string]*url.URL{
+					"www.example.com": must.Get(url.Parse("http://127.0.0.1:8081")),
+				},
+				ExtPort:   8443,
+				IntPort:   8080,
+				VSOCKPort: 1024,
+			},
+			wantErrs: 3,
+		},
+		{
+			name: "virtual hosts without FQDN",
+			cfg: &Veil{
+				VirtualHosts: map[string]*url.URL{
+					"example.com": must.Get(url.Parse("http://127.0.0.1:8081")),
+				},
+				ExtPort:   8443,
+				IntPort:   8080,
+				VSOCKPort: 1024,
+			},
+			wantErrs: 1,
+		},
+		{
+			name: "virtual host with different case",
+			cfg: &Veil{
+				FQDN:     "example.com",
+				AltFQDNs: []string{"api.example.com"},
+				VirtualHosts: map[string]*url.URL{
+					"API.example.com": must.Get(url.Parse("http://127.0.0.1:8082")),
+				},
+				ExtPort:   8443,
+				IntPort:   8080,
+				VSOCKPort: 1024,
+			},
+		},
+		{
+			name: "alternative names without FQDN",
+			cfg: &Veil{
+				AltFQDNs:  []string{"api.example.com"},
+				ExtPort:   8443,
+				IntPort:   8080,
+				VSOCKPort: 1024,
+			},
+			wantErrs: 1,
+		},
+		{
+			name: "valid ACME config",
+			cfg: &Veil{
+				ACMEDirectory: "https://acme.example.com/directory",
+				ACMEEmail:     "admin@example.com",
+				FQDN:          "example.com",
+				ExtPort:       8443,
+				IntPort:       8080,
+				VSOCKPort:     1024,
+			},
+		},
+		{
+			name: "invalid ACME config",
+			cfg: &Veil{
+				ACMEDirectory: "http://acme.example.com/directory",
+				RATLS:         true,
+				ExtPort:       8443,
+				IntPort:       8080,
+				VSOCKPort:     1024,
+			},
+			wantErrs: 3,
+		},
+		{
+			name: "ACME options without directory",
+			cfg: &Veil{
+				ACMEEmail: "admin@example.com",
+				ACMERoots: "roots.pem",
+				ExtPort:   8443,
+				IntPort:   8080,
+				VSOCKPort: 1024,
+			},
+			wantErrs: 2,
+		},
 	}
 
 	for _, c := range cases {
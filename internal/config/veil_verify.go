@@ -6,12 +6,42 @@ import (
 	"path"
 )
 
+// The output formats that veil-verify supports.
+const (
+	OutputText = "text"
+	OutputJSON = "json"
+)
+
+// The backends that veil-verify can reproducibly build enclave images with.
+const (
+	BuilderKaniko   = "kaniko"
+	BuilderBuildKit = "buildkit"
+)
+
+// The CPU architectures that Nitro Enclaves run on.
+const (
+	ArchAMD64 = "amd64"
+	ArchARM64 = "arm64"
+)
+
+// validArch returns true if the given architecture is empty (which means
+// `ArchAMD64`) or one that Nitro Enclaves run on.
+func validArch(arch string) bool {
+	return arch == "" || arch == ArchAMD64 || arch == ArchARM64
+}
+
 // VeilVerify represents veil-verify's configuration.
 type VeilVerify struct {
 	// Addr contains the enclave's address, e.g.:
 	//	https://enclave.example.com
+	// Addr may also contain a comma-separated list of addresses, in which case
+	// we verify all of them.
 	Addr string
 
+	// Resolve can be set to true to verify every IP address that the
+	// address's host name resolves to.
+	Resolve bool
+
 	// Dir contains the (relative or absolute) directory of the software
 	// repository containing the enclave application.
 	Dir string
@@ -20,6 +50,98 @@ type VeilVerify struct {
 	// used to build the enclave application.
 	Dockerfile string
 
+	// EIF contains the path to an enclave image file.  If set, we compute the
+	// expected PCR values from the given file instead of building the enclave
+	// image from the source code in `Dir`.
+	EIF string
+
+	// Arch contains the CPU architecture that the enclave runs on, i.e.,
+	// `ArchAMD64` (the default) or `ArchARM64`.
+	Arch string
+
+	// Builder determines the backend that reproducibly builds the enclave
+	// image, i.e., `BuilderKaniko` or `BuilderBuildKit`.
+	Builder string
+
+	// CacheDir contains the path to the directory that caches the results of
+	// reproducible builds.  If empty, we use veil-verify's directory in the
+	// user's cache directory.
+	CacheDir string
+
+	// NoCache forces a reproducible build even if the build cache contains
+	// its result.
+	NoCache bool
+
+	// Lock contains the path to a lock file that pins the helper images that
+	// we use to reproduce the enclave image by digest.  If empty, we use the
+	// images' tags.
+	Lock string
+
+	// Offline forbids network access for everything but attestation.  We
+	// then load the builder and compiler images from the tarballs in
+	// `BuilderImage` and `CompilerImage` instead of pulling and building them,
+	// and the builder has no network access, so the build context must be
+	// self-contained.
+	Offline bool
+
+	// BuilderImage contains the path to a tarball of the builder's image, as
+	// created by `docker save`.  If set, we load the image instead of pulling
+	// it.
+	BuilderImage string
+
+	// CompilerImage contains the path to a tarball of the compiler image that
+	// contains nitro-cli, as created by `docker save`.  If set, we load the
+	// image instead of building it.
+	CompilerImage string
+
+	// PCRs contains the path to a file with JSON-encoded measurements, as
+	// published for each release.  If set, we check the enclave against these
+	// PCR values instead of building the enclave image ourselves.
+	PCRs string
+
+	// Manifest contains the path to a signed release manifest.  If set, we
+	// check the enclave against the manifest's PCR values instead of building
+	// the enclave image ourselves.  This requires `PublicKey` to be set.
+	Manifest string
+
+	// PublicKey contains the path to the PEM-encoded public key that we trust
+	// to sign manifests.
+	PublicKey string
+
+	// Policy contains the path to a JSON-encoded PCR policy, which determines
+	// the PCR values that we accept.  If we also build the enclave image
+	// ourselves, the resulting PCR values are added to the policy's allowed
+	// sets.
+	Policy string
+
+	// Checkout instructs us to clone the source code revision that the
+	// enclave advertises in its attested configuration and to build it,
+	// instead of building the source code in `Dir`.
+	Checkout bool
+
+	// CheckConfig instructs us to fetch the enclave's attested runtime
+	// configuration and verify that it belongs to the attested enclave.
+	CheckConfig bool
+
+	// ConfigPolicy contains the path to a JSON object that maps the names of
+	// the enclave's configuration fields to the values that they must have,
+	// e.g.:
+	//
+	//	{"Debug": false, "EnclaveCodeURI": "https://github.com/foo/bar"}
+	//
+	// Setting ConfigPolicy implies CheckConfig.
+	ConfigPolicy string
+
+	// Roots contains the path to a PEM file with root certificates that
+	// attestation documents must chain up to.  If empty, we use AWS's Nitro
+	// Enclaves root certificate.  This is only useful for testing, e.g., with
+	// the emulator attester.
+	Roots string
+
+	// Output determines veil-verify's output format, i.e., `OutputText` or
+	// `OutputJSON`.
+	Output string
+
 	// Verbose prints extra information if set to true.
 	Verbose bool
 
@@ -35,6 +157,102 @@ func (c *VeilVerify) Validate() map[string]string {
 	if c.Addr == "" {
 		problems["-addr"] = "argument is required"
 	}
+	if c.Output != "" && c.Output != OutputText && c.Output != OutputJSON {
+		problems["-output"] = fmt.Sprintf("output must be %q or %q", OutputText, OutputJSON)
+	}
+	if !validArch(c.Arch) {
+		problems["-arch"] = fmt.Sprintf("architecture must be %q or %q", ArchAMD64, ArchARM64)
+	}
+	if c.Builder != "" && c.Builder != BuilderKaniko && c.Builder != BuilderBuildKit {
+		problems["-builder"] = fmt.Sprintf("builder must be %q or %q", BuilderKaniko, BuilderBuildKit)
+	}
+	if c.BuilderImage != "" {
+		if _, err := os.Stat(c.BuilderImage); err != nil {
+			problems["-builder-image"] = fmt.Sprintf("given builder image %q does not exist", c.BuilderImage)
+		}
+	}
+	if c.CompilerImage != "" {
+		if _, err := os.Stat(c.CompilerImage); err != nil {
+			problems["-compiler-image"] = fmt.Sprintf("given compiler image %q does not exist", c.CompilerImage)
+		}
+	}
+	if c.Lock != "" {
+		if _, err := os.Stat(c.Lock); err != nil {
+			problems["-lock"] = fmt.Sprintf("given lock file %q does not exist", c.Lock)
+		}
+	}
+	if c.ConfigPolicy != "" {
+		if _, err := os.Stat(c.ConfigPolicy); err != nil {
+			problems["-config-policy"] = fmt.Sprintf("given config policy %q does not exist", c.ConfigPolicy)
+		}
+	}
+
+	if c.Policy != "" {
+		if _, err := os.Stat(c.Policy); err != nil {
+			problems["-policy"] = fmt.Sprintf("given policy %q does not exist", c.Policy)
+		}
+		// A policy may be all we need to verify the enclave.
+		if c.Dir == "" && c.EIF == "" && c.PCRs == "" && c.Manifest == "" && !c.Checkout {
+			return problems
+		}
+	}
+
+	if c.Checkout && (c.Dir != "" || c.EIF != "" || c.PCRs != "" || c.Manifest != "") {
+		problems["-checkout"] = "argument cannot be combined with -dir, -eif, -pcrs, or -manifest"
+	}
+
+	// We don't need to build the enclave image if we're given a signed
+	// manifest.
+	if c.Manifest != "" {
+		if _, err := os.Stat(c.Manifest); err != nil {
+			problems["-manifest"] = fmt.Sprintf("given manifest %q does not exist", c.Manifest)
+		}
+		if c.PublicKey == "" {
+			problems["-pubkey"] = "argument is required for -manifest"
+		} else if _, err := os.Stat(c.PublicKey); err != nil {
+			problems["-pubkey"] = fmt.Sprintf("given public key %q does not exist", c.PublicKey)
+		}
+		if c.EIF != "" || c.PCRs != "" {
+			problems["-manifest"] = "argument cannot be combined with -eif or -pcrs"
+		}
+		return problems
+	}
+
+	// We don't need to build the enclave image if we're given the expected
+	// measurements.
+	if c.PCRs != "" {
+		if _, err := os.Stat(c.PCRs); err != nil {
+			problems["-pcrs"] = fmt.Sprintf("given measurements %q do not exist", c.PCRs)
+		}
+		if c.EIF != "" {
+			problems["-pcrs"] = "argument cannot be combined with -eif"
+		}
+		return problems
+	}
+
+	// We don't need to build the enclave image if we're given an enclave
+	// image file.
+	if c.EIF != "" {
+		if _, err := os.Stat(c.EIF); err != nil {
+			problems["-eif"] = fmt.Sprintf("given EIF %q does not exist", c.EIF)
+		}
+		return problems
+	}
+	if c.Offline {
+		if c.Checkout {
+			problems["-checkout"] = "argument cannot be combined with -offline"
+		}
+		if c.BuilderImage == "" {
+			problems["-builder-image"] = "argument is required for -offline"
+		}
+		if c.CompilerImage == "" {
+			problems["-compiler-image"] = "argument is required for -offline"
+		}
+	}
+	// The source code doesn't exist yet if we're supposed to check it out.
+	if c.Checkout {
+		return problems
+	}
 	if c.Dir == "" {
 		problems["-dir"] = "argument is required"
 	}
@@ -36,6 +36,162 @@ func TestVeilVerifyConfig(t *testing.T) {
 			},
 			wantErrs: 1,
 		},
+		{
+			name: "invalid output",
+			cfg: &VeilVerify{
+				Addr:   "https://example.com",
+				EIF:    "veil_verify.go",
+				Output: "yaml",
+			},
+			wantErrs: 1,
+		},
+		{
+			name: "missing eif",
+			cfg: &VeilVerify{
+				Addr: "https://example.com",
+				EIF:  "does-not-exist.eif",
+			},
+			wantErrs: 1,
+		},
+		{
+			name: "eif instead of dir",
+			cfg: &VeilVerify{
+				Addr: "https://example.com",
+				EIF:  "veil_verify.go",
+			},
+		},
+		{
+			name: "pcrs instead of dir",
+			cfg: &VeilVerify{
+				Addr: "https://example.com",
+				PCRs: "veil_verify.go",
+			},
+		},
+		{
+			name: "pcrs and eif",
+			cfg: &VeilVerify{
+				Addr: "https://example.com",
+				PCRs: "veil_verify.go",
+				EIF:  "veil_verify.go",
+			},
+			wantErrs: 1,
+		},
+		{
+			name: "manifest instead of dir",
+			cfg: &VeilVerify{
+				Addr:      "https://example.com",
+				Manifest:  "veil_verify.go",
+				PublicKey: "veil_verify.go",
+			},
+		},
+		{
+			name: "manifest without public key",
+			cfg: &VeilVerify{
+				Addr:     "https://example.com",
+				Manifest: "veil_verify.go",
+			},
+			wantErrs: 1,
+		},
+		{
+			name: "policy instead of dir",
+			cfg: &VeilVerify{
+				Addr:   "https://example.com",
+				Policy: "veil_verify.go",
+			},
+		},
+		{
+			name: "missing config policy",
+			cfg: &VeilVerify{
+				Addr:         "https://example.com",
+				EIF:          "veil_verify.go",
+				ConfigPolicy: "does-not-exist.json",
+			},
+			wantErrs: 1,
+		},
+		{
+			name: "missing policy",
+			cfg: &VeilVerify{
+				Addr:   "https://example.com",
+				Policy: "does-not-exist.json",
+			},
+			wantErrs: 1,
+		},
+		{
+			name: "checkout instead of dir",
+			cfg: &VeilVerify{
+				Addr:       "https://example.com",
+				Checkout:   true,
+				Dockerfile: "Dockerfile",
+			},
+		},
+		{
+			name: "checkout and eif",
+			cfg: &VeilVerify{
+				Addr:     "https://example.com",
+				Checkout: true,
+				EIF:      "veil_verify.go",
+			},
+			wantErrs: 1,
+		},
+		{
+			name: "invalid builder",
+			cfg: &VeilVerify{
+				Addr:    "https://example.com",
+				EIF:     "veil_verify.go",
+				Builder: "docker",
+			},
+			wantErrs: 1,
+		},
+		{
+			name: "arm64",
+			cfg: &VeilVerify{
+				Addr:       "https://example.com",
+				Dir:        ".",
+				Dockerfile: "veil_verify.go",
+				Arch:       ArchARM64,
+			},
+		},
+		{
+			name: "invalid architecture",
+			cfg: &VeilVerify{
+				Addr:       "https://example.com",
+				Dir:        ".",
+				Dockerfile: "veil_verify.go",
+				Arch:       "x86_64",
+			},
+			wantErrs: 1,
+		},
+		{
+			name: "missing lock file",
+			cfg: &VeilVerify{
+				Addr:       "https://example.com",
+				Dir:        ".",
+				Dockerfile: "veil_verify.go",
+				Lock:       "does-not-exist.lock",
+			},
+			wantErrs: 1,
+		},
+		{
+			name: "offline without images",
+			cfg: &VeilVerify{
+				Addr:       "https://example.com",
+				Dir:        ".",
+				Dockerfile: "veil_verify.go",
+				Offline:    true,
+			},
+			wantErrs: 2,
+		},
+		{
+			name: "offline checkout and missing compiler image",
+			cfg: &VeilVerify{
+				Addr:          "https://example.com",
+				Checkout:      true,
+				Offline:       true,
+				BuilderImage:  "veil_verify.go",
+				CompilerImage: "does-not-exist.tar",
+			},
+			wantErrs: 2,
+		},
 	}
 
 	for _, c := range cases {
@@ -0,0 +1,174 @@
+package eif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+
+	"github.com/Amnesic-Systems/veil/internal/enclave"
+	"github.com/Amnesic-Systems/veil/internal/errs"
+)
+
+const (
+	// The default resources that nitro-cli records in the images it builds.
+	defaultMem  = 1 << 30
+	defaultCPUs = 2
+)
+
+// Builder assembles an unsigned EIF from its parts.  The output only depends
+// on the builder's fields, i.e., identical inputs result in byte-identical
+// images.
+type Builder struct {
+	// Arch is the architecture that the image targets, i.e., "amd64" or
+	// "arm64".
+	Arch string
+	// Kernel contains the enclave's kernel image.
+	Kernel []byte
+	// Cmdline contains the kernel's command line.
+	Cmdline string
+	// Metadata contains optional JSON-encoded build metadata.  The metadata
+	// is not measured, so it does not affect the image's PCR values.
+	Metadata []byte
+	// Ramdisks contains the image's ramdisks.  The first ramdisk is the
+	// bootstrap ramdisk and all remaining ramdisks are customer ramdisks.
+	Ramdisks [][]byte
+}
+
+type section struct {
+	typ  SectionType
+	data []byte
+}
+
+// sections returns the image's sections in the order in which nitro-cli
+// writes them.
+func (b *Builder) sections() ([]section, error) {
+	if len(b.Kernel) == 0 {
+		return nil, errors.New("kernel is missing")
+	}
+	if len(b.Ramdisks) < 2 {
+		return nil, errors.New("image must contain at least two ramdisks")
+	}
+	if b.Arch != "amd64" && b.Arch != "arm64" {
+		return nil, fmt.Errorf("unsupported architecture %q", b.Arch)
+	}
+
+	s := []section{
+		{SectionKernel, b.Kernel},
+		{SectionCmdline, []byte(b.Cmdline)},
+	}
+	if len(b.Metadata) > 0 {
+		s = append(s, section{SectionMetadata, b.Metadata})
+	}
+	for _, r := range b.Ramdisks {
+		s = append(s, section{SectionRamdisk, r})
+	}
+	if len(s) > maxSections {
+		return nil, fmt.Errorf("image has more than %d sections", maxSections)
+	}
+	return s, nil
+}
+
+// WriteTo writes the image to the given writer.
+func (b *Builder) WriteTo(w io.Writer) (_ int64, err error) {
+	defer errs.Wrap(&err, "failed to write enclave image file")
+
+	sections, err := b.sections()
+	if err != nil {
+		return 0, err
+	}
+
+	h := Header{
+		Magic:       magic,
+		Version:     Version,
+		DefaultMem:  defaultMem,
+		DefaultCPUs: defaultCPUs,
+		NumSections: uint16(len(sections)),
+	}
+	if b.Arch == "arm64" {
+		h.Flags |= FlagArm64
+	}
+	rawSectionHeaders := make([][]byte, len(sections))
+	offset := uint64(headerLen)
+	for i, s := range sections {
+		var buf bytes.Buffer
+		if err := binary.Write(&buf, binary.BigEndian, &sectionHeader{
+			Type: s.typ,
+			Size: uint64(len(s.data)),
+		}); err != nil {
+			return 0, err
+		}
+		rawSectionHeaders[i] = buf.Bytes()
+		h.SectionOffsets[i] = offset
+		h.SectionSizes[i] = uint64(len(s.data))
+		offset += sectionHeaderLen + uint64(len(s.data))
+	}
+
+	// The checksum covers the header (minus the checksum itself), followed by
+	// all section headers and their data.
+	var header bytes.Buffer
+	if err := binary.Write(&header, binary.BigEndian, &h); err != nil {
+		return 0, err
+	}
+	crc := crc32.NewIEEE()
+	_, _ = crc.Write(header.Bytes()[:headerLen-4])
+	for i, s := range sections {
+		_, _ = crc.Write(rawSectionHeaders[i])
+		_, _ = crc.Write(s.data)
+	}
+	binary.BigEndian.PutUint32(header.Bytes()[headerLen-4:], crc.Sum32())
+
+	var n int64
+	write := func(b []byte) error {
+		m, err := w.Write(b)
+		n += int64(m)
+		return err
+	}
+	if err := write(header.Bytes()); err != nil {
+		return n, err
+	}
+	for i, s := range sections {
+		if err := write(rawSectionHeaders[i]); err != nil {
+			return n, err
+		}
+		if err := write(s.data); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// WriteFile writes the image to the given path.
+func (b *Builder) WriteFile(path string) (err error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	_, err = b.WriteTo(f)
+	return err
+}
+
+// PCRs computes the PCR values of the image that the builder produces.
+func (b *Builder) PCRs() (_ enclave.PCR, err error) {
+	defer errs.Wrap(&err, "failed to compute PCRs")
+
+	sections, err := b.sections()
+	if err != nil {
+		return nil, err
+	}
+	types := make([]SectionType, len(sections))
+	for i, s := range sections {
+		types[i] = s.typ
+	}
+	return measure(types, func(i int) io.Reader {
+		return bytes.NewReader(sections[i].data)
+	})
+}
@@ -0,0 +1,150 @@
+package eif
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/Amnesic-Systems/veil/internal/testutil"
+	"github.com/Amnesic-Systems/veil/internal/util/must"
+)
+
+func newTestBlobs(t *testing.T) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"bzImage": "kernel",
+		"cmdline": "console=ttyS0 reboot=k\n",
+		"init":    "init",
+		"nsm.ko":  "nsm",
+	} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600))
+	}
+	return dir
+}
+
+func newTestImageTarball(t *testing.T) string {
+	t.Helper()
+
+	config := map[string]any{
+		"architecture": "amd64",
+		"created":      "1970-01-01T00:00:00Z",
+		"config": map[string]any{
+			"Entrypoint": []string{"/bin/app"},
+			"Cmd":        []string{"-flag"},
+			"Env":        []string{"PATH=/bin"},
+		},
+	}
+	return testutil.NewImageTarball(t, config,
+		testutil.NewTar(t,
+			testutil.TarFile{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0o755},
+			testutil.TarFile{Name: "bin/app", Body: "app", Mode: 0o755},
+		),
+	)
+}
+
+func TestBuilder(t *testing.T) {
+	b, err := FromImage(newTestImageTarball(t), "", newTestBlobs(t))
+	require.NoError(t, err)
+	require.Equal(t, "console=ttyS0 reboot=k", b.Cmdline)
+
+	// The image doesn't target arm64.
+	_, err = FromImage(newTestImageTarball(t), "arm64", newTestBlobs(t))
+	require.ErrorContains(t, err, `image targets "amd64" instead of "arm64"`)
+
+	var buf bytes.Buffer
+	_, err = b.WriteTo(&buf)
+	require.NoError(t, err)
+
+	// The written image must be valid, and its PCR values must match the
+	// ones that the builder computed.
+	img, err := Parse(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	require.NoError(t, err)
+	require.NoError(t, img.VerifyCRC())
+	require.Equal(t, "amd64", img.Header.Arch())
+	require.Equal(t, uint64(defaultMem), img.Header.DefaultMem)
+
+	wantTypes := []SectionType{
+		SectionKernel,
+		SectionCmdline,
+		SectionMetadata,
+		SectionRamdisk,
+		SectionRamdisk,
+	}
+	require.Len(t, img.Sections, len(wantTypes))
+	for i, s := range img.Sections {
+		require.Equal(t, wantTypes[i], s.Type)
+	}
+
+	wantPCRs, err := b.PCRs()
+	require.NoError(t, err)
+	gotPCRs, err := img.PCRs()
+	require.NoError(t, err)
+	require.Equal(t, wantPCRs, gotPCRs)
+}
+
+func TestBuilderIsDeterministic(t *testing.T) {
+	var (
+		tarball = newTestImageTarball(t)
+		blobs   = newTestBlobs(t)
+		dir     = t.TempDir()
+	)
+	for _, name := range []string{"a.eif", "b.eif"} {
+		b, err := FromImage(tarball, "amd64", blobs)
+		require.NoError(t, err)
+		require.NoError(t, b.WriteFile(filepath.Join(dir, name)))
+	}
+	require.Equal(t,
+		must.Get(os.ReadFile(filepath.Join(dir, "a.eif"))),
+		must.Get(os.ReadFile(filepath.Join(dir, "b.eif"))),
+	)
+}
+
+func TestBuilderErrors(t *testing.T) {
+	valid := Builder{
+		Arch:     "amd64",
+		Kernel:   []byte("kernel"),
+		Ramdisks: [][]byte{[]byte("bootstrap"), []byte("customer")},
+	}
+	noKernel := valid
+	noKernel.Kernel = nil
+	oneRamdisk := valid
+	oneRamdisk.Ramdisks = valid.Ramdisks[:1]
+	badArch := valid
+	badArch.Arch = "riscv64"
+
+	for name, b := range map[string]Builder{
+		"no kernel":   noKernel,
+		"one ramdisk": oneRamdisk,
+		"bad arch":    badArch,
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := b.WriteTo(io.Discard)
+			require.Error(t, err)
+			_, err = b.PCRs()
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestRamdisk(t *testing.T) {
+	raw, err := newRamdisk(nil)
+	require.NoError(t, err)
+
+	gr, err := gzip.NewReader(bytes.NewReader(raw))
+	require.NoError(t, err)
+	archive := must.Get(io.ReadAll(gr))
+
+	// An empty archive only contains the trailer, padded to a multiple of
+	// four bytes.
+	require.Len(t, archive, 124)
+	require.True(t, bytes.HasPrefix(archive, []byte("070701")))
+	require.Contains(t, string(archive), cpioTrailer)
+}
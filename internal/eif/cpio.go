@@ -0,0 +1,133 @@
+package eif
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+)
+
+// File mode bits, as used by the cpio format.  See:
+// https://man7.org/linux/man-pages/man7/inode.7.html
+const (
+	modeDir     = 0o040000
+	modeReg     = 0o100000
+	modeSymlink = 0o120000
+	modeChar    = 0o020000
+	modeBlock   = 0o060000
+	modeFIFO    = 0o010000
+	cpioTrailer = "TRAILER!!!"
+)
+
+// cpioWriter writes cpio archives in the "newc" format, which is the format
+// that the Linux kernel expects for its initial ramdisk.  The format is
+// documented in:
+// https://www.kernel.org/doc/html/latest/driver-api/early-userspace/buffer-format.html
+//
+// The writer is deterministic: inode numbers are assigned sequentially and
+// file metadata is taken as-is from the given tar headers.
+type cpioWriter struct {
+	w   io.Writer
+	n   int64
+	ino uint32
+}
+
+func newCPIOWriter(w io.Writer) *cpioWriter {
+	return &cpioWriter{w: w}
+}
+
+func (c *cpioWriter) write(b []byte) error {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	return err
+}
+
+func (c *cpioWriter) pad() error {
+	if rem := c.n % 4; rem != 0 {
+		return c.write(make([]byte, 4-rem))
+	}
+	return nil
+}
+
+// writeFile adds a file to the archive.  For regular files, data contains the
+// file's content.  The link target of symbolic links is taken from the
+// header.
+func (c *cpioWriter) writeFile(hdr *tar.Header, data []byte) error {
+	mode := uint32(hdr.Mode) & 0o7777
+	switch hdr.Typeflag {
+	case tar.TypeReg:
+		mode |= modeReg
+	case tar.TypeDir:
+		mode |= modeDir
+		data = nil
+	case tar.TypeSymlink:
+		mode |= modeSymlink
+		data = []byte(hdr.Linkname)
+	case tar.TypeChar:
+		mode |= modeChar
+		data = nil
+	case tar.TypeBlock:
+		mode |= modeBlock
+		data = nil
+	case tar.TypeFifo:
+		mode |= modeFIFO
+		data = nil
+	default:
+		return fmt.Errorf("unsupported file type %q of %s", hdr.Typeflag, hdr.Name)
+	}
+
+	nlink := 1
+	if hdr.Typeflag == tar.TypeDir {
+		nlink = 2
+	}
+	var mtime int64
+	if !hdr.ModTime.IsZero() && hdr.ModTime.Unix() > 0 {
+		mtime = hdr.ModTime.Unix()
+	}
+
+	c.ino++
+	return c.writeEntry(hdr.Name, c.ino, mode, hdr.Uid, hdr.Gid, nlink, mtime,
+		uint32(hdr.Devmajor), uint32(hdr.Devminor), data)
+}
+
+func (c *cpioWriter) writeEntry(
+	name string,
+	ino, mode uint32,
+	uid, gid, nlink int,
+	mtime int64,
+	rdevmajor, rdevminor uint32,
+	data []byte,
+) error {
+	header := fmt.Sprintf("070701%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X",
+		ino,
+		mode,
+		uint32(uid),
+		uint32(gid),
+		uint32(nlink),
+		uint32(mtime),
+		uint32(len(data)),
+		0, // devmajor
+		0, // devminor
+		rdevmajor,
+		rdevminor,
+		uint32(len(name)+1),
+		0, // check
+	)
+	if err := c.write([]byte(header)); err != nil {
+		return err
+	}
+	if err := c.write(append([]byte(name), 0)); err != nil {
+		return err
+	}
+	if err := c.pad(); err != nil {
+		return err
+	}
+	if err := c.write(data); err != nil {
+		return err
+	}
+	return c.pad()
+}
+
+// close writes the archive's trailer.
+func (c *cpioWriter) close() error {
+	return c.writeEntry(cpioTrailer, 0, 0, 0, 0, 1, 0, 0, 0, nil)
+}
@@ -0,0 +1,224 @@
+// Package eif implements support for AWS's Enclave Image Format (EIF), which
+// is the format that Nitro Enclaves boot from.  The format is specified by the
+// reference implementation in:
+// https://github.com/aws/aws-nitro-enclaves-image-format
+package eif
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+
+	"github.com/Amnesic-Systems/veil/internal/errs"
+)
+
+const (
+	// Version is the EIF version that we support.
+	Version = 4
+	// maxSections is the maximum number of sections in an EIF.
+	maxSections = 32
+	// FlagArm64 is set in the header's flags if the image targets arm64.
+	FlagArm64 = 1 << 0
+	// The lengths of the (big-endian) binary representations of our headers.
+	headerLen        = 548
+	sectionHeaderLen = 12
+)
+
+// SectionType represents the type of an EIF section.
+type SectionType uint16
+
+const (
+	SectionInvalid SectionType = iota
+	SectionKernel
+	SectionCmdline
+	SectionRamdisk
+	SectionSignature
+	SectionMetadata
+)
+
+var (
+	magic = [4]byte{'.', 'e', 'i', 'f'}
+
+	ErrBadMagic = errors.New("not an enclave image file")
+	ErrBadCRC   = errors.New("enclave image file checksum mismatch")
+)
+
+// Header represents an EIF's header, which is at the very beginning of the
+// file.
+type Header struct {
+	Magic          [4]byte
+	Version        uint16
+	Flags          uint16
+	DefaultMem     uint64
+	DefaultCPUs    uint64
+	Reserved       uint16
+	NumSections    uint16
+	SectionOffsets [maxSections]uint64
+	SectionSizes   [maxSections]uint64
+	Unused         uint32
+	CRC32          uint32
+}
+
+// Arch returns the architecture that the image targets, i.e., "amd64" or
+// "arm64".
+func (h *Header) Arch() string {
+	if h.Flags&FlagArm64 != 0 {
+		return "arm64"
+	}
+	return "amd64"
+}
+
+// sectionHeader precedes each section in an EIF.
+type sectionHeader struct {
+	Type  SectionType
+	Flags uint16
+	Size  uint64
+}
+
+// Section represents an EIF section.  Offset points to the section's data,
+// i.e., the byte right after the section header.
+type Section struct {
+	Type   SectionType
+	Flags  uint16
+	Offset int64
+	Size   int64
+}
+
+// Image represents a parsed EIF.
+type Image struct {
+	Header   Header
+	Sections []Section
+	r        io.ReaderAt
+	closer   io.Closer
+}
+
+// Parse parses the EIF that's readable via the given reader.  The given size
+// is the size of the EIF in bytes.
+func Parse(r io.ReaderAt, size int64) (_ *Image, err error) {
+	defer errs.Wrap(&err, "failed to parse enclave image file")
+
+	img := &Image{r: r}
+	if err := binary.Read(
+		io.NewSectionReader(r, 0, headerLen),
+		binary.BigEndian,
+		&img.Header,
+	); err != nil {
+		return nil, err
+	}
+	if img.Header.Magic != magic {
+		return nil, ErrBadMagic
+	}
+	if img.Header.NumSections > maxSections {
+		return nil, fmt.Errorf("%w: too many sections (%d)",
+			errs.ErrInvalidFormat, img.Header.NumSections)
+	}
+
+	for i := range int(img.Header.NumSections) {
+		offset := int64(img.Header.SectionOffsets[i])
+		// Compare without adding to offset, which could overflow.
+		if offset < headerLen || offset > size-sectionHeaderLen {
+			return nil, fmt.Errorf("%w: section %d out of bounds",
+				errs.ErrInvalidFormat, i)
+		}
+
+		var h sectionHeader
+		if err := binary.Read(
+			io.NewSectionReader(r, offset, sectionHeaderLen),
+			binary.BigEndian,
+			&h,
+		); err != nil {
+			return nil, err
+		}
+		if h.Size != img.Header.SectionSizes[i] {
+			return nil, fmt.Errorf("%w: size mismatch for section %d",
+				errs.ErrInvalidFormat, i)
+		}
+		if h.Type == SectionInvalid || h.Type > SectionMetadata {
+			return nil, fmt.Errorf("%w: unknown type %d of section %d",
+				errs.ErrInvalidFormat, h.Type, i)
+		}
+		s := Section{
+			Type:   h.Type,
+			Flags:  h.Flags,
+			Offset: offset + sectionHeaderLen,
+			Size:   int64(h.Size),
+		}
+		if s.Size < 0 || s.Size > size-s.Offset {
+			return nil, fmt.Errorf("%w: section %d out of bounds",
+				errs.ErrInvalidFormat, i)
+		}
+		img.Sections = append(img.Sections, s)
+	}
+
+	return img, nil
+}
+
+// SectionReader returns a reader for the data of the given section.
+func (img *Image) SectionReader(s Section) *io.SectionReader {
+	return io.NewSectionReader(img.r, s.Offset, s.Size)
+}
+
+// VerifyCRC verifies the image's CRC32 checksum, which covers the header
+// (except for the checksum itself), and all section headers and data.
+func (img *Image) VerifyCRC() (err error) {
+	defer errs.Wrap(&err, "failed to verify checksum")
+
+	crc := crc32.NewIEEE()
+	if _, err := io.Copy(crc, io.NewSectionReader(img.r, 0, headerLen-4)); err != nil {
+		return err
+	}
+	for _, s := range img.Sections {
+		if _, err := io.Copy(crc, io.NewSectionReader(
+			img.r,
+			s.Offset-sectionHeaderLen,
+			s.Size+sectionHeaderLen,
+		)); err != nil {
+			return err
+		}
+	}
+	if crc.Sum32() != img.Header.CRC32 {
+		return ErrBadCRC
+	}
+	return nil
+}
+
+// Open opens, parses, and verifies the EIF at the given path.  The caller must
+// close the image once it's done with it.
+func Open(path string) (_ *Image, err error) {
+	defer errs.Wrap(&err, "failed to open enclave image file")
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			_ = f.Close()
+		}
+	}()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	img, err := Parse(f, info.Size())
+	if err != nil {
+		return nil, err
+	}
+	if err := img.VerifyCRC(); err != nil {
+		return nil, err
+	}
+	img.closer = f
+	return img, nil
+}
+
+// Close closes the file underlying the image if the image was opened via Open.
+func (img *Image) Close() error {
+	if img.closer == nil {
+		return nil
+	}
+	return img.closer.Close()
+}
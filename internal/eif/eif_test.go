@@ -0,0 +1,262 @@
+package eif
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/binary"
+	"hash/crc32"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Amnesic-Systems/veil/internal/enclave"
+	"github.com/Amnesic-Systems/veil/internal/errs"
+	"github.com/Amnesic-Systems/veil/internal/util/must"
+)
+
+type testSection struct {
+	typ  SectionType
+	data []byte
+}
+
+// encodeTestImage encodes the given sections as EIF.
+func encodeTestImage(t *testing.T, flags uint16, sections ...testSection) []byte {
+	t.Helper()
+
+	h := Header{
+		Magic:       magic,
+		Version:     Version,
+		Flags:       flags,
+		NumSections: uint16(len(sections)),
+	}
+	var body bytes.Buffer
+	offset := uint64(headerLen)
+	for i, s := range sections {
+		h.SectionOffsets[i] = offset
+		h.SectionSizes[i] = uint64(len(s.data))
+		require.NoError(t, binary.Write(&body, binary.BigEndian, &sectionHeader{
+			Type: s.typ,
+			Size: uint64(len(s.data)),
+		}))
+		body.Write(s.data)
+		offset += sectionHeaderLen + uint64(len(s.data))
+	}
+
+	var header bytes.Buffer
+	require.NoError(t, binary.Write(&header, binary.BigEndian, &h))
+	crc := crc32.NewIEEE()
+	crc.Write(header.Bytes()[:headerLen-4])
+	crc.Write(body.Bytes())
+	h.CRC32 = crc.Sum32()
+
+	header.Reset()
+	require.NoError(t, binary.Write(&header, binary.BigEndian, &h))
+	return append(header.Bytes(), body.Bytes()...)
+}
+
+func wantPCR(data ...[]byte) []byte {
+	inner := sha512.Sum384(bytes.Join(data, nil))
+	outer := sha512.Sum384(append(make([]byte, sha512.Size384), inner[:]...))
+	return outer[:]
+}
+
+func TestHeaderLen(t *testing.T) {
+	require.Equal(t, headerLen, binary.Size(Header{}))
+	require.Equal(t, sectionHeaderLen, binary.Size(sectionHeader{}))
+}
+
+func TestPCRs(t *testing.T) {
+	var (
+		kernel    = []byte("kernel")
+		cmdline   = []byte("console=ttyS0")
+		bootstrap = []byte("bootstrap ramdisk")
+		app1      = []byte("customer ramdisk")
+		app2      = []byte("another customer ramdisk")
+		cert      = []byte("certificate")
+		metadata  = []byte(`{"img_name":"foo"}`)
+		signature = must.Get(cbor.Marshal([]pcrSignature{{
+			SigningCertificate: cert,
+			Signature:          []byte("signature"),
+		}}))
+	)
+
+	cases := []struct {
+		name     string
+		sections []testSection
+		wantPCRs enclave.PCR
+		wantErr  bool
+	}{
+		{
+			name: "missing customer ramdisk",
+			sections: []testSection{
+				{SectionKernel, kernel},
+				{SectionCmdline, cmdline},
+				{SectionRamdisk, bootstrap},
+			},
+			wantErr: true,
+		},
+		{
+			name: "unsigned",
+			sections: []testSection{
+				{SectionKernel, kernel},
+				{SectionCmdline, cmdline},
+				{SectionMetadata, metadata},
+				{SectionRamdisk, bootstrap},
+				{SectionRamdisk, app1},
+			},
+			wantPCRs: enclave.PCR{
+				0: wantPCR(kernel, cmdline, bootstrap, app1),
+				1: wantPCR(kernel, cmdline, bootstrap),
+				2: wantPCR(app1),
+			},
+		},
+		{
+			name: "signed with two customer ramdisks",
+			sections: []testSection{
+				{SectionKernel, kernel},
+				{SectionCmdline, cmdline},
+				{SectionRamdisk, bootstrap},
+				{SectionRamdisk, app1},
+				{SectionRamdisk, app2},
+				{SectionSignature, signature},
+			},
+			wantPCRs: enclave.PCR{
+				0: wantPCR(kernel, cmdline, bootstrap, app1, app2),
+				1: wantPCR(kernel, cmdline, bootstrap),
+				2: wantPCR(app1, app2),
+				8: wantPCR(cert),
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			raw := encodeTestImage(t, 0, c.sections...)
+			img, err := Parse(bytes.NewReader(raw), int64(len(raw)))
+			require.NoError(t, err)
+			require.NoError(t, img.VerifyCRC())
+
+			pcrs, err := img.PCRs()
+			if c.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, c.wantPCRs, pcrs)
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	valid := encodeTestImage(t, 0,
+		testSection{SectionKernel, []byte("kernel")},
+		testSection{SectionRamdisk, []byte("ramdisk")},
+	)
+	badMagic := bytes.Clone(valid)
+	badMagic[0] = 'x'
+	truncated := valid[:len(valid)-1]
+	badType := bytes.Clone(valid)
+	badType[headerLen+1] = 42
+	// withHeader returns a copy of the valid image whose header was modified
+	// by the given function.
+	withHeader := func(modify func(*Header)) []byte {
+		var h Header
+		require.NoError(t, binary.Read(bytes.NewReader(valid), binary.BigEndian, &h))
+		modify(&h)
+		var buf bytes.Buffer
+		require.NoError(t, binary.Write(&buf, binary.BigEndian, &h))
+		return append(buf.Bytes(), valid[headerLen:]...)
+	}
+	// The section's size is so large that adding it to the section's offset
+	// overflows.
+	const hugeSize = math.MaxInt64 - 100
+	hugeSection := withHeader(func(h *Header) { h.SectionSizes[0] = hugeSize })
+	binary.BigEndian.PutUint64(hugeSection[headerLen+4:], hugeSize)
+	hugeOffset := withHeader(func(h *Header) { h.SectionOffsets[0] = math.MaxInt64 - 1 })
+
+	cases := []struct {
+		name    string
+		in      []byte
+		wantErr error
+	}{
+		{
+			name:    "bad magic",
+			in:      badMagic,
+			wantErr: ErrBadMagic,
+		},
+		{
+			name:    "truncated",
+			in:      truncated,
+			wantErr: errs.ErrInvalidFormat,
+		},
+		{
+			name:    "bad section type",
+			in:      badType,
+			wantErr: errs.ErrInvalidFormat,
+		},
+		{
+			name:    "overflowing section size",
+			in:      hugeSection,
+			wantErr: errs.ErrInvalidFormat,
+		},
+		{
+			name:    "overflowing section offset",
+			in:      hugeOffset,
+			wantErr: errs.ErrInvalidFormat,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := Parse(bytes.NewReader(c.in), int64(len(c.in)))
+			require.ErrorIs(t, err, c.wantErr)
+		})
+	}
+}
+
+func TestOpen(t *testing.T) {
+	raw := encodeTestImage(t, FlagArm64,
+		testSection{SectionKernel, []byte("kernel")},
+		testSection{SectionRamdisk, []byte("ramdisk")},
+	)
+	dir := t.TempDir()
+	valid := filepath.Join(dir, "valid.eif")
+	require.NoError(t, os.WriteFile(valid, raw, 0o600))
+
+	corrupted := filepath.Join(dir, "corrupted.eif")
+	raw[len(raw)-1] ^= 1
+	require.NoError(t, os.WriteFile(corrupted, raw, 0o600))
+
+	img, err := Open(valid)
+	require.NoError(t, err)
+	require.Equal(t, "arm64", img.Header.Arch())
+	require.Len(t, img.Sections, 2)
+	require.NoError(t, img.Close())
+
+	_, err = Open(corrupted)
+	require.ErrorIs(t, err, ErrBadCRC)
+}
+
+func TestSignatureAsIntArray(t *testing.T) {
+	// The reference implementation encodes byte vectors as CBOR arrays of
+	// integers rather than as byte strings.
+	cert := []byte{1, 2, 3}
+	type intSignature struct {
+		SigningCertificate []int `cbor:"signing_certificate"`
+		Signature          []int `cbor:"signature"`
+	}
+	raw := encodeTestImage(t, 0,
+		testSection{SectionSignature, must.Get(cbor.Marshal([]intSignature{{
+			SigningCertificate: []int{1, 2, 3},
+			Signature:          []int{4},
+		}}))},
+	)
+	img := must.Get(Parse(bytes.NewReader(raw), int64(len(raw))))
+	m, err := measureSigner(img.SectionReader(img.Sections[0]))
+	require.NoError(t, err)
+	require.Equal(t, wantPCR(cert), m.pcr())
+}
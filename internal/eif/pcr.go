@@ -0,0 +1,140 @@
+package eif
+
+import (
+	"crypto/sha512"
+	"encoding/pem"
+	"errors"
+	"hash"
+	"io"
+
+	"github.com/fxamacker/cbor/v2"
+
+	"github.com/Amnesic-Systems/veil/internal/enclave"
+	"github.com/Amnesic-Systems/veil/internal/errs"
+)
+
+// pcrSignature represents an element of the CBOR-encoded signature section.
+// The signing certificate is PEM-encoded.
+type pcrSignature struct {
+	SigningCertificate []byte `cbor:"signing_certificate"`
+	Signature          []byte `cbor:"signature"`
+}
+
+// measurer computes PCR values the way the Nitro hypervisor does, i.e., by
+// extending an all-zero PCR with the SHA-384 hash over the measured data:
+//
+//	PCR = SHA-384(0^48 || SHA-384(data))
+type measurer struct {
+	hash.Hash
+}
+
+func newMeasurer() *measurer {
+	return &measurer{sha512.New384()}
+}
+
+func (m *measurer) pcr() []byte {
+	h := sha512.New384()
+	_, _ = h.Write(make([]byte, sha512.Size384))
+	_, _ = h.Write(m.Sum(nil))
+	return h.Sum(nil)
+}
+
+// PCRs computes the image's PCR values.  PCR0 is a measurement over the
+// kernel, the command line, and all ramdisks.  PCR1 is a measurement over the
+// kernel, the command line, and the first ("bootstrap") ramdisk.  PCR2 is a
+// measurement over all remaining ("customer") ramdisks.  PCR8 is only set if
+// the image is signed, and contains a measurement over the signing
+// certificate.
+func (img *Image) PCRs() (_ enclave.PCR, err error) {
+	defer errs.Wrap(&err, "failed to compute PCRs")
+
+	types := make([]SectionType, len(img.Sections))
+	for i, s := range img.Sections {
+		types[i] = s.Type
+	}
+	return measure(types, func(i int) io.Reader {
+		return img.SectionReader(img.Sections[i])
+	})
+}
+
+// measure computes PCR values over the sections of the given types.  The given
+// function returns a reader for the data of the i-th section.
+func measure(types []SectionType, data func(i int) io.Reader) (enclave.PCR, error) {
+	var (
+		image, bootstrap, app = newMeasurer(), newMeasurer(), newMeasurer()
+		signer                *measurer
+		numRamdisks           int
+		err                   error
+	)
+	for i, typ := range types {
+		var w io.Writer
+		switch typ {
+		case SectionKernel, SectionCmdline:
+			w = io.MultiWriter(image, bootstrap)
+		case SectionRamdisk:
+			w = io.MultiWriter(image, app)
+			if numRamdisks == 0 {
+				w = io.MultiWriter(image, bootstrap)
+			}
+			numRamdisks++
+		case SectionSignature:
+			if signer, err = measureSigner(data(i)); err != nil {
+				return nil, err
+			}
+			continue
+		default:
+			// The metadata section is not measured.
+			continue
+		}
+		if _, err := io.Copy(w, data(i)); err != nil {
+			return nil, err
+		}
+	}
+	if numRamdisks < 2 {
+		return nil, errors.New("image must contain at least two ramdisks")
+	}
+
+	pcrs := enclave.PCR{
+		0: image.pcr(),
+		1: bootstrap.pcr(),
+		2: app.pcr(),
+	}
+	if signer != nil {
+		pcrs[8] = signer.pcr()
+	}
+	return pcrs, nil
+}
+
+func measureSigner(r io.Reader) (*measurer, error) {
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var sigs []pcrSignature
+	if err := cbor.Unmarshal(raw, &sigs); err != nil {
+		return nil, errs.Add(err, "failed to decode signature section")
+	}
+	if len(sigs) == 0 {
+		return nil, errors.New("signature section is empty")
+	}
+
+	// The hypervisor measures the DER encoding of the signing certificate.
+	cert := sigs[0].SigningCertificate
+	if block, _ := pem.Decode(cert); block != nil {
+		cert = block.Bytes
+	}
+	m := newMeasurer()
+	_, _ = m.Write(cert)
+	return m, nil
+}
+
+// ReadPCRs opens the EIF at the given path and returns its PCR values.
+func ReadPCRs(path string) (_ enclave.PCR, err error) {
+	img, err := Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = img.Close() }()
+
+	return img.PCRs()
+}
@@ -0,0 +1,225 @@
+package eif
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Amnesic-Systems/veil/internal/errs"
+	"github.com/Amnesic-Systems/veil/internal/oci"
+)
+
+const (
+	// The files that we expect in the blobs directory.  These files are
+	// shipped with nitro-cli, typically in /usr/share/nitro_enclaves/blobs/.
+	blobCmdline = "cmdline"
+	blobInit    = "init"
+	blobNSM     = "nsm.ko"
+	// The directory in the customer ramdisk that holds the image's root file
+	// system.  The init process chroots into this directory.
+	rootfsDir = "rootfs"
+	buildTool = "veil"
+)
+
+// kernelBlob returns the file name of the kernel blob for the given
+// architecture.
+func kernelBlob(arch string) string {
+	if arch == "arm64" {
+		return "Image"
+	}
+	return "bzImage"
+}
+
+// metadata represents the EIF's metadata section.  We only set fields that
+// are derived from the build's inputs, so the section is deterministic.
+type metadata struct {
+	ImageName     string        `json:"ImageName"`
+	ImageVersion  string        `json:"ImageVersion"`
+	BuildMetadata buildMetadata `json:"BuildMetadata"`
+}
+
+type buildMetadata struct {
+	BuildTime       string `json:"BuildTime"`
+	BuildTool       string `json:"BuildTool"`
+	OperatingSystem string `json:"OperatingSystem"`
+}
+
+// FromImage returns a builder for an EIF that boots the given container image
+// tarball on the given architecture.  If the architecture is empty, we use
+// the image's architecture.  The kernel, its command line, and the init
+// process are read from the given blobs directory.  The builder's output is
+// deterministic, but we haven't compared its PCR values with those of an EIF
+// that nitro-cli built from the same image, so don't use them to verify
+// enclaves that run nitro-cli's EIFs.
+func FromImage(tarball, arch, blobsDir string) (_ *Builder, err error) {
+	defer errs.Wrap(&err, "failed to prepare enclave image")
+
+	img, err := oci.Open(tarball, arch)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case arch == "":
+		arch = img.Architecture
+	case img.Architecture != "" && img.Architecture != arch:
+		return nil, fmt.Errorf("image targets %q instead of %q", img.Architecture, arch)
+	}
+	if arch == "" {
+		arch = "amd64"
+	}
+
+	readBlob := func(name string) ([]byte, error) {
+		return os.ReadFile(filepath.Join(blobsDir, name))
+	}
+	kernel, err := readBlob(kernelBlob(arch))
+	if err != nil {
+		return nil, err
+	}
+	cmdline, err := readBlob(blobCmdline)
+	if err != nil {
+		return nil, err
+	}
+	bootstrap, err := bootstrapRamdisk(readBlob)
+	if err != nil {
+		return nil, err
+	}
+	customer, err := customerRamdisk(img)
+	if err != nil {
+		return nil, err
+	}
+	meta, err := json.Marshal(&metadata{
+		ImageName:    filepath.Base(tarball),
+		ImageVersion: "1.0",
+		BuildMetadata: buildMetadata{
+			BuildTime:       img.Created,
+			BuildTool:       buildTool,
+			OperatingSystem: "linux",
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Builder{
+		Arch:     arch,
+		Kernel:   kernel,
+		Cmdline:  strings.TrimSpace(string(cmdline)),
+		Metadata: meta,
+		Ramdisks: [][]byte{bootstrap, customer},
+	}, nil
+}
+
+// bootstrapRamdisk returns the ramdisk that contains the enclave's init
+// process and the kernel module of the Nitro Secure Module.
+func bootstrapRamdisk(readBlob func(string) ([]byte, error)) ([]byte, error) {
+	var files []*oci.File
+	for _, name := range []string{blobInit, blobNSM} {
+		data, err := readBlob(name)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, &oci.File{
+			Header: &tar.Header{
+				Name:     name,
+				Typeflag: tar.TypeReg,
+				Mode:     0o755,
+			},
+			Data: data,
+		})
+	}
+	return newRamdisk(files)
+}
+
+// customerRamdisk returns the ramdisk that contains the container image's
+// root file system, and the command and environment that init runs the image
+// with.
+func customerRamdisk(img *oci.Image) ([]byte, error) {
+	rootfs, err := img.Flatten()
+	if err != nil {
+		return nil, err
+	}
+
+	dir := func(name string, mode int64) *oci.File {
+		return &oci.File{Header: &tar.Header{
+			Name:     name,
+			Typeflag: tar.TypeDir,
+			Mode:     mode,
+		}}
+	}
+	file := func(name string, lines []string) *oci.File {
+		data := []byte(strings.Join(lines, "\n") + "\n")
+		return &oci.File{
+			Header: &tar.Header{
+				Name:     name,
+				Typeflag: tar.TypeReg,
+				Mode:     0o644,
+				Size:     int64(len(data)),
+			},
+			Data: data,
+		}
+	}
+
+	// init mounts pseudo file systems into the following directories, so
+	// they must exist.
+	existing := make(map[string]bool)
+	for _, f := range rootfs {
+		existing[f.Header.Name] = true
+	}
+	files := []*oci.File{dir(rootfsDir, 0o755)}
+	for _, name := range []string{"dev", "proc", "run", "sys", "tmp", "var"} {
+		if existing[name] {
+			continue
+		}
+		mode := int64(0o755)
+		if name == "tmp" {
+			mode = 0o1777
+		}
+		files = append(files, dir(name, mode))
+	}
+	files = append(files, rootfs...)
+	for _, f := range files[1:] {
+		h := *f.Header
+		h.Name = rootfsDir + "/" + h.Name
+		f.Header = &h
+	}
+
+	c := img.Config
+	if len(c.Entrypoint)+len(c.Cmd) == 0 {
+		return nil, errors.New("image has neither an entrypoint nor a command")
+	}
+	files = append(files,
+		file("cmd", append(append([]string{}, c.Entrypoint...), c.Cmd...)),
+		file("env", c.Env),
+	)
+	return newRamdisk(files)
+}
+
+// newRamdisk returns a gzip-compressed cpio archive containing the given
+// files, in the given order.
+func newRamdisk(files []*oci.File) ([]byte, error) {
+	var buf bytes.Buffer
+	// We don't set gzip's header fields, so the output is deterministic.
+	gw, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	cw := newCPIOWriter(gw)
+	for _, f := range files {
+		if err := cw.writeFile(f.Header, f.Data); err != nil {
+			return nil, err
+		}
+	}
+	if err := cw.close(); err != nil {
+		return nil, err
+	}
+	if err := gw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
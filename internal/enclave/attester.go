@@ -40,11 +40,18 @@ type AuxInfo struct {
 	Nonce     []byte `json:"nonce,omitempty" cbor:"nonce"`
 }
 
+// Verifier defines functions for the verification of attestation documents.
+// Clients only need a Verifier, which, unlike an Attester, doesn't require
+// access to the AWS Nitro hypervisor.
+type Verifier interface {
+	Type() string
+	Verify(*RawDocument, *nonce.Nonce) (*Document, error)
+}
+
 // Attester defines functions for the creation and verification of attestation
 // documents. Making this an interface helps with testing: It allows us to
 // implement a dummy attester that works without the AWS Nitro hypervisor.
 type Attester interface {
-	Type() string
+	Verifier
 	Attest(*AuxInfo) (*RawDocument, error)
-	Verify(*RawDocument, *nonce.Nonce) (*Document, error)
 }
@@ -0,0 +1,290 @@
+// Package emulator implements an attester that emulates the AWS Nitro
+// Enclave's Nitro Secure Module (NSM) in software.  The emulator produces
+// COSE_Sign1-encoded attestation documents in the exact format of the NSM,
+// but signs them with a locally-generated certificate hierarchy.  This allows
+// us to exercise the Nitro verification code path without Nitro hardware.
+package emulator
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+
+	"github.com/Amnesic-Systems/veil/internal/enclave"
+	"github.com/Amnesic-Systems/veil/internal/enclave/nitro"
+	"github.com/Amnesic-Systems/veil/internal/errs"
+	"github.com/Amnesic-Systems/veil/internal/nonce"
+)
+
+const (
+	// numPCRs is the number of PCRs that the NSM includes in attestation
+	// documents.
+	numPCRs = 16
+	// coseAlgES384 is the COSE algorithm identifier for ECDSA with SHA-384.
+	// See: https://datatracker.ietf.org/doc/html/rfc8152#section-8.1
+	coseAlgES384 = -35
+	certOrg      = "Amnesic Systems"
+	certValidity = time.Hour * 24
+	moduleID     = "i-00000000000000000-enc0000000000000000"
+)
+
+var _ enclave.Attester = (*Attester)(nil)
+
+// Attester implements the attester interface by emulating the Nitro Secure
+// Module.  Its attestation documents are verifiable by the nitro attester if
+// (and only if) the nitro attester trusts the emulator's root certificate.
+type Attester struct {
+	pcrs     enclave.PCR
+	root     *x509.Certificate
+	cabundle [][]byte
+	leaf     []byte
+	leafKey  *ecdsa.PrivateKey
+}
+
+type Opts func(*Attester)
+
+// WithPCRs sets the PCR values that the emulator embeds in its attestation
+// documents.  PCRs that are not set are zeroed, like the NSM does.
+func WithPCRs(pcrs enclave.PCR) Opts {
+	return func(a *Attester) {
+		for i, pcr := range pcrs {
+			a.pcrs[i] = pcr
+		}
+	}
+}
+
+// NewAttester returns a new emulator attester.  The attester generates its
+// own CA hierarchy, consisting of a root, an intermediate, and a leaf
+// certificate, which is used to sign attestation documents.
+func NewAttester(opts ...Opts) (_ *Attester, err error) {
+	defer errs.Wrap(&err, "failed to create emulator attester")
+
+	a := &Attester{pcrs: defaultPCRs()}
+	for _, opt := range opts {
+		opt(a)
+	}
+
+	rootKey, rootDER, err := newCert("root", nil, nil, true)
+	if err != nil {
+		return nil, err
+	}
+	if a.root, err = x509.ParseCertificate(rootDER); err != nil {
+		return nil, err
+	}
+	interKey, interDER, err := newCert("intermediate", a.root, rootKey, true)
+	if err != nil {
+		return nil, err
+	}
+	inter, err := x509.ParseCertificate(interDER)
+	if err != nil {
+		return nil, err
+	}
+	if a.leafKey, a.leaf, err = newCert(moduleID, inter, interKey, false); err != nil {
+		return nil, err
+	}
+	// Like the NSM, we start the CA bundle with the root certificate.
+	a.cabundle = [][]byte{rootDER, interDER}
+
+	return a, nil
+}
+
+// Roots returns a certificate pool containing the emulator's root certificate.
+func (a *Attester) Roots() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(a.root)
+	return pool
+}
+
+// RootPEM returns the PEM-encoded root certificate of the emulator.
+func (a *Attester) RootPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: a.root.Raw})
+}
+
+// Type returns the nitro type because the emulator's attestation documents are
+// indistinguishable from the ones created by the NSM.
+func (*Attester) Type() string {
+	return enclave.TypeNitro
+}
+
+func (a *Attester) Attest(aux *enclave.AuxInfo) (_ *enclave.RawDocument, err error) {
+	defer errs.Wrap(&err, "failed to create attestation document")
+
+	if aux == nil {
+		return nil, fmt.Errorf("%w: %s", errs.ErrIsNil, "aux info")
+	}
+	// The NSM refuses to attest auxiliary fields that exceed the maximum
+	// length, and so do we.
+	for _, field := range [][]byte{aux.PublicKey, aux.UserData, aux.Nonce} {
+		if len(field) > enclave.AuxFieldLen {
+			return nil, errs.ErrInvalidLength
+		}
+	}
+
+	pcrs := make(enclave.PCR, len(a.pcrs))
+	for i, pcr := range a.pcrs {
+		pcrs[i] = pcr
+	}
+	payload, err := cbor.Marshal(&enclave.Document{
+		ModuleID:    moduleID,
+		Timestamp:   uint64(time.Now().UnixMilli()),
+		Digest:      "SHA384",
+		PCRs:        pcrs,
+		Certificate: a.leaf,
+		CABundle:    a.cabundle,
+		AuxInfo:     *aux,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	doc, err := a.sign(payload)
+	if err != nil {
+		return nil, err
+	}
+	return &enclave.RawDocument{
+		Type: enclave.TypeNitro,
+		Doc:  doc,
+	}, nil
+}
+
+// Verify verifies the given attestation document using the nitro attester,
+// configured to trust the emulator's root certificate.
+func (a *Attester) Verify(
+	doc *enclave.RawDocument,
+	n *nonce.Nonce,
+) (*enclave.Document, error) {
+	return nitro.NewAttester(nitro.WithRoots(a.Roots())).Verify(doc, n)
+}
+
+// sign wraps the given payload in a COSE_Sign1 structure, as specified in:
+// https://datatracker.ietf.org/doc/html/rfc8152#section-4.2
+func (a *Attester) sign(payload []byte) ([]byte, error) {
+	protected, err := cbor.Marshal(map[int]int{1: coseAlgES384})
+	if err != nil {
+		return nil, err
+	}
+	unprotected, err := cbor.Marshal(map[int]int{})
+	if err != nil {
+		return nil, err
+	}
+
+	sigStruct, err := cbor.Marshal(&coseSignature{
+		Context:     "Signature1",
+		Protected:   protected,
+		ExternalAAD: []byte{},
+		Payload:     payload,
+	})
+	if err != nil {
+		return nil, err
+	}
+	hash := sha512.Sum384(sigStruct)
+	r, s, err := ecdsa.Sign(rand.Reader, a.leafKey, hash[:])
+	if err != nil {
+		return nil, err
+	}
+	// COSE encodes ECDSA signatures as the concatenation of the fixed-length
+	// big-endian representations of r and s.
+	sig := make([]byte, 2*sha512.Size384)
+	r.FillBytes(sig[:sha512.Size384])
+	s.FillBytes(sig[sha512.Size384:])
+
+	return cbor.Marshal(&cosePayload{
+		Protected:   protected,
+		Unprotected: unprotected,
+		Payload:     payload,
+		Signature:   sig,
+	})
+}
+
+type cosePayload struct {
+	_ struct{} `cbor:",toarray"`
+
+	Protected   []byte
+	Unprotected cbor.RawMessage
+	Payload     []byte
+	Signature   []byte
+}
+
+type coseSignature struct {
+	_ struct{} `cbor:",toarray"`
+
+	Context     string
+	Protected   []byte
+	ExternalAAD []byte
+	Payload     []byte
+}
+
+// defaultPCRs returns zeroed PCRs, except for PCRs 0, 1, and 2, which are set to
+// fixed, non-zero values.  Zeroed PCRs 0, 1, and 2 would indicate that the
+// enclave is running in debug mode.
+func defaultPCRs() enclave.PCR {
+	pcrs := make(enclave.PCR, numPCRs)
+	for i := range uint(numPCRs) {
+		pcrs[i] = make([]byte, sha512.Size384)
+	}
+	for i := range uint(3) {
+		pcr := sha512.Sum384(fmt.Appendf(nil, "emulated PCR%d", i))
+		pcrs[i] = pcr[:]
+	}
+	return pcrs
+}
+
+// newCert creates a new P-384 key and a certificate for the key, signed by the
+// given parent.  If the parent is nil, the certificate is self-signed.
+func newCert(
+	name string,
+	parent *x509.Certificate,
+	parentKey *ecdsa.PrivateKey,
+	isCA bool,
+) (*ecdsa.PrivateKey, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
+	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			Organization: []string{certOrg},
+			CommonName:   name,
+		},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(certValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	if isCA {
+		template.KeyUsage |= x509.KeyUsageCertSign
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(
+		rand.Reader,
+		template,
+		parent,
+		&key.PublicKey,
+		parentKey,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, der, nil
+}
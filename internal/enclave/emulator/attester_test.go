@@ -0,0 +1,157 @@
+package emulator
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/Amnesic-Systems/veil/internal/enclave"
+	"github.com/Amnesic-Systems/veil/internal/enclave/nitro"
+	"github.com/Amnesic-Systems/veil/internal/errs"
+	"github.com/Amnesic-Systems/veil/internal/nonce"
+	"github.com/Amnesic-Systems/veil/internal/util/must"
+)
+
+func TestType(t *testing.T) {
+	require.Equal(t, enclave.TypeNitro, must.Get(NewAttester()).Type())
+}
+
+func TestAttest(t *testing.T) {
+	a := must.Get(NewAttester())
+
+	cases := []struct {
+		name    string
+		aux     *enclave.AuxInfo
+		wantErr error
+	}{
+		{
+			name:    "nil aux info",
+			wantErr: errs.ErrIsNil,
+		},
+		{
+			name: "oversized aux info",
+			aux: &enclave.AuxInfo{
+				UserData: bytes.Repeat([]byte("a"), enclave.AuxFieldLen+1),
+			},
+			wantErr: errs.ErrInvalidLength,
+		},
+		{
+			name: "empty aux info",
+			aux:  &enclave.AuxInfo{},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			doc, err := a.Attest(c.aux)
+			require.ErrorIs(t, err, c.wantErr)
+			if c.wantErr == nil {
+				require.Equal(t, enclave.TypeNitro, doc.Type)
+			}
+		})
+	}
+}
+
+func TestVerify(t *testing.T) {
+	var (
+		pcrs = enclave.PCR{
+			0: []byte(strings.Repeat("a", 48)),
+			1: []byte(strings.Repeat("b", 48)),
+			2: []byte(strings.Repeat("c", 48)),
+		}
+		a     = must.Get(NewAttester(WithPCRs(pcrs)))
+		other = must.Get(NewAttester())
+		n     = must.Get(nonce.New())
+		aux   = &enclave.AuxInfo{
+			PublicKey: []byte("public key"),
+			UserData:  []byte("user data"),
+			Nonce:     n.ToSlice(),
+		}
+		rawDoc = must.Get(a.Attest(aux))
+	)
+	tampered := &enclave.RawDocument{
+		Type: rawDoc.Type,
+		Doc:  bytes.Clone(rawDoc.Doc),
+	}
+	tampered.Doc[len(tampered.Doc)-1] ^= 1
+
+	cases := []struct {
+		name     string
+		verifier enclave.Attester
+		doc      *enclave.RawDocument
+		nonce    *nonce.Nonce
+		wantErr  bool
+	}{
+		{
+			name:     "default roots",
+			verifier: nitro.NewAttester(),
+			doc:      rawDoc,
+			nonce:    n,
+			wantErr:  true,
+		},
+		{
+			name:     "foreign roots",
+			verifier: nitro.NewAttester(nitro.WithRoots(other.Roots())),
+			doc:      rawDoc,
+			nonce:    n,
+			wantErr:  true,
+		},
+		{
+			name:     "tampered signature",
+			verifier: a,
+			doc:      tampered,
+			nonce:    n,
+			wantErr:  true,
+		},
+		{
+			name:     "nonce mismatch",
+			verifier: a,
+			doc:      rawDoc,
+			nonce:    must.Get(nonce.New()),
+			wantErr:  true,
+		},
+		{
+			name:     "emulator roots",
+			verifier: nitro.NewAttester(nitro.WithRoots(a.Roots())),
+			doc:      rawDoc,
+			nonce:    n,
+		},
+		{
+			name:     "emulator",
+			verifier: a,
+			doc:      rawDoc,
+			nonce:    n,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			doc, err := c.verifier.Verify(c.doc, c.nonce)
+			if c.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, *aux, doc.AuxInfo)
+			require.Equal(t, "SHA384", doc.Digest)
+			require.Len(t, doc.PCRs, numPCRs)
+			for i, pcr := range pcrs {
+				require.Equal(t, pcr, doc.PCRs[i])
+			}
+		})
+	}
+}
+
+func TestDebugMode(t *testing.T) {
+	a := must.Get(NewAttester(WithPCRs(enclave.PCR{
+		0: make([]byte, 48),
+		1: make([]byte, 48),
+		2: make([]byte, 48),
+	})))
+	rawDoc := must.Get(a.Attest(&enclave.AuxInfo{}))
+
+	_, err := a.Verify(rawDoc, nil)
+	require.ErrorIs(t, err, nitro.ErrDebugMode)
+}
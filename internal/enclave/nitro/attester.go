@@ -1,11 +1,12 @@
 package nitro
 
 import (
+	"crypto/x509"
 	"errors"
 	"fmt"
-	"time"
 
 	"github.com/Amnesic-Systems/veil/internal/enclave"
+	"github.com/Amnesic-Systems/veil/internal/enclave/nitro/verify"
 	"github.com/Amnesic-Systems/veil/internal/errs"
 	"github.com/Amnesic-Systems/veil/internal/nonce"
 
@@ -14,17 +15,36 @@ import (
 )
 
 var _ enclave.Attester = (*Attester)(nil)
-var ErrDebugMode = errors.New("attestation document was produced in debug mode")
+
+// ErrDebugMode means that the attestation document was produced in debug
+// mode.
+var ErrDebugMode = verify.ErrDebugMode
 
 // Attester implements the attester interface by drawing on the AWS Nitro
 // Enclave hypervisor.
 type Attester struct {
 	session *nsm.Session
+	roots   *x509.CertPool
+}
+
+type Opts func(*Attester)
+
+// WithRoots sets the root certificates that attestation documents must chain
+// up to.  By default, we only trust AWS's Nitro Enclaves root certificate, so
+// this option is only useful for testing, e.g., with the emulator attester.
+func WithRoots(roots *x509.CertPool) Opts {
+	return func(a *Attester) {
+		a.roots = roots
+	}
 }
 
 // NewAttester returns a new nitroAttester.
-func NewAttester() enclave.Attester {
-	return new(Attester)
+func NewAttester(opts ...Opts) enclave.Attester {
+	a := new(Attester)
+	for _, opt := range opts {
+		opt(a)
+	}
+	return a
 }
 
 func (*Attester) Type() string {
@@ -67,40 +87,6 @@ func (a *Attester) Attest(aux *enclave.AuxInfo) (_ *enclave.RawDocument, err err
 func (a *Attester) Verify(
 	doc *enclave.RawDocument,
 	ourNonce *nonce.Nonce,
-) (_ *enclave.Document, err error) {
-	defer errs.Wrap(&err, "failed to verify attestation document")
-
-	if doc == nil {
-		return nil, errors.New("attestation document is nil")
-	}
-	if doc.Type != a.Type() {
-		return nil, errs.ErrTypeMismatch
-	}
-
-	// First, verify the attestation document.
-	opts := verifyOptions{CurrentTime: time.Now().UTC()}
-	res, err := verify(doc.Doc, opts)
-	if err != nil {
-		return nil, err
-	}
-
-	// Verify that the attestation document contains the nonce that we may have
-	// asked it to embed.
-	if ourNonce != nil {
-		docNonce, err := nonce.FromSlice(res.Document.Nonce[:])
-		if err != nil {
-			return nil, err
-		}
-		if *ourNonce != *docNonce {
-			return nil, errs.ErrNonceMismatch
-		}
-	}
-
-	// If the enclave is running in debug mode, return an error *and* the
-	// auxiliary information.
-	if res.Document.PCRs.FromDebugMode() {
-		err = ErrDebugMode
-	}
-
-	return res.Document, err
+) (*enclave.Document, error) {
+	return verify.NewVerifier(verify.WithRoots(a.roots)).Verify(doc, ourNonce)
 }
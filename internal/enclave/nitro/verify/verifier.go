@@ -1,4 +1,4 @@
-package nitro
+package verify
 
 // This file was taken from Stojan Dimitrovski's excellent nitrite package:
 // https://github.com/hf/nitrite
@@ -0,0 +1,91 @@
+// Package verify verifies AWS Nitro Enclave attestation documents.  Unlike
+// package nitro, it doesn't talk to the Nitro Secure Module, so clients can
+// verify attestation documents without depending on enclave-only code.
+package verify
+
+import (
+	"crypto/x509"
+	"errors"
+	"time"
+
+	"github.com/Amnesic-Systems/veil/internal/enclave"
+	"github.com/Amnesic-Systems/veil/internal/errs"
+	"github.com/Amnesic-Systems/veil/internal/nonce"
+)
+
+var _ enclave.Verifier = (*Verifier)(nil)
+var ErrDebugMode = errors.New("attestation document was produced in debug mode")
+
+// Verifier implements the verifier interface for attestation documents that
+// the AWS Nitro Enclave hypervisor created.
+type Verifier struct {
+	roots *x509.CertPool
+}
+
+type Opts func(*Verifier)
+
+// WithRoots sets the root certificates that attestation documents must chain
+// up to.  By default, we only trust AWS's Nitro Enclaves root certificate, so
+// this option is only useful for testing, e.g., with the emulator attester.
+func WithRoots(roots *x509.CertPool) Opts {
+	return func(v *Verifier) {
+		v.roots = roots
+	}
+}
+
+// NewVerifier returns a new Nitro verifier.
+func NewVerifier(opts ...Opts) enclave.Verifier {
+	v := new(Verifier)
+	for _, opt := range opts {
+		opt(v)
+	}
+	return v
+}
+
+func (*Verifier) Type() string {
+	return enclave.TypeNitro
+}
+
+func (v *Verifier) Verify(
+	doc *enclave.RawDocument,
+	ourNonce *nonce.Nonce,
+) (_ *enclave.Document, err error) {
+	defer errs.Wrap(&err, "failed to verify attestation document")
+
+	if doc == nil {
+		return nil, errors.New("attestation document is nil")
+	}
+	if doc.Type != v.Type() {
+		return nil, errs.ErrTypeMismatch
+	}
+
+	// First, verify the attestation document.
+	opts := verifyOptions{
+		Roots:       v.roots,
+		CurrentTime: time.Now().UTC(),
+	}
+	res, err := verify(doc.Doc, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// Verify that the attestation document contains the nonce that we may have
+	// asked it to embed.
+	if ourNonce != nil {
+		docNonce, err := nonce.FromSlice(res.Document.Nonce[:])
+		if err != nil {
+			return nil, err
+		}
+		if *ourNonce != *docNonce {
+			return nil, errs.ErrNonceMismatch
+		}
+	}
+
+	// If the enclave is running in debug mode, return an error *and* the
+	// auxiliary information.
+	if res.Document.PCRs.FromDebugMode() {
+		err = ErrDebugMode
+	}
+
+	return res.Document, err
+}
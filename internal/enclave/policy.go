@@ -0,0 +1,249 @@
+package enclave
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const pcrPrefix = "PCR"
+
+var (
+	ErrEmptyPolicy   = errors.New("policy neither allows nor requires PCR values")
+	ErrNoAllowedPCRs = errors.New("policy allows no set of PCR values")
+)
+
+// Policy determines what PCR values we accept from an enclave.  A policy is
+// typically read from a JSON file that looks as follows:
+//
+//	{
+//	  "allowed": [
+//	    {"PCR0": "8b92...", "PCR1": "4b4d...", "PCR2": "22d2..."},
+//	    {"PCR0": "17b3...", "PCR1": "4b4d...", "PCR2": "9f1a..."}
+//	  ],
+//	  "required": {"PCR3": "60a1..."},
+//	  "ignored": [4]
+//	}
+type Policy struct {
+	// Allowed contains sets of PCR values.  An enclave's PCR values must
+	// match at least one of these sets, e.g., the current and the previous
+	// release during a rollout.  Only the allowed sets pin the enclave image
+	// (PCR0 to PCR2), so we refuse to check enclaves against a policy without
+	// allowed sets.
+	Allowed []PCR
+	// Required contains PCR values that an enclave must have in addition to
+	// matching an allowed set, e.g., PCR3 (the parent's IAM role), PCR4 (the
+	// parent's instance ID), or PCR8 (the image's signing certificate).
+	Required PCR
+	// Ignored contains the indices of PCRs that we don't compare.  When
+	// decoding a policy that doesn't list ignored PCRs, we ignore PCR4, just
+	// like NewPolicy.
+	Ignored []uint
+}
+
+// Mismatch represents a PCR whose value violates a policy.  A nil value means
+// that the PCR is unset.
+type Mismatch struct {
+	Index uint
+	Want  []byte
+	Got   []byte
+}
+
+func (m Mismatch) String() string {
+	format := func(b []byte) string {
+		if b == nil {
+			return "<unset>"
+		}
+		return fmt.Sprintf("%x", b)
+	}
+	return fmt.Sprintf("PCR%d: expected %s but got %s", m.Index, format(m.Want), format(m.Got))
+}
+
+// NewPolicy returns a policy that allows the given sets of PCR values.  Like
+// PCR.Equal, the policy ignores PCR4 because it contains a hash over the
+// parent's instance ID, which is only known at runtime.
+func NewPolicy(allowed ...PCR) *Policy {
+	return &Policy{
+		Allowed: allowed,
+		Ignored: []uint{4},
+	}
+}
+
+// ReadPolicy reads a JSON-encoded policy from the given file.
+func ReadPolicy(path string) (*Policy, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var p Policy
+	if err := json.Unmarshal(raw, &p); err != nil {
+		return nil, fmt.Errorf("failed to parse policy %q: %w", path, err)
+	}
+	if p.IsEmpty() {
+		return nil, ErrEmptyPolicy
+	}
+	return &p, nil
+}
+
+// IsEmpty returns true if the policy neither allows nor requires any PCR
+// values, in which case it would accept any enclave.
+func (p *Policy) IsEmpty() bool {
+	return len(p.Allowed) == 0 && len(p.Required) == 0
+}
+
+// CanCheck returns ErrEmptyPolicy or ErrNoAllowedPCRs if the policy cannot
+// meaningfully check an enclave, i.e., if it doesn't allow any set of PCR
+// values.  A policy that only requires PCR values would accept any enclave
+// image.
+func (p *Policy) CanCheck() error {
+	if p.IsEmpty() {
+		return ErrEmptyPolicy
+	}
+	if len(p.Allowed) == 0 {
+		return ErrNoAllowedPCRs
+	}
+	return nil
+}
+
+// Check returns nil if the given PCR values satisfy the policy.  Otherwise,
+// it returns the PCRs that violate the policy, sorted by index.  If the policy
+// allows several sets of PCR values, the returned mismatches refer to the set
+// that's closest to the given PCR values.  Callers must make sure that
+// CanCheck returns nil first.
+func (p *Policy) Check(pcrs PCR) []Mismatch {
+	var mismatches []Mismatch
+	for _, i := range slices.Sorted(maps.Keys(p.Required)) {
+		if !bytes.Equal(p.Required[i], pcrs[i]) {
+			mismatches = append(mismatches, Mismatch{
+				Index: i,
+				Want:  p.Required[i],
+				Got:   pcrs[i],
+			})
+		}
+	}
+
+	// PCRs that are required are already checked above.
+	skip := func(i uint) bool {
+		_, required := p.Required[i]
+		return required || slices.Contains(p.Ignored, i)
+	}
+	var closest []Mismatch
+	for n, allowed := range p.Allowed {
+		diff := diffPCRs(allowed, pcrs, skip)
+		if n == 0 || len(diff) < len(closest) {
+			closest = diff
+		}
+		if len(closest) == 0 {
+			break
+		}
+	}
+
+	mismatches = append(mismatches, closest...)
+	slices.SortStableFunc(mismatches, func(a, b Mismatch) int {
+		return int(a.Index) - int(b.Index)
+	})
+	return mismatches
+}
+
+// diffPCRs returns the PCRs whose values differ in the given sets, except for
+// the ones that should be skipped.
+func diffPCRs(want, got PCR, skip func(uint) bool) []Mismatch {
+	indices := slices.Collect(maps.Keys(want))
+	for i := range got {
+		if _, ok := want[i]; !ok {
+			indices = append(indices, i)
+		}
+	}
+	slices.Sort(indices)
+
+	var diff []Mismatch
+	for _, i := range indices {
+		if skip(i) || bytes.Equal(want[i], got[i]) {
+			continue
+		}
+		diff = append(diff, Mismatch{Index: i, Want: want[i], Got: got[i]})
+	}
+	return diff
+}
+
+// policyJSON is the JSON representation of a policy.  PCR values are
+// hex-encoded and keyed by "PCR" followed by the PCR's index, just like in
+// nitro-cli's output.
+type policyJSON struct {
+	Allowed  []map[string]string `json:"allowed,omitempty"`
+	Required map[string]string   `json:"required,omitempty"`
+	// Ignored is a pointer, so we can tell a missing list, which defaults to
+	// PCR4, from an empty one.
+	Ignored *[]uint `json:"ignored,omitempty"`
+}
+
+func (p *Policy) MarshalJSON() ([]byte, error) {
+	encode := func(pcrs PCR) map[string]string {
+		m := make(map[string]string, len(pcrs))
+		for i, v := range pcrs {
+			m[pcrPrefix+strconv.FormatUint(uint64(i), 10)] = hex.EncodeToString(v)
+		}
+		return m
+	}
+	ignored := p.Ignored
+	if ignored == nil {
+		ignored = []uint{}
+	}
+	j := policyJSON{Ignored: &ignored}
+	for _, pcrs := range p.Allowed {
+		j.Allowed = append(j.Allowed, encode(pcrs))
+	}
+	if len(p.Required) > 0 {
+		j.Required = encode(p.Required)
+	}
+	return json.Marshal(&j)
+}
+
+func (p *Policy) UnmarshalJSON(data []byte) error {
+	var j policyJSON
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+
+	decode := func(m map[string]string) (PCR, error) {
+		pcrs := make(PCR, len(m))
+		for k, v := range m {
+			i, err := strconv.ParseUint(strings.TrimPrefix(k, pcrPrefix), 10, 8)
+			if err != nil || !strings.HasPrefix(k, pcrPrefix) {
+				return nil, fmt.Errorf("invalid PCR name %q", k)
+			}
+			b, err := hex.DecodeString(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value of %s: %w", k, err)
+			}
+			pcrs[uint(i)] = b
+		}
+		return pcrs, nil
+	}
+	*p = Policy{Ignored: []uint{4}}
+	if j.Ignored != nil {
+		p.Ignored = *j.Ignored
+	}
+	for _, m := range j.Allowed {
+		pcrs, err := decode(m)
+		if err != nil {
+			return err
+		}
+		p.Allowed = append(p.Allowed, pcrs)
+	}
+	if len(j.Required) > 0 {
+		pcrs, err := decode(j.Required)
+		if err != nil {
+			return err
+		}
+		p.Required = pcrs
+	}
+	return nil
+}
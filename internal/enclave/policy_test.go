@@ -0,0 +1,154 @@
+package enclave
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPolicyCheck(t *testing.T) {
+	var (
+		current  = PCR{0: []byte("a"), 1: []byte("b"), 2: []byte("c")}
+		previous = PCR{0: []byte("x"), 1: []byte("b"), 2: []byte("y")}
+	)
+	with := func(pcrs PCR, i uint, v []byte) PCR {
+		c := make(PCR, len(pcrs)+1)
+		for k, v := range pcrs {
+			c[k] = v
+		}
+		c[i] = v
+		return c
+	}
+
+	cases := []struct {
+		name   string
+		policy *Policy
+		pcrs   PCR
+		want   []Mismatch
+	}{
+		{
+			name:   "current release",
+			policy: NewPolicy(current, previous),
+			pcrs:   current,
+		},
+		{
+			name:   "previous release",
+			policy: NewPolicy(current, previous),
+			pcrs:   previous,
+		},
+		{
+			name:   "ignore PCR4",
+			policy: NewPolicy(current),
+			pcrs:   with(current, 4, []byte("instance")),
+		},
+		{
+			name:   "diff against closest set",
+			policy: NewPolicy(current, previous),
+			pcrs:   with(previous, 2, []byte("z")),
+			want:   []Mismatch{{Index: 2, Want: []byte("y"), Got: []byte("z")}},
+		},
+		{
+			name:   "unexpected PCR",
+			policy: NewPolicy(current),
+			pcrs:   with(current, 3, []byte("role")),
+			want:   []Mismatch{{Index: 3, Got: []byte("role")}},
+		},
+		{
+			name:   "missing PCR",
+			policy: NewPolicy(current),
+			pcrs:   PCR{0: []byte("a"), 1: []byte("b")},
+			want:   []Mismatch{{Index: 2, Want: []byte("c")}},
+		},
+		{
+			name: "required PCR",
+			policy: &Policy{
+				Allowed:  []PCR{current},
+				Required: PCR{3: []byte("role")},
+			},
+			pcrs: with(current, 3, []byte("role")),
+		},
+		{
+			name: "wrong required PCR",
+			policy: &Policy{
+				Allowed:  []PCR{current},
+				Required: PCR{3: []byte("role")},
+			},
+			pcrs: with(current, 3, []byte("other role")),
+			want: []Mismatch{{Index: 3, Want: []byte("role"), Got: []byte("other role")}},
+		},
+		{
+			name:   "only required PCRs",
+			policy: &Policy{Required: PCR{8: []byte("cert")}},
+			pcrs:   with(current, 8, []byte("cert")),
+		},
+		{
+			name:   "ignored PCR",
+			policy: &Policy{Allowed: []PCR{current}, Ignored: []uint{2}},
+			pcrs:   with(current, 2, []byte("whatever")),
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			require.Equal(t, c.want, c.policy.Check(c.pcrs))
+		})
+	}
+}
+
+func TestPolicyJSON(t *testing.T) {
+	want := &Policy{
+		Allowed:  []PCR{{0: []byte{0xaa}, 1: []byte{0xbb}}},
+		Required: PCR{3: []byte{0xcc}},
+		Ignored:  []uint{4},
+	}
+	raw, err := json.Marshal(want)
+	require.NoError(t, err)
+	require.JSONEq(t, `{
+		"allowed": [{"PCR0": "aa", "PCR1": "bb"}],
+		"required": {"PCR3": "cc"},
+		"ignored": [4]
+	}`, string(raw))
+
+	var got Policy
+	require.NoError(t, json.Unmarshal(raw, &got))
+	require.Equal(t, want, &got)
+
+	// Without a list of ignored PCRs, we ignore PCR4 like NewPolicy does.
+	require.NoError(t, json.Unmarshal([]byte(`{"allowed": [{"PCR0": "aa"}]}`), &got))
+	require.Equal(t, []uint{4}, got.Ignored)
+	require.NoError(t, json.Unmarshal([]byte(`{"allowed": [{"PCR0": "aa"}], "ignored": []}`), &got))
+	require.Empty(t, got.Ignored)
+
+	for _, bad := range []string{
+		`{"allowed": [{"0": "aa"}]}`,
+		`{"allowed": [{"PCRx": "aa"}]}`,
+		`{"required": {"PCR3": "not hex"}}`,
+	} {
+		require.Error(t, json.Unmarshal([]byte(bad), &got), bad)
+	}
+}
+
+func TestPolicyCanCheck(t *testing.T) {
+	require.ErrorIs(t, NewPolicy().CanCheck(), ErrEmptyPolicy)
+	require.ErrorIs(t, (&Policy{Required: PCR{3: []byte{0xaa}}}).CanCheck(), ErrNoAllowedPCRs)
+	require.NoError(t, NewPolicy(PCR{0: []byte{0xaa}}).CanCheck())
+}
+
+func TestReadPolicy(t *testing.T) {
+	dir := t.TempDir()
+	empty := filepath.Join(dir, "empty.json")
+	require.NoError(t, os.WriteFile(empty, []byte(`{"ignored": [4]}`), 0o600))
+	valid := filepath.Join(dir, "valid.json")
+	require.NoError(t, os.WriteFile(valid, []byte(`{"required": {"PCR8": "aa"}}`), 0o600))
+
+	_, err := ReadPolicy(filepath.Join(dir, "does-not-exist.json"))
+	require.Error(t, err)
+	_, err = ReadPolicy(empty)
+	require.ErrorIs(t, err, ErrEmptyPolicy)
+	p, err := ReadPolicy(valid)
+	require.NoError(t, err)
+	require.Equal(t, PCR{8: []byte{0xaa}}, p.Required)
+}
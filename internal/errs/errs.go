@@ -12,9 +12,11 @@ var (
 	ErrIsNil           = errors.New("argument must not be nil")
 	ErrPCRMismatch     = errors.New("enclave code does not match local code")
 	ErrBindingMismatch = errors.New("TLS certificate does not match attestation document")
+	ErrChannelBinding  = errors.New("attestation document is not bound to TLS connection")
 	ErrNonceMismatch   = errors.New("nonce does not match")
 	ErrTypeMismatch    = errors.New("attestation document type mismatch")
 	ErrEnclaveErr      = errors.New("enclave returned an error")
+	ErrConfigMismatch  = errors.New("enclave configuration violates policy")
 )
 
 // Wrap wraps the given error using the given string and (if provided) string
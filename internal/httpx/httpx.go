@@ -10,22 +10,25 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/asn1"
 	"encoding/base64"
 	"encoding/pem"
 	"errors"
 	"fmt"
 	"log"
 	"math/big"
+	"net"
 	"net/http"
 	"time"
 
+	"github.com/Amnesic-Systems/veil/internal/addr"
 	"github.com/Amnesic-Systems/veil/internal/errs"
 	"github.com/Amnesic-Systems/veil/internal/nonce"
 )
 
 const (
 	certOrg      = "Amnesic Systems"
-	certValidity = time.Hour * 24 * 365 // One year.
+	CertValidity = time.Hour * 24 * 365 // One year.
 	ParamNonce   = "nonce"
 )
 
@@ -143,10 +146,83 @@ func GetCertHash(rawCert []byte) (hash [sha256.Size]byte, err error) {
 	return sha256.Sum256(cert.Raw), nil
 }
 
+// OIDAttestation identifies the X.509 extension in which enclaves embed their
+// attestation document (see WithAttestation).
+//
+// The OID is experimental: it's in an arc that the project doesn't control,
+// and it will change once the project has an IANA Private Enterprise Number.
+// Clients and the veil-daemon must then be updated together, so don't hard-code
+// the OID outside of this module.
+var OIDAttestation = asn1.ObjectIdentifier{1, 3, 9900, 1337, 1}
+
+// CertOption configures the certificates that CreateCertificate creates.
+type CertOption func(*certOptions)
+
+type certOptions struct {
+	attest   func(pubKeyHash *[sha256.Size]byte) ([]byte, error)
+	dnsNames []string
+	ips      []net.IP
+}
+
+// WithDNSNames adds the given domain names to the certificate's subject
+// alternative names, in addition to the FQDN.
+func WithDNSNames(names ...string) CertOption {
+	return func(o *certOptions) {
+		o.dnsNames = append(o.dnsNames, names...)
+	}
+}
+
+// WithIPAddresses adds the given IP addresses to the certificate's subject
+// alternative names, for clients that reach the enclave without DNS.
+func WithIPAddresses(ips ...net.IP) CertOption {
+	return func(o *certOptions) {
+		o.ips = append(o.ips, ips...)
+	}
+}
+
+// WithAttestation embeds an attestation document in the certificate.  The
+// given function receives the SHA-256 hash of the certificate's DER-encoded
+// SubjectPublicKeyInfo and must return an attestation document that attests
+// to the hash.  This binds the document to the certificate's key, which never
+// leaves the enclave, so clients can verify the enclave during the TLS
+// handshake.
+func WithAttestation(attest func(pubKeyHash *[sha256.Size]byte) ([]byte, error)) CertOption {
+	return func(o *certOptions) {
+		o.attest = attest
+	}
+}
+
+// CertAttestation returns the attestation document that is embedded in the
+// given certificate, or false if the certificate contains no document.
+func CertAttestation(cert *x509.Certificate) ([]byte, bool) {
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(OIDAttestation) {
+			continue
+		}
+		var doc []byte
+		if rest, err := asn1.Unmarshal(ext.Value, &doc); err != nil || len(rest) > 0 {
+			return nil, false
+		}
+		return doc, true
+	}
+	return nil, false
+}
+
+// PublicKeyHash returns the SHA-256 hash of the given certificate's
+// DER-encoded SubjectPublicKeyInfo.
+func PublicKeyHash(cert *x509.Certificate) [sha256.Size]byte {
+	return sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+}
+
 // CreateCertificate creates a self-signed certificate and returns the
 // PEM-encoded certificate and key.  Some of the code below was taken from:
 // https://eli.thegreenplace.net/2021/go-https-servers-with-tls/
-func CreateCertificate(fqdn string) (cert []byte, key []byte, err error) {
+func CreateCertificate(fqdn string, opts ...CertOption) (cert []byte, key []byte, err error) {
+	var o certOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
 	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
 		return nil, nil, err
@@ -163,13 +239,21 @@ func CreateCertificate(fqdn string) (cert []byte, key []byte, err error) {
 		Subject: pkix.Name{
 			Organization: []string{certOrg},
 		},
-		DNSNames:              []string{fqdn},
+		DNSNames:              append([]string{fqdn}, o.dnsNames...),
+		IPAddresses:           o.ips,
 		NotBefore:             time.Now(),
-		NotAfter:              time.Now().Add(certValidity),
+		NotAfter:              time.Now().Add(CertValidity),
 		KeyUsage:              x509.KeyUsageDigitalSignature,
 		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
 		BasicConstraintsValid: true,
 	}
+	if o.attest != nil {
+		ext, err := attestationExtension(&privateKey.PublicKey, o.attest)
+		if err != nil {
+			return nil, nil, err
+		}
+		template.ExtraExtensions = append(template.ExtraExtensions, ext)
+	}
 
 	derBytes, err := x509.CreateCertificate(
 		rand.Reader,
@@ -198,3 +282,28 @@ func CreateCertificate(fqdn string) (cert []byte, key []byte, err error) {
 
 	return pemCert, pemKey, nil
 }
+
+// attestationExtension returns an X.509 extension that contains an
+// attestation document for the given public key.
+func attestationExtension(
+	pubKey *ecdsa.PublicKey,
+	attest func(*[sha256.Size]byte) ([]byte, error),
+) (_ pkix.Extension, err error) {
+	defer errs.Wrap(&err, "failed to create attestation extension")
+
+	spki, err := x509.MarshalPKIXPublicKey(pubKey)
+	if err != nil {
+		return pkix.Extension{}, err
+	}
+	doc, err := attest(addr.Of(sha256.Sum256(spki)))
+	if err != nil {
+		return pkix.Extension{}, err
+	}
+	// Extension values must be DER-encoded, so we wrap the document in an
+	// OCTET STRING.
+	value, err := asn1.Marshal(doc)
+	if err != nil {
+		return pkix.Extension{}, err
+	}
+	return pkix.Extension{Id: OIDAttestation, Value: value}, nil
+}
@@ -2,6 +2,10 @@ package httpx
 
 import (
 	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -110,3 +114,55 @@ func TestExtractNonce(t *testing.T) {
 		})
 	}
 }
+
+func parseCert(t *testing.T, rawCert []byte) *x509.Certificate {
+	t.Helper()
+	block, _ := pem.Decode(rawCert)
+	require.NotNil(t, block)
+	return must.Get(x509.ParseCertificate(block.Bytes))
+}
+
+func TestCreateCertificateWithAttestation(t *testing.T) {
+	var gotHash *[sha256.Size]byte
+	rawCert, _, err := CreateCertificate("example.com", WithAttestation(
+		func(pubKeyHash *[sha256.Size]byte) ([]byte, error) {
+			gotHash = pubKeyHash
+			return []byte("attestation document"), nil
+		},
+	))
+	require.NoError(t, err)
+
+	cert := parseCert(t, rawCert)
+	require.Equal(t, PublicKeyHash(cert), *gotHash)
+	doc, ok := CertAttestation(cert)
+	require.True(t, ok)
+	require.Equal(t, []byte("attestation document"), doc)
+
+	// Certificates don't contain a document by default.
+	rawCert, _, err = CreateCertificate("example.com")
+	require.NoError(t, err)
+	_, ok = CertAttestation(parseCert(t, rawCert))
+	require.False(t, ok)
+
+	// Errors during attestation abort certificate creation.
+	_, _, err = CreateCertificate("example.com", WithAttestation(
+		func(*[sha256.Size]byte) ([]byte, error) { return nil, errs.ErrIsNil },
+	))
+	require.ErrorIs(t, err, errs.ErrIsNil)
+}
+
+func TestCreateCertificateWithSANs(t *testing.T) {
+	rawCert, _, err := CreateCertificate(
+		"example.com",
+		WithDNSNames("api.example.com", "www.example.com"),
+		WithIPAddresses(net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")),
+	)
+	require.NoError(t, err)
+
+	cert := parseCert(t, rawCert)
+	require.Equal(t, []string{"example.com", "api.example.com", "www.example.com"}, cert.DNSNames)
+	require.Len(t, cert.IPAddresses, 2)
+	require.True(t, cert.IPAddresses[0].Equal(net.ParseIP("192.0.2.1")))
+	require.True(t, cert.IPAddresses[1].Equal(net.ParseIP("2001:db8::1")))
+	require.NoError(t, cert.VerifyHostname("192.0.2.1"))
+}
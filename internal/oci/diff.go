@@ -0,0 +1,178 @@
+package oci
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Amnesic-Systems/veil/internal/errs"
+)
+
+// Entry describes a file in one of an image's layers, i.e., everything about
+// the file that affects the layer's digest.
+type Entry struct {
+	Path     string
+	Type     byte
+	Mode     int64
+	ModTime  time.Time
+	UID      int
+	GID      int
+	Uname    string
+	Gname    string
+	Size     int64
+	Linkname string
+	// SHA256 contains the hex-encoded hash of the content of regular files.
+	SHA256 string
+}
+
+// Difference describes how a file or an image's metadata differs between two
+// images.  Layer is -1 for differences in the image's metadata.  A and B
+// contain the value of the given field in the first and second image.
+type Difference struct {
+	Layer int
+	Path  string
+	Field string
+	A     string
+	B     string
+}
+
+func (d Difference) String() string {
+	if d.Layer < 0 {
+		return fmt.Sprintf("image: %s: %s != %s", d.Field, d.A, d.B)
+	}
+	return fmt.Sprintf("layer %d: %s: %s: %s != %s", d.Layer, d.Path, d.Field, d.A, d.B)
+}
+
+// LayerEntries returns the files in the given layer, sorted by path.
+func (img *Image) LayerEntries(layer int) (_ []Entry, err error) {
+	defer errs.Wrap(&err, "failed to read layer entries")
+
+	var entries []Entry
+	err = img.WalkLayer(layer, func(hdr *tar.Header, r io.Reader) error {
+		e := Entry{
+			Path:     CleanPath(hdr.Name),
+			Type:     hdr.Typeflag,
+			Mode:     hdr.Mode,
+			ModTime:  hdr.ModTime.UTC(),
+			UID:      hdr.Uid,
+			GID:      hdr.Gid,
+			Uname:    hdr.Uname,
+			Gname:    hdr.Gname,
+			Size:     hdr.Size,
+			Linkname: hdr.Linkname,
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			h := sha256.New()
+			if _, err := io.Copy(h, r); err != nil {
+				return err
+			}
+			e.SHA256 = hex.EncodeToString(h.Sum(nil))
+		}
+		entries = append(entries, e)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	slices.SortStableFunc(entries, func(a, b Entry) int {
+		return strings.Compare(a.Path, b.Path)
+	})
+	return entries, nil
+}
+
+// Diff compares the metadata of the given images and the files in each of
+// their layers, and returns all differences.  Identical images result in no
+// differences.
+func Diff(a, b *Image) (_ []Difference, err error) {
+	defer errs.Wrap(&err, "failed to diff images")
+
+	var diffs []Difference
+	addImageDiff := func(field, x, y string) {
+		if x != y {
+			diffs = append(diffs, Difference{Layer: -1, Field: field, A: x, B: y})
+		}
+	}
+	addImageDiff("architecture", a.Architecture, b.Architecture)
+	addImageDiff("created", a.Created, b.Created)
+	addImageDiff("entrypoint", fmt.Sprintf("%q", a.Config.Entrypoint), fmt.Sprintf("%q", b.Config.Entrypoint))
+	addImageDiff("cmd", fmt.Sprintf("%q", a.Config.Cmd), fmt.Sprintf("%q", b.Config.Cmd))
+	addImageDiff("env", fmt.Sprintf("%q", a.Config.Env), fmt.Sprintf("%q", b.Config.Env))
+	addImageDiff("workdir", a.Config.WorkingDir, b.Config.WorkingDir)
+	addImageDiff("layers", strconv.Itoa(len(a.Layers)), strconv.Itoa(len(b.Layers)))
+
+	// We compare the layers pairwise.  If one image has more layers than the
+	// other, we compare the surplus layers to empty layers.
+	for i := range max(len(a.Layers), len(b.Layers)) {
+		entriesA, err := layerEntries(a, i)
+		if err != nil {
+			return nil, err
+		}
+		entriesB, err := layerEntries(b, i)
+		if err != nil {
+			return nil, err
+		}
+		diffs = append(diffs, diffEntries(i, entriesA, entriesB)...)
+	}
+	return diffs, nil
+}
+
+// layerEntries returns the given layer's entries, keyed by path, or no entries
+// if the layer doesn't exist.
+func layerEntries(img *Image, layer int) (map[string]Entry, error) {
+	entries := make(map[string]Entry)
+	if layer >= len(img.Layers) {
+		return entries, nil
+	}
+	list, err := img.LayerEntries(layer)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range list {
+		entries[e.Path] = e
+	}
+	return entries, nil
+}
+
+func diffEntries(layer int, a, b map[string]Entry) []Difference {
+	var diffs []Difference
+	paths := slices.Sorted(maps.Keys(a))
+	for p := range b {
+		if _, ok := a[p]; !ok {
+			paths = append(paths, p)
+		}
+	}
+	slices.Sort(paths)
+
+	for _, p := range paths {
+		add := func(field, x, y string) {
+			if x != y {
+				diffs = append(diffs, Difference{Layer: layer, Path: p, Field: field, A: x, B: y})
+			}
+		}
+		x, okA := a[p]
+		y, okB := b[p]
+		if !okA || !okB {
+			add("exists", strconv.FormatBool(okA), strconv.FormatBool(okB))
+			continue
+		}
+		add("type", string(rune(x.Type)), string(rune(y.Type)))
+		add("mode", fmt.Sprintf("%#o", x.Mode), fmt.Sprintf("%#o", y.Mode))
+		add("mtime", x.ModTime.Format(time.RFC3339Nano), y.ModTime.Format(time.RFC3339Nano))
+		add("owner", owner(x), owner(y))
+		add("size", strconv.FormatInt(x.Size, 10), strconv.FormatInt(y.Size, 10))
+		add("link", x.Linkname, y.Linkname)
+		add("sha256", x.SHA256, y.SHA256)
+	}
+	return diffs
+}
+
+func owner(e Entry) string {
+	return fmt.Sprintf("%d:%d (%s:%s)", e.UID, e.GID, e.Uname, e.Gname)
+}
@@ -0,0 +1,145 @@
+package oci
+
+import (
+	"archive/tar"
+	"io"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/Amnesic-Systems/veil/internal/errs"
+)
+
+// See the OCI image specification for details on whiteouts:
+// https://github.com/opencontainers/image-spec/blob/main/layer.md#whiteouts
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = whiteoutPrefix + whiteoutPrefix + ".opq"
+)
+
+// File represents a file in an image's root file system.  Data is only set for
+// regular files.
+type File struct {
+	Header *tar.Header
+	Data   []byte
+}
+
+// CleanPath turns the given tar path into a relative path without a leading
+// "./" or "/".  The root directory is returned as the empty string.
+func CleanPath(p string) string {
+	return strings.TrimPrefix(path.Clean("/"+p), "/")
+}
+
+// Flatten applies the image's layers on top of each other and returns the
+// resulting root file system, sorted by path.  Whiteouts are applied, hard
+// links are turned into regular files, and missing parent directories are
+// added.
+func (img *Image) Flatten() (_ []*File, err error) {
+	defer errs.Wrap(&err, "failed to flatten image")
+
+	files := make(map[string]*File)
+	for i := range img.Layers {
+		// Whiteouts only apply to lower layers, which is why we apply a
+		// layer's files only after we processed its whiteouts.
+		var added []*File
+		if err := img.WalkLayer(i, func(hdr *tar.Header, r io.Reader) error {
+			name := CleanPath(hdr.Name)
+			if name == "" {
+				return nil
+			}
+			dir, base := path.Split(name)
+			switch {
+			case base == whiteoutOpaque:
+				removeChildren(files, path.Clean(dir))
+			case strings.HasPrefix(base, whiteoutPrefix):
+				target := path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix))
+				delete(files, target)
+				removeChildren(files, target)
+			default:
+				f := &File{Header: copyHeader(hdr, name)}
+				if hdr.Typeflag == tar.TypeReg {
+					data, err := io.ReadAll(r)
+					if err != nil {
+						return err
+					}
+					f.Data = data
+				}
+				added = append(added, f)
+			}
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+
+		for _, f := range added {
+			name := f.Header.Name
+			// Hard links refer to a file in the same or a lower layer.  We turn
+			// them into copies of the file's current state.
+			if f.Header.Typeflag == tar.TypeLink {
+				target, ok := files[f.Header.Linkname]
+				if !ok || target.Header.Typeflag != tar.TypeReg {
+					continue
+				}
+				h := *target.Header
+				h.Name = name
+				f = &File{Header: &h, Data: target.Data}
+			}
+			if old, ok := files[name]; ok &&
+				old.Header.Typeflag == tar.TypeDir &&
+				f.Header.Typeflag != tar.TypeDir {
+				removeChildren(files, name)
+			}
+			files[name] = f
+		}
+	}
+
+	addParentDirs(files)
+
+	sorted := make([]*File, 0, len(files))
+	for _, f := range files {
+		sorted = append(sorted, f)
+	}
+	slices.SortFunc(sorted, func(a, b *File) int {
+		return strings.Compare(a.Header.Name, b.Header.Name)
+	})
+	return sorted, nil
+}
+
+func copyHeader(hdr *tar.Header, name string) *tar.Header {
+	h := *hdr
+	h.Name = name
+	if h.Typeflag == tar.TypeRegA {
+		h.Typeflag = tar.TypeReg
+	}
+	if h.Typeflag == tar.TypeLink {
+		h.Linkname = CleanPath(h.Linkname)
+	}
+	return &h
+}
+
+func removeChildren(files map[string]*File, dir string) {
+	prefix := dir + "/"
+	if dir == "." || dir == "" {
+		prefix = ""
+	}
+	for name := range files {
+		if strings.HasPrefix(name, prefix) && name != dir {
+			delete(files, name)
+		}
+	}
+}
+
+func addParentDirs(files map[string]*File) {
+	for name := range files {
+		for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+			if _, ok := files[dir]; ok {
+				break
+			}
+			files[dir] = &File{Header: &tar.Header{
+				Name:     dir,
+				Typeflag: tar.TypeDir,
+				Mode:     0o755,
+			}}
+		}
+	}
+}
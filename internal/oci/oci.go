@@ -0,0 +1,234 @@
+// Package oci reads container image tarballs, i.e., the tar archives that are
+// created by "docker save", kaniko's --tarPath, or BuildKit's OCI exporter.
+// Both the Docker archive format and the OCI image layout are supported.
+package oci
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/Amnesic-Systems/veil/internal/errs"
+)
+
+const (
+	dockerManifest = "manifest.json"
+	ociIndex       = "index.json"
+	mediaTypeIndex = "application/vnd.oci.image.index.v1+json"
+	// maxMetadataLen caps the size of the JSON files that we read into memory.
+	maxMetadataLen = 4 << 20
+)
+
+var ErrNotFound = errors.New("file not found in image tarball")
+
+// Config contains the parts of an image's configuration that matter for
+// running the image.
+type Config struct {
+	Entrypoint []string `json:"Entrypoint"`
+	Cmd        []string `json:"Cmd"`
+	Env        []string `json:"Env"`
+	WorkingDir string   `json:"WorkingDir"`
+}
+
+// imageConfig represents an image's configuration file, as specified in:
+// https://github.com/opencontainers/image-spec/blob/main/config.md
+type imageConfig struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Created      string `json:"created"`
+	Config       Config `json:"config"`
+}
+
+// Image represents a container image tarball.
+type Image struct {
+	// Path is the path of the tarball.
+	Path string
+	// Architecture is the image's CPU architecture, e.g., "amd64".
+	Architecture string
+	// Created is the image's creation time, as recorded in its configuration.
+	Created string
+	// Config is the image's run configuration.
+	Config Config
+	// Layers contains the paths of the image's layers inside the tarball,
+	// from the bottom-most to the top-most layer.
+	Layers []string
+}
+
+type dockerManifestEntry struct {
+	Config string   `json:"Config"`
+	Layers []string `json:"Layers"`
+}
+
+type descriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Platform  *struct {
+		Architecture string `json:"architecture"`
+	} `json:"platform,omitempty"`
+}
+
+type ociManifest struct {
+	MediaType string       `json:"mediaType"`
+	Config    descriptor   `json:"config"`
+	Layers    []descriptor `json:"layers"`
+	Manifests []descriptor `json:"manifests"`
+}
+
+// Open reads the image tarball at the given path.  If the tarball is an OCI
+// image index with several images, Open picks the image for the given
+// architecture, or the first image if the architecture is empty.
+func Open(tarball, arch string) (_ *Image, err error) {
+	defer errs.Wrap(&err, "failed to open image tarball %q", tarball)
+
+	img := &Image{Path: tarball}
+	var cfgPath string
+	raw, err := img.readFile(dockerManifest)
+	switch {
+	case err == nil:
+		var entries []dockerManifestEntry
+		if err := json.Unmarshal(raw, &entries); err != nil {
+			return nil, err
+		}
+		if len(entries) != 1 {
+			return nil, fmt.Errorf("expected one image but found %d", len(entries))
+		}
+		cfgPath, img.Layers = entries[0].Config, entries[0].Layers
+	case errors.Is(err, ErrNotFound):
+		if cfgPath, err = img.resolveOCIIndex(arch); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, err
+	}
+
+	raw, err = img.readFile(cfgPath)
+	if err != nil {
+		return nil, err
+	}
+	var cfg imageConfig
+	if err := json.Unmarshal(raw, &cfg); err != nil {
+		return nil, err
+	}
+	img.Architecture, img.Created, img.Config = cfg.Architecture, cfg.Created, cfg.Config
+	return img, nil
+}
+
+// resolveOCIIndex follows the tarball's OCI index to an image manifest.  It
+// sets the image's layers and returns the path of the image's configuration.
+func (img *Image) resolveOCIIndex(arch string) (string, error) {
+	raw, err := img.readFile(ociIndex)
+	if err != nil {
+		return "", err
+	}
+	// Indexes may point to other indexes, so we follow them until we arrive
+	// at an image manifest.
+	for range 3 {
+		var m ociManifest
+		if err := json.Unmarshal(raw, &m); err != nil {
+			return "", err
+		}
+		if len(m.Manifests) == 0 {
+			img.Layers = make([]string, len(m.Layers))
+			for i, l := range m.Layers {
+				img.Layers[i] = blobPath(l.Digest)
+			}
+			return blobPath(m.Config.Digest), nil
+		}
+
+		next := m.Manifests[0]
+		for _, d := range m.Manifests {
+			if arch != "" && d.Platform != nil && d.Platform.Architecture == arch {
+				next = d
+				break
+			}
+		}
+		if raw, err = img.readFile(blobPath(next.Digest)); err != nil {
+			return "", err
+		}
+	}
+	return "", fmt.Errorf("%w: nested too deeply", errs.ErrInvalidFormat)
+}
+
+func blobPath(digest string) string {
+	return path.Join("blobs", strings.Replace(digest, ":", "/", 1))
+}
+
+// forFile calls the given function with a reader for the given file inside
+// the tarball.
+func (img *Image) forFile(name string, fn func(io.Reader) error) error {
+	f, err := os.Open(img.Path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+
+	name = path.Clean(name)
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return fmt.Errorf("%w: %s", ErrNotFound, name)
+		}
+		if err != nil {
+			return err
+		}
+		if path.Clean(hdr.Name) == name {
+			return fn(tr)
+		}
+	}
+}
+
+func (img *Image) readFile(name string) (b []byte, err error) {
+	err = img.forFile(name, func(r io.Reader) error {
+		b, err = io.ReadAll(io.LimitReader(r, maxMetadataLen))
+		return err
+	})
+	return b, err
+}
+
+// WalkLayer calls the given function for each file in the given layer.  The
+// function's reader provides the file's content.
+func (img *Image) WalkLayer(
+	layer int,
+	fn func(*tar.Header, io.Reader) error,
+) error {
+	if layer < 0 || layer >= len(img.Layers) {
+		return fmt.Errorf("layer %d does not exist", layer)
+	}
+	return img.forFile(img.Layers[layer], func(r io.Reader) error {
+		// Layers may or may not be gzip-compressed.
+		br := bufio.NewReader(r)
+		if magic, err := br.Peek(2); err == nil && bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+			gr, err := gzip.NewReader(br)
+			if err != nil {
+				return err
+			}
+			defer func() { _ = gr.Close() }()
+			r = gr
+		} else {
+			r = br
+		}
+
+		tr := tar.NewReader(r)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err := fn(hdr, tr); err != nil {
+				return err
+			}
+		}
+	})
+}
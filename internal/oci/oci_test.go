@@ -0,0 +1,198 @@
+package oci
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"maps"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/Amnesic-Systems/veil/internal/testutil"
+)
+
+var testConfig = map[string]any{
+	"architecture": "amd64",
+	"os":           "linux",
+	"created":      "1970-01-01T00:00:00Z",
+	"config": map[string]any{
+		"Entrypoint": []string{"/bin/app"},
+		"Cmd":        []string{"-flag"},
+		"Env":        []string{"PATH=/bin"},
+	},
+}
+
+func testLayers(t *testing.T) [][]byte {
+	return [][]byte{
+		testutil.NewTar(t,
+			testutil.TarFile{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0o755},
+			testutil.TarFile{Name: "bin/app", Body: "app v1", Mode: 0o755},
+			testutil.TarFile{Name: "etc/deleted", Body: "deleted"},
+			testutil.TarFile{Name: "opaque/old", Body: "old"},
+			testutil.TarFile{Name: "link", Typeflag: tar.TypeLink, Linkname: "bin/app"},
+		),
+		// The second layer is compressed.
+		testutil.Gzip(t, testutil.NewTar(t,
+			testutil.TarFile{Name: "./bin/app", Body: "app v2", Mode: 0o755},
+			testutil.TarFile{Name: "etc/.wh.deleted"},
+			testutil.TarFile{Name: "opaque/.wh..wh..opq"},
+			testutil.TarFile{Name: "opaque/new", Body: "new"},
+			testutil.TarFile{Name: "usr/bin/sh", Typeflag: tar.TypeSymlink, Linkname: "/bin/app"},
+		)),
+	}
+}
+
+func TestOpenDockerArchive(t *testing.T) {
+	img, err := Open(testutil.NewImageTarball(t, testConfig, testLayers(t)...), "")
+	require.NoError(t, err)
+	require.Equal(t, "amd64", img.Architecture)
+	require.Equal(t, []string{"/bin/app"}, img.Config.Entrypoint)
+	require.Equal(t, []string{"-flag"}, img.Config.Cmd)
+	require.Len(t, img.Layers, 2)
+}
+
+func TestOpenOCILayout(t *testing.T) {
+	layer := testLayers(t)[0]
+	config, err := json.Marshal(testConfig)
+	require.NoError(t, err)
+	manifest, err := json.Marshal(map[string]any{
+		"config": map[string]string{"digest": "sha256:config"},
+		"layers": []map[string]string{{"digest": "sha256:layer"}},
+	})
+	require.NoError(t, err)
+	index, err := json.Marshal(map[string]any{
+		"manifests": []map[string]any{
+			{
+				"digest":   "sha256:other",
+				"platform": map[string]string{"architecture": "arm64"},
+			},
+			{
+				"digest":   "sha256:manifest",
+				"platform": map[string]string{"architecture": "amd64"},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	p := filepath.Join(t.TempDir(), "oci.tar")
+	require.NoError(t, os.WriteFile(p, testutil.NewTar(t,
+		testutil.TarFile{Name: "index.json", Body: string(index)},
+		testutil.TarFile{Name: "blobs/sha256/manifest", Body: string(manifest)},
+		testutil.TarFile{Name: "blobs/sha256/config", Body: string(config)},
+		testutil.TarFile{Name: "blobs/sha256/layer", Body: string(layer)},
+	), 0o600))
+
+	img, err := Open(p, "amd64")
+	require.NoError(t, err)
+	require.Equal(t, []string{"blobs/sha256/layer"}, img.Layers)
+	files, err := img.Flatten()
+	require.NoError(t, err)
+	require.NotEmpty(t, files)
+
+	// The arm64 manifest is missing from the tarball.
+	_, err = Open(p, "arm64")
+	require.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestOpenErrors(t *testing.T) {
+	_, err := Open(filepath.Join(t.TempDir(), "missing.tar"), "")
+	require.Error(t, err)
+
+	p := filepath.Join(t.TempDir(), "empty.tar")
+	require.NoError(t, os.WriteFile(p, testutil.NewTar(t), 0o600))
+	_, err = Open(p, "")
+	require.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestFlatten(t *testing.T) {
+	img, err := Open(testutil.NewImageTarball(t, testConfig, testLayers(t)...), "")
+	require.NoError(t, err)
+	files, err := img.Flatten()
+	require.NoError(t, err)
+
+	got := make(map[string]string)
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Header.Name)
+		got[f.Header.Name] = string(f.Data)
+	}
+	require.Equal(t, []string{
+		"bin",
+		"bin/app",
+		"link",
+		"opaque",
+		"opaque/new",
+		"usr",
+		"usr/bin",
+		"usr/bin/sh",
+	}, names)
+	// The directory "etc" is gone because it was never explicitly created and
+	// its only file was deleted.
+	require.Equal(t, "app v2", got["bin/app"])
+	require.Equal(t, "app v1", got["link"])
+	require.Equal(t, "new", got["opaque/new"])
+}
+
+func TestCleanPath(t *testing.T) {
+	cases := map[string]string{
+		"./":         "",
+		"/":          "",
+		"./foo/bar":  "foo/bar",
+		"/foo/":      "foo",
+		"foo/../bar": "bar",
+	}
+	for in, want := range cases {
+		require.Equal(t, want, CleanPath(in), in)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	img, err := Open(testutil.NewImageTarball(t, testConfig, testLayers(t)...), "")
+	require.NoError(t, err)
+	diffs, err := Diff(img, img)
+	require.NoError(t, err)
+	require.Empty(t, diffs)
+
+	otherConfig := maps.Clone(testConfig)
+	otherConfig["created"] = "2024-01-01T00:00:00Z"
+	layers := testLayers(t)
+	layers[0] = testutil.NewTar(t,
+		testutil.TarFile{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0o700},
+		testutil.TarFile{Name: "bin/app", Body: "app v1", Mode: 0o755, ModTime: time.Unix(1, 0), Uid: 1000},
+		testutil.TarFile{Name: "etc/deleted", Body: "changed"},
+		testutil.TarFile{Name: "opaque/old", Body: "old"},
+		testutil.TarFile{Name: "link", Typeflag: tar.TypeLink, Linkname: "bin/app"},
+		testutil.TarFile{Name: "new", Body: "new"},
+	)
+	other, err := Open(testutil.NewImageTarball(t, otherConfig, append(layers, testutil.NewTar(t,
+		testutil.TarFile{Name: "extra", Body: "extra"},
+	))...), "")
+	require.NoError(t, err)
+
+	diffs, err = Diff(img, other)
+	require.NoError(t, err)
+	var got []string
+	for _, d := range diffs {
+		got = append(got, d.String())
+	}
+	require.Equal(t, []string{
+		"image: created: 1970-01-01T00:00:00Z != 2024-01-01T00:00:00Z",
+		"image: layers: 2 != 3",
+		"layer 0: bin: mode: 0755 != 0700",
+		"layer 0: bin/app: mtime: 1970-01-01T00:00:00Z != 1970-01-01T00:00:01Z",
+		"layer 0: bin/app: owner: 0:0 (:) != 1000:0 (:)",
+		"layer 0: etc/deleted: sha256: " + sha256Hex("deleted") + " != " + sha256Hex("changed"),
+		"layer 0: new: exists: false != true",
+		"layer 2: extra: exists: false != true",
+	}, got)
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
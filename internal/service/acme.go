@@ -0,0 +1,261 @@
+package service
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+
+	"github.com/Amnesic-Systems/veil/internal/config"
+	"github.com/Amnesic-Systems/veil/internal/errs"
+)
+
+const (
+	// challengeTLSALPN01 is the type of the only ACME challenge that we
+	// solve.  Unlike HTTP-01, TLS-ALPN-01 works on the external Web server's
+	// TLS port, which is the only port that the enclave exposes.
+	challengeTLSALPN01 = "tls-alpn-01"
+	// acmeTimeout bounds the time that we spend on a single certificate
+	// order.
+	acmeTimeout = 10 * time.Minute
+	// If an order fails, we try again after acmeMinRetry, and double the delay
+	// after each failure, up to acmeMaxRetry.  ACME servers rate-limit failed
+	// validations, so we must not retry too eagerly.
+	acmeMinRetry = 10 * time.Second
+	acmeMaxRetry = time.Hour
+)
+
+var errNoTLSALPN01 = errors.New("ACME server offers no tls-alpn-01 challenge")
+
+// acmeManager obtains and renews certificates from an ACME server.  Both the
+// ACME account key and the certificates' keys are generated in the enclave and
+// never leave it.
+type acmeManager struct {
+	client *acme.Client
+	email  string
+
+	// regMu serializes account registration because we obtain the
+	// certificates of several host names concurrently.
+	regMu sync.Mutex
+
+	// challenges maps domain names to the certificates that solve their
+	// pending TLS-ALPN-01 challenges.
+	mu         sync.Mutex
+	challenges map[string]*tls.Certificate
+}
+
+// newACMEManager returns a new acmeManager that uses the ACME server in the
+// given configuration.
+func newACMEManager(cfg *config.Veil) (_ *acmeManager, err error) {
+	defer errs.Wrap(&err, "failed to create ACME manager")
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if cfg.ACMERoots != "" {
+		pem, err := os.ReadFile(cfg.ACMERoots)
+		if err != nil {
+			return nil, err
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.ACMERoots)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+	}
+
+	return &acmeManager{
+		client: &acme.Client{
+			Key:          key,
+			DirectoryURL: cfg.ACMEDirectory,
+			HTTPClient:   &http.Client{Transport: transport},
+			UserAgent:    "veil",
+		},
+		email:      cfg.ACMEEmail,
+		challenges: make(map[string]*tls.Certificate),
+	}, nil
+}
+
+// isChallenge returns true if the given ClientHello is an ACME server's
+// attempt to validate a TLS-ALPN-01 challenge.
+func isChallenge(hello *tls.ClientHelloInfo) bool {
+	return len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == acme.ALPNProto
+}
+
+// getChallengeCert returns the certificate that solves the pending
+// TLS-ALPN-01 challenge for the given ClientHello's server name.
+func (m *acmeManager) getChallengeCert(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	cert, ok := m.challenges[hello.ServerName]
+	if !ok {
+		return nil, fmt.Errorf("no pending ACME challenge for %q", hello.ServerName)
+	}
+	return cert, nil
+}
+
+func (m *acmeManager) setChallengeCert(domain string, cert *tls.Certificate) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if cert == nil {
+		delete(m.challenges, domain)
+		return
+	}
+	m.challenges[domain] = cert
+}
+
+// register creates our ACME account unless we already have one.
+func (m *acmeManager) register(ctx context.Context) error {
+	m.regMu.Lock()
+	defer m.regMu.Unlock()
+
+	if m.client.KID != "" {
+		return nil
+	}
+	acct := new(acme.Account)
+	if m.email != "" {
+		acct.Contact = []string{"mailto:" + m.email}
+	}
+	_, err := m.client.Register(ctx, acct, acme.AcceptTOS)
+	if errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return nil
+	}
+	return err
+}
+
+// obtain orders, validates, and returns a new certificate for the given domain
+// names.
+func (m *acmeManager) obtain(ctx context.Context, names []string) (_ *tls.Certificate, err error) {
+	defer errs.Wrap(&err, "failed to obtain ACME certificate")
+
+	ctx, cancel := context.WithTimeout(ctx, acmeTimeout)
+	defer cancel()
+
+	if err := m.register(ctx); err != nil {
+		return nil, err
+	}
+	order, err := m.client.AuthorizeOrder(ctx, acme.DomainIDs(names...))
+	if err != nil {
+		return nil, err
+	}
+	for _, url := range order.AuthzURLs {
+		if err := m.authorize(ctx, url); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := m.client.WaitOrder(ctx, order.URI); err != nil {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		DNSNames: names,
+	}, key)
+	if err != nil {
+		return nil, err
+	}
+	chain, _, err := m.client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(chain[0])
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: chain, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// authorize solves the TLS-ALPN-01 challenge of the given authorization,
+// unless the authorization is already valid.
+func (m *acmeManager) authorize(ctx context.Context, url string) error {
+	authz, err := m.client.GetAuthorization(ctx, url)
+	if err != nil {
+		return err
+	}
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+	var chal *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == challengeTLSALPN01 {
+			chal = c
+			break
+		}
+	}
+	if chal == nil {
+		return errNoTLSALPN01
+	}
+
+	domain := authz.Identifier.Value
+	cert, err := m.client.TLSALPN01ChallengeCert(chal.Token, domain)
+	if err != nil {
+		return err
+	}
+	m.setChallengeCert(domain, &cert)
+	defer m.setChallengeCert(domain, nil)
+
+	if _, err := m.client.Accept(ctx, chal); err != nil {
+		return err
+	}
+	_, err = m.client.WaitAuthorization(ctx, authz.URI)
+	return err
+}
+
+// renewAt returns the time at which we renew the given certificate, i.e.,
+// after two thirds of its lifetime.  For Let's Encrypt's 90-day certificates,
+// that's 30 days before they expire.
+func renewAt(cert *x509.Certificate) time.Time {
+	lifetime := cert.NotAfter.Sub(cert.NotBefore)
+	return cert.NotBefore.Add(lifetime * 2 / 3)
+}
+
+// manage obtains a certificate, installs it in the given certificate store,
+// and renews it until the given context is canceled.  If an order fails, we
+// keep serving the current certificate and try again with exponential
+// backoff.
+func (m *acmeManager) manage(ctx context.Context, certs *certStore) {
+	domains := strings.Join(certs.names, ", ")
+	retry := acmeMinRetry
+	for {
+		var next time.Time
+		cert, err := m.obtain(ctx, certs.names)
+		if err == nil {
+			err = certs.install(cert)
+		}
+		if err != nil {
+			log.Print(err)
+			next = time.Now().Add(retry)
+			retry = min(2*retry, acmeMaxRetry)
+		} else {
+			log.Printf("Installed ACME certificate for %s, valid until %s.",
+				domains, cert.Leaf.NotAfter.Format(time.RFC3339))
+			next = renewAt(cert.Leaf)
+			retry = acmeMinRetry
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(next)):
+		}
+	}
+}
@@ -1,7 +1,6 @@
 package attestation
 
 import (
-	"bytes"
 	"crypto/sha256"
 
 	"github.com/Amnesic-Systems/veil/internal/enclave"
@@ -30,10 +29,18 @@ func GetSHA256(aux *enclave.AuxInfo) (*[sha256.Size]byte, error) {
 	return &sha, nil
 }
 
+// GetHashes returns the hashes from the claims in the given auxiliary info.
 func GetHashes(aux *enclave.AuxInfo) (*Hashes, error) {
 	if aux.PublicKey == nil {
 		return nil, errs.ErrIsNil
 	}
-	sanitized := bytes.Trim(aux.PublicKey[:], "\x00") // TODO: smth better?
-	return DeserializeHashes(sanitized)
+	return DeserializeHashes(aux.PublicKey)
+}
+
+// GetClaims returns the claims from the given auxiliary info.
+func GetClaims(aux *enclave.AuxInfo) (*Claims, error) {
+	if aux.PublicKey == nil {
+		return nil, errs.ErrIsNil
+	}
+	return ParseClaims(aux.PublicKey)
 }
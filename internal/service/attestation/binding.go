@@ -0,0 +1,42 @@
+package attestation
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
+
+	"github.com/Amnesic-Systems/veil/internal/errs"
+	"github.com/Amnesic-Systems/veil/internal/nonce"
+)
+
+const (
+	// The label and length of the tls-exporter channel binding, as defined
+	// in RFC 9266.
+	exporterLabel = "EXPORTER-Channel-Binding"
+	exporterLen   = 32
+)
+
+// ChannelBinding returns the value that binds an attestation document to the
+// TLS connection with the given state and to the given nonce: the SHA-256 hash
+// over the nonce and the connection's tls-exporter channel binding (RFC 9266).
+// Client and server compute the same value, but a man-in-the-middle, even one
+// that holds a copy of the enclave's certificate and key, ends up with
+// different values on its connections to the client and the enclave.
+func ChannelBinding(cs *tls.ConnectionState, n *nonce.Nonce) (_ [sha256.Size]byte, err error) {
+	defer errs.Wrap(&err, "failed to derive channel binding")
+
+	if cs == nil {
+		return [sha256.Size]byte{}, errors.New("connection doesn't use TLS")
+	}
+	if n == nil {
+		return [sha256.Size]byte{}, errs.ErrIsNil
+	}
+	// ExportKeyingMaterial fails for TLS 1.2 connections without the
+	// extended master secret extension, whose exported keying material isn't
+	// unique to the connection.
+	ekm, err := cs.ExportKeyingMaterial(exporterLabel, nil, exporterLen)
+	if err != nil {
+		return [sha256.Size]byte{}, err
+	}
+	return sha256.Sum256(append(n.ToSlice(), ekm...)), nil
+}
@@ -0,0 +1,43 @@
+package attestation
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/Amnesic-Systems/veil/internal/errs"
+	"github.com/Amnesic-Systems/veil/internal/nonce"
+	"github.com/Amnesic-Systems/veil/internal/util/must"
+)
+
+func TestChannelBinding(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer srv.Close()
+	connState := func() *tls.ConnectionState {
+		// Disable keep-alives, so that every request uses a new connection.
+		client := srv.Client()
+		client.Transport.(*http.Transport).DisableKeepAlives = true
+		resp, err := client.Get(srv.URL)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		return resp.TLS
+	}
+	n1, n2 := must.Get(nonce.New()), must.Get(nonce.New())
+	cs1, cs2 := connState(), connState()
+
+	b1, err := ChannelBinding(cs1, n1)
+	require.NoError(t, err)
+	// The binding is deterministic, and differs across nonces and
+	// connections.
+	require.Equal(t, b1, must.Get(ChannelBinding(cs1, n1)))
+	require.NotEqual(t, b1, must.Get(ChannelBinding(cs1, n2)))
+	require.NotEqual(t, b1, must.Get(ChannelBinding(cs2, n1)))
+
+	_, err = ChannelBinding(nil, n1)
+	require.Error(t, err)
+	_, err = ChannelBinding(cs1, nil)
+	require.ErrorIs(t, err, errs.ErrIsNil)
+}
@@ -2,6 +2,7 @@ package attestation
 
 import (
 	"crypto/sha256"
+	"sync"
 
 	"github.com/Amnesic-Systems/veil/internal/enclave"
 	"github.com/Amnesic-Systems/veil/internal/nonce"
@@ -10,10 +11,18 @@ import (
 // Builder is an abstraction purpose-built for veil's HTTP handlers.  It bundles
 // an attester with auxiliary fields because these two are always used together.
 // As a Builder is passed through the stack, its auxiliary fields are updated
-// and eventually used to create an attestation document.
+// and eventually used to create an attestation document.  HTTP handlers share
+// a Builder, so the fields that are specific to a request must be passed to
+// Attest, which doesn't retain them.
 type Builder struct {
 	enclave.Attester
+	// mu guards the auxiliary fields and hashes.
+	mu sync.Mutex
 	enclave.AuxInfo
+	// hashes are serialized into the public key field whenever we attest, so
+	// that attestation documents reflect hashes and claims that the
+	// application set after we were created.
+	hashes *Hashes
 }
 
 type auxField func(*Builder)
@@ -30,18 +39,29 @@ func NewBuilder(attester enclave.Attester, opts ...auxField) *Builder {
 
 // Update updates the builder with the given auxiliary fields.
 func (b *Builder) Update(opts ...auxField) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
 	for _, opt := range opts {
 		opt(b)
 	}
 }
 
 // Attest returns an attestation document with the auxiliary fields that were
-// either already set, or are now passed in as options.
+// either already set, or are now passed in as options.  The options only apply
+// to this attestation document and don't change the builder.
 func (b *Builder) Attest(opts ...auxField) (*enclave.RawDocument, error) {
+	b.mu.Lock()
+	req := &Builder{AuxInfo: b.AuxInfo, hashes: b.hashes}
+	b.mu.Unlock()
+
 	for _, opt := range opts {
-		opt(b)
+		opt(req)
+	}
+	if req.hashes != nil {
+		req.PublicKey = req.hashes.Serialize()
 	}
-	return b.Attester.Attest(&b.AuxInfo)
+	return b.Attester.Attest(&req.AuxInfo)
 }
 
 // WithHashes sets the given hashes in an auxiliary field.
@@ -50,6 +70,7 @@ func WithHashes(h *Hashes) auxField {
 		if h == nil {
 			return
 		}
+		b.hashes = h
 		b.PublicKey = h.Serialize()
 	}
 }
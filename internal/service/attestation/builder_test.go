@@ -77,3 +77,31 @@ func TestBuilder(t *testing.T) {
 		})
 	}
 }
+
+func TestBuilderUpdatedHashes(t *testing.T) {
+	hashes := &Hashes{TlsKeyHash: addr.Of(sha256.Sum256([]byte("foo")))}
+	b := NewBuilder(noop.NewAttester(), WithHashes(hashes))
+
+	// The application sets its hash after the builder was created.
+	hashes.SetAppHash(addr.Of(sha256.Sum256([]byte("bar"))))
+	rawDoc, err := b.Attest()
+	require.NoError(t, err)
+	doc, err := noop.NewAttester().Verify(rawDoc, nil)
+	require.NoError(t, err)
+
+	got, err := GetHashes(&doc.AuxInfo)
+	require.NoError(t, err)
+	require.Equal(t, hashes.AppKeyHash, got.AppKeyHash)
+}
+
+func TestBuilderAttestDoesNotPersist(t *testing.T) {
+	b := NewBuilder(noop.NewAttester())
+
+	_, err := b.Attest(WithSHA256(sha256.Sum256([]byte("foo"))))
+	require.NoError(t, err)
+	rawDoc, err := b.Attest()
+	require.NoError(t, err)
+	doc, err := noop.NewAttester().Verify(rawDoc, nil)
+	require.NoError(t, err)
+	require.Empty(t, doc.UserData)
+}
@@ -0,0 +1,146 @@
+package attestation
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+
+	"github.com/fxamacker/cbor/v2"
+
+	"github.com/Amnesic-Systems/veil/internal/enclave"
+	"github.com/Amnesic-Systems/veil/internal/errs"
+	"github.com/Amnesic-Systems/veil/internal/util/must"
+)
+
+const (
+	// LegacyClaimsVersion is the version of claims that we parsed from the
+	// legacy "sha256:<b64>;sha256:<b64>" format.  We never encode it.
+	LegacyClaimsVersion = 0
+	// ClaimsVersion is the version of the claims that we encode.
+	ClaimsVersion = 1
+	// The names of the key hashes in Claims.Keys.  KeyTLSPrevious belongs
+	// to the TLS certificate that the enclave served before its most recent
+	// rotation.  If the enclave serves a separate certificate for each host
+	// name, the names of the host names' hashes are, e.g.,
+	// "tls:api.example.com" and "tls_prev:api.example.com".
+	KeyTLS         = "tls"
+	KeyTLSPrevious = "tls_prev"
+	KeyApp         = "app"
+	// AlgSHA256 identifies SHA-256 digests.
+	AlgSHA256 = "sha256"
+
+	legacyPrefix = "sha256:"
+	hostSep      = ":"
+)
+
+var (
+	// Claims are encoded in CBOR's core deterministic encoding, so the same
+	// claims always result in the same bytes.
+	claimsEncMode = must.Get(cbor.CoreDetEncOptions().EncMode())
+	claimsDecMode = must.Get(cbor.DecOptions{
+		DupMapKey:   cbor.DupMapKeyEnforcedAPF,
+		IndefLength: cbor.IndefLengthForbidden,
+	}.DecMode())
+)
+
+// Claims is the versioned set of claims that an enclave embeds in the public
+// key field of its attestation documents.  Claims are CBOR-encoded with
+// integer map keys to keep them compact, and must fit in
+// enclave.AuxFieldLen bytes.
+type Claims struct {
+	Version uint `cbor:"1,keyasint"`
+	// Keys maps key names (e.g., KeyTLS and KeyApp) to the digests of the
+	// corresponding public keys or certificates.
+	Keys map[string]Digest `cbor:"2,keyasint,omitempty"`
+	// Config is the optional digest of the enclave's configuration.
+	Config *Digest `cbor:"3,keyasint,omitempty"`
+	// App contains optional claims that the enclave application defines.
+	App map[string][]byte `cbor:"4,keyasint,omitempty"`
+}
+
+// Digest is a hash together with the algorithm that created it.
+type Digest struct {
+	Alg   string `cbor:"1,keyasint"`
+	Value []byte `cbor:"2,keyasint"`
+}
+
+// NewSHA256Digest returns a digest for the given SHA-256 hash.
+func NewSHA256Digest(hash *[sha256.Size]byte) Digest {
+	return Digest{Alg: AlgSHA256, Value: bytes.Clone(hash[:])}
+}
+
+// SHA256 returns the digest's SHA-256 hash, or an error if the digest was
+// created by a different algorithm.
+func (d Digest) SHA256() (*[sha256.Size]byte, error) {
+	if d.Alg != AlgSHA256 || len(d.Value) != sha256.Size {
+		return nil, fmt.Errorf("%w: not a SHA-256 digest", errs.ErrInvalidFormat)
+	}
+	return (*[sha256.Size]byte)(bytes.Clone(d.Value)), nil
+}
+
+// KeySHA256 returns the SHA-256 hash of the given key, or nil if the claims
+// don't contain the key.
+func (c *Claims) KeySHA256(name string) (*[sha256.Size]byte, error) {
+	d, ok := c.Keys[name]
+	if !ok {
+		return nil, nil
+	}
+	return d.SHA256()
+}
+
+// Marshal returns the claims' CBOR encoding, or an error if the encoding
+// doesn't fit in an attestation document's auxiliary field.
+func (c *Claims) Marshal() (_ []byte, err error) {
+	defer errs.Wrap(&err, "failed to marshal claims")
+
+	b, err := claimsEncMode.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > enclave.AuxFieldLen {
+		return nil, fmt.Errorf("claims take %d bytes but must not exceed %d bytes",
+			len(b), enclave.AuxFieldLen)
+	}
+	return b, nil
+}
+
+// ParseClaims parses the given claims.  During the transition to CBOR-encoded
+// claims, we also accept the legacy "sha256:<b64>;sha256:<b64>" format, which
+// results in claims of version LegacyClaimsVersion.
+func ParseClaims(b []byte) (_ *Claims, err error) {
+	defer errs.Wrap(&err, "failed to parse claims")
+
+	if bytes.HasPrefix(b, []byte(legacyPrefix)) {
+		return parseLegacyClaims(b)
+	}
+
+	var c Claims
+	rest, err := claimsDecMode.UnmarshalFirst(b, &c)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errs.ErrInvalidFormat, err)
+	}
+	// Attesters may pad auxiliary fields with NUL bytes, but nothing else may
+	// follow the claims.
+	if len(bytes.TrimRight(rest, "\x00")) != 0 {
+		return nil, fmt.Errorf("%w: trailing data after claims", errs.ErrInvalidFormat)
+	}
+	if c.Version != ClaimsVersion {
+		return nil, fmt.Errorf("%w: unsupported claims version %d", errs.ErrInvalidFormat, c.Version)
+	}
+	return &c, nil
+}
+
+// parseLegacyClaims parses claims in the legacy format, e.g.:
+//
+//	sha256:3CMEDy2oTLyBCLE2BufzgUy6zIY=;sha256:92AfmU4AXOKZpz61NGqqII12Tlw=
+//
+// The second hash, which belongs to the application's key, may be empty.
+func parseLegacyClaims(b []byte) (*Claims, error) {
+	h, err := deserializeLegacyHashes(bytes.TrimRight(b, "\x00"))
+	if err != nil {
+		return nil, err
+	}
+	c := h.claims()
+	c.Version = LegacyClaimsVersion
+	return c, nil
+}
@@ -0,0 +1,135 @@
+package attestation
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Amnesic-Systems/veil/internal/addr"
+	"github.com/Amnesic-Systems/veil/internal/enclave"
+	"github.com/Amnesic-Systems/veil/internal/errs"
+	"github.com/Amnesic-Systems/veil/internal/util/must"
+)
+
+func TestClaims(t *testing.T) {
+	tlsHash := addr.Of(sha256.Sum256([]byte("foo")))
+	appHash := addr.Of(sha256.Sum256([]byte("bar")))
+	configHash := addr.Of(sha256.Sum256([]byte("baz")))
+	// Both hashes in the legacy format.
+	legacy := []byte("sha256:LCa0a2j/xo/5m0U8HTBBNBNCLXBkg7+g+YpeiGJm564=;" +
+		"sha256:/N4rLtula/QIYB+3If6bXDONEO5CnqBPrlURto+/j7k=")
+
+	cases := []struct {
+		name       string
+		in         []byte
+		wantClaims *Claims
+		wantErr    error
+	}{
+		{
+			name: "all fields",
+			in: (&Hashes{
+				TlsKeyHash: tlsHash,
+				AppKeyHash: appHash,
+				ConfigHash: configHash,
+				AppClaims:  map[string][]byte{"region": []byte("eu")},
+			}).Serialize(),
+			wantClaims: &Claims{
+				Version: ClaimsVersion,
+				Keys: map[string]Digest{
+					KeyTLS: NewSHA256Digest(tlsHash),
+					KeyApp: NewSHA256Digest(appHash),
+				},
+				Config: addr.Of(NewSHA256Digest(configHash)),
+				App:    map[string][]byte{"region": []byte("eu")},
+			},
+		},
+		{
+			name: "NUL padding",
+			in:   append((&Hashes{TlsKeyHash: tlsHash}).Serialize(), 0, 0, 0),
+			wantClaims: &Claims{
+				Version: ClaimsVersion,
+				Keys:    map[string]Digest{KeyTLS: NewSHA256Digest(tlsHash)},
+			},
+		},
+		{
+			name: "legacy format",
+			in:   legacy,
+			wantClaims: &Claims{
+				Version: LegacyClaimsVersion,
+				Keys: map[string]Digest{
+					KeyTLS: NewSHA256Digest(tlsHash),
+					KeyApp: NewSHA256Digest(appHash),
+				},
+			},
+		},
+		{
+			name: "legacy format with NUL padding",
+			in:   append(bytes.Clone(legacy), 0, 0),
+			wantClaims: &Claims{
+				Version: LegacyClaimsVersion,
+				Keys: map[string]Digest{
+					KeyTLS: NewSHA256Digest(tlsHash),
+					KeyApp: NewSHA256Digest(appHash),
+				},
+			},
+		},
+		{
+			name:    "trailing data",
+			in:      append((&Hashes{TlsKeyHash: tlsHash}).Serialize(), 'x'),
+			wantErr: errs.ErrInvalidFormat,
+		},
+		{
+			name:    "unsupported version",
+			in:      must.Get(cbor.Marshal(&Claims{Version: ClaimsVersion + 1})),
+			wantErr: errs.ErrInvalidFormat,
+		},
+		{
+			name:    "not CBOR",
+			in:      []byte{0xff},
+			wantErr: errs.ErrInvalidFormat,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			claims, err := ParseClaims(c.in)
+			require.ErrorIs(t, err, c.wantErr)
+			require.Equal(t, c.wantClaims, claims)
+		})
+	}
+}
+
+func TestClaimsDeterministic(t *testing.T) {
+	newHashes := func() *Hashes {
+		h := &Hashes{TlsKeyHash: addr.Of(sha256.Sum256([]byte("foo")))}
+		require.NoError(t, h.SetAppClaims(map[string][]byte{
+			"a": []byte("1"), "b": []byte("2"), "c": []byte("3"),
+		}))
+		return h
+	}
+	require.Equal(t, newHashes().Serialize(), newHashes().Serialize())
+}
+
+func TestDigestSHA256(t *testing.T) {
+	hash := addr.Of(sha256.Sum256([]byte("foo")))
+	got, err := NewSHA256Digest(hash).SHA256()
+	require.NoError(t, err)
+	require.Equal(t, hash, got)
+
+	_, err = Digest{Alg: "sha384", Value: make([]byte, 48)}.SHA256()
+	require.ErrorIs(t, err, errs.ErrInvalidFormat)
+	_, err = Digest{Alg: AlgSHA256, Value: make([]byte, 16)}.SHA256()
+	require.ErrorIs(t, err, errs.ErrInvalidFormat)
+}
+
+func TestSetAppClaims(t *testing.T) {
+	h := &Hashes{TlsKeyHash: addr.Of(sha256.Sum256([]byte("foo")))}
+	require.NoError(t, h.SetAppClaims(map[string][]byte{"small": make([]byte, 512)}))
+	require.Error(t, h.SetAppClaims(map[string][]byte{"large": make([]byte, enclave.AuxFieldLen)}))
+	// A failed update leaves the previous claims in place.
+	require.Len(t, h.AppClaims["small"], 512)
+	require.LessOrEqual(t, len(h.Serialize()), enclave.AuxFieldLen)
+}
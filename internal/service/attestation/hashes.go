@@ -4,19 +4,30 @@ import (
 	"crypto/sha256"
 	"encoding/base64"
 	"fmt"
+	"maps"
 	"strings"
 	"sync"
 
 	"github.com/Amnesic-Systems/veil/internal/addr"
 	"github.com/Amnesic-Systems/veil/internal/errs"
+	"github.com/Amnesic-Systems/veil/internal/util/must"
 )
 
 // Hashes contains hashes over public key material which we embed in
 // the enclave's attestation document for clients to verify.
 type Hashes struct {
 	sync.Mutex
-	TlsKeyHash *[sha256.Size]byte `json:"tls_key_hash"` // Always set.
-	AppKeyHash *[sha256.Size]byte `json:"app_key_hash"` // Only set if the application has keys.
+	TlsKeyHash     *[sha256.Size]byte `json:"tls_key_hash"`                // Always set.
+	PrevTlsKeyHash *[sha256.Size]byte `json:"prev_tls_key_hash,omitempty"` // Only set while a rotated certificate overlaps.
+	AppKeyHash     *[sha256.Size]byte `json:"app_key_hash"`                // Only set if the application has keys.
+	ConfigHash     *[sha256.Size]byte `json:"config_hash,omitempty"`       // Only set if the enclave attests its configuration.
+	AppClaims      map[string][]byte  `json:"app_claims,omitempty"`        // Only set if the application defines claims.
+	// HostTlsKeyHashes and PrevHostTlsKeyHashes map host names to the hashes
+	// of their current and previous certificates.  They are only set if the
+	// enclave serves a separate certificate for each host name, in which case
+	// TlsKeyHash belongs to the certificate of the enclave's primary FQDN.
+	HostTlsKeyHashes     map[string]*[sha256.Size]byte `json:"host_tls_key_hashes,omitempty"`
+	PrevHostTlsKeyHashes map[string]*[sha256.Size]byte `json:"prev_host_tls_key_hashes,omitempty"`
 }
 
 func (a *Hashes) SetAppHash(hash *[sha256.Size]byte) {
@@ -33,22 +44,227 @@ func (a *Hashes) SetTLSHash(hash *[sha256.Size]byte) {
 	a.TlsKeyHash = hash
 }
 
-func (a *Hashes) Serialize() []byte {
+// RotateTLSHash sets the given hash as the TLS certificate's hash, and keeps
+// the current hash as the previous certificate's hash.  Clients that pinned
+// the previous certificate can therefore keep verifying the enclave until
+// ExpirePrevTLSHash is called.
+func (a *Hashes) RotateTLSHash(hash *[sha256.Size]byte) {
+	a.Lock()
+	defer a.Unlock()
+
+	a.PrevTlsKeyHash, a.TlsKeyHash = a.TlsKeyHash, hash
+}
+
+// ExpirePrevTLSHash removes the previous TLS certificate's hash if it's the
+// given hash.  If another rotation happened in the meantime, we leave the
+// newer previous hash alone.
+func (a *Hashes) ExpirePrevTLSHash(hash *[sha256.Size]byte) {
+	a.Lock()
+	defer a.Unlock()
+
+	if a.PrevTlsKeyHash != nil && *a.PrevTlsKeyHash == *hash {
+		a.PrevTlsKeyHash = nil
+	}
+}
+
+// RotateHostTLSHash is like RotateTLSHash for the certificate of the given
+// host name.  We return an error if the claims wouldn't fit in the
+// attestation document with the host name's hashes.
+func (a *Hashes) RotateHostTLSHash(host string, hash *[sha256.Size]byte) error {
+	a.Lock()
+	defer a.Unlock()
+
+	if _, ok := a.HostTlsKeyHashes[host]; !ok {
+		worstCase := a.worstCase(a.AppClaims)
+		worstCase.HostTlsKeyHashes[host] = hash
+		worstCase.PrevHostTlsKeyHashes[host] = hash
+		if _, err := worstCase.claims().Marshal(); err != nil {
+			return err
+		}
+	}
+	if prev := a.HostTlsKeyHashes[host]; prev != nil {
+		if a.PrevHostTlsKeyHashes == nil {
+			a.PrevHostTlsKeyHashes = make(map[string]*[sha256.Size]byte)
+		}
+		a.PrevHostTlsKeyHashes[host] = prev
+	}
+	if a.HostTlsKeyHashes == nil {
+		a.HostTlsKeyHashes = make(map[string]*[sha256.Size]byte)
+	}
+	a.HostTlsKeyHashes[host] = hash
+	return nil
+}
+
+// ExpirePrevHostTLSHash is like ExpirePrevTLSHash for the certificate of the
+// given host name.
+func (a *Hashes) ExpirePrevHostTLSHash(host string, hash *[sha256.Size]byte) {
+	a.Lock()
+	defer a.Unlock()
+
+	if prev := a.PrevHostTlsKeyHashes[host]; prev != nil && *prev == *hash {
+		delete(a.PrevHostTlsKeyHashes, host)
+	}
+}
+
+// HasTLSHash returns true if the given hash belongs to one of the current or
+// previous TLS certificates.
+func (a *Hashes) HasTLSHash(hash *[sha256.Size]byte) bool {
+	a.Lock()
+	defer a.Unlock()
+
+	matches := func(h *[sha256.Size]byte) bool { return h != nil && *h == *hash }
+	if matches(a.TlsKeyHash) || matches(a.PrevTlsKeyHash) {
+		return true
+	}
+	for _, hashes := range []map[string]*[sha256.Size]byte{a.HostTlsKeyHashes, a.PrevHostTlsKeyHashes} {
+		for _, h := range hashes {
+			if matches(h) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (a *Hashes) SetConfigHash(hash *[sha256.Size]byte) {
+	a.Lock()
+	defer a.Unlock()
+
+	a.ConfigHash = hash
+}
+
+// SetAppClaims sets the application-defined claims.  We return an error if
+// the claims wouldn't fit in the attestation document, even after all hashes
+// are set.
+func (a *Hashes) SetAppClaims(claims map[string][]byte) error {
 	a.Lock()
 	defer a.Unlock()
 
-	str := fmt.Sprintf("sha256:%s;sha256:",
-		base64.StdEncoding.EncodeToString(a.TlsKeyHash[:]))
-	// The application's hash is optional.
+	if _, err := a.worstCase(claims).claims().Marshal(); err != nil {
+		return err
+	}
+	a.AppClaims = maps.Clone(claims)
+	return nil
+}
+
+// worstCase returns hashes with the given application claims, in which all
+// hashes, including those of the previous certificates, are set.  The caller
+// must hold the lock.
+func (a *Hashes) worstCase(claims map[string][]byte) *Hashes {
+	placeholder := addr.Of([sha256.Size]byte{})
+	w := &Hashes{
+		TlsKeyHash:           placeholder,
+		PrevTlsKeyHash:       placeholder,
+		AppKeyHash:           placeholder,
+		ConfigHash:           placeholder,
+		AppClaims:            claims,
+		HostTlsKeyHashes:     make(map[string]*[sha256.Size]byte),
+		PrevHostTlsKeyHashes: make(map[string]*[sha256.Size]byte),
+	}
+	for host := range a.HostTlsKeyHashes {
+		w.HostTlsKeyHashes[host] = placeholder
+		w.PrevHostTlsKeyHashes[host] = placeholder
+	}
+	return w
+}
+
+// Claims returns the claims that correspond to the hashes.
+func (a *Hashes) Claims() *Claims {
+	a.Lock()
+	defer a.Unlock()
+
+	return a.claims()
+}
+
+func (a *Hashes) claims() *Claims {
+	c := &Claims{
+		Version: ClaimsVersion,
+		Keys:    make(map[string]Digest),
+		App:     maps.Clone(a.AppClaims),
+	}
+	if a.TlsKeyHash != nil {
+		c.Keys[KeyTLS] = NewSHA256Digest(a.TlsKeyHash)
+	}
+	if a.PrevTlsKeyHash != nil {
+		c.Keys[KeyTLSPrevious] = NewSHA256Digest(a.PrevTlsKeyHash)
+	}
+	for host, hash := range a.HostTlsKeyHashes {
+		c.Keys[KeyTLS+hostSep+host] = NewSHA256Digest(hash)
+	}
+	for host, hash := range a.PrevHostTlsKeyHashes {
+		c.Keys[KeyTLSPrevious+hostSep+host] = NewSHA256Digest(hash)
+	}
 	if a.AppKeyHash != nil {
-		str += base64.StdEncoding.EncodeToString(a.AppKeyHash[:])
+		c.Keys[KeyApp] = NewSHA256Digest(a.AppKeyHash)
+	}
+	if a.ConfigHash != nil {
+		c.Config = addr.Of(NewSHA256Digest(a.ConfigHash))
 	}
-	return []byte(str)
+	return c
 }
 
+// Serialize returns the CBOR-encoded claims that correspond to the hashes.
+// SetAppClaims guarantees that the claims fit in the attestation document.
+func (a *Hashes) Serialize() []byte {
+	a.Lock()
+	defer a.Unlock()
+
+	return must.Get(a.claims().Marshal())
+}
+
+// DeserializeHashes parses the given claims, in either the CBOR or the legacy
+// format, and returns the contained hashes.
 func DeserializeHashes(b []byte) (h *Hashes, err error) {
-	errs.Wrap(&err, "failed to deserialize hashes")
+	defer errs.Wrap(&err, "failed to deserialize hashes")
+
+	c, err := ParseClaims(b)
+	if err != nil {
+		return nil, err
+	}
+	return hashesFromClaims(c)
+}
+
+func hashesFromClaims(c *Claims) (_ *Hashes, err error) {
+	h := &Hashes{AppClaims: c.App}
+	if h.TlsKeyHash, err = c.KeySHA256(KeyTLS); err != nil {
+		return nil, err
+	}
+	if h.TlsKeyHash == nil {
+		return nil, fmt.Errorf("%w: claims lack TLS key hash", errs.ErrInvalidFormat)
+	}
+	if h.PrevTlsKeyHash, err = c.KeySHA256(KeyTLSPrevious); err != nil {
+		return nil, err
+	}
+	for name := range c.Keys {
+		key, host, ok := strings.Cut(name, hostSep)
+		if !ok || (key != KeyTLS && key != KeyTLSPrevious) {
+			continue
+		}
+		hashes := &h.HostTlsKeyHashes
+		if key == KeyTLSPrevious {
+			hashes = &h.PrevHostTlsKeyHashes
+		}
+		hash, err := c.KeySHA256(name)
+		if err != nil {
+			return nil, err
+		}
+		if *hashes == nil {
+			*hashes = make(map[string]*[sha256.Size]byte)
+		}
+		(*hashes)[host] = hash
+	}
+	if h.AppKeyHash, err = c.KeySHA256(KeyApp); err != nil {
+		return nil, err
+	}
+	if c.Config != nil {
+		if h.ConfigHash, err = c.Config.SHA256(); err != nil {
+			return nil, err
+		}
+	}
+	return h, nil
+}
 
+func deserializeLegacyHashes(b []byte) (*Hashes, error) {
 	// Examples of the serialized format are:
 	//   sha256:3CMEDy2oTLyBCLE2BufzgUy6zIY=;sha256:92AfmU4AXOKZpz61NGqqII12Tlw=
 	// or:
@@ -58,9 +274,9 @@ func DeserializeHashes(b []byte) (h *Hashes, err error) {
 		return nil, errs.ErrInvalidFormat
 	}
 	// Extract the base64-encoded hashes.
-	tlsKeyHash := []byte(strings.TrimPrefix(s[0], "sha256:"))
-	appKeyHash := []byte(strings.TrimPrefix(s[1], "sha256:"))
-	h = &Hashes{
+	tlsKeyHash := []byte(strings.TrimPrefix(s[0], legacyPrefix))
+	appKeyHash := []byte(strings.TrimPrefix(s[1], legacyPrefix))
+	h := &Hashes{
 		TlsKeyHash: addr.Of([sha256.Size]byte{}),
 	}
 
@@ -2,6 +2,7 @@ package attestation
 
 import (
 	"crypto/sha256"
+	"fmt"
 	"testing"
 
 	"github.com/Amnesic-Systems/veil/internal/addr"
@@ -55,3 +56,79 @@ func TestFailedDeserialization(t *testing.T) {
 		})
 	}
 }
+
+func TestRotateTLSHash(t *testing.T) {
+	var (
+		hashes = new(Hashes)
+		first  = addr.Of(sha256.Sum256([]byte("first")))
+		second = addr.Of(sha256.Sum256([]byte("second")))
+		third  = addr.Of(sha256.Sum256([]byte("third")))
+	)
+	hashes.RotateTLSHash(first)
+	require.Nil(t, hashes.PrevTlsKeyHash)
+	require.True(t, hashes.HasTLSHash(first))
+
+	// After a rotation, both certificates are attested, and the hashes survive
+	// serialization.
+	hashes.RotateTLSHash(second)
+	require.True(t, hashes.HasTLSHash(first))
+	require.True(t, hashes.HasTLSHash(second))
+	require.False(t, hashes.HasTLSHash(third))
+	deserialized, err := DeserializeHashes(hashes.Serialize())
+	require.NoError(t, err)
+	require.Equal(t, hashes, deserialized)
+
+	// Expiring a hash that's no longer the previous one has no effect.
+	hashes.RotateTLSHash(third)
+	hashes.ExpirePrevTLSHash(first)
+	require.Equal(t, second, hashes.PrevTlsKeyHash)
+	hashes.ExpirePrevTLSHash(second)
+	require.Nil(t, hashes.PrevTlsKeyHash)
+	require.True(t, hashes.HasTLSHash(third))
+	require.False(t, hashes.HasTLSHash(second))
+}
+
+func TestRotateHostTLSHash(t *testing.T) {
+	var (
+		hashes = new(Hashes)
+		first  = addr.Of(sha256.Sum256([]byte("first")))
+		second = addr.Of(sha256.Sum256([]byte("second")))
+	)
+	hashes.RotateTLSHash(addr.Of(sha256.Sum256([]byte("primary"))))
+	require.NoError(t, hashes.RotateHostTLSHash("api.example.com", first))
+	require.NoError(t, hashes.RotateHostTLSHash("api.example.com", second))
+	require.True(t, hashes.HasTLSHash(first))
+	require.True(t, hashes.HasTLSHash(second))
+
+	// The host names' hashes survive serialization.
+	claims := hashes.Claims()
+	require.Contains(t, claims.Keys, "tls:api.example.com")
+	require.Contains(t, claims.Keys, "tls_prev:api.example.com")
+	deserialized, err := DeserializeHashes(hashes.Serialize())
+	require.NoError(t, err)
+	require.Equal(t, hashes, deserialized)
+
+	// Expiring a hash that isn't the previous one has no effect.
+	hashes.ExpirePrevHostTLSHash("api.example.com", second)
+	require.True(t, hashes.HasTLSHash(first))
+	hashes.ExpirePrevHostTLSHash("api.example.com", first)
+	require.False(t, hashes.HasTLSHash(first))
+	require.True(t, hashes.HasTLSHash(second))
+}
+
+func TestRotateHostTLSHashTooManyHosts(t *testing.T) {
+	hashes := new(Hashes)
+	hash := addr.Of(sha256.Sum256([]byte("foo")))
+
+	var err error
+	for i := 0; err == nil; i++ {
+		err = hashes.RotateHostTLSHash(fmt.Sprintf("host-%d.example.com", i), hash)
+	}
+	require.Error(t, err)
+	// The hashes that we accepted still fit in the attestation document,
+	// even after all previous certificates are set.
+	for host, hash := range hashes.HostTlsKeyHashes {
+		require.NoError(t, hashes.RotateHostTLSHash(host, hash))
+	}
+	require.NotPanics(t, func() { hashes.Serialize() })
+}
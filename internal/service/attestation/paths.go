@@ -0,0 +1,12 @@
+package attestation
+
+// The URL paths of veil's attestation endpoints.  They live here rather than
+// in package service, so that clients can use them without depending on the
+// service.
+const (
+	PathAttestation = "/veil/attestation"
+
+	// PathChannelBoundAttestation serves attestation documents that are bound
+	// to the client's TLS connection.
+	PathChannelBoundAttestation = "/veil/attestation/tls-exporter"
+)
@@ -0,0 +1,81 @@
+package attestation
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+
+	"github.com/Amnesic-Systems/veil/internal/enclave"
+	"github.com/Amnesic-Systems/veil/internal/errs"
+	"github.com/Amnesic-Systems/veil/internal/httpx"
+)
+
+// KeyTLSPublicKey names the digest of the TLS certificate's public key in the
+// claims of attestation documents that are embedded in the certificate.  The
+// certificate's own hash can't be in the claims because the certificate
+// contains the document.
+const KeyTLSPublicKey = "tls_pubkey"
+
+// ErrNoCertAttestation means that a certificate contains no attestation
+// document.
+var ErrNoCertAttestation = errors.New("certificate contains no attestation document")
+
+// AttestPublicKey returns a function for httpx.WithAttestation that uses the
+// given attester to attest to the certificate's public key.  The function
+// returns a JSON-encoded enclave.RawDocument.
+func AttestPublicKey(attester enclave.Attester) func(*[sha256.Size]byte) ([]byte, error) {
+	return func(pubKeyHash *[sha256.Size]byte) (_ []byte, err error) {
+		defer errs.Wrap(&err, "failed to attest public key")
+
+		claims, err := (&Claims{
+			Version: ClaimsVersion,
+			Keys:    map[string]Digest{KeyTLSPublicKey: NewSHA256Digest(pubKeyHash)},
+		}).Marshal()
+		if err != nil {
+			return nil, err
+		}
+		rawDoc, err := attester.Attest(&enclave.AuxInfo{PublicKey: claims})
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(rawDoc)
+	}
+}
+
+// VerifyCertificate verifies the attestation document that is embedded in the
+// given certificate, and makes sure that the document attests to the
+// certificate's public key.  Embedded documents contain no nonce; they are
+// bound to the certificate's private key instead, which never leaves the
+// enclave.  The caller must check the document's PCR values.
+func VerifyCertificate(
+	cert *x509.Certificate,
+	verifier enclave.Verifier,
+) (_ *enclave.Document, err error) {
+	defer errs.Wrap(&err, "failed to verify certificate's attestation document")
+
+	raw, ok := httpx.CertAttestation(cert)
+	if !ok {
+		return nil, ErrNoCertAttestation
+	}
+	var rawDoc enclave.RawDocument
+	if err := json.Unmarshal(raw, &rawDoc); err != nil {
+		return nil, err
+	}
+	doc, err := verifier.Verify(&rawDoc, nil)
+	if err != nil {
+		return nil, err
+	}
+	claims, err := GetClaims(&doc.AuxInfo)
+	if err != nil {
+		return nil, err
+	}
+	hash, err := claims.KeySHA256(KeyTLSPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	if hash == nil || *hash != httpx.PublicKeyHash(cert) {
+		return nil, errs.ErrBindingMismatch
+	}
+	return doc, nil
+}
@@ -0,0 +1,75 @@
+package attestation
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/Amnesic-Systems/veil/internal/enclave"
+	"github.com/Amnesic-Systems/veil/internal/enclave/noop"
+	"github.com/Amnesic-Systems/veil/internal/errs"
+	"github.com/Amnesic-Systems/veil/internal/httpx"
+	"github.com/Amnesic-Systems/veil/internal/util/must"
+)
+
+func TestVerifyCertificate(t *testing.T) {
+	attester := noop.NewAttester()
+	newCert := func(opts ...httpx.CertOption) *x509.Certificate {
+		rawCert, _, err := httpx.CreateCertificate("example.com", opts...)
+		require.NoError(t, err)
+		block, _ := pem.Decode(rawCert)
+		return must.Get(x509.ParseCertificate(block.Bytes))
+	}
+
+	cases := []struct {
+		name    string
+		cert    *x509.Certificate
+		wantErr error
+	}{
+		{
+			name: "valid",
+			cert: newCert(httpx.WithAttestation(AttestPublicKey(attester))),
+		},
+		{
+			name:    "no attestation document",
+			cert:    newCert(),
+			wantErr: ErrNoCertAttestation,
+		},
+		{
+			name: "document for other key",
+			cert: newCert(httpx.WithAttestation(func(*[sha256.Size]byte) ([]byte, error) {
+				return AttestPublicKey(attester)(new([sha256.Size]byte))
+			})),
+			wantErr: errs.ErrBindingMismatch,
+		},
+		{
+			name: "document without key",
+			cert: newCert(httpx.WithAttestation(func(*[sha256.Size]byte) ([]byte, error) {
+				rawDoc, err := attester.Attest(&enclave.AuxInfo{
+					PublicKey: must.Get((&Claims{Version: ClaimsVersion}).Marshal()),
+				})
+				require.NoError(t, err)
+				return json.Marshal(rawDoc)
+			})),
+			wantErr: errs.ErrBindingMismatch,
+		},
+		{
+			name: "document of other type",
+			cert: newCert(httpx.WithAttestation(func(*[sha256.Size]byte) ([]byte, error) {
+				return json.Marshal(&enclave.RawDocument{Type: enclave.TypeNitro})
+			})),
+			wantErr: errs.ErrTypeMismatch,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := VerifyCertificate(c.cert, attester)
+			require.ErrorIs(t, err, c.wantErr)
+		})
+	}
+}
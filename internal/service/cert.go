@@ -0,0 +1,306 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"log"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Amnesic-Systems/veil/internal/config"
+	"github.com/Amnesic-Systems/veil/internal/enclave"
+	"github.com/Amnesic-Systems/veil/internal/errs"
+	"github.com/Amnesic-Systems/veil/internal/httpx"
+	"github.com/Amnesic-Systems/veil/internal/service/attestation"
+	"github.com/Amnesic-Systems/veil/internal/service/handle"
+)
+
+// raTLSRefreshInterval determines how often we re-issue a certificate with an
+// embedded attestation document.  Nitro's attestation documents are signed by
+// a short-lived certificate, so an embedded document becomes unverifiable long
+// before our certificate expires.
+const raTLSRefreshInterval = time.Hour
+
+// rotationInterval returns how often we rotate our self-signed certificate,
+// or 0 if we don't.
+func rotationInterval(cfg *config.Veil) time.Duration {
+	switch {
+	case cfg.ACMEDirectory != "":
+		// The ACME manager renews certificates on its own schedule.
+		return 0
+	case cfg.RATLS && (cfg.CertRotation == 0 || cfg.CertRotation > raTLSRefreshInterval):
+		return raTLSRefreshInterval
+	default:
+		return cfg.CertRotation
+	}
+}
+
+// certStores holds the certificates of the host names that the external Web
+// server serves.  The primary certificate belongs to FQDN, and also serves
+// AltFQDNs unless each host name gets its own certificate.
+type certStores struct {
+	primary *certStore
+	hosts   map[string]*certStore
+	// acme is set if we obtain certificates from an ACME server.
+	acme *acmeManager
+}
+
+// newCertStores returns new certStores with freshly created certificates.  If
+// RA-TLS is enabled, the certificates embed an attestation document from the
+// given attester.  If ACME is enabled, the self-signed certificates only serve
+// until the ACME server issues certificates.
+func newCertStores(
+	cfg *config.Veil,
+	attester enclave.Attester,
+	hashes *attestation.Hashes,
+) (_ *certStores, err error) {
+	defer errs.Wrap(&err, "failed to create certificates")
+
+	var opts []httpx.CertOption
+	if cfg.RATLS {
+		opts = append(opts, httpx.WithAttestation(attestation.AttestPublicKey(attester)))
+	}
+	c := &certStores{hosts: make(map[string]*certStore)}
+	if cfg.ACMEDirectory != "" {
+		if c.acme, err = newACMEManager(cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	names := []string{cfg.FQDN}
+	if !cfg.CertPerHost {
+		names = append(names, cfg.AltFQDNs...)
+	}
+	primaryOpts := append(slices.Clone(opts), httpx.WithIPAddresses(cfg.IPSANs...))
+	if c.primary, err = newCertStore("", names, primaryOpts, cfg, hashes); err != nil {
+		return nil, err
+	}
+	if !cfg.CertPerHost {
+		return c, nil
+	}
+	for _, host := range cfg.AltFQDNs {
+		if c.hosts[strings.ToLower(host)], err = newCertStore(host, []string{host}, opts, cfg, hashes); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// all returns all certificate stores, starting with the primary one.
+func (c *certStores) all() []*certStore {
+	stores := []*certStore{c.primary}
+	for _, host := range slices.Sorted(maps.Keys(c.hosts)) {
+		stores = append(stores, c.hosts[host])
+	}
+	return stores
+}
+
+// getCertificate implements tls.Config.GetCertificate.  We pick the
+// certificate of the host name that the client asks for via SNI, and fall
+// back to the primary certificate.  If we obtain certificates via ACME, we
+// also answer the ACME server's TLS-ALPN-01 challenges.
+func (c *certStores) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if c.acme != nil && isChallenge(hello) {
+		return c.acme.getChallengeCert(hello)
+	}
+	if s, ok := c.hosts[strings.ToLower(hello.ServerName)]; ok {
+		return s.cert.Load(), nil
+	}
+	return c.primary.cert.Load(), nil
+}
+
+// list returns the hashes of the current and the previous certificates.
+func (c *certStores) list() *handle.CertHashes {
+	certs := c.primary.list()
+	for host, s := range c.hosts {
+		if certs.Hosts == nil {
+			certs.Hosts = make(map[string]*handle.CertHashes)
+		}
+		certs.Hosts[host] = s.list()
+	}
+	return certs
+}
+
+// refresh renews all certificates at the given interval until the given
+// context is canceled.
+func (c *certStores) refresh(ctx context.Context, interval time.Duration) {
+	for _, s := range c.all() {
+		go s.refresh(ctx, interval)
+	}
+}
+
+// manageACME obtains and renews all certificates via ACME until the given
+// context is canceled.
+func (c *certStores) manageACME(ctx context.Context) {
+	for _, s := range c.all() {
+		go c.acme.manage(ctx, s)
+	}
+}
+
+// certStore holds one of the external Web server's certificates and keeps
+// the certificate's hash in the attestation hashes up to date.  When we
+// install a new certificate, we keep attesting to the previous certificate
+// for an overlap window, so clients that connected before the rotation can
+// still verify the enclave.
+type certStore struct {
+	cert atomic.Pointer[tls.Certificate]
+	// host is the host name that the certificate belongs to if each host
+	// name gets its own certificate, and empty for the primary certificate.
+	host string
+	// names contains the domain names that the certificate is for.
+	names   []string
+	opts    []httpx.CertOption
+	hashes  *attestation.Hashes
+	overlap time.Duration
+
+	// mu serializes rotations and guards the hashes of the current and the
+	// previous certificate.
+	mu       sync.Mutex
+	current  *servedCert
+	previous *servedCert
+}
+
+// servedCert contains the hash of a certificate that we serve or served.
+type servedCert struct {
+	hash     [sha256.Size]byte
+	notAfter time.Time
+	// attestedUntil is only set for the previous certificate.
+	attestedUntil time.Time
+}
+
+func (c *servedCert) toCertHash() *handle.CertHash {
+	return &handle.CertHash{
+		SHA256:        hex.EncodeToString(c.hash[:]),
+		NotAfter:      c.notAfter,
+		AttestedUntil: c.attestedUntil,
+	}
+}
+
+// newCertStore returns a new certStore with a freshly created certificate for
+// the given host name, or the primary certificate if host is empty.
+func newCertStore(
+	host string,
+	names []string,
+	opts []httpx.CertOption,
+	cfg *config.Veil,
+	hashes *attestation.Hashes,
+) (*certStore, error) {
+	s := &certStore{
+		host:    host,
+		names:   names,
+		opts:    append(slices.Clone(opts), httpx.WithDNSNames(names[1:]...)),
+		hashes:  hashes,
+		overlap: cfg.CertOverlap,
+	}
+	return s, s.renew()
+}
+
+// renew creates a new certificate and starts serving it.
+func (s *certStore) renew() (err error) {
+	defer errs.Wrap(&err, "failed to renew certificate")
+
+	cert, key, err := httpx.CreateCertificate(s.names[0], s.opts...)
+	if err != nil {
+		return err
+	}
+	pair, err := tls.X509KeyPair(cert, key)
+	if err != nil {
+		return err
+	}
+	return s.install(&pair)
+}
+
+// install starts serving the given certificate and adds its hash to the
+// attestation hashes.  The previous certificate's hash remains in the
+// attestation hashes until the overlap window ends.
+func (s *certStore) install(cert *tls.Certificate) error {
+	if len(cert.Certificate) == 0 {
+		return errors.New("certificate chain is empty")
+	}
+	leaf := cert.Leaf
+	if leaf == nil {
+		var err error
+		if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return err
+		}
+	}
+	hash := sha256.Sum256(cert.Certificate[0])
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Attest to the new certificate before we serve it.  Until then, we
+	// serve the previous certificate, which remains attested.
+	if s.host == "" {
+		s.hashes.RotateTLSHash(&hash)
+	} else if err := s.hashes.RotateHostTLSHash(s.host, &hash); err != nil {
+		return err
+	}
+	s.cert.Store(cert)
+
+	if prev := s.current; prev != nil {
+		prev.attestedUntil = time.Now().Add(s.overlap)
+		s.previous = prev
+		time.AfterFunc(s.overlap, func() { s.expire(prev) })
+	}
+	s.current = &servedCert{hash: hash, notAfter: leaf.NotAfter}
+	return nil
+}
+
+// expire stops attesting to the given previous certificate, unless a newer
+// rotation already replaced it.
+func (s *certStore) expire(prev *servedCert) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.previous != prev {
+		return
+	}
+	s.previous = nil
+	if s.host == "" {
+		s.hashes.ExpirePrevTLSHash(&prev.hash)
+	} else {
+		s.hashes.ExpirePrevHostTLSHash(s.host, &prev.hash)
+	}
+}
+
+// list returns the hashes of the current and the previous certificate.
+func (s *certStore) list() *handle.CertHashes {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	certs := new(handle.CertHashes)
+	if s.current != nil {
+		certs.Current = s.current.toCertHash()
+	}
+	if s.previous != nil {
+		certs.Previous = s.previous.toCertHash()
+	}
+	return certs
+}
+
+// refresh renews the certificate at the given interval until the given
+// context is canceled.  If renewal fails, we keep serving the current
+// certificate and try again at the next interval.
+func (s *certStore) refresh(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.renew(); err != nil {
+				log.Print(err)
+			}
+		}
+	}
+}
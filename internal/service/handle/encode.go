@@ -7,6 +7,7 @@ import (
 	"net/http"
 
 	"github.com/Amnesic-Systems/veil/internal/httperr"
+	"github.com/Amnesic-Systems/veil/internal/nonce"
 	"github.com/Amnesic-Systems/veil/internal/service/attestation"
 )
 
@@ -25,12 +26,13 @@ func encodeAndAttest[T any](
 	w http.ResponseWriter,
 	status int,
 	builder *attestation.Builder,
+	n *nonce.Nonce,
 	v T,
 ) {
-	// It's a bug if the caller didn't set a nonce in the builder.  Attestation
-	// documents can be replayed if they're not tied to a nonce, so it's best to
-	// return an error.
-	if builder.Nonce == nil {
+	// It's a bug if the caller didn't pass a nonce.  Attestation documents can
+	// be replayed if they're not tied to a nonce, so it's best to return an
+	// error.
+	if n == nil {
 		encode(w, http.StatusInternalServerError, httperr.New("caller didn't set nonce"))
 		return
 	}
@@ -45,6 +47,7 @@ func encodeAndAttest[T any](
 	// hash and the client's nonce.
 	hash := sha256.Sum256(body)
 	attestation, err := builder.Attest(
+		attestation.WithNonce(n),
 		attestation.WithSHA256(hash),
 	)
 	if err != nil {
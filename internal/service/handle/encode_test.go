@@ -54,8 +54,8 @@ func TestEncodeAndAttest(t *testing.T) {
 	for _, c := range cases {
 		t.Run(c.name, func(t *testing.T) {
 			rec := httptest.NewRecorder()
-			builder := attestation.NewBuilder(attester, attestation.WithNonce(c.nonce))
-			encodeAndAttest(rec, http.StatusOK, builder, c.body)
+			builder := attestation.NewBuilder(attester)
+			encodeAndAttest(rec, http.StatusOK, builder, c.nonce, c.body)
 
 			resp := rec.Result()
 			require.Equal(t, c.wantStatus, resp.StatusCode, httperr.FromBody(resp))
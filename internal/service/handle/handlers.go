@@ -7,9 +7,11 @@ import (
 	"io"
 	"net/http"
 	"sync"
+	"time"
 
 	"github.com/Amnesic-Systems/veil/internal/addr"
 	"github.com/Amnesic-Systems/veil/internal/config"
+	"github.com/Amnesic-Systems/veil/internal/enclave"
 	"github.com/Amnesic-Systems/veil/internal/httperr"
 	"github.com/Amnesic-Systems/veil/internal/httpx"
 	"github.com/Amnesic-Systems/veil/internal/service/attestation"
@@ -18,13 +20,17 @@ import (
 
 // Index informs the visitor that this host runs inside an enclave. This is
 // useful for testing.
-func Index(enclaveCodeURI string) http.HandlerFunc {
+func Index(enclaveCodeURI, enclaveCodeRev string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		page := "This host runs inside an AWS Nitro Enclave."
 		if enclaveCodeURI != "" {
 			page += fmt.Sprintf("\nThe application's source code is available at: %s.",
 				enclaveCodeURI)
 		}
+		if enclaveCodeRev != "" {
+			page += fmt.Sprintf("\nThe enclave image was built from revision: %s.",
+				enclaveCodeRev)
+		}
 		_, _ = fmt.Fprintln(w, page)
 	}
 }
@@ -40,8 +46,7 @@ func Config(
 		// because this isn't a security-sensitive endpoint, so we simply return
 		// the configuration without attestation.
 		if n, err := httpx.ExtractNonce(r); err == nil {
-			builder.Update(attestation.WithNonce(n))
-			encodeAndAttest(w, http.StatusOK, builder, cfg)
+			encodeAndAttest(w, http.StatusOK, builder, n, cfg)
 		} else {
 			encode(w, http.StatusOK, cfg)
 		}
@@ -58,15 +63,16 @@ func Hashes(hashes *attestation.Hashes) http.HandlerFunc {
 	}
 }
 
-// AppHash sets the application hash in the attestation document.
-func AppHash(
-	setAppHash func(*[sha256.Size]byte),
-) http.HandlerFunc {
+// AppHash sets the application hash and the application-defined claims in the
+// attestation document.
+func AppHash(hashes *attestation.Hashes) http.HandlerFunc {
 	b := must.Get(json.Marshal(&attestation.Hashes{
 		TlsKeyHash: addr.Of(sha256.Sum256([]byte("foo"))),
 		AppKeyHash: addr.Of(sha256.Sum256([]byte("bar"))),
 	}))
-	maxHashesLen := len(b) + 1 // Allow extra byte for the \n.
+	// Allow extra bytes for the Base64-encoded application claims, which must
+	// fit in the attestation document, and the \n.
+	maxHashesLen := len(b) + 2*enclave.AuxFieldLen + 1
 
 	return func(w http.ResponseWriter, r *http.Request) {
 		body, err := io.ReadAll(io.LimitReader(r.Body, int64(maxHashesLen)))
@@ -81,7 +87,41 @@ func AppHash(
 			encode(w, http.StatusBadRequest, httperr.New(err.Error()))
 			return
 		}
-		setAppHash(theirHashes.AppKeyHash)
+		if err := hashes.SetAppClaims(theirHashes.AppClaims); err != nil {
+			encode(w, http.StatusBadRequest, httperr.New(err.Error()))
+			return
+		}
+		hashes.SetAppHash(theirHashes.AppKeyHash)
+	}
+}
+
+// CertHash describes one of the external Web server's TLS certificates.
+type CertHash struct {
+	// SHA256 contains the hex-encoded SHA-256 hash of the DER-encoded
+	// certificate, which is what the attestation document attests to.
+	SHA256   string    `json:"sha256"`
+	NotAfter time.Time `json:"not_after"`
+	// AttestedUntil is only set for the previous certificate, and contains
+	// the time at which the enclave stops attesting to it.
+	AttestedUntil time.Time `json:"attested_until,omitzero"`
+}
+
+// CertHashes contains the external Web server's current certificate and,
+// during a rotation's overlap window, its previous certificate.  If the
+// external Web server serves a separate certificate for each host name, Hosts
+// maps the host names to their certificates.
+type CertHashes struct {
+	Current  *CertHash              `json:"current"`
+	Previous *CertHash              `json:"previous,omitempty"`
+	Hosts    map[string]*CertHashes `json:"hosts,omitempty"`
+}
+
+// Certs returns the hashes of the external Web server's current and previous
+// TLS certificates, so clients can re-pin before the previous certificate's
+// hash disappears from attestation documents.
+func Certs(certs func() *CertHashes) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		encode(w, http.StatusOK, certs())
 	}
 }
 
@@ -125,3 +165,35 @@ func Attestation(
 		encode(w, http.StatusOK, attestation)
 	}
 }
+
+// ChannelBoundAttestation returns an attestation document that is bound to
+// the request's TLS connection: the document's user data contains the
+// connection's channel binding for the client's nonce (see
+// attestation.ChannelBinding).  Unlike the certificate hash, the binding
+// differs for every connection.
+func ChannelBoundAttestation(
+	builder *attestation.Builder,
+) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		n, err := httpx.ExtractNonce(r)
+		if err != nil {
+			encode(w, http.StatusBadRequest, httperr.New(err.Error()))
+			return
+		}
+		binding, err := attestation.ChannelBinding(r.TLS, n)
+		if err != nil {
+			encode(w, http.StatusBadRequest, httperr.New(err.Error()))
+			return
+		}
+
+		attestation, err := builder.Attest(
+			attestation.WithNonce(n),
+			attestation.WithSHA256(binding),
+		)
+		if err != nil {
+			encode(w, http.StatusInternalServerError, httperr.New(err.Error()))
+			return
+		}
+		encode(w, http.StatusOK, attestation)
+	}
+}
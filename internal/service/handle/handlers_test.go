@@ -4,9 +4,11 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"testing"
 
 	"github.com/Amnesic-Systems/veil/internal/config"
+	"github.com/Amnesic-Systems/veil/internal/enclave"
 	"github.com/Amnesic-Systems/veil/internal/enclave/noop"
 	"github.com/Amnesic-Systems/veil/internal/nonce"
 	"github.com/Amnesic-Systems/veil/internal/service/attestation"
@@ -19,6 +21,7 @@ func TestIndex(t *testing.T) {
 	cases := []struct {
 		name    string
 		codeURI string
+		codeRev string
 	}{
 		{
 			name: "without code URI",
@@ -27,16 +30,22 @@ func TestIndex(t *testing.T) {
 			name:    "with code URI",
 			codeURI: "https://example.com",
 		},
+		{
+			name:    "with code URI and revision",
+			codeURI: "https://example.com",
+			codeRev: "v1.2.0",
+		},
 	}
 
 	for _, c := range cases {
 		t.Run(c.name, func(t *testing.T) {
-			handler := Index(c.codeURI)
+			handler := Index(c.codeURI, c.codeRev)
 			resp := httptest.NewRecorder()
 			handler.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/", http.NoBody))
 
 			assert.Equal(t, http.StatusOK, resp.Code)
 			assert.Contains(t, resp.Body.String(), c.codeURI)
+			assert.Contains(t, resp.Body.String(), c.codeRev)
 		})
 	}
 }
@@ -122,3 +131,62 @@ func TestReady(t *testing.T) {
 		})
 	}
 }
+
+func TestChannelBoundAttestation(t *testing.T) {
+	attester := noop.NewAttester()
+	srv := httptest.NewTLSServer(ChannelBoundAttestation(attestation.NewBuilder(attester)))
+	defer srv.Close()
+	n := must.Get(nonce.New())
+
+	// Requests must use TLS.
+	resp := httptest.NewRecorder()
+	ChannelBoundAttestation(attestation.NewBuilder(attester)).ServeHTTP(
+		resp,
+		httptest.NewRequest(http.MethodGet, "/?nonce="+n.B64(), http.NoBody),
+	)
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+
+	// The attestation document contains the channel binding that the client
+	// derives from its connection.
+	httpResp, err := srv.Client().Get(srv.URL + "?nonce=" + url.QueryEscape(n.B64()))
+	require.NoError(t, err)
+	defer func() { _ = httpResp.Body.Close() }()
+	require.Equal(t, http.StatusOK, httpResp.StatusCode)
+
+	var rawDoc enclave.RawDocument
+	require.NoError(t, json.NewDecoder(httpResp.Body).Decode(&rawDoc))
+	doc, err := attester.Verify(&rawDoc, n)
+	require.NoError(t, err)
+	want, err := attestation.ChannelBinding(httpResp.TLS, n)
+	require.NoError(t, err)
+	require.Equal(t, want[:], doc.UserData)
+}
+
+func TestChannelBindingDoesNotPersist(t *testing.T) {
+	attester := noop.NewAttester()
+	builder := attestation.NewBuilder(attester)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/bound", ChannelBoundAttestation(builder))
+	mux.HandleFunc("/plain", Attestation(builder))
+	srv := httptest.NewTLSServer(mux)
+	defer srv.Close()
+
+	attest := func(path string) *enclave.Document {
+		n := must.Get(nonce.New())
+		resp, err := srv.Client().Get(srv.URL + path + "?nonce=" + url.QueryEscape(n.B64()))
+		require.NoError(t, err)
+		defer func() { _ = resp.Body.Close() }()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var rawDoc enclave.RawDocument
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&rawDoc))
+		doc, err := attester.Verify(&rawDoc, n)
+		require.NoError(t, err)
+		return doc
+	}
+
+	// The channel binding of the first request must not leak into the
+	// attestation document of the second request.
+	require.NotEmpty(t, attest("/bound").UserData)
+	require.Empty(t, attest("/plain").UserData)
+}
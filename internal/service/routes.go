@@ -1,7 +1,9 @@
 package service
 
 import (
+	"net/http"
 	"net/http/httputil"
+	"strings"
 
 	"github.com/Amnesic-Systems/veil/internal/config"
 	"github.com/Amnesic-Systems/veil/internal/service/attestation"
@@ -14,10 +16,15 @@ import (
 const (
 	PathIndex       = "/veil"
 	PathConfig      = "/veil/config"
-	PathAttestation = "/veil/attestation"
+	PathAttestation = attestation.PathAttestation
 	PathReady       = "/veil/ready"
 	PathHashes      = "/veil/hashes"
 	PathHash        = "/veil/hash"
+	PathCerts       = "/veil/certs"
+
+	// PathChannelBoundAttestation serves attestation documents that are bound
+	// to the client's TLS connection.
+	PathChannelBoundAttestation = attestation.PathChannelBoundAttestation
 )
 
 func setupMiddlewares(r *chi.Mux, cfg *config.Veil) {
@@ -33,21 +40,54 @@ func addExternalPublicRoutes(
 ) {
 	setupMiddlewares(r, cfg)
 
-	r.Get(PathIndex, handle.Index(cfg.EnclaveCodeURI))
+	r.Get(PathIndex, handle.Index(cfg.EnclaveCodeURI, cfg.EnclaveCodeRev))
 	r.Get(PathConfig, handle.Config(builder, cfg))
 	r.Get(PathAttestation, handle.Attestation(builder))
+	r.Get(PathChannelBoundAttestation, handle.ChannelBoundAttestation(builder))
 
 	// Set up reverse proxy for the application' Web server.
+	if proxy := newAppProxy(cfg); proxy != nil {
+		r.Handle("/*", proxy)
+	}
+}
+
+// newAppProxy returns a reverse proxy for the application's Web servers, or
+// nil if there are none.  We pick the virtual host by the host name that the
+// client asked for via SNI rather than by the Host header, so a request always
+// reaches the backend whose certificate the client saw.  Requests for other
+// host names go to AppWebSrv.
+func newAppProxy(cfg *config.Veil) http.Handler {
+	var fallback http.Handler
 	if cfg.AppWebSrv != nil {
-		reverseProxy := httputil.NewSingleHostReverseProxy(cfg.AppWebSrv)
-		r.Handle("/*", reverseProxy)
+		fallback = httputil.NewSingleHostReverseProxy(cfg.AppWebSrv)
+	}
+	if len(cfg.VirtualHosts) == 0 {
+		return fallback
+	}
+	if fallback == nil {
+		fallback = http.NotFoundHandler()
+	}
+
+	vhosts := make(map[string]http.Handler, len(cfg.VirtualHosts))
+	for host, backend := range cfg.VirtualHosts {
+		vhosts[strings.ToLower(host)] = httputil.NewSingleHostReverseProxy(backend)
 	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil {
+			if proxy, ok := vhosts[strings.ToLower(r.TLS.ServerName)]; ok {
+				proxy.ServeHTTP(w, r)
+				return
+			}
+		}
+		fallback.ServeHTTP(w, r)
+	})
 }
 
 func addInternalRoutes(
 	r *chi.Mux,
 	cfg *config.Veil,
 	hashes *attestation.Hashes,
+	certs *certStores,
 	appReady chan struct{},
 ) {
 	setupMiddlewares(r, cfg)
@@ -58,5 +98,6 @@ func addInternalRoutes(
 		close(appReady)
 	}
 	r.Get(PathHashes, handle.Hashes(hashes))
-	r.Post(PathHash, handle.AppHash(hashes.SetAppHash))
+	r.Post(PathHash, handle.AppHash(hashes))
+	r.Get(PathCerts, handle.Certs(certs.list))
 }
@@ -2,7 +2,9 @@ package service
 
 import (
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/fs"
@@ -11,11 +13,12 @@ import (
 	"net/http"
 	"time"
 
+	"golang.org/x/crypto/acme"
+
 	"github.com/Amnesic-Systems/veil/internal/addr"
 	"github.com/Amnesic-Systems/veil/internal/config"
 	"github.com/Amnesic-Systems/veil/internal/enclave"
 	"github.com/Amnesic-Systems/veil/internal/errs"
-	"github.com/Amnesic-Systems/veil/internal/httpx"
 	"github.com/Amnesic-Systems/veil/internal/service/attestation"
 	"github.com/Amnesic-Systems/veil/internal/system"
 	"github.com/Amnesic-Systems/veil/internal/tunnel"
@@ -39,32 +42,35 @@ func Run(
 		log.Fatalf("Failed to set up system: %v", err)
 	}
 
-	// Create a TLS certificate for the external Web server and determine its
-	// certificate hash.
-	cert, key, err := httpx.CreateCertificate(cfg.FQDN)
+	// Initialize hashes for the attestation document, and create TLS
+	// certificates for the external Web server, whose hashes we add to the
+	// hashes.
+	hashes := new(attestation.Hashes)
+	certs, err := newCertStores(cfg, attester, hashes)
 	if err != nil {
-		log.Fatalf("Failed to create certificate: %v", err)
+		log.Fatalf("Failed to create certificates: %v", err)
 	}
-	hash, err := httpx.GetCertHash(cert)
-	if err != nil {
-		log.Fatalf("Failed to get certificate hash: %v", err)
+	if interval := rotationInterval(cfg); interval > 0 {
+		certs.refresh(ctx, interval)
 	}
-
-	// Initialize hashes for the attestation document.
-	hashes := new(attestation.Hashes)
-	hashes.SetTLSHash(addr.Of(hash))
+	// Attest the hash of the configuration that we serve at PathConfig.
+	hashes.SetConfigHash(addr.Of(sha256.Sum256(must.Get(json.Marshal(cfg)))))
 
 	// Initialize Web servers.
-	intSrv := newIntSrv(cfg, hashes, appReady)
+	intSrv := newIntSrv(cfg, hashes, certs, appReady)
 	builder := attestation.NewBuilder(
 		attester,
 		attestation.WithHashes(hashes),
 	)
 	extSrv := newExtSrv(cfg, builder)
 	extSrv.TLSConfig = &tls.Config{
-		Certificates: []tls.Certificate{
-			must.Get(tls.X509KeyPair(cert, key)),
-		},
+		GetCertificate: certs.getCertificate,
+	}
+	if certs.acme != nil {
+		// Without the ALPN protocol, our external Web server can't
+		// negotiate TLS-ALPN-01 challenges.  net/http adds the protocols
+		// for HTTP/1.1 and HTTP/2.
+		extSrv.TLSConfig.NextProtos = []string{acme.ALPNProto}
 	}
 
 	// Set up the networking tunnel. This function will block until the tunnel
@@ -73,6 +79,19 @@ func Run(
 		log.Fatalf("Failed to set up tunnel: %v", err)
 	}
 
+	// Obtain certificates from the ACME server, if configured.  To solve
+	// challenges, our external Web server must be up, which happens once the
+	// application is ready.
+	if certs.acme != nil {
+		go func() {
+			select {
+			case <-ctx.Done():
+			case <-appReady:
+				certs.manageACME(ctx)
+			}
+		}()
+	}
+
 	// Start all Web servers and block until all Web servers have stopped, which
 	// should only happen if the given context is canceled.
 	startAllWebSrvs(ctx, appReady, intSrv, extSrv)
@@ -158,10 +177,11 @@ func startAllWebSrvs(
 func newIntSrv(
 	cfg *config.Veil,
 	hashes *attestation.Hashes,
+	certs *certStores,
 	appReady chan struct{},
 ) *http.Server {
 	r := chi.NewRouter()
-	addInternalRoutes(r, cfg, hashes, appReady)
+	addInternalRoutes(r, cfg, hashes, certs, appReady)
 
 	return &http.Server{
 		Addr:    net.JoinHostPort("127.0.0.1", fmt.Sprintf("%d", cfg.IntPort)),
@@ -0,0 +1,531 @@
+package testutil
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// oidACMEIdentifier is the OID of the X.509 extension that contains a
+// TLS-ALPN-01 challenge's key authorization, as per RFC 8737.
+var oidACMEIdentifier = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+
+// ACMEServer is a minimal ACME server (RFC 8555) that stands in for Pebble in
+// tests.  It only supports a single account with an ES256 key and the
+// TLS-ALPN-01 challenge, which it validates by connecting to a fixed address.
+// Like a real ACME server, it rejects requests whose JWS signature, nonce, or
+// URL is invalid.
+type ACMEServer struct {
+	*httptest.Server
+	// CA contains the root certificate that signs all issued certificates.
+	CA *x509.Certificate
+
+	caKey          *ecdsa.PrivateKey
+	validationAddr string
+	lifetime       time.Duration
+
+	mu sync.Mutex
+	// nonces contains the nonces that we handed out and that clients haven't
+	// used yet.
+	nonces     map[string]bool
+	accountKey *ecdsa.PublicKey
+	thumbprint string
+	orders     []*acmeOrder
+}
+
+type acmeOrder struct {
+	domain string
+	token  string
+	// status is the order's status, and authzStatus the status of the
+	// order's only authorization.
+	status      string
+	authzStatus string
+	chain       []byte
+}
+
+type acmeJWS struct {
+	Protected string `json:"protected"`
+	Payload   string `json:"payload"`
+	Signature string `json:"signature"`
+}
+
+type acmeHeader struct {
+	Alg   string   `json:"alg"`
+	Nonce string   `json:"nonce"`
+	URL   string   `json:"url"`
+	KID   string   `json:"kid"`
+	JWK   *acmeJWK `json:"jwk"`
+}
+
+type acmeJWK struct {
+	Crv string `json:"crv"`
+	Kty string `json:"kty"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// NewACMEServer starts a new ACME server that validates challenges by
+// connecting to the given address, and issues certificates that are valid for
+// the given duration.
+func NewACMEServer(t *testing.T, validationAddr string, lifetime time.Duration) *ACMEServer {
+	t.Helper()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "veil test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &ACMEServer{
+		CA:             ca,
+		caKey:          caKey,
+		validationAddr: validationAddr,
+		lifetime:       lifetime,
+		nonces:         make(map[string]bool),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /dir", s.directory)
+	mux.HandleFunc("HEAD /nonce", func(http.ResponseWriter, *http.Request) {})
+	mux.HandleFunc("POST /account", s.newAccount)
+	mux.HandleFunc("POST /order", s.newOrder)
+	mux.HandleFunc("POST /order/{id}", s.withOrder(s.getOrder))
+	mux.HandleFunc("POST /authz/{id}", s.withOrder(s.getAuthz))
+	mux.HandleFunc("POST /chal/{id}", s.withOrder(s.acceptChallenge))
+	mux.HandleFunc("POST /finalize/{id}", s.withOrder(s.finalize))
+	mux.HandleFunc("POST /cert/{id}", s.withOrder(s.getCert))
+	s.Server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nonce := rand.Text()
+		s.mu.Lock()
+		s.nonces[nonce] = true
+		s.mu.Unlock()
+
+		w.Header().Set("Replay-Nonce", nonce)
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// DirectoryURL returns the URL of the server's ACME directory.
+func (s *ACMEServer) DirectoryURL() string {
+	return s.URL + "/dir"
+}
+
+// WriteRoots writes the certificate of the server's HTTPS endpoint to a
+// temporary PEM file and returns the file's path.
+func (s *ACMEServer) WriteRoots(t *testing.T) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "acme-roots.pem")
+	block := &pem.Block{Type: "CERTIFICATE", Bytes: s.Certificate().Raw}
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// Issued returns the number of certificates that the server issued.
+func (s *ACMEServer) Issued() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var n int
+	for _, o := range s.orders {
+		if o.chain != nil {
+			n++
+		}
+	}
+	return n
+}
+
+func (s *ACMEServer) directory(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{
+		"newNonce":   s.URL + "/nonce",
+		"newAccount": s.URL + "/account",
+		"newOrder":   s.URL + "/order",
+		"revokeCert": s.URL + "/revoke",
+		"keyChange":  s.URL + "/key-change",
+	})
+}
+
+func (s *ACMEServer) newAccount(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	header, _, err := s.verifyJWS(r)
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, err)
+		return
+	}
+	if header.JWK == nil {
+		writeProblem(w, http.StatusBadRequest, errors.New("new account requires jwk"))
+		return
+	}
+	key, err := header.JWK.publicKey()
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, err)
+		return
+	}
+	// Compute the account key's thumbprint as per RFC 7638.
+	jwk := fmt.Sprintf(`{"crv":%q,"kty":"EC","x":%q,"y":%q}`, header.JWK.Crv, header.JWK.X, header.JWK.Y)
+	hash := sha256.Sum256([]byte(jwk))
+	s.accountKey = key
+	s.thumbprint = base64.RawURLEncoding.EncodeToString(hash[:])
+
+	w.Header().Set("Location", s.accountURL())
+	writeJSON(w, http.StatusCreated, map[string]string{"status": "valid"})
+}
+
+func (s *ACMEServer) newOrder(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var payload struct {
+		Identifiers []struct {
+			Type  string `json:"type"`
+			Value string `json:"value"`
+		} `json:"identifiers"`
+	}
+	if err := s.verifyAccountJWS(r, &payload); err != nil {
+		writeProblem(w, http.StatusBadRequest, err)
+		return
+	}
+	if len(payload.Identifiers) != 1 || payload.Identifiers[0].Type != "dns" {
+		writeProblem(w, http.StatusBadRequest, errors.New("expected a single DNS identifier"))
+		return
+	}
+
+	o := &acmeOrder{
+		domain:      payload.Identifiers[0].Value,
+		token:       rand.Text(),
+		status:      "pending",
+		authzStatus: "pending",
+	}
+	s.orders = append(s.orders, o)
+	id := len(s.orders) - 1
+
+	w.Header().Set("Location", s.orderURL("order", id))
+	s.writeOrder(w, http.StatusCreated, id, o)
+}
+
+// withOrder verifies the request's JWS, looks up the order whose ID is in the
+// request path, and calls the given handler with the JWS's payload while
+// holding the server's lock.
+func (s *ACMEServer) withOrder(
+	handler func(http.ResponseWriter, json.RawMessage, int, *acmeOrder),
+) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		var payload json.RawMessage
+		if err := s.verifyAccountJWS(r, &payload); err != nil {
+			writeProblem(w, http.StatusBadRequest, err)
+			return
+		}
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil || id < 0 || id >= len(s.orders) {
+			writeProblem(w, http.StatusNotFound, errors.New("no such order"))
+			return
+		}
+		handler(w, payload, id, s.orders[id])
+	}
+}
+
+func (s *ACMEServer) getOrder(w http.ResponseWriter, _ json.RawMessage, id int, o *acmeOrder) {
+	w.Header().Set("Location", s.orderURL("order", id))
+	s.writeOrder(w, http.StatusOK, id, o)
+}
+
+func (s *ACMEServer) getAuthz(w http.ResponseWriter, _ json.RawMessage, id int, o *acmeOrder) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"status":     o.authzStatus,
+		"identifier": map[string]string{"type": "dns", "value": o.domain},
+		"challenges": []any{s.challenge(id, o)},
+	})
+}
+
+func (s *ACMEServer) acceptChallenge(w http.ResponseWriter, _ json.RawMessage, id int, o *acmeOrder) {
+	if err := s.validate(o); err != nil {
+		o.status, o.authzStatus = "invalid", "invalid"
+		writeProblem(w, http.StatusForbidden, err)
+		return
+	}
+	o.status, o.authzStatus = "ready", "valid"
+	writeJSON(w, http.StatusOK, s.challenge(id, o))
+}
+
+func (s *ACMEServer) finalize(w http.ResponseWriter, rawPayload json.RawMessage, id int, o *acmeOrder) {
+	var payload struct {
+		CSR string `json:"csr"`
+	}
+	if err := json.Unmarshal(rawPayload, &payload); err != nil {
+		writeProblem(w, http.StatusBadRequest, err)
+		return
+	}
+	if o.status != "ready" {
+		writeProblem(w, http.StatusForbidden, fmt.Errorf("order is %s", o.status))
+		return
+	}
+	chain, err := s.issue(o, payload.CSR)
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, err)
+		return
+	}
+	o.status, o.chain = "valid", chain
+	w.Header().Set("Location", s.orderURL("order", id))
+	s.writeOrder(w, http.StatusOK, id, o)
+}
+
+func (s *ACMEServer) getCert(w http.ResponseWriter, _ json.RawMessage, _ int, o *acmeOrder) {
+	if o.chain == nil {
+		writeProblem(w, http.StatusNotFound, errors.New("certificate not issued"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/pem-certificate-chain")
+	_, _ = w.Write(o.chain)
+}
+
+// validate validates the given order's TLS-ALPN-01 challenge.
+func (s *ACMEServer) validate(o *acmeOrder) error {
+	conn, err := tls.Dial("tcp", s.validationAddr, &tls.Config{
+		ServerName:         o.domain,
+		NextProtos:         []string{"acme-tls/1"},
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		return err
+	}
+	defer func() { _ = conn.Close() }()
+
+	state := conn.ConnectionState()
+	if state.NegotiatedProtocol != "acme-tls/1" {
+		return fmt.Errorf("negotiated protocol %q", state.NegotiatedProtocol)
+	}
+	cert := state.PeerCertificates[0]
+	if !slices.Equal(cert.DNSNames, []string{o.domain}) {
+		return fmt.Errorf("challenge certificate is for %v", cert.DNSNames)
+	}
+	keyAuth := sha256.Sum256([]byte(o.token + "." + s.thumbprint))
+	want, err := asn1.Marshal(keyAuth[:])
+	if err != nil {
+		return err
+	}
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(oidACMEIdentifier) && ext.Critical && bytes.Equal(ext.Value, want) {
+			return nil
+		}
+	}
+	return errors.New("challenge certificate lacks key authorization")
+}
+
+// issue returns a PEM-encoded certificate chain for the given CSR.
+func (s *ACMEServer) issue(o *acmeOrder, b64CSR string) ([]byte, error) {
+	rawCSR, err := base64.RawURLEncoding.DecodeString(b64CSR)
+	if err != nil {
+		return nil, err
+	}
+	csr, err := x509.ParseCertificateRequest(rawCSR)
+	if err != nil {
+		return nil, err
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, err
+	}
+	if !slices.Equal(csr.DNSNames, []string{o.domain}) {
+		return nil, fmt.Errorf("CSR is for %v", csr.DNSNames)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	raw, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: serial,
+		DNSNames:     csr.DNSNames,
+		NotBefore:    now,
+		NotAfter:     now.Add(s.lifetime),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, s.CA, csr.PublicKey, s.caKey)
+	if err != nil {
+		return nil, err
+	}
+	chain := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: raw})
+	return append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.CA.Raw})...), nil
+}
+
+func (s *ACMEServer) accountURL() string {
+	return s.URL + "/account/1"
+}
+
+func (s *ACMEServer) orderURL(kind string, id int) string {
+	return fmt.Sprintf("%s/%s/%d", s.URL, kind, id)
+}
+
+func (s *ACMEServer) challenge(id int, o *acmeOrder) map[string]string {
+	return map[string]string{
+		"type":   "tls-alpn-01",
+		"url":    s.orderURL("chal", id),
+		"token":  o.token,
+		"status": o.authzStatus,
+	}
+}
+
+func (s *ACMEServer) writeOrder(w http.ResponseWriter, code, id int, o *acmeOrder) {
+	v := map[string]any{
+		"status":         o.status,
+		"identifiers":    []any{map[string]string{"type": "dns", "value": o.domain}},
+		"authorizations": []string{s.orderURL("authz", id)},
+		"finalize":       s.orderURL("finalize", id),
+	}
+	if o.chain != nil {
+		v["certificate"] = s.orderURL("cert", id)
+	}
+	writeJSON(w, code, v)
+}
+
+// verifyAccountJWS verifies that the given request's JWS was signed by the
+// account key, and decodes its payload into the given value.  A POST-as-GET
+// request's empty payload leaves the value unchanged.  The caller must hold
+// the server's lock.
+func (s *ACMEServer) verifyAccountJWS(r *http.Request, payload any) error {
+	header, rawPayload, err := s.verifyJWS(r)
+	if err != nil {
+		return err
+	}
+	if header.JWK != nil || header.KID != s.accountURL() {
+		return fmt.Errorf("unknown account %q", header.KID)
+	}
+	if len(rawPayload) == 0 {
+		return nil
+	}
+	return json.Unmarshal(rawPayload, payload)
+}
+
+// verifyJWS decodes the given request's JWS-encoded body, and verifies its
+// nonce, URL, and ES256 signature, either with the JWK in the protected header
+// or with the account key.  The caller must hold the server's lock.
+func (s *ACMEServer) verifyJWS(r *http.Request) (*acmeHeader, []byte, error) {
+	var jws acmeJWS
+	if err := json.NewDecoder(r.Body).Decode(&jws); err != nil {
+		return nil, nil, err
+	}
+	rawHeader, err := base64.RawURLEncoding.DecodeString(jws.Protected)
+	if err != nil {
+		return nil, nil, err
+	}
+	var header acmeHeader
+	if err := json.Unmarshal(rawHeader, &header); err != nil {
+		return nil, nil, err
+	}
+	if header.Alg != "ES256" {
+		return nil, nil, fmt.Errorf("unsupported algorithm %q", header.Alg)
+	}
+	if !s.nonces[header.Nonce] {
+		return nil, nil, fmt.Errorf("bad nonce %q", header.Nonce)
+	}
+	delete(s.nonces, header.Nonce)
+	if want := s.URL + r.URL.Path; header.URL != want {
+		return nil, nil, fmt.Errorf("JWS is for %q instead of %q", header.URL, want)
+	}
+
+	key := s.accountKey
+	if header.JWK != nil {
+		if key, err = header.JWK.publicKey(); err != nil {
+			return nil, nil, err
+		}
+	}
+	if key == nil {
+		return nil, nil, errors.New("no account key")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(jws.Signature)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(sig) != 64 {
+		return nil, nil, fmt.Errorf("bad signature length %d", len(sig))
+	}
+	hash := sha256.Sum256([]byte(jws.Protected + "." + jws.Payload))
+	rInt, sInt := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+	if !ecdsa.Verify(key, hash[:], rInt, sInt) {
+		return nil, nil, errors.New("bad JWS signature")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(jws.Payload)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &header, payload, nil
+}
+
+// publicKey returns the P-256 public key that the JWK represents.
+func (k *acmeJWK) publicKey() (*ecdsa.PublicKey, error) {
+	if k.Kty != "EC" || k.Crv != "P-256" {
+		return nil, fmt.Errorf("unsupported key type %s/%s", k.Kty, k.Crv)
+	}
+	x, err := base64.RawURLEncoding.DecodeString(k.X)
+	if err != nil {
+		return nil, err
+	}
+	y, err := base64.RawURLEncoding.DecodeString(k.Y)
+	if err != nil {
+		return nil, err
+	}
+	// The uncompressed point encoding is 0x04 || X || Y.
+	raw := append([]byte{4}, append(x, y...)...)
+	return ecdsa.ParseUncompressedPublicKey(elliptic.P256(), raw)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeProblem(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(map[string]string{
+		"type":   "urn:ietf:params:acme:error:malformed",
+		"detail": err.Error(),
+	})
+}
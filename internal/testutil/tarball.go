@@ -0,0 +1,111 @@
+package testutil
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TarFile represents a file that NewTar adds to a tar archive.  If Typeflag is
+// unset, the file is a regular file.
+type TarFile struct {
+	Name     string
+	Body     string
+	Typeflag byte
+	Linkname string
+	Mode     int64
+	ModTime  time.Time
+	Uid      int
+}
+
+// NewTar returns a tar archive that contains the given files.
+func NewTar(t *testing.T, files ...TarFile) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, f := range files {
+		hdr := &tar.Header{
+			Name:     f.Name,
+			Typeflag: f.Typeflag,
+			Linkname: f.Linkname,
+			Mode:     f.Mode,
+			ModTime:  f.ModTime,
+			Uid:      f.Uid,
+			Size:     int64(len(f.Body)),
+		}
+		if hdr.Typeflag == 0 {
+			hdr.Typeflag = tar.TypeReg
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			hdr.Size = 0
+		}
+		if hdr.Mode == 0 {
+			hdr.Mode = 0o644
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(f.Body[:hdr.Size])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// Gzip returns the gzip-compressed representation of the given bytes.
+func Gzip(t *testing.T, b []byte) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	if _, err := gw.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// NewImageTarball writes a Docker archive (as created by "docker save") with
+// the given image configuration and layers to a temporary directory, and
+// returns the archive's path.
+func NewImageTarball(t *testing.T, config any, layers ...[]byte) string {
+	t.Helper()
+
+	rawConfig, err := json.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := []TarFile{{Name: "config.json", Body: string(rawConfig)}}
+	manifest := []struct {
+		Config string
+		Layers []string
+	}{{Config: "config.json"}}
+	for i, layer := range layers {
+		name := fmt.Sprintf("layer%d.tar", i)
+		manifest[0].Layers = append(manifest[0].Layers, name)
+		files = append(files, TarFile{Name: name, Body: string(layer)})
+	}
+	rawManifest, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files = append(files, TarFile{Name: "manifest.json", Body: string(rawManifest)})
+
+	p := filepath.Join(t.TempDir(), "image.tar")
+	if err := os.WriteFile(p, NewTar(t, files...), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}